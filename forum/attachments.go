@@ -0,0 +1,476 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/google/uuid"
+)
+
+// allowedUploadTypes lists the MIME types accepted for uploads. The type is
+// sniffed from the file contents; the name and declared type are ignored.
+var allowedUploadTypes = map[string]bool{
+	"image/jpeg":      true,
+	"image/png":       true,
+	"image/gif":       true,
+	"application/pdf": true,
+	"text/plain":      true,
+	"application/zip": true,
+}
+
+const (
+	// thumbnailSize is the bounding box of generated thumbnails
+	thumbnailSize = 320
+	// maxAttachmentsPerItem limits how many files a post or comment can carry
+	maxAttachmentsPerItem = 10
+	// orphanAttachmentAge is how long an unlinked upload is kept before it is
+	// garbage-collected, giving the author time to finish their post
+	orphanAttachmentAge = 24 * time.Hour
+)
+
+var (
+	errUnsupportedFileType   = errors.New("unsupported file type")
+	errAttachmentUnavailable = errors.New("attachment not found or already used")
+	errInvalidImage          = errors.New("invalid image")
+)
+
+// processUpload validates an uploaded file, strips image metadata, generates
+// a thumbnail and stores everything in the blob store and the database
+func processUpload(ctx context.Context, uploaderID int, filename string, data []byte) (*Attachment, error) {
+	mimeType, _, _ := mime.ParseMediaType(http.DetectContentType(data))
+	if !allowedUploadTypes[mimeType] {
+		return nil, errUnsupportedFileType
+	}
+
+	attachment := &Attachment{
+		UploaderID: uploaderID,
+		Filename:   cleanFilename(filename),
+		MimeType:   mimeType,
+	}
+
+	var thumbnail []byte
+	if strings.HasPrefix(mimeType, "image/") {
+		img, err := decodeImage(data)
+		if err == errImageTooLarge {
+			return nil, err
+		} else if err != nil {
+			return nil, errInvalidImage
+		}
+		attachment.Width = img.Bounds().Dx()
+		attachment.Height = img.Bounds().Dy()
+
+		// Re-encode the original so EXIF and other metadata never reach other users
+		if mimeType == "image/gif" {
+			data, err = reencodeGIF(data)
+			if err != nil {
+				return nil, errInvalidImage
+			}
+		} else {
+			data, err = encodeImage(img, mimeType)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		thumbnail, err = encodeImage(resizeImage(img, thumbnailSize, thumbnailSize), mimeType)
+		if err != nil {
+			return nil, err
+		}
+	}
+	attachment.Size = int64(len(data))
+
+	key := "attachments/" + uuid.New().String()
+	if err := blobs.Put(ctx, key, data, mimeType); err != nil {
+		return nil, err
+	}
+	attachment.BlobKey = key
+
+	if thumbnail != nil {
+		thumbKey := key + "-thumb"
+		thumbType := "image/png"
+		if mimeType == "image/jpeg" {
+			thumbType = "image/jpeg"
+		}
+		if err := blobs.Put(ctx, thumbKey, thumbnail, thumbType); err != nil {
+			blobs.Delete(ctx, key)
+			return nil, err
+		}
+		attachment.ThumbKey = thumbKey
+	}
+
+	if err := createAttachment(attachment); err != nil {
+		blobs.Delete(ctx, attachment.BlobKey)
+		if attachment.ThumbKey != "" {
+			blobs.Delete(ctx, attachment.ThumbKey)
+		}
+		return nil, err
+	}
+
+	return attachment, nil
+}
+
+// cleanFilename keeps the base name of an uploaded file without control characters
+func cleanFilename(name string) string {
+	name = filepath.Base(strings.ReplaceAll(name, "\\", "/"))
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, name)
+	name = truncateRunes(strings.TrimSpace(name), 200)
+	if name == "" || name == "." || name == "/" {
+		return "file"
+	}
+	return name
+}
+
+// setAttachmentURLs fills in the URLs clients use to fetch an attachment
+func setAttachmentURLs(attachment *Attachment) {
+	attachment.URL = "/api/attachments/" + strconv.Itoa(attachment.ID)
+	if attachment.ThumbKey != "" {
+		attachment.ThumbnailURL = attachment.URL + "/thumb"
+	}
+}
+
+// createAttachment stores a new, not yet linked attachment
+func createAttachment(attachment *Attachment) error {
+	var thumbKey interface{}
+	if attachment.ThumbKey != "" {
+		thumbKey = attachment.ThumbKey
+	}
+	result, err := db.Exec(`
+		INSERT INTO attachments (blob_key, thumb_key, uploader_id, filename, mime_type, size, width, height)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		attachment.BlobKey, thumbKey, attachment.UploaderID, attachment.Filename, attachment.MimeType,
+		attachment.Size, attachment.Width, attachment.Height)
+	if err != nil {
+		return err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+	attachment.ID = int(id)
+	attachment.Created = time.Now()
+	setAttachmentURLs(attachment)
+	return nil
+}
+
+// attachmentColumns is the SELECT list matching scanAttachment
+const attachmentColumns = "id, blob_key, thumb_key, uploader_id, post_id, comment_id, filename, mime_type, size, width, height, created"
+
+// scanAttachment reads an attachment row selected with attachmentColumns
+func scanAttachment(scanner interface{ Scan(...interface{}) error }) (*Attachment, error) {
+	attachment := &Attachment{}
+	var thumbKey sql.NullString
+	var postID, commentID sql.NullInt64
+	err := scanner.Scan(&attachment.ID, &attachment.BlobKey, &thumbKey, &attachment.UploaderID, &postID, &commentID,
+		&attachment.Filename, &attachment.MimeType, &attachment.Size, &attachment.Width, &attachment.Height, &attachment.Created)
+	if err != nil {
+		return nil, err
+	}
+
+	attachment.ThumbKey = thumbKey.String
+	if postID.Valid {
+		id := int(postID.Int64)
+		attachment.PostID = &id
+	}
+	if commentID.Valid {
+		id := int(commentID.Int64)
+		attachment.CommentID = &id
+	}
+	setAttachmentURLs(attachment)
+	return attachment, nil
+}
+
+// getAttachment retrieves an attachment by ID
+func getAttachment(id int) (*Attachment, error) {
+	return scanAttachment(db.QueryRow("SELECT "+attachmentColumns+" FROM attachments WHERE id = ?", id))
+}
+
+// getAttachments retrieves the attachments of a post or comment
+func getAttachments(column string, id int) ([]Attachment, error) {
+	rows, err := db.Query("SELECT "+attachmentColumns+" FROM attachments WHERE "+column+" = ? ORDER BY id", id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var attachments []Attachment
+	for rows.Next() {
+		attachment, err := scanAttachment(rows)
+		if err != nil {
+			return nil, err
+		}
+		attachments = append(attachments, *attachment)
+	}
+	return attachments, rows.Err()
+}
+
+// linkAttachments attaches uploads to a post, comment or draft ("post_id",
+// "comment_id" or "draft_id" column). Only uploads of the same user that are
+// not linked to a post or comment yet can be used.
+func linkAttachments(tx *sql.Tx, uploaderID int, attachmentIDs []int, column string, targetID int64) error {
+	for _, attachmentID := range attachmentIDs {
+		result, err := tx.Exec(`
+			UPDATE attachments SET `+column+` = ?
+			WHERE id = ? AND uploader_id = ? AND post_id IS NULL AND comment_id IS NULL`,
+			targetID, attachmentID, uploaderID)
+		if err != nil {
+			return err
+		}
+		if affected, err := result.RowsAffected(); err != nil {
+			return err
+		} else if affected == 0 {
+			return errAttachmentUnavailable
+		}
+	}
+	return nil
+}
+
+// parseAttachmentIDs parses the comma-separated "attachments" form field
+func parseAttachmentIDs(value string) ([]int, error) {
+	var ids []int
+	seen := make(map[int]bool)
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		id, err := strconv.Atoi(part)
+		if err != nil {
+			return nil, err
+		}
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) > maxAttachmentsPerItem {
+		return nil, errors.New("too many attachments")
+	}
+	return ids, nil
+}
+
+// canViewAttachment checks whether a user may download an attachment: the
+// uploader and moderators always can, others only once it is linked to
+// visible content
+func canViewAttachment(user *User, attachment *Attachment) bool {
+	if attachment.UploaderID == user.ID || isModerator(user) {
+		return true
+	}
+
+	postID := 0
+	switch {
+	case attachment.PostID != nil:
+		postID = *attachment.PostID
+	case attachment.CommentID != nil:
+		id, err := getCommentPostID(*attachment.CommentID)
+		if err != nil {
+			return false
+		}
+		postID = id
+	default:
+		return false
+	}
+
+	_, err := getPostLocked(postID)
+	return err == nil
+}
+
+// collectOrphanAttachments deletes uploads that were never linked to a post
+// or comment, or whose post or comment has been deleted. Uploads kept in a
+// draft are left alone until the draft is deleted.
+func collectOrphanAttachments() {
+	cutoff := time.Now().Add(-orphanAttachmentAge).UTC().Format(sqliteTimeLayout)
+	rows, err := db.Query(`
+		SELECT `+attachmentColumns+` FROM attachments
+		WHERE created < ? AND (
+			(post_id IS NULL AND comment_id IS NULL AND (draft_id IS NULL OR draft_id NOT IN (SELECT id FROM drafts)))
+			OR post_id NOT IN (SELECT id FROM posts)
+			OR comment_id NOT IN (SELECT id FROM comments)
+		)`, cutoff)
+	if err != nil {
+		log.Printf("Attachment GC - query error: %v", err)
+		return
+	}
+
+	var orphans []*Attachment
+	for rows.Next() {
+		attachment, err := scanAttachment(rows)
+		if err != nil {
+			log.Printf("Attachment GC - scan error: %v", err)
+			break
+		}
+		orphans = append(orphans, attachment)
+	}
+	rows.Close()
+
+	ctx := context.Background()
+	for _, attachment := range orphans {
+		if err := blobs.Delete(ctx, attachment.BlobKey); err != nil {
+			log.Printf("Attachment GC - error deleting blob %s: %v", attachment.BlobKey, err)
+			continue
+		}
+		if attachment.ThumbKey != "" {
+			if err := blobs.Delete(ctx, attachment.ThumbKey); err != nil {
+				log.Printf("Attachment GC - error deleting blob %s: %v", attachment.ThumbKey, err)
+			}
+		}
+		if _, err := db.Exec("DELETE FROM attachments WHERE id = ?", attachment.ID); err != nil {
+			log.Printf("Attachment GC - error deleting attachment %d: %v", attachment.ID, err)
+		}
+	}
+
+	if len(orphans) > 0 {
+		log.Printf("Attachment GC - removed %d orphaned attachments", len(orphans))
+	}
+}
+
+// startAttachmentGC runs collectOrphanAttachments now and then every hour
+func startAttachmentGC() {
+	go func() {
+		for {
+			collectOrphanAttachments()
+			time.Sleep(time.Hour)
+		}
+	}()
+}
+
+// uploadAttachmentHandler accepts a multipart upload in the "file" field
+func uploadAttachmentHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, ok := requireActiveUser(w, r)
+	if !ok {
+		return
+	}
+
+	// Leave some room for the multipart framing around the file itself
+	maxBytes := appConfig.MaxUploadBytes
+	r.Body = http.MaxBytesReader(w, r.Body, maxBytes+64<<10)
+	if err := r.ParseMultipartForm(maxBytes); err != nil {
+		ErrorResponse(w, http.StatusRequestEntityTooLarge, "Файл слишком большой")
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		ErrorResponse(w, http.StatusBadRequest, "File is required")
+		return
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(io.LimitReader(file, maxBytes+1))
+	if err != nil {
+		ErrorResponse(w, http.StatusBadRequest, "Error reading file")
+		return
+	}
+	if int64(len(data)) > maxBytes {
+		ErrorResponse(w, http.StatusRequestEntityTooLarge, "Файл слишком большой")
+		return
+	}
+	if len(data) == 0 {
+		ErrorResponse(w, http.StatusBadRequest, "Файл пустой")
+		return
+	}
+
+	attachment, err := processUpload(r.Context(), user.ID, header.Filename, data)
+	switch {
+	case err == errUnsupportedFileType:
+		ErrorResponse(w, http.StatusUnsupportedMediaType, "Недопустимый тип файла")
+		return
+	case err == errImageTooLarge:
+		ErrorResponse(w, http.StatusBadRequest, "Слишком большое разрешение изображения")
+		return
+	case err == errInvalidImage:
+		ErrorResponse(w, http.StatusBadRequest, "Не удалось обработать изображение")
+		return
+	case err != nil:
+		log.Printf("Upload error: %v", err)
+		ErrorResponse(w, http.StatusInternalServerError, "Error storing file")
+		return
+	}
+
+	JSONResponse(w, http.StatusCreated, attachment)
+}
+
+// attachmentHandler serves an attachment (/api/attachments/{id}) or its
+// thumbnail (/api/attachments/{id}/thumb) to logged in users
+func attachmentHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, err := getCurrentUser(r)
+	if err != nil {
+		ErrorResponse(w, http.StatusUnauthorized, "Authentication required")
+		return
+	}
+
+	// pathParts = ["api", "attachments", "5"] or ["api", "attachments", "5", "thumb"]
+	pathParts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(pathParts) < 3 || len(pathParts) > 4 || (len(pathParts) == 4 && pathParts[3] != "thumb") {
+		ErrorResponse(w, http.StatusNotFound, "Attachment not found")
+		return
+	}
+	attachmentID, err := strconv.Atoi(pathParts[2])
+	if err != nil {
+		ErrorResponse(w, http.StatusBadRequest, "Invalid attachment ID")
+		return
+	}
+
+	attachment, err := getAttachment(attachmentID)
+	if err != nil || !canViewAttachment(user, attachment) {
+		ErrorResponse(w, http.StatusNotFound, "Attachment not found")
+		return
+	}
+
+	key, contentType := attachment.BlobKey, attachment.MimeType
+	if len(pathParts) == 4 {
+		if attachment.ThumbKey == "" {
+			ErrorResponse(w, http.StatusNotFound, "Attachment has no thumbnail")
+			return
+		}
+		key = attachment.ThumbKey
+		if contentType != "image/jpeg" {
+			contentType = "image/png"
+		}
+	}
+
+	reader, err := blobs.Get(r.Context(), key)
+	if err != nil {
+		log.Printf("Attachment %d - error reading blob %s: %v", attachment.ID, key, err)
+		ErrorResponse(w, http.StatusNotFound, "Attachment not found")
+		return
+	}
+	defer reader.Close()
+
+	disposition := "attachment"
+	if strings.HasPrefix(contentType, "image/") {
+		disposition = "inline"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": attachment.Filename}))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; sandbox")
+	w.Header().Set("Cache-Control", "private, max-age=86400")
+	io.Copy(w, reader)
+}
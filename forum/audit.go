@@ -0,0 +1,293 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// execer is implemented by both *sql.DB and *sql.Tx, so audit entries can be
+// written inside the transaction of the action they describe
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// queryer is the read-side counterpart of execer
+type queryer interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// clientIP returns the IP address of the client that sent the request
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// recordAudit appends an entry to the audit log. Snapshots are stored as JSON;
+// pass nil when there is nothing to record (e.g. no "after" for a deletion).
+func recordAudit(ex execer, actorID int, action, targetType string, targetID int, before, after interface{}, reason, ip string) error {
+	beforeJSON, err := marshalSnapshot(before)
+	if err != nil {
+		return err
+	}
+	afterJSON, err := marshalSnapshot(after)
+	if err != nil {
+		return err
+	}
+
+	_, err = ex.Exec(`
+		INSERT INTO audit_log (actor_id, action, target_type, target_id, before_snapshot, after_snapshot, reason, ip)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		actorID, action, targetType, targetID, beforeJSON, afterJSON, reason, ip)
+	return err
+}
+
+// marshalSnapshot encodes a snapshot for storage, keeping NULL for nil
+func marshalSnapshot(snapshot interface{}) (sql.NullString, error) {
+	if snapshot == nil {
+		return sql.NullString{}, nil
+	}
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return sql.NullString{}, err
+	}
+	return sql.NullString{String: string(data), Valid: true}, nil
+}
+
+// snapshotContent captures the current state of a post or comment for the
+// audit log; it returns nil when the content does not exist
+func snapshotContent(q queryer, targetType string, targetID int) (interface{}, error) {
+	var authorID int
+	var content string
+	var hidden bool
+
+	switch targetType {
+	case "post":
+		var title string
+		err := q.QueryRow("SELECT title, content, author_id, hidden FROM posts WHERE id = ?", targetID).
+			Scan(&title, &content, &authorID, &hidden)
+		if err == sql.ErrNoRows {
+			return nil, nil
+		} else if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{
+			"id":        targetID,
+			"title":     title,
+			"content":   content,
+			"author_id": authorID,
+			"hidden":    hidden,
+		}, nil
+	case "comment":
+		var postID int
+		err := q.QueryRow("SELECT post_id, content, author_id, hidden FROM comments WHERE id = ?", targetID).
+			Scan(&postID, &content, &authorID, &hidden)
+		if err == sql.ErrNoRows {
+			return nil, nil
+		} else if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{
+			"id":        targetID,
+			"post_id":   postID,
+			"content":   content,
+			"author_id": authorID,
+			"hidden":    hidden,
+		}, nil
+	}
+	return nil, errContentNotFound
+}
+
+// AuditFilter narrows down the audit log listing; zero values match everything
+type AuditFilter struct {
+	ActorID    int
+	Action     string
+	TargetType string
+	TargetID   int
+	Since      time.Time
+	Until      time.Time
+	Limit      int
+	Offset     int
+}
+
+// getAuditLog retrieves audit entries matching the filter, newest first
+func getAuditLog(filter AuditFilter) ([]AuditEntry, error) {
+	var conditions []string
+	var args []interface{}
+
+	if filter.ActorID != 0 {
+		conditions = append(conditions, "a.actor_id = ?")
+		args = append(args, filter.ActorID)
+	}
+	if filter.Action != "" {
+		conditions = append(conditions, "a.action = ?")
+		args = append(args, filter.Action)
+	}
+	if filter.TargetType != "" {
+		conditions = append(conditions, "a.target_type = ?")
+		args = append(args, filter.TargetType)
+	}
+	if filter.TargetID != 0 {
+		conditions = append(conditions, "a.target_id = ?")
+		args = append(args, filter.TargetID)
+	}
+	if !filter.Since.IsZero() {
+		conditions = append(conditions, "a.created >= ?")
+		args = append(args, filter.Since.UTC().Format(sqliteTimeLayout))
+	}
+	if !filter.Until.IsZero() {
+		conditions = append(conditions, "a.created < ?")
+		args = append(args, filter.Until.UTC().Format(sqliteTimeLayout))
+	}
+
+	query := `
+		SELECT a.id, a.actor_id, u.username, a.action, a.target_type, a.target_id,
+			   a.before_snapshot, a.after_snapshot, a.reason, a.ip, a.created
+		FROM audit_log a
+		JOIN users u ON a.actor_id = u.id`
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	query += " ORDER BY a.id DESC"
+	if filter.Limit > 0 {
+		query += " LIMIT ? OFFSET ?"
+		args = append(args, filter.Limit, filter.Offset)
+	}
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []AuditEntry{}
+	for rows.Next() {
+		var entry AuditEntry
+		var before, after sql.NullString
+		err := rows.Scan(&entry.ID, &entry.ActorID, &entry.ActorName, &entry.Action, &entry.TargetType, &entry.TargetID,
+			&before, &after, &entry.Reason, &entry.IP, &entry.Created)
+		if err != nil {
+			return nil, err
+		}
+		if before.Valid {
+			entry.Before = json.RawMessage(before.String)
+		}
+		if after.Valid {
+			entry.After = json.RawMessage(after.String)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+// parseTimeParam accepts either an RFC 3339 timestamp or a plain date
+func parseTimeParam(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	return time.Parse("2006-01-02", value)
+}
+
+// auditLogHandler lists audit entries for admins, as JSON or as CSV with format=csv
+func auditLogHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if _, ok := requireAdmin(w, r); !ok {
+		return
+	}
+
+	query := r.URL.Query()
+	filter := AuditFilter{
+		Action:     query.Get("action"),
+		TargetType: query.Get("target_type"),
+		Limit:      100,
+	}
+
+	intParams := map[string]*int{
+		"actor_id":  &filter.ActorID,
+		"target_id": &filter.TargetID,
+		"limit":     &filter.Limit,
+		"offset":    &filter.Offset,
+	}
+	for name, dest := range intParams {
+		if value := query.Get(name); value != "" {
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 {
+				ErrorResponse(w, http.StatusBadRequest, "Invalid "+name)
+				return
+			}
+			*dest = n
+		}
+	}
+
+	timeParams := map[string]*time.Time{
+		"since": &filter.Since,
+		"until": &filter.Until,
+	}
+	for name, dest := range timeParams {
+		if value := query.Get(name); value != "" {
+			t, err := parseTimeParam(value)
+			if err != nil {
+				ErrorResponse(w, http.StatusBadRequest, "Invalid "+name)
+				return
+			}
+			*dest = t
+		}
+	}
+
+	format := query.Get("format")
+	if format == "csv" && query.Get("limit") == "" {
+		// Exports include the whole matching history unless asked otherwise
+		filter.Limit = 0
+	}
+
+	entries, err := getAuditLog(filter)
+	if err != nil {
+		ErrorResponse(w, http.StatusInternalServerError, "Error retrieving audit log")
+		return
+	}
+
+	if format == "csv" {
+		writeAuditCSV(w, entries)
+		return
+	}
+
+	JSONResponse(w, http.StatusOK, entries)
+}
+
+// writeAuditCSV sends audit entries as a CSV download
+func writeAuditCSV(w http.ResponseWriter, entries []AuditEntry) {
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="audit_log.csv"`)
+
+	writer := csv.NewWriter(w)
+	writer.Write([]string{"id", "created", "actor_id", "actor_name", "action", "target_type", "target_id", "before", "after", "reason", "ip"})
+	for _, entry := range entries {
+		writer.Write([]string{
+			strconv.Itoa(entry.ID),
+			entry.Created.UTC().Format(time.RFC3339),
+			strconv.Itoa(entry.ActorID),
+			entry.ActorName,
+			entry.Action,
+			entry.TargetType,
+			strconv.Itoa(entry.TargetID),
+			string(entry.Before),
+			string(entry.After),
+			entry.Reason,
+			entry.IP,
+		})
+	}
+	writer.Flush()
+}
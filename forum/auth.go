@@ -73,6 +73,39 @@ func getCurrentUser(r *http.Request) (*User, error) {
 	return user, nil
 }
 
+// isModerator reports whether the user may act on reported content
+func isModerator(user *User) bool {
+	return user.Role == "moderator" || user.Role == "admin"
+}
+
+// requireModerator gets the current user and makes sure they are a moderator.
+// It writes the error response itself and returns false when they are not.
+func requireModerator(w http.ResponseWriter, r *http.Request) (*User, bool) {
+	user, ok := requireActiveUser(w, r)
+	if !ok {
+		return nil, false
+	}
+	if !isModerator(user) {
+		ErrorResponse(w, http.StatusForbidden, "Moderator access required")
+		return nil, false
+	}
+	return user, true
+}
+
+// requireAdmin gets the current user and makes sure they are an admin.
+// It writes the error response itself and returns false when they are not.
+func requireAdmin(w http.ResponseWriter, r *http.Request) (*User, bool) {
+	user, ok := requireActiveUser(w, r)
+	if !ok {
+		return nil, false
+	}
+	if user.Role != "admin" {
+		ErrorResponse(w, http.StatusForbidden, "Admin access required")
+		return nil, false
+	}
+	return user, true
+}
+
 // setSessionCookie sets the session cookie
 func setSessionCookie(w http.ResponseWriter, sessionID string) {
 	http.SetCookie(w, &http.Cookie{
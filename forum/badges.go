@@ -0,0 +1,226 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"time"
+)
+
+// badgeMetrics are the counters badge rules are based on. Each query takes
+// the user ID as ?1 and returns a single count.
+var badgeMetrics = map[string]string{
+	"posts":    "SELECT COUNT(*) FROM posts WHERE author_id = ?1 AND hidden = 0",
+	"comments": "SELECT COUNT(*) FROM comments WHERE author_id = ?1 AND hidden = 0",
+	"likes_received": `
+		SELECT COUNT(*) FROM reactions l
+		LEFT JOIN posts p ON l.post_id = p.id
+		LEFT JOIN comments c ON l.comment_id = c.id
+		WHERE l.reaction = 'like' AND l.user_id != ?1 AND (p.author_id = ?1 OR c.author_id = ?1)`,
+	"likes_given": "SELECT COUNT(*) FROM reactions WHERE user_id = ?1 AND reaction = 'like'",
+	"comment_categories": `
+		SELECT COUNT(DISTINCT pc.category_id) FROM comments c
+		JOIN post_categories pc ON pc.post_id = c.post_id
+		WHERE c.author_id = ?1 AND c.hidden = 0`,
+}
+
+// badgeRules declares the badges: a badge is awarded once its metric
+// reaches the threshold. Keys are stored with awards and must not change.
+var badgeRules = []BadgeRule{
+	{Key: "first_post", Name: "Первый пост", Description: "Написал первый пост", Metric: "posts", Threshold: 1},
+	{Key: "writer", Name: "Писатель", Description: "Написал 25 постов", Metric: "posts", Threshold: 25},
+	{Key: "first_comment", Name: "Первый комментарий", Description: "Оставил первый комментарий", Metric: "comments", Threshold: 1},
+	{Key: "commentator", Name: "Комментатор", Description: "Оставил 100 комментариев", Metric: "comments", Threshold: 100},
+	{Key: "liked", Name: "Нравится людям", Description: "Получил 10 лайков", Metric: "likes_received", Threshold: 10},
+	{Key: "star", Name: "Звезда", Description: "Получил 100 лайков", Metric: "likes_received", Threshold: 100},
+	{Key: "supporter", Name: "Ценитель", Description: "Поставил 50 лайков", Metric: "likes_given", Threshold: 50},
+	{Key: "versatile", Name: "Разносторонний", Description: "Комментировал в 10 категориях", Metric: "comment_categories", Threshold: 10},
+}
+
+// badgeRule finds a badge by key
+func badgeRule(key string) (BadgeRule, bool) {
+	for _, rule := range badgeRules {
+		if rule.Key == key {
+			return rule, true
+		}
+	}
+	return BadgeRule{}, false
+}
+
+// evaluateBadges awards a user the badges they earned. Only rules based on
+// the given metrics are checked, or all rules when none are passed.
+func evaluateBadges(userID int, metrics ...string) {
+	awarded, err := getAwardedBadgeKeys(userID)
+	if err != nil {
+		log.Printf("Badges - error loading badges of user %d: %v", userID, err)
+		return
+	}
+
+	values := make(map[string]int)
+	for _, rule := range badgeRules {
+		if awarded[rule.Key] || (len(metrics) > 0 && !containsString(metrics, rule.Metric)) {
+			continue
+		}
+
+		value, ok := values[rule.Metric]
+		if !ok {
+			if err := db.QueryRow(badgeMetrics[rule.Metric], userID).Scan(&value); err != nil {
+				log.Printf("Badges - error computing %s of user %d: %v", rule.Metric, userID, err)
+				continue
+			}
+			values[rule.Metric] = value
+		}
+		if value < rule.Threshold {
+			continue
+		}
+
+		result, err := db.Exec("INSERT OR IGNORE INTO user_badges (user_id, badge_key) VALUES (?, ?)", userID, rule.Key)
+		if err != nil {
+			log.Printf("Badges - error awarding %s to user %d: %v", rule.Key, userID, err)
+			continue
+		}
+		if n, _ := result.RowsAffected(); n > 0 {
+			events.publish("badge", map[string]interface{}{
+				"key":         rule.Key,
+				"name":        rule.Name,
+				"description": rule.Description,
+			}, userTopic(userID))
+		}
+	}
+}
+
+// getAwardedBadgeKeys returns the keys of the badges a user already has
+func getAwardedBadgeKeys(userID int) (map[string]bool, error) {
+	rows, err := db.Query("SELECT badge_key FROM user_badges WHERE user_id = ?", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := make(map[string]bool)
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		keys[key] = true
+	}
+	return keys, rows.Err()
+}
+
+// getUserBadges lists the badges of a user in the order they were awarded.
+// Awards of badges that no longer have a rule are skipped.
+func getUserBadges(userID int) ([]UserBadge, error) {
+	rows, err := db.Query("SELECT badge_key, awarded FROM user_badges WHERE user_id = ? ORDER BY awarded, badge_key", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	badges := []UserBadge{}
+	for rows.Next() {
+		var key string
+		var awarded time.Time
+		if err := rows.Scan(&key, &awarded); err != nil {
+			return nil, err
+		}
+		rule, ok := badgeRule(key)
+		if !ok {
+			continue
+		}
+		badges = append(badges, UserBadge{Key: key, Name: rule.Name, Description: rule.Description, Awarded: awarded})
+	}
+	return badges, rows.Err()
+}
+
+// evaluateVoteBadges checks the badges affected by a vote, for the voter and
+// the author of the post or comment
+func evaluateVoteBadges(voterID int, postID, commentID *int) {
+	evaluateBadges(voterID, "likes_given")
+
+	var authorID int
+	var err error
+	if commentID != nil {
+		err = db.QueryRow("SELECT author_id FROM comments WHERE id = ?", *commentID).Scan(&authorID)
+	} else {
+		err = db.QueryRow("SELECT author_id FROM posts WHERE id = ?", *postID).Scan(&authorID)
+	}
+	if err != nil {
+		log.Printf("Badges - error loading author: %v", err)
+		return
+	}
+	if authorID != voterID {
+		evaluateBadges(authorID, "likes_received")
+	}
+}
+
+// evaluateAllBadges checks every rule for every user, catching awards
+// missed by the event hooks and rules added later
+func evaluateAllBadges() {
+	rows, err := db.Query("SELECT id FROM users")
+	if err != nil {
+		log.Printf("Badges - error loading users: %v", err)
+		return
+	}
+	var userIDs []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			log.Printf("Badges - error loading users: %v", err)
+			rows.Close()
+			return
+		}
+		userIDs = append(userIDs, id)
+	}
+	rows.Close()
+
+	for _, userID := range userIDs {
+		evaluateBadges(userID)
+	}
+}
+
+// startBadgeJob runs evaluateAllBadges now and then every hour
+func startBadgeJob() {
+	go func() {
+		for {
+			evaluateAllBadges()
+			time.Sleep(time.Hour)
+		}
+	}()
+}
+
+// badgesHandler lists all badges with the number of users who earned each
+func badgesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	rows, err := db.Query("SELECT badge_key, COUNT(*) FROM user_badges GROUP BY badge_key")
+	if err != nil {
+		ErrorResponse(w, http.StatusInternalServerError, "Error retrieving badges")
+		return
+	}
+	defer rows.Close()
+
+	counts := make(map[string]int)
+	for rows.Next() {
+		var key string
+		var count int
+		if err := rows.Scan(&key, &count); err != nil {
+			ErrorResponse(w, http.StatusInternalServerError, "Error retrieving badges")
+			return
+		}
+		counts[key] = count
+	}
+
+	badges := make([]Badge, 0, len(badgeRules))
+	for _, rule := range badgeRules {
+		badges = append(badges, Badge{
+			Key:          rule.Key,
+			Name:         rule.Name,
+			Description:  rule.Description,
+			AwardedCount: counts[rule.Key],
+		})
+	}
+	JSONResponse(w, http.StatusOK, badges)
+}
@@ -0,0 +1,474 @@
+package main
+
+import (
+	"database/sql"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// getActiveSuspension retrieves the suspension currently in force for a user,
+// or nil when the user is not suspended
+func getActiveSuspension(userID int) (*Suspension, error) {
+	suspension := &Suspension{}
+	var until sql.NullTime
+	err := db.QueryRow(`
+		SELECT id, user_id, reason, until, created FROM suspensions
+		WHERE user_id = ? AND lifted_at IS NULL AND (until IS NULL OR until > ?)
+		ORDER BY until IS NULL DESC, until DESC
+		LIMIT 1`, userID, time.Now().UTC().Format(sqliteTimeLayout)).
+		Scan(&suspension.ID, &suspension.UserID, &suspension.Reason, &until, &suspension.Created)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if until.Valid {
+		suspension.Until = &until.Time
+	} else {
+		suspension.Permanent = true
+	}
+	return suspension, nil
+}
+
+// suspendUser suspends a user until the given time (permanently when nil)
+// and revokes all of their sessions
+func suspendUser(moderatorID, userID int, reason string, until *time.Time, ip string) error {
+	before, err := getActiveSuspension(userID)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var untilValue interface{}
+	if until != nil {
+		untilValue = until.UTC().Format(sqliteTimeLayout)
+	}
+
+	// A new suspension replaces whatever was in force before
+	_, err = tx.Exec("UPDATE suspensions SET lifted_at = CURRENT_TIMESTAMP, lifted_by = ? WHERE user_id = ? AND lifted_at IS NULL", moderatorID, userID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("INSERT INTO suspensions (user_id, moderator_id, reason, until) VALUES (?, ?, ?, ?)", userID, moderatorID, reason, untilValue)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("DELETE FROM sessions WHERE user_id = ?", userID)
+	if err != nil {
+		return err
+	}
+
+	after := map[string]interface{}{"reason": reason, "until": until, "permanent": until == nil}
+	err = recordAudit(tx, moderatorID, "user.suspend", "user", userID, suspensionSnapshot(before), after, reason, ip)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// liftSuspension ends the active suspension of a user early
+func liftSuspension(moderatorID, userID int, reason, ip string) error {
+	before, err := getActiveSuspension(userID)
+	if err != nil {
+		return err
+	}
+	if before == nil {
+		return sql.ErrNoRows
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("UPDATE suspensions SET lifted_at = CURRENT_TIMESTAMP, lifted_by = ? WHERE user_id = ? AND lifted_at IS NULL", moderatorID, userID)
+	if err != nil {
+		return err
+	}
+
+	err = recordAudit(tx, moderatorID, "user.unsuspend", "user", userID, suspensionSnapshot(before), nil, reason, ip)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// suspensionSnapshot describes a suspension for the audit log
+func suspensionSnapshot(suspension *Suspension) interface{} {
+	if suspension == nil {
+		return nil
+	}
+	return map[string]interface{}{
+		"reason":    suspension.Reason,
+		"until":     suspension.Until,
+		"permanent": suspension.Permanent,
+	}
+}
+
+// suspensionMessage explains a suspension to the suspended user
+func suspensionMessage(suspension *Suspension) string {
+	message := "Ваш аккаунт заблокирован навсегда"
+	if !suspension.Permanent {
+		message = "Ваш аккаунт заблокирован до " + suspension.Until.Local().Format("02.01.2006 15:04")
+	}
+	if suspension.Reason != "" {
+		message += ". Причина: " + suspension.Reason
+	}
+	return message
+}
+
+// requireActiveUser gets the current user for an endpoint that changes data.
+// Anonymous users get 401 and suspended users get 403 with the suspension
+// details; the error response is written here and false is returned.
+func requireActiveUser(w http.ResponseWriter, r *http.Request) (*User, bool) {
+	user, err := getCurrentUser(r)
+	if err != nil {
+		ErrorResponse(w, http.StatusUnauthorized, "Authentication required")
+		return nil, false
+	}
+
+	suspension, err := getActiveSuspension(user.ID)
+	if err != nil {
+		ErrorResponse(w, http.StatusInternalServerError, "Error checking account status")
+		return nil, false
+	}
+	if suspension != nil {
+		JSONResponse(w, http.StatusForbidden, map[string]interface{}{
+			"error":      suspensionMessage(suspension),
+			"suspension": suspension,
+		})
+		return nil, false
+	}
+
+	return user, true
+}
+
+// suspensionError returns a 403 requestError explaining the suspension of
+// a suspended user, for pages that can't show the suspension details
+func suspensionError(user *User) error {
+	suspension, err := getActiveSuspension(user.ID)
+	if err != nil {
+		return err
+	}
+	if suspension != nil {
+		return &requestError{http.StatusForbidden, suspensionMessage(suspension)}
+	}
+	return nil
+}
+
+// ipBlockedError returns a 403 requestError for requests coming from a
+// blocked IP range
+func ipBlockedError(r *http.Request) error {
+	blocked, err := isIPBlocked(clientIP(r))
+	if err != nil {
+		return err
+	}
+	if blocked {
+		return &requestError{http.StatusForbidden, "Регистрация и вход с вашего IP-адреса заблокированы"}
+	}
+	return nil
+}
+
+// requireUserForMethod gets the current user for an endpoint that reads
+// with GET and changes data with its other methods: reading only needs a
+// login, changing data needs an active user like requireActiveUser. The
+// error response is written here and false is returned.
+func requireUserForMethod(w http.ResponseWriter, r *http.Request) (*User, bool) {
+	if r.Method != "GET" {
+		return requireActiveUser(w, r)
+	}
+	user, err := getCurrentUser(r)
+	if err != nil {
+		ErrorResponse(w, http.StatusUnauthorized, "Authentication required")
+		return nil, false
+	}
+	return user, true
+}
+
+// checkIPAllowed rejects requests coming from a blocked IP range with 403.
+// It writes the error response itself and returns false when blocked.
+func checkIPAllowed(w http.ResponseWriter, r *http.Request) bool {
+	return writeRequestError(w, ipBlockedError(r))
+}
+
+// parseIPBlock normalizes a single IP address or a CIDR range to CIDR notation
+func parseIPBlock(value string) (string, error) {
+	value = strings.TrimSpace(value)
+	if !strings.Contains(value, "/") {
+		ip := net.ParseIP(value)
+		if ip == nil {
+			return "", &net.ParseError{Type: "IP address", Text: value}
+		}
+		if ip.To4() != nil {
+			value += "/32"
+		} else {
+			value += "/128"
+		}
+	}
+
+	_, network, err := net.ParseCIDR(value)
+	if err != nil {
+		return "", err
+	}
+	return network.String(), nil
+}
+
+// isIPBlocked checks whether an IP address falls into any blocked range
+func isIPBlocked(ipStr string) (bool, error) {
+	ip := net.ParseIP(ipStr)
+	if ip == nil {
+		return false, nil
+	}
+
+	blocks, err := getIPBlocks()
+	if err != nil {
+		return false, err
+	}
+
+	for _, block := range blocks {
+		_, network, err := net.ParseCIDR(block.CIDR)
+		if err == nil && network.Contains(ip) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// getIPBlocks retrieves all blocked IP ranges
+func getIPBlocks() ([]IPBlock, error) {
+	rows, err := db.Query("SELECT id, cidr, reason, created_by, created FROM ip_blocks ORDER BY created DESC")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	blocks := []IPBlock{}
+	for rows.Next() {
+		var block IPBlock
+		if err := rows.Scan(&block.ID, &block.CIDR, &block.Reason, &block.CreatedBy, &block.Created); err != nil {
+			return nil, err
+		}
+		blocks = append(blocks, block)
+	}
+	return blocks, rows.Err()
+}
+
+// addIPBlock blocks registration and login from an IP range
+func addIPBlock(moderatorID int, cidr, reason, ip string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("INSERT INTO ip_blocks (cidr, reason, created_by) VALUES (?, ?, ?)", cidr, reason, moderatorID)
+	if err != nil {
+		return err
+	}
+	blockID, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+
+	after := map[string]interface{}{"cidr": cidr, "reason": reason}
+	if err := recordAudit(tx, moderatorID, "ip.block", "ip_block", int(blockID), nil, after, reason, ip); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// removeIPBlock lifts a block on an IP range
+func removeIPBlock(moderatorID, blockID int, ip string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var cidr, reason string
+	err = tx.QueryRow("SELECT cidr, reason FROM ip_blocks WHERE id = ?", blockID).Scan(&cidr, &reason)
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec("DELETE FROM ip_blocks WHERE id = ?", blockID); err != nil {
+		return err
+	}
+
+	before := map[string]interface{}{"cidr": cidr, "reason": reason}
+	if err := recordAudit(tx, moderatorID, "ip.unblock", "ip_block", blockID, before, nil, "", ip); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// suspendHandler suspends a user temporarily (until=...) or permanently (permanent=true)
+func suspendHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	moderator, ok := requireModerator(w, r)
+	if !ok {
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		ErrorResponse(w, http.StatusBadRequest, "Invalid form data")
+		return
+	}
+
+	userID, err := strconv.Atoi(r.FormValue("user_id"))
+	if err != nil {
+		ErrorResponse(w, http.StatusBadRequest, "Invalid user ID")
+		return
+	}
+
+	reason := strings.TrimSpace(r.FormValue("reason"))
+	if reason == "" {
+		ErrorResponse(w, http.StatusBadRequest, "Укажите причину блокировки")
+		return
+	}
+
+	var until *time.Time
+	if r.FormValue("permanent") != "true" {
+		untilStr := r.FormValue("until")
+		if untilStr == "" {
+			ErrorResponse(w, http.StatusBadRequest, "Either until or permanent=true is required")
+			return
+		}
+		t, err := parseTimeParam(untilStr)
+		if err != nil {
+			ErrorResponse(w, http.StatusBadRequest, "Invalid until")
+			return
+		}
+		if !t.After(time.Now()) {
+			ErrorResponse(w, http.StatusBadRequest, "Дата окончания блокировки должна быть в будущем")
+			return
+		}
+		until = &t
+	}
+
+	target, err := getUserByID(userID)
+	if err != nil {
+		ErrorResponse(w, http.StatusNotFound, "User not found")
+		return
+	}
+	if target.ID == moderator.ID {
+		ErrorResponse(w, http.StatusBadRequest, "Нельзя заблокировать самого себя")
+		return
+	}
+	if isModerator(target) && moderator.Role != "admin" {
+		ErrorResponse(w, http.StatusForbidden, "Only admins can suspend moderators")
+		return
+	}
+
+	if err := suspendUser(moderator.ID, target.ID, reason, until, clientIP(r)); err != nil {
+		ErrorResponse(w, http.StatusInternalServerError, "Error suspending user")
+		return
+	}
+
+	JSONResponse(w, http.StatusOK, map[string]string{"message": "User suspended"})
+}
+
+// unsuspendHandler lifts the active suspension of a user
+func unsuspendHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	moderator, ok := requireModerator(w, r)
+	if !ok {
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		ErrorResponse(w, http.StatusBadRequest, "Invalid form data")
+		return
+	}
+
+	userID, err := strconv.Atoi(r.FormValue("user_id"))
+	if err != nil {
+		ErrorResponse(w, http.StatusBadRequest, "Invalid user ID")
+		return
+	}
+
+	err = liftSuspension(moderator.ID, userID, strings.TrimSpace(r.FormValue("reason")), clientIP(r))
+	if err == sql.ErrNoRows {
+		ErrorResponse(w, http.StatusNotFound, "User is not suspended")
+		return
+	} else if err != nil {
+		ErrorResponse(w, http.StatusInternalServerError, "Error lifting suspension")
+		return
+	}
+
+	JSONResponse(w, http.StatusOK, map[string]string{"message": "Suspension lifted"})
+}
+
+// ipBlocksHandler lists (GET), adds (POST) and removes (DELETE ?id=) blocked IP ranges
+func ipBlocksHandler(w http.ResponseWriter, r *http.Request) {
+	moderator, ok := requireModerator(w, r)
+	if !ok {
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		blocks, err := getIPBlocks()
+		if err != nil {
+			ErrorResponse(w, http.StatusInternalServerError, "Error retrieving IP blocks")
+			return
+		}
+		JSONResponse(w, http.StatusOK, blocks)
+	case "POST":
+		if err := r.ParseForm(); err != nil {
+			ErrorResponse(w, http.StatusBadRequest, "Invalid form data")
+			return
+		}
+		cidr, err := parseIPBlock(r.FormValue("cidr"))
+		if err != nil {
+			ErrorResponse(w, http.StatusBadRequest, "Invalid IP address or CIDR range")
+			return
+		}
+		if err := addIPBlock(moderator.ID, cidr, strings.TrimSpace(r.FormValue("reason")), clientIP(r)); err != nil {
+			ErrorResponse(w, http.StatusConflict, "IP range is already blocked")
+			return
+		}
+		JSONResponse(w, http.StatusCreated, map[string]string{"message": "IP range blocked", "cidr": cidr})
+	case "DELETE":
+		blockID, err := strconv.Atoi(r.URL.Query().Get("id"))
+		if err != nil {
+			ErrorResponse(w, http.StatusBadRequest, "Invalid block ID")
+			return
+		}
+		err = removeIPBlock(moderator.ID, blockID, clientIP(r))
+		if err == sql.ErrNoRows {
+			ErrorResponse(w, http.StatusNotFound, "IP block not found")
+			return
+		} else if err != nil {
+			ErrorResponse(w, http.StatusInternalServerError, "Error removing IP block")
+			return
+		}
+		JSONResponse(w, http.StatusOK, map[string]string{"message": "IP block removed"})
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
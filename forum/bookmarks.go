@@ -0,0 +1,456 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	maxBookmarkFolders    = 50
+	maxFolderNameLength   = 50
+	bookmarksPageSize     = 20
+	bookmarkExcerptLength = 200
+)
+
+var errFolderNotFound = errors.New("bookmark folder not found")
+
+// getBookmarkStatus reports whether a user bookmarked a post ("post_id" column,
+// excluding comment bookmarks) or a comment ("comment_id" column)
+func getBookmarkStatus(userID int, column string, id int) (*bool, error) {
+	query := "SELECT COUNT(*) FROM bookmarks WHERE user_id = ? AND " + column + " = ?"
+	if column == "post_id" {
+		query += " AND comment_id IS NULL"
+	}
+	var count int
+	if err := db.QueryRow(query, userID, id).Scan(&count); err != nil {
+		return nil, err
+	}
+	bookmarked := count > 0
+	return &bookmarked, nil
+}
+
+// checkFolderOwner makes sure a bookmark folder exists and belongs to the user
+func checkFolderOwner(folderID, userID int) error {
+	var ownerID int
+	err := db.QueryRow("SELECT user_id FROM bookmark_folders WHERE id = ?", folderID).Scan(&ownerID)
+	if err == sql.ErrNoRows || (err == nil && ownerID != userID) {
+		return errFolderNotFound
+	}
+	return err
+}
+
+// saveBookmark bookmarks a post, or a comment of the post when commentID is
+// set. Bookmarking the same content again moves it to the given folder.
+func saveBookmark(userID, postID int, commentID, folderID *int) (created bool, err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var result sql.Result
+	if commentID != nil {
+		result, err = tx.Exec("UPDATE bookmarks SET folder_id = ? WHERE user_id = ? AND comment_id = ?",
+			folderID, userID, *commentID)
+	} else {
+		result, err = tx.Exec("UPDATE bookmarks SET folder_id = ? WHERE user_id = ? AND post_id = ? AND comment_id IS NULL",
+			folderID, userID, postID)
+	}
+	if err != nil {
+		return false, err
+	}
+	if updated, err := result.RowsAffected(); err != nil {
+		return false, err
+	} else if updated == 0 {
+		if _, err := tx.Exec("INSERT INTO bookmarks (user_id, post_id, comment_id, folder_id) VALUES (?, ?, ?, ?)",
+			userID, postID, commentID, folderID); err != nil {
+			return false, err
+		}
+		created = true
+	}
+	return created, tx.Commit()
+}
+
+// removeBookmark deletes a user's bookmark of a post or a comment
+func removeBookmark(userID int, column string, id int) error {
+	query := "DELETE FROM bookmarks WHERE user_id = ? AND " + column + " = ?"
+	if column == "post_id" {
+		query += " AND comment_id IS NULL"
+	}
+	result, err := db.Exec(query, userID, id)
+	if err != nil {
+		return err
+	}
+	if deleted, err := result.RowsAffected(); err != nil {
+		return err
+	} else if deleted == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// getBookmarks lists a user's bookmarks, newest first, optionally only those
+// in one folder. Bookmarks of deleted or hidden content stay in the list with
+// Available set to false and without the content details.
+func getBookmarks(userID int, folderID *int, page int) ([]Bookmark, bool, error) {
+	query := `
+		SELECT b.id, b.post_id, b.comment_id, b.folder_id, b.created,
+			CASE WHEN b.comment_id IS NULL
+				THEN p.id IS NOT NULL AND p.hidden = 0
+				ELSE c.id IS NOT NULL AND c.hidden = 0 AND p.id IS NOT NULL AND p.hidden = 0
+			END AS available,
+			COALESCE(p.title, ''),
+			COALESCE(CASE WHEN b.comment_id IS NULL THEN p.content ELSE c.content END, ''),
+			COALESCE(u.username, '')
+		FROM bookmarks b
+		LEFT JOIN posts p ON b.post_id = p.id
+		LEFT JOIN comments c ON b.comment_id = c.id
+		LEFT JOIN users u ON u.id = CASE WHEN b.comment_id IS NULL THEN p.author_id ELSE c.author_id END
+		WHERE b.user_id = ?`
+	args := []interface{}{userID}
+	if folderID != nil {
+		query += " AND b.folder_id = ?"
+		args = append(args, *folderID)
+	}
+	query += " ORDER BY b.created DESC, b.id DESC LIMIT ? OFFSET ?"
+	args = append(args, bookmarksPageSize+1, (page-1)*bookmarksPageSize)
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, false, err
+	}
+	defer rows.Close()
+
+	bookmarks := []Bookmark{}
+	for rows.Next() {
+		var bookmark Bookmark
+		var content string
+		err := rows.Scan(&bookmark.ID, &bookmark.PostID, &bookmark.CommentID, &bookmark.FolderID, &bookmark.Created,
+			&bookmark.Available, &bookmark.PostTitle, &content, &bookmark.AuthorName)
+		if err != nil {
+			return nil, false, err
+		}
+		bookmark.Type = "post"
+		if bookmark.CommentID != nil {
+			bookmark.Type = "comment"
+		}
+		if bookmark.Available {
+			bookmark.Excerpt = truncateRunes(content, bookmarkExcerptLength)
+		} else {
+			bookmark.PostTitle, bookmark.AuthorName = "", ""
+		}
+		bookmarks = append(bookmarks, bookmark)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, false, err
+	}
+
+	hasMore := len(bookmarks) > bookmarksPageSize
+	if hasMore {
+		bookmarks = bookmarks[:bookmarksPageSize]
+	}
+	return bookmarks, hasMore, nil
+}
+
+// getBookmarkFolders lists a user's folders by name with their bookmark counts
+func getBookmarkFolders(userID int) ([]BookmarkFolder, error) {
+	rows, err := db.Query(`
+		SELECT f.id, f.name, f.created, (SELECT COUNT(*) FROM bookmarks b WHERE b.folder_id = f.id)
+		FROM bookmark_folders f
+		WHERE f.user_id = ?
+		ORDER BY f.name COLLATE NOCASE`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	folders := []BookmarkFolder{}
+	for rows.Next() {
+		var folder BookmarkFolder
+		if err := rows.Scan(&folder.ID, &folder.Name, &folder.Created, &folder.Count); err != nil {
+			return nil, err
+		}
+		folders = append(folders, folder)
+	}
+	return folders, rows.Err()
+}
+
+// deleteBookmarkFolder removes a folder; its bookmarks are kept without a folder
+func deleteBookmarkFolder(folderID int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("UPDATE bookmarks SET folder_id = NULL WHERE folder_id = ?", folderID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM bookmark_folders WHERE id = ?", folderID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// validFolderName checks a folder name, writing the error response itself
+func validFolderName(w http.ResponseWriter, name string) bool {
+	if name == "" || utf8.RuneCountInString(name) > maxFolderNameLength || strings.ContainsAny(name, "\r\n") {
+		ErrorResponse(w, http.StatusBadRequest, "Название папки должно быть одной строкой от 1 до 50 символов")
+		return false
+	}
+	return true
+}
+
+// parseFolderID reads an optional folder ID owned by the user from a form or
+// query value. It writes the error response itself and returns false on failure.
+func parseFolderID(w http.ResponseWriter, value string, userID int) (*int, bool) {
+	if value == "" {
+		return nil, true
+	}
+	folderID, err := strconv.Atoi(value)
+	if err != nil {
+		ErrorResponse(w, http.StatusBadRequest, "Invalid folder ID")
+		return nil, false
+	}
+	if err := checkFolderOwner(folderID, userID); err == errFolderNotFound {
+		ErrorResponse(w, http.StatusNotFound, "Folder not found")
+		return nil, false
+	} else if err != nil {
+		ErrorResponse(w, http.StatusInternalServerError, "Error retrieving folder")
+		return nil, false
+	}
+	return &folderID, true
+}
+
+// bookmarksHandler lists the current user's bookmarks (GET with optional
+// folder_id and page), bookmarks a post or comment (POST with post_id or
+// comment_id and optional folder_id) or removes a bookmark (DELETE with
+// ?post_id= or ?comment_id=)
+func bookmarksHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "POST" && r.Method != "DELETE" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Suspended users can see their bookmarks but not change them
+	user, ok := requireUserForMethod(w, r)
+	if !ok {
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		ErrorResponse(w, http.StatusBadRequest, "Invalid form data")
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		folderID, ok := parseFolderID(w, r.FormValue("folder_id"), user.ID)
+		if !ok {
+			return
+		}
+		page := 1
+		if value := r.FormValue("page"); value != "" {
+			var err error
+			page, err = strconv.Atoi(value)
+			if err != nil || page < 1 {
+				ErrorResponse(w, http.StatusBadRequest, "Invalid page")
+				return
+			}
+		}
+
+		bookmarks, hasMore, err := getBookmarks(user.ID, folderID, page)
+		if err != nil {
+			ErrorResponse(w, http.StatusInternalServerError, "Error retrieving bookmarks")
+			return
+		}
+		JSONResponse(w, http.StatusOK, map[string]interface{}{
+			"bookmarks": bookmarks,
+			"page":      page,
+			"has_more":  hasMore,
+		})
+
+	case "POST":
+		folderID, ok := parseFolderID(w, r.FormValue("folder_id"), user.ID)
+		if !ok {
+			return
+		}
+
+		var postID int
+		var commentID *int
+		if value := r.FormValue("comment_id"); value != "" {
+			id, err := strconv.Atoi(value)
+			if err != nil {
+				ErrorResponse(w, http.StatusBadRequest, "Invalid comment ID")
+				return
+			}
+			commentID = &id
+			postID, err = getCommentPostID(id)
+			if err == errContentNotFound {
+				ErrorResponse(w, http.StatusNotFound, "Comment not found")
+				return
+			} else if err != nil {
+				ErrorResponse(w, http.StatusInternalServerError, "Error saving bookmark")
+				return
+			}
+		} else {
+			var err error
+			postID, err = strconv.Atoi(r.FormValue("post_id"))
+			if err != nil {
+				ErrorResponse(w, http.StatusBadRequest, "Invalid post ID")
+				return
+			}
+		}
+		if _, err := getPostLocked(postID); err == errContentNotFound {
+			ErrorResponse(w, http.StatusNotFound, "Post not found")
+			return
+		} else if err != nil {
+			ErrorResponse(w, http.StatusInternalServerError, "Error saving bookmark")
+			return
+		}
+
+		created, err := saveBookmark(user.ID, postID, commentID, folderID)
+		if err != nil {
+			ErrorResponse(w, http.StatusInternalServerError, "Error saving bookmark")
+			return
+		}
+		if created {
+			JSONResponse(w, http.StatusCreated, map[string]string{"message": "Bookmark saved"})
+		} else {
+			JSONResponse(w, http.StatusOK, map[string]string{"message": "Bookmark updated"})
+		}
+
+	case "DELETE":
+		column, value := "post_id", r.FormValue("post_id")
+		if r.FormValue("comment_id") != "" {
+			column, value = "comment_id", r.FormValue("comment_id")
+		}
+		id, err := strconv.Atoi(value)
+		if err != nil {
+			ErrorResponse(w, http.StatusBadRequest, "Invalid ID")
+			return
+		}
+
+		err = removeBookmark(user.ID, column, id)
+		if err == sql.ErrNoRows {
+			ErrorResponse(w, http.StatusNotFound, "Bookmark not found")
+			return
+		} else if err != nil {
+			ErrorResponse(w, http.StatusInternalServerError, "Error removing bookmark")
+			return
+		}
+		JSONResponse(w, http.StatusOK, map[string]string{"message": "Bookmark removed"})
+	}
+}
+
+// bookmarkFoldersHandler lists (GET) or creates (POST with name) the
+// current user's bookmark folders
+func bookmarkFoldersHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Suspended users can see their folders but not change them
+	user, ok := requireUserForMethod(w, r)
+	if !ok {
+		return
+	}
+
+	if r.Method == "POST" {
+		if err := r.ParseForm(); err != nil {
+			ErrorResponse(w, http.StatusBadRequest, "Invalid form data")
+			return
+		}
+		name := strings.TrimSpace(r.FormValue("name"))
+		if !validFolderName(w, name) {
+			return
+		}
+
+		var count int
+		if err := db.QueryRow("SELECT COUNT(*) FROM bookmark_folders WHERE user_id = ?", user.ID).Scan(&count); err != nil {
+			ErrorResponse(w, http.StatusInternalServerError, "Error creating folder")
+			return
+		}
+		if count >= maxBookmarkFolders {
+			ErrorResponse(w, http.StatusBadRequest, "Можно создать не более 50 папок")
+			return
+		}
+
+		result, err := db.Exec("INSERT INTO bookmark_folders (user_id, name) VALUES (?, ?)", user.ID, name)
+		if err != nil {
+			ErrorResponse(w, http.StatusConflict, "Папка с таким названием уже есть")
+			return
+		}
+		folderID, _ := result.LastInsertId()
+		JSONResponse(w, http.StatusCreated, map[string]interface{}{"id": folderID, "name": name})
+		return
+	}
+
+	folders, err := getBookmarkFolders(user.ID)
+	if err != nil {
+		ErrorResponse(w, http.StatusInternalServerError, "Error retrieving folders")
+		return
+	}
+	JSONResponse(w, http.StatusOK, folders)
+}
+
+// bookmarkFolderHandler renames (POST /api/bookmarks/folders/{id} with name)
+// or deletes (DELETE) one of the current user's folders
+func bookmarkFolderHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" && r.Method != "DELETE" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, ok := requireActiveUser(w, r)
+	if !ok {
+		return
+	}
+
+	// pathParts = ["api", "bookmarks", "folders", "5"]
+	pathParts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(pathParts) != 4 {
+		ErrorResponse(w, http.StatusNotFound, "Not found")
+		return
+	}
+	folderID, err := strconv.Atoi(pathParts[3])
+	if err != nil {
+		ErrorResponse(w, http.StatusBadRequest, "Invalid folder ID")
+		return
+	}
+	if err := checkFolderOwner(folderID, user.ID); err == errFolderNotFound {
+		ErrorResponse(w, http.StatusNotFound, "Folder not found")
+		return
+	} else if err != nil {
+		ErrorResponse(w, http.StatusInternalServerError, "Error retrieving folder")
+		return
+	}
+
+	if r.Method == "DELETE" {
+		if err := deleteBookmarkFolder(folderID); err != nil {
+			ErrorResponse(w, http.StatusInternalServerError, "Error deleting folder")
+			return
+		}
+		JSONResponse(w, http.StatusOK, map[string]string{"message": "Folder deleted"})
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		ErrorResponse(w, http.StatusBadRequest, "Invalid form data")
+		return
+	}
+	name := strings.TrimSpace(r.FormValue("name"))
+	if !validFolderName(w, name) {
+		return
+	}
+	if _, err := db.Exec("UPDATE bookmark_folders SET name = ? WHERE id = ?", name, folderID); err != nil {
+		ErrorResponse(w, http.StatusConflict, "Папка с таким названием уже есть")
+		return
+	}
+	JSONResponse(w, http.StatusOK, map[string]string{"message": "Folder renamed"})
+}
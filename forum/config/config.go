@@ -0,0 +1,126 @@
+// Package config reads the forum settings from environment variables.
+package config
+
+import (
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Config holds the settings of the forum server
+type Config struct {
+	// Blob storage for attachments: "local" (default) or "s3"
+	BlobBackend string
+	BlobDir     string // Root directory of the local backend
+
+	// S3-compatible backend (AWS S3, MinIO, ...)
+	S3Endpoint  string // e.g. http://localhost:9000
+	S3Region    string
+	S3Bucket    string
+	S3AccessKey string
+	S3SecretKey string
+
+	// Upload limits
+	MaxUploadBytes int64
+
+	// Reputation points an author gets per vote received
+	ReputationPostLike       int
+	ReputationPostDislike    int
+	ReputationCommentLike    int
+	ReputationCommentDislike int
+
+	// Reactions offered besides like and dislike
+	Reactions []Reaction
+
+	// Public URL of the forum, e.g. https://forum.example.com, for absolute
+	// links in feeds. When empty it is derived from each request.
+	BaseURL string
+}
+
+// Reaction is an emoji reaction users can add to posts and comments
+type Reaction struct {
+	Key   string `json:"key"`   // Stored with each reaction; must not change
+	Emoji string `json:"emoji"` // Shown to users
+}
+
+// defaultReactions is the reaction set used when FORUM_REACTIONS is unset
+const defaultReactions = "heart:❤️,laugh:😂,wow:😮,sad:😢,party:🎉"
+
+// Load reads the configuration from the environment, falling back to defaults
+func Load() Config {
+	return Config{
+		BlobBackend:    getEnv("FORUM_BLOB_BACKEND", "local"),
+		BlobDir:        getEnv("FORUM_BLOB_DIR", "./uploads"),
+		S3Endpoint:     getEnv("FORUM_S3_ENDPOINT", ""),
+		S3Region:       getEnv("FORUM_S3_REGION", "us-east-1"),
+		S3Bucket:       getEnv("FORUM_S3_BUCKET", "forum"),
+		S3AccessKey:    getEnv("FORUM_S3_ACCESS_KEY", ""),
+		S3SecretKey:    getEnv("FORUM_S3_SECRET_KEY", ""),
+		MaxUploadBytes: getEnvInt64("FORUM_MAX_UPLOAD_BYTES", 5<<20),
+		BaseURL:        strings.TrimRight(getEnv("FORUM_BASE_URL", ""), "/"),
+		Reactions:      parseReactions(getEnv("FORUM_REACTIONS", defaultReactions)),
+
+		ReputationPostLike:       getEnvInt("FORUM_REPUTATION_POST_LIKE", 10),
+		ReputationPostDislike:    getEnvInt("FORUM_REPUTATION_POST_DISLIKE", -2),
+		ReputationCommentLike:    getEnvInt("FORUM_REPUTATION_COMMENT_LIKE", 5),
+		ReputationCommentDislike: getEnvInt("FORUM_REPUTATION_COMMENT_DISLIKE", -1),
+	}
+}
+
+// getEnv returns the value of an environment variable or a fallback when unset
+func getEnv(key, fallback string) string {
+	if value, ok := os.LookupEnv(key); ok && value != "" {
+		return value
+	}
+	return fallback
+}
+
+// getEnvInt64 returns an integer environment variable or a fallback when unset or invalid
+func getEnvInt64(key string, fallback int64) int64 {
+	value, err := strconv.ParseInt(getEnv(key, ""), 10, 64)
+	if err != nil {
+		return fallback
+	}
+	return value
+}
+
+// getEnvInt returns an integer environment variable or a fallback when unset or invalid
+func getEnvInt(key string, fallback int) int {
+	value, err := strconv.Atoi(getEnv(key, ""))
+	if err != nil {
+		return fallback
+	}
+	return value
+}
+
+// parseReactions reads a comma-separated list of "key:emoji" pairs. Keys are
+// lower-case letters, digits and underscores; malformed and repeated
+// entries, and the built-in like and dislike, are skipped.
+func parseReactions(value string) []Reaction {
+	var reactions []Reaction
+	seen := map[string]bool{"like": true, "dislike": true}
+	for _, item := range strings.Split(value, ",") {
+		key, emoji, ok := strings.Cut(strings.TrimSpace(item), ":")
+		key, emoji = strings.TrimSpace(key), strings.TrimSpace(emoji)
+		if !ok || !validReactionKey(key) || emoji == "" || seen[key] {
+			continue
+		}
+		seen[key] = true
+		reactions = append(reactions, Reaction{Key: key, Emoji: emoji})
+	}
+	return reactions
+}
+
+// validReactionKey reports whether a reaction key is 1-20 characters of
+// lower-case letters, digits and underscores
+func validReactionKey(key string) bool {
+	if key == "" || len(key) > 20 {
+		return false
+	}
+	for _, r := range key {
+		if !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '_') {
+			return false
+		}
+	}
+	return true
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"database/sql"
+	"fmt"
 	"log"
 	"time"
 
@@ -10,6 +11,10 @@ import (
 
 var db *sql.DB
 
+// sqliteTimeLayout matches the format SQLite uses for CURRENT_TIMESTAMP, so
+// timestamps passed as parameters compare correctly with stored ones
+const sqliteTimeLayout = "2006-01-02 15:04:05"
+
 // initDB initializes the database and creates all necessary tables
 func initDB() {
 	var err error
@@ -25,6 +30,13 @@ func initDB() {
 		username TEXT UNIQUE NOT NULL,
 		email TEXT UNIQUE NOT NULL,
 		password TEXT NOT NULL,
+		role TEXT NOT NULL DEFAULT 'user',
+		bio TEXT NOT NULL DEFAULT '',
+		location TEXT NOT NULL DEFAULT '',
+		avatar_key TEXT NOT NULL DEFAULT '',
+		reputation INTEGER NOT NULL DEFAULT 0,
+		trust_level INTEGER NOT NULL DEFAULT 0,
+		trust_level_locked BOOLEAN NOT NULL DEFAULT 0,
 		created DATETIME DEFAULT CURRENT_TIMESTAMP
 	);`
 
@@ -32,7 +44,11 @@ func initDB() {
 	createCategoriesTable := `
 	CREATE TABLE IF NOT EXISTS categories (
 		id INTEGER PRIMARY KEY AUTOINCREMENT,
-		name TEXT UNIQUE NOT NULL
+		name TEXT UNIQUE NOT NULL,
+		parent_id INTEGER,
+		min_trust_level INTEGER NOT NULL DEFAULT 0,
+		qa BOOLEAN NOT NULL DEFAULT 0,
+		FOREIGN KEY (parent_id) REFERENCES categories (id)
 	);`
 
 	// Create posts table
@@ -41,7 +57,14 @@ func initDB() {
 		id INTEGER PRIMARY KEY AUTOINCREMENT,
 		title TEXT NOT NULL,
 		content TEXT NOT NULL,
+		content_html TEXT NOT NULL DEFAULT '',
+		content_html_version INTEGER NOT NULL DEFAULT 0,
 		author_id INTEGER NOT NULL,
+		hidden BOOLEAN NOT NULL DEFAULT 0,
+		pinned BOOLEAN NOT NULL DEFAULT 0,
+		locked BOOLEAN NOT NULL DEFAULT 0,
+		accepted_comment_id INTEGER,
+		views INTEGER NOT NULL DEFAULT 0,
 		created DATETIME DEFAULT CURRENT_TIMESTAMP,
 		updated DATETIME DEFAULT CURRENT_TIMESTAMP,
 		FOREIGN KEY (author_id) REFERENCES users (id)
@@ -52,8 +75,12 @@ func initDB() {
 	CREATE TABLE IF NOT EXISTS comments (
 		id INTEGER PRIMARY KEY AUTOINCREMENT,
 		post_id INTEGER NOT NULL,
+		parent_id INTEGER REFERENCES comments (id),
 		content TEXT NOT NULL,
+		content_html TEXT NOT NULL DEFAULT '',
+		content_html_version INTEGER NOT NULL DEFAULT 0,
 		author_id INTEGER NOT NULL,
+		hidden BOOLEAN NOT NULL DEFAULT 0,
 		created DATETIME DEFAULT CURRENT_TIMESTAMP,
 		FOREIGN KEY (post_id) REFERENCES posts (id),
 		FOREIGN KEY (author_id) REFERENCES users (id)
@@ -68,31 +95,392 @@ func initDB() {
 		FOREIGN KEY (user_id) REFERENCES users (id)
 	);`
 
-	// Create likes table
-	createLikesTable := `
-	CREATE TABLE IF NOT EXISTS likes (
+	// Create reactions table (likes, dislikes and emoji reactions; a user
+	// gives each reaction at most once and only one of like and dislike).
+	// Older databases relied on a UNIQUE constraint that the NULL post or
+	// comment ID of every row kept from firing, so the duplicates it let
+	// through are dropped before the unique indexes are created: the first
+	// of each reaction and the latest of each like or dislike are kept.
+	createReactionsTable := `
+	CREATE TABLE IF NOT EXISTS reactions (
 		id INTEGER PRIMARY KEY AUTOINCREMENT,
 		user_id INTEGER NOT NULL,
 		post_id INTEGER,
 		comment_id INTEGER,
-		is_like BOOLEAN NOT NULL,
+		reaction TEXT NOT NULL,
 		created DATETIME DEFAULT CURRENT_TIMESTAMP,
 		FOREIGN KEY (user_id) REFERENCES users (id),
 		FOREIGN KEY (post_id) REFERENCES posts (id),
-		FOREIGN KEY (comment_id) REFERENCES comments (id),
-		UNIQUE(user_id, post_id, comment_id)
-	);`
+		FOREIGN KEY (comment_id) REFERENCES comments (id)
+	);
+	DELETE FROM reactions WHERE id NOT IN (
+		SELECT MIN(id) FROM reactions GROUP BY user_id, post_id, comment_id, reaction
+	);
+	DELETE FROM reactions WHERE reaction IN ('like', 'dislike') AND id NOT IN (
+		SELECT MAX(id) FROM reactions WHERE reaction IN ('like', 'dislike') GROUP BY user_id, post_id, comment_id
+	);
+	CREATE UNIQUE INDEX IF NOT EXISTS idx_reactions_post_unique ON reactions (user_id, post_id, reaction) WHERE comment_id IS NULL;
+	CREATE UNIQUE INDEX IF NOT EXISTS idx_reactions_comment_unique ON reactions (user_id, comment_id, reaction) WHERE comment_id IS NOT NULL;
+	CREATE UNIQUE INDEX IF NOT EXISTS idx_reactions_vote ON reactions (user_id, IFNULL(post_id, 0), IFNULL(comment_id, 0)) WHERE reaction IN ('like', 'dislike');
+	CREATE INDEX IF NOT EXISTS idx_reactions_post ON reactions (post_id, reaction);
+	CREATE INDEX IF NOT EXISTS idx_reactions_comment ON reactions (comment_id, reaction);
+	CREATE INDEX IF NOT EXISTS idx_reactions_user ON reactions (user_id, created);`
+
+	// Create vote_events table (every vote or reaction a user added, kept for
+	// an hour for the rate limit)
+	createVoteEventsTable := `
+	CREATE TABLE IF NOT EXISTS vote_events (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL,
+		created DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (user_id) REFERENCES users (id)
+	);
+	CREATE INDEX IF NOT EXISTS idx_vote_events_user ON vote_events (user_id, created);`
 
 	// Create post_categories table (many-to-many relationship)
 	createPostCategoriesTable := `
 	CREATE TABLE IF NOT EXISTS post_categories (
 		post_id INTEGER NOT NULL,
 		category_id INTEGER NOT NULL,
+		pinned BOOLEAN NOT NULL DEFAULT 0,
 		PRIMARY KEY (post_id, category_id),
 		FOREIGN KEY (post_id) REFERENCES posts (id),
 		FOREIGN KEY (category_id) REFERENCES categories (id)
 	);`
 
+	// Create reports table (user flags on posts and comments)
+	createReportsTable := `
+	CREATE TABLE IF NOT EXISTS reports (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		reporter_id INTEGER NOT NULL,
+		target_type TEXT NOT NULL,
+		target_id INTEGER NOT NULL,
+		reason TEXT NOT NULL,
+		details TEXT NOT NULL DEFAULT '',
+		status TEXT NOT NULL DEFAULT 'open',
+		resolution TEXT,
+		resolved_by INTEGER,
+		resolved_at DATETIME,
+		created DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (reporter_id) REFERENCES users (id),
+		FOREIGN KEY (resolved_by) REFERENCES users (id)
+	);`
+
+	// Create warnings table (moderator warnings issued to users)
+	createWarningsTable := `
+	CREATE TABLE IF NOT EXISTS warnings (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL,
+		moderator_id INTEGER NOT NULL,
+		reason TEXT NOT NULL,
+		target_type TEXT,
+		target_id INTEGER,
+		created DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (user_id) REFERENCES users (id),
+		FOREIGN KEY (moderator_id) REFERENCES users (id)
+	);`
+
+	// Create audit_log table (record of privileged actions)
+	createAuditLogTable := `
+	CREATE TABLE IF NOT EXISTS audit_log (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		actor_id INTEGER NOT NULL,
+		action TEXT NOT NULL,
+		target_type TEXT NOT NULL,
+		target_id INTEGER NOT NULL,
+		before_snapshot TEXT,
+		after_snapshot TEXT,
+		reason TEXT NOT NULL DEFAULT '',
+		ip TEXT NOT NULL DEFAULT '',
+		created DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (actor_id) REFERENCES users (id)
+	);`
+
+	// The audit log is append-only: reject any attempt to rewrite history
+	createAuditLogTriggers := `
+	CREATE TRIGGER IF NOT EXISTS audit_log_no_update BEFORE UPDATE ON audit_log
+	BEGIN
+		SELECT RAISE(ABORT, 'audit_log is append-only');
+	END;
+	CREATE TRIGGER IF NOT EXISTS audit_log_no_delete BEFORE DELETE ON audit_log
+	BEGIN
+		SELECT RAISE(ABORT, 'audit_log is append-only');
+	END;`
+
+	// Create suspensions table (temporary and permanent user bans)
+	createSuspensionsTable := `
+	CREATE TABLE IF NOT EXISTS suspensions (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL,
+		moderator_id INTEGER NOT NULL,
+		reason TEXT NOT NULL,
+		until DATETIME,
+		created DATETIME DEFAULT CURRENT_TIMESTAMP,
+		lifted_at DATETIME,
+		lifted_by INTEGER,
+		FOREIGN KEY (user_id) REFERENCES users (id),
+		FOREIGN KEY (moderator_id) REFERENCES users (id)
+	);`
+
+	// Create ip_blocks table (IP ranges barred from registering and logging in)
+	createIPBlocksTable := `
+	CREATE TABLE IF NOT EXISTS ip_blocks (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		cidr TEXT UNIQUE NOT NULL,
+		reason TEXT NOT NULL DEFAULT '',
+		created_by INTEGER NOT NULL,
+		created DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (created_by) REFERENCES users (id)
+	);`
+
+	// Create announcements table (site-wide banner messages)
+	createAnnouncementsTable := `
+	CREATE TABLE IF NOT EXISTS announcements (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		message TEXT NOT NULL,
+		author_id INTEGER NOT NULL,
+		active BOOLEAN NOT NULL DEFAULT 1,
+		created DATETIME DEFAULT CURRENT_TIMESTAMP,
+		expires_at DATETIME,
+		FOREIGN KEY (author_id) REFERENCES users (id)
+	);`
+
+	// Create attachments table (uploaded files; unlinked until the post or comment is created)
+	createAttachmentsTable := `
+	CREATE TABLE IF NOT EXISTS attachments (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		blob_key TEXT UNIQUE NOT NULL,
+		thumb_key TEXT,
+		uploader_id INTEGER NOT NULL,
+		post_id INTEGER,
+		comment_id INTEGER,
+		draft_id INTEGER,
+		filename TEXT NOT NULL,
+		mime_type TEXT NOT NULL,
+		size INTEGER NOT NULL,
+		width INTEGER NOT NULL DEFAULT 0,
+		height INTEGER NOT NULL DEFAULT 0,
+		created DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (uploader_id) REFERENCES users (id)
+	);`
+
+	// Create notifications table (one row per event; collapsed into groups when read)
+	createNotificationsTable := `
+	CREATE TABLE IF NOT EXISTS notifications (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL,
+		actor_id INTEGER NOT NULL,
+		type TEXT NOT NULL,
+		post_id INTEGER NOT NULL,
+		comment_id INTEGER,
+		is_read BOOLEAN NOT NULL DEFAULT 0,
+		created DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (user_id) REFERENCES users (id),
+		FOREIGN KEY (actor_id) REFERENCES users (id)
+	);
+	CREATE INDEX IF NOT EXISTS idx_notifications_user ON notifications (user_id, is_read, created);`
+
+	// Create notification_preferences table (only types a user changed are stored)
+	createNotificationPreferencesTable := `
+	CREATE TABLE IF NOT EXISTS notification_preferences (
+		user_id INTEGER NOT NULL,
+		type TEXT NOT NULL,
+		enabled BOOLEAN NOT NULL,
+		PRIMARY KEY (user_id, type),
+		FOREIGN KEY (user_id) REFERENCES users (id)
+	);`
+
+	// Create mentions table (users referenced as @username in posts and comments)
+	createMentionsTable := `
+	CREATE TABLE IF NOT EXISTS mentions (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL,
+		post_id INTEGER NOT NULL,
+		comment_id INTEGER,
+		author_id INTEGER NOT NULL,
+		created DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (user_id) REFERENCES users (id),
+		FOREIGN KEY (author_id) REFERENCES users (id)
+	);
+	CREATE INDEX IF NOT EXISTS idx_mentions_post ON mentions (post_id, comment_id);`
+
+	// Create conversation tables (private messages between two or more users)
+	createConversationsTables := `
+	CREATE TABLE IF NOT EXISTS conversations (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		created_by INTEGER NOT NULL,
+		created DATETIME DEFAULT CURRENT_TIMESTAMP,
+		updated DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (created_by) REFERENCES users (id)
+	);
+	CREATE TABLE IF NOT EXISTS conversation_participants (
+		conversation_id INTEGER NOT NULL,
+		user_id INTEGER NOT NULL,
+		last_read_message_id INTEGER NOT NULL DEFAULT 0,
+		joined DATETIME DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (conversation_id, user_id),
+		FOREIGN KEY (conversation_id) REFERENCES conversations (id),
+		FOREIGN KEY (user_id) REFERENCES users (id)
+	);
+	CREATE INDEX IF NOT EXISTS idx_conversation_participants_user ON conversation_participants (user_id);
+	CREATE TABLE IF NOT EXISTS messages (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		conversation_id INTEGER NOT NULL,
+		sender_id INTEGER NOT NULL,
+		content TEXT NOT NULL,
+		created DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (conversation_id) REFERENCES conversations (id),
+		FOREIGN KEY (sender_id) REFERENCES users (id)
+	);
+	CREATE INDEX IF NOT EXISTS idx_messages_conversation ON messages (conversation_id, id);`
+
+	// Create user_blocks table (users who may not message the blocker)
+	createUserBlocksTable := `
+	CREATE TABLE IF NOT EXISTS user_blocks (
+		blocker_id INTEGER NOT NULL,
+		blocked_id INTEGER NOT NULL,
+		created DATETIME DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (blocker_id, blocked_id),
+		FOREIGN KEY (blocker_id) REFERENCES users (id),
+		FOREIGN KEY (blocked_id) REFERENCES users (id)
+	);`
+
+	// Create bookmark tables. Bookmarks have no foreign keys to posts and
+	// comments because they outlive deleted content and show as unavailable.
+	createBookmarksTables := `
+	CREATE TABLE IF NOT EXISTS bookmark_folders (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL,
+		name TEXT NOT NULL,
+		created DATETIME DEFAULT CURRENT_TIMESTAMP,
+		UNIQUE (user_id, name),
+		FOREIGN KEY (user_id) REFERENCES users (id)
+	);
+	CREATE TABLE IF NOT EXISTS bookmarks (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL,
+		post_id INTEGER NOT NULL,
+		comment_id INTEGER,
+		folder_id INTEGER,
+		created DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (user_id) REFERENCES users (id),
+		FOREIGN KEY (folder_id) REFERENCES bookmark_folders (id)
+	);
+	CREATE UNIQUE INDEX IF NOT EXISTS idx_bookmarks_post ON bookmarks (user_id, post_id) WHERE comment_id IS NULL;
+	CREATE UNIQUE INDEX IF NOT EXISTS idx_bookmarks_comment ON bookmarks (user_id, comment_id) WHERE comment_id IS NOT NULL;`
+
+	// Create follows table (users, categories and posts a user follows)
+	createFollowsTable := `
+	CREATE TABLE IF NOT EXISTS follows (
+		user_id INTEGER NOT NULL,
+		target_type TEXT NOT NULL CHECK (target_type IN ('user', 'category', 'post')),
+		target_id INTEGER NOT NULL,
+		created DATETIME DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (user_id, target_type, target_id),
+		FOREIGN KEY (user_id) REFERENCES users (id)
+	);
+	CREATE INDEX IF NOT EXISTS idx_follows_target ON follows (target_type, target_id);`
+
+	// Create post_reads table (posts a user has opened, for trust levels,
+	// and the last comment they have seen there)
+	createPostReadsTable := `
+	CREATE TABLE IF NOT EXISTS post_reads (
+		user_id INTEGER NOT NULL,
+		post_id INTEGER NOT NULL,
+		last_comment_id INTEGER,
+		created DATETIME DEFAULT CURRENT_TIMESTAMP,
+		updated DATETIME DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (user_id, post_id),
+		FOREIGN KEY (user_id) REFERENCES users (id)
+	);`
+
+	// Create post_views table (one row per viewer and post, for view counts)
+	createPostViewsTable := `
+	CREATE TABLE IF NOT EXISTS post_views (
+		post_id INTEGER NOT NULL,
+		viewer TEXT NOT NULL,
+		created DATETIME DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (post_id, viewer),
+		FOREIGN KEY (post_id) REFERENCES posts (id)
+	);`
+
+	// Create user_badges table (each badge is awarded to a user once)
+	createUserBadgesTable := `
+	CREATE TABLE IF NOT EXISTS user_badges (
+		user_id INTEGER NOT NULL,
+		badge_key TEXT NOT NULL,
+		awarded DATETIME DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (user_id, badge_key),
+		FOREIGN KEY (user_id) REFERENCES users (id)
+	);`
+
+	// Create poll tables (a post has at most one poll, a user one ballot per poll)
+	createPollsTables := `
+	CREATE TABLE IF NOT EXISTS polls (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		post_id INTEGER UNIQUE NOT NULL,
+		question TEXT NOT NULL,
+		multiple BOOLEAN NOT NULL DEFAULT 0,
+		results TEXT NOT NULL DEFAULT 'always' CHECK (results IN ('always', 'after_vote', 'after_close')),
+		closes_at DATETIME,
+		FOREIGN KEY (post_id) REFERENCES posts (id)
+	);
+	CREATE TABLE IF NOT EXISTS poll_options (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		poll_id INTEGER NOT NULL,
+		position INTEGER NOT NULL,
+		text TEXT NOT NULL,
+		FOREIGN KEY (poll_id) REFERENCES polls (id)
+	);
+	CREATE TABLE IF NOT EXISTS poll_votes (
+		poll_id INTEGER NOT NULL,
+		option_id INTEGER NOT NULL,
+		user_id INTEGER NOT NULL,
+		created DATETIME DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (option_id, user_id),
+		FOREIGN KEY (poll_id) REFERENCES polls (id),
+		FOREIGN KEY (option_id) REFERENCES poll_options (id),
+		FOREIGN KEY (user_id) REFERENCES users (id)
+	);
+	CREATE INDEX IF NOT EXISTS idx_poll_votes_user ON poll_votes (poll_id, user_id);`
+
+	// Create drafts table (unpublished posts; fields holds the form as
+	// submitted, URL-encoded, so incomplete drafts can be stored)
+	createDraftsTable := `
+	CREATE TABLE IF NOT EXISTS drafts (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL,
+		fields TEXT NOT NULL DEFAULT '',
+		publish_at DATETIME,
+		error TEXT NOT NULL DEFAULT '',
+		created DATETIME DEFAULT CURRENT_TIMESTAMP,
+		updated DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (user_id) REFERENCES users (id)
+	);
+	CREATE INDEX IF NOT EXISTS idx_drafts_user ON drafts (user_id, updated);
+	CREATE INDEX IF NOT EXISTS idx_drafts_publish_at ON drafts (publish_at);`
+
+	// Create tags tables (free-form post tags; a synonym maps another
+	// spelling to a tag)
+	createTagsTables := `
+	CREATE TABLE IF NOT EXISTS tags (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT UNIQUE NOT NULL
+	);
+	CREATE TABLE IF NOT EXISTS post_tags (
+		post_id INTEGER NOT NULL,
+		tag_id INTEGER NOT NULL,
+		PRIMARY KEY (post_id, tag_id),
+		FOREIGN KEY (post_id) REFERENCES posts (id),
+		FOREIGN KEY (tag_id) REFERENCES tags (id)
+	);
+	CREATE INDEX IF NOT EXISTS idx_post_tags_tag ON post_tags (tag_id);
+	CREATE TABLE IF NOT EXISTS tag_synonyms (
+		synonym TEXT PRIMARY KEY,
+		tag_id INTEGER NOT NULL,
+		FOREIGN KEY (tag_id) REFERENCES tags (id)
+	);`
+
 	// Execute all table creation statements
 	statements := []string{
 		createUsersTable,
@@ -100,8 +488,30 @@ func initDB() {
 		createPostsTable,
 		createCommentsTable,
 		createSessionsTable,
-		createLikesTable,
+		createReactionsTable,
+		createVoteEventsTable,
 		createPostCategoriesTable,
+		createReportsTable,
+		createWarningsTable,
+		createAuditLogTable,
+		createAuditLogTriggers,
+		createSuspensionsTable,
+		createIPBlocksTable,
+		createAnnouncementsTable,
+		createAttachmentsTable,
+		createNotificationsTable,
+		createNotificationPreferencesTable,
+		createMentionsTable,
+		createConversationsTables,
+		createUserBlocksTable,
+		createBookmarksTables,
+		createFollowsTable,
+		createPostReadsTable,
+		createPostViewsTable,
+		createUserBadgesTable,
+		createPollsTables,
+		createDraftsTable,
+		createTagsTables,
 	}
 
 	for _, stmt := range statements {
@@ -111,10 +521,178 @@ func initDB() {
 		}
 	}
 
+	// Add columns introduced after the initial schema to existing databases
+	added := migrateSchema()
+	migrateLikes()
+	if added["users.trust_level"] {
+		migrateTrustLevels()
+	}
+	migrateReadMarkers()
+
 	// Insert default categories if they don't exist
 	insertDefaultCategories()
 }
 
+// migrateSchema brings databases created by older versions up to date.
+// CREATE TABLE IF NOT EXISTS never alters an existing table, so new columns
+// have to be added here as well as in the table definitions above. It
+// returns the columns it added as "table.column".
+func migrateSchema() map[string]bool {
+	migrations := []struct {
+		table, column, definition string
+	}{
+		{"categories", "parent_id", "INTEGER REFERENCES categories (id)"},
+		{"users", "role", "TEXT NOT NULL DEFAULT 'user'"},
+		{"posts", "hidden", "BOOLEAN NOT NULL DEFAULT 0"},
+		{"comments", "hidden", "BOOLEAN NOT NULL DEFAULT 0"},
+		{"posts", "pinned", "BOOLEAN NOT NULL DEFAULT 0"},
+		{"posts", "locked", "BOOLEAN NOT NULL DEFAULT 0"},
+		{"post_categories", "pinned", "BOOLEAN NOT NULL DEFAULT 0"},
+		{"posts", "content_html", "TEXT NOT NULL DEFAULT ''"},
+		{"posts", "content_html_version", "INTEGER NOT NULL DEFAULT 0"},
+		{"comments", "content_html", "TEXT NOT NULL DEFAULT ''"},
+		{"comments", "content_html_version", "INTEGER NOT NULL DEFAULT 0"},
+		{"users", "bio", "TEXT NOT NULL DEFAULT ''"},
+		{"users", "location", "TEXT NOT NULL DEFAULT ''"},
+		{"users", "avatar_key", "TEXT NOT NULL DEFAULT ''"},
+		{"comments", "parent_id", "INTEGER REFERENCES comments (id)"},
+		{"users", "reputation", "INTEGER NOT NULL DEFAULT 0"},
+		{"users", "trust_level", "INTEGER NOT NULL DEFAULT 0"},
+		{"users", "trust_level_locked", "BOOLEAN NOT NULL DEFAULT 0"},
+		{"categories", "min_trust_level", "INTEGER NOT NULL DEFAULT 0"},
+		{"categories", "qa", "BOOLEAN NOT NULL DEFAULT 0"},
+		{"posts", "accepted_comment_id", "INTEGER"},
+		{"attachments", "draft_id", "INTEGER"},
+		{"posts", "views", "INTEGER NOT NULL DEFAULT 0"},
+		{"post_reads", "last_comment_id", "INTEGER"},
+		{"post_reads", "updated", "DATETIME"},
+	}
+
+	added := make(map[string]bool)
+	for _, m := range migrations {
+		ok, err := addColumnIfMissing(m.table, m.column, m.definition)
+		if err != nil {
+			log.Fatal(err)
+		}
+		added[m.table+"."+m.column] = ok
+	}
+	return added
+}
+
+// migrateTrustLevels runs when trust levels are introduced to an existing
+// forum. Reads were not tracked before, so the posts users wrote or
+// commented on count as read, and existing accounts start as members
+// (level 1) instead of newcomers; the hourly job promotes them further.
+func migrateTrustLevels() {
+	tx, err := db.Begin()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer tx.Rollback()
+
+	statements := []string{
+		"INSERT OR IGNORE INTO post_reads (user_id, post_id, created) SELECT author_id, id, created FROM posts",
+		"INSERT OR IGNORE INTO post_reads (user_id, post_id, created) SELECT author_id, post_id, MIN(created) FROM comments GROUP BY author_id, post_id",
+	}
+	for _, stmt := range statements {
+		if _, err := tx.Exec(stmt); err != nil {
+			log.Fatal(err)
+		}
+	}
+	result, err := tx.Exec("UPDATE users SET trust_level = 1 WHERE trust_level = 0")
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		log.Fatal(err)
+	}
+
+	migrated, _ := result.RowsAffected()
+	log.Printf("Set %d existing users to trust level 1", migrated)
+}
+
+// migrateLikes moves the votes of the likes table used by older versions
+// into reactions and drops it
+func migrateLikes() {
+	var count int
+	if err := db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'likes'").Scan(&count); err != nil {
+		log.Fatal(err)
+	}
+	if count == 0 {
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`
+		INSERT OR IGNORE INTO reactions (user_id, post_id, comment_id, reaction, created)
+		SELECT user_id, post_id, comment_id, CASE WHEN is_like THEN 'like' ELSE 'dislike' END, created
+		FROM likes ORDER BY id`)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if _, err := tx.Exec("DROP TABLE likes"); err != nil {
+		log.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		log.Fatal(err)
+	}
+
+	migrated, _ := result.RowsAffected()
+	log.Printf("Migrated %d likes to reactions", migrated)
+}
+
+// migrateReadMarkers sets the last read comment of posts read before it was
+// tracked to the last comment that existed when the post was first opened
+func migrateReadMarkers() {
+	result, err := db.Exec(`
+		UPDATE post_reads SET
+			last_comment_id = (SELECT COALESCE(MAX(id), 0) FROM comments WHERE post_id = post_reads.post_id AND created <= post_reads.created),
+			updated = created
+		WHERE last_comment_id IS NULL`)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if migrated, _ := result.RowsAffected(); migrated > 0 {
+		log.Printf("Set read markers of %d read posts", migrated)
+	}
+}
+
+// addColumnIfMissing adds a column to a table unless it already exists and
+// reports whether it did
+func addColumnIfMissing(table, column, definition string) (bool, error) {
+	rows, err := db.Query("PRAGMA table_info(" + table + ")")
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, colType string
+		var defaultValue sql.NullString
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &defaultValue, &pk); err != nil {
+			return false, err
+		}
+		if name == column {
+			return false, nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return false, err
+	}
+	rows.Close()
+
+	if _, err := db.Exec("ALTER TABLE " + table + " ADD COLUMN " + column + " " + definition); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
 // insertDefaultCategories adds some default categories to the forum
 func insertDefaultCategories() {
 	categories := []string{"Общие", "Технологии", "Спорт", "Кино", "Музыка", "Книги", "Путешествия", "Другие"}
@@ -125,13 +703,27 @@ func insertDefaultCategories() {
 			log.Printf("Error inserting category %s: %v", category, err)
 		}
 	}
+
+	// Sub-categories, keyed by the name of their parent
+	subcategories := map[string][]string{
+		"Технологии": {"Go", "Базы данных"},
+	}
+
+	for parent, children := range subcategories {
+		for _, child := range children {
+			_, err := db.Exec("INSERT OR IGNORE INTO categories (name, parent_id) SELECT ?, id FROM categories WHERE name = ?", child, parent)
+			if err != nil {
+				log.Printf("Error inserting category %s: %v", child, err)
+			}
+		}
+	}
 }
 
 // getUserByEmail retrieves a user by email
 func getUserByEmail(email string) (*User, error) {
 	user := &User{}
-	err := db.QueryRow("SELECT id, username, email, password, created FROM users WHERE email = ?", email).
-		Scan(&user.ID, &user.Username, &user.Email, &user.Password, &user.Created)
+	err := db.QueryRow("SELECT id, username, email, password, role, bio, location, avatar_key, reputation, trust_level, trust_level_locked, created FROM users WHERE email = ?", email).
+		Scan(&user.ID, &user.Username, &user.Email, &user.Password, &user.Role, &user.Bio, &user.Location, &user.AvatarKey, &user.Reputation, &user.TrustLevel, &user.TrustLevelLocked, &user.Created)
 	if err != nil {
 		return nil, err
 	}
@@ -141,8 +733,8 @@ func getUserByEmail(email string) (*User, error) {
 // getUserByID retrieves a user by ID
 func getUserByID(id int) (*User, error) {
 	user := &User{}
-	err := db.QueryRow("SELECT id, username, email, password, created FROM users WHERE id = ?", id).
-		Scan(&user.ID, &user.Username, &user.Email, &user.Password, &user.Created)
+	err := db.QueryRow("SELECT id, username, email, password, role, bio, location, avatar_key, reputation, trust_level, trust_level_locked, created FROM users WHERE id = ?", id).
+		Scan(&user.ID, &user.Username, &user.Email, &user.Password, &user.Role, &user.Bio, &user.Location, &user.AvatarKey, &user.Reputation, &user.TrustLevel, &user.TrustLevelLocked, &user.Created)
 	if err != nil {
 		return nil, err
 	}
@@ -184,15 +776,18 @@ func deleteAllSessionsForUser(userID int) error {
 	return err
 }
 
-// createPost creates a new post
-func createPost(title, content string, authorID int, categoryIDs []int) (int64, error) {
+// createPost creates a new post and links the given uploads to it. A draft
+// the post was published from (draftID, 0 for none) is deleted in the same
+// transaction.
+func createPost(title, content string, authorID int, categoryIDs []int, tags []string, attachmentIDs []int, poll *pollInput, draftID int) (int64, error) {
 	tx, err := db.Begin()
 	if err != nil {
 		return 0, err
 	}
 	defer tx.Rollback()
 
-	result, err := tx.Exec("INSERT INTO posts (title, content, author_id) VALUES (?, ?, ?)", title, content, authorID)
+	result, err := tx.Exec("INSERT INTO posts (title, content, content_html, content_html_version, author_id) VALUES (?, ?, ?, ?, ?)",
+		title, content, renderMarkdown(content), markdownVersion, authorID)
 	if err != nil {
 		return 0, err
 	}
@@ -210,6 +805,26 @@ func createPost(title, content string, authorID int, categoryIDs []int) (int64,
 		}
 	}
 
+	if err := setPostTags(tx, postID, tags); err != nil {
+		return 0, err
+	}
+
+	if err := linkAttachments(tx, authorID, attachmentIDs, "post_id", postID); err != nil {
+		return 0, err
+	}
+
+	if poll != nil {
+		if err := createPoll(tx, postID, poll); err != nil {
+			return 0, err
+		}
+	}
+
+	if draftID != 0 {
+		if err := removeDraft(tx, draftID); err != nil {
+			return 0, err
+		}
+	}
+
 	err = tx.Commit()
 	if err != nil {
 		return 0, err
@@ -218,40 +833,63 @@ func createPost(title, content string, authorID int, categoryIDs []int) (int64,
 	return postID, nil
 }
 
+// postsQuery is the SELECT shared by all post listings. The %s placeholder
+// is the expression deciding whether a post is pinned in the listing.
+const postsQuery = `
+	SELECT p.id, p.title, p.content, p.content_html, p.content_html_version, p.author_id, u.username, p.created, p.updated,
+		   (SELECT COUNT(*) FROM reactions WHERE post_id = p.id AND reaction = 'like') as likes,
+		   (SELECT COUNT(*) FROM reactions WHERE post_id = p.id AND reaction = 'dislike') as dislikes,
+		   %s as pinned, p.locked, ` + isQuestionSQL + ` as is_question, p.accepted_comment_id, p.views
+	FROM posts p
+	JOIN users u ON p.author_id = u.id`
+
 // getPosts retrieves all posts with optional filtering
 func getPosts(userID *int, filter string, filterValue string) ([]Post, error) {
-	var query string
 	var args []interface{}
 
+	// filterSQL holds the joins and WHERE clause of the selected filter.
+	// Globally pinned posts come first; personal lists stay chronological.
+	pinned := "p.pinned"
+	filterSQL := "WHERE p.hidden = 0"
+	order := "ORDER BY pinned DESC, p.created DESC"
+
 	log.Printf("getPosts - Filter: %s, FilterValue: %s, UserID: %v", filter, filterValue, userID)
 
 	switch filter {
 	case "category":
-		query = `
-			SELECT p.id, p.title, p.content, p.author_id, u.username, p.created, p.updated,
-				   (SELECT COUNT(*) FROM likes WHERE post_id = p.id AND is_like = 1) as likes,
-				   (SELECT COUNT(*) FROM likes WHERE post_id = p.id AND is_like = 0) as dislikes
-			FROM posts p
-			JOIN users u ON p.author_id = u.id
-			JOIN post_categories pc ON p.id = pc.post_id
-			JOIN categories c ON pc.category_id = c.id
-			WHERE c.name = ?
-			ORDER BY p.created DESC`
-		args = append(args, filterValue)
+		// Posts pinned in this category are listed first along with global pins
+		pinned = `(p.pinned OR EXISTS (
+				SELECT 1 FROM post_categories pp JOIN categories cc ON pp.category_id = cc.id
+				WHERE pp.post_id = p.id AND pp.pinned = 1 AND cc.name = ?
+			))`
+		filterSQL = `
+			WHERE p.hidden = 0 AND p.id IN (
+				SELECT pc.post_id FROM post_categories pc
+				WHERE pc.category_id IN (` + categorySubtreeQuery + `)
+			)`
+		args = append(args, filterValue, filterValue)
 		log.Printf("getPosts - Using category filter with value: %s", filterValue)
+	case "tag":
+		// Value is a tag as written by the user; synonyms find the same posts
+		tag, err := resolveTag(db, normalizeTag(filterValue))
+		if err != nil {
+			return nil, err
+		}
+		filterSQL = `
+			WHERE p.hidden = 0 AND p.id IN (
+				SELECT pt.post_id FROM post_tags pt JOIN tags t ON pt.tag_id = t.id
+				WHERE t.name = ?
+			)`
+		order = "ORDER BY p.created DESC"
+		args = append(args, tag)
+		log.Printf("getPosts - Using tag filter with value: %s", tag)
 	case "created":
 		if userID == nil {
 			log.Printf("getPosts - UserID is nil for created filter, returning empty")
 			return nil, nil
 		}
-		query = `
-			SELECT p.id, p.title, p.content, p.author_id, u.username, p.created, p.updated,
-				   (SELECT COUNT(*) FROM likes WHERE post_id = p.id AND is_like = 1) as likes,
-				   (SELECT COUNT(*) FROM likes WHERE post_id = p.id AND is_like = 0) as dislikes
-			FROM posts p
-			JOIN users u ON p.author_id = u.id
-			WHERE p.author_id = ?
-			ORDER BY p.created DESC`
+		filterSQL = "WHERE p.author_id = ? AND p.hidden = 0"
+		order = "ORDER BY p.created DESC"
 		args = append(args, *userID)
 		log.Printf("getPosts - Using created filter for user ID: %d", *userID)
 	case "liked":
@@ -259,43 +897,100 @@ func getPosts(userID *int, filter string, filterValue string) ([]Post, error) {
 			log.Printf("getPosts - UserID is nil for liked filter, returning empty")
 			return nil, nil
 		}
-		query = `
-			SELECT p.id, p.title, p.content, p.author_id, u.username, p.created, p.updated,
-				   (SELECT COUNT(*) FROM likes WHERE post_id = p.id AND is_like = 1) as likes,
-				   (SELECT COUNT(*) FROM likes WHERE post_id = p.id AND is_like = 0) as dislikes
-			FROM posts p
-			JOIN users u ON p.author_id = u.id
-			JOIN likes l ON p.id = l.post_id
-			WHERE l.user_id = ? AND l.is_like = 1
-			ORDER BY p.created DESC`
+		filterSQL = `
+			JOIN reactions l ON p.id = l.post_id
+			WHERE l.user_id = ? AND l.reaction = 'like' AND p.hidden = 0`
+		order = "ORDER BY p.created DESC"
 		args = append(args, *userID)
 		log.Printf("getPosts - Using liked filter for user ID: %d", *userID)
+	case "author":
+		// Public list of a user's posts; value is the user ID
+		filterSQL = "WHERE p.author_id = ? AND p.hidden = 0"
+		order = "ORDER BY p.created DESC"
+		args = append(args, filterValue)
+		log.Printf("getPosts - Using author filter for user ID: %s", filterValue)
+	case "unanswered":
+		// Questions without an accepted answer; value optionally selects a category
+		filterSQL = "WHERE p.hidden = 0 AND p.accepted_comment_id IS NULL AND " + isQuestionSQL
+		if filterValue != "" {
+			filterSQL += `
+				AND p.id IN (
+					SELECT pc.post_id FROM post_categories pc
+					WHERE pc.category_id IN (` + categorySubtreeQuery + `)
+				)`
+			args = append(args, filterValue)
+		}
+		order = "ORDER BY p.created DESC"
+		log.Printf("getPosts - Using unanswered filter with value: %s", filterValue)
+	case "saved":
+		if userID == nil {
+			log.Printf("getPosts - UserID is nil for saved filter, returning empty")
+			return nil, nil
+		}
+		// Post bookmarks, most recently saved first; value optionally selects a folder
+		filterSQL = `
+			JOIN bookmarks b ON p.id = b.post_id AND b.comment_id IS NULL
+			WHERE b.user_id = ? AND p.hidden = 0`
+		args = append(args, *userID)
+		if filterValue != "" {
+			filterSQL += " AND b.folder_id = ?"
+			args = append(args, filterValue)
+		}
+		order = "ORDER BY b.created DESC, b.id DESC"
+		log.Printf("getPosts - Using saved filter for user ID: %d", *userID)
 	default:
-		query = `
-			SELECT p.id, p.title, p.content, p.author_id, u.username, p.created, p.updated,
-				   (SELECT COUNT(*) FROM likes WHERE post_id = p.id AND is_like = 1) as likes,
-				   (SELECT COUNT(*) FROM likes WHERE post_id = p.id AND is_like = 0) as dislikes
-			FROM posts p
-			JOIN users u ON p.author_id = u.id
-			ORDER BY p.created DESC`
 		log.Printf("getPosts - Using default filter (all posts)")
 	}
 
+	query := fmt.Sprintf(postsQuery, pinned) + "\n" + filterSQL + "\n" + order
+
 	log.Printf("getPosts - Executing query: %s with args: %v", query, args)
-	rows, err := db.Query(query, args...)
+	posts, err := queryPosts(userID, query, args...)
 	if err != nil {
 		log.Printf("getPosts - Database error: %v", err)
 		return nil, err
 	}
+
+	log.Printf("getPosts - Found %d posts", len(posts))
+	return posts, nil
+}
+
+// getPost retrieves a single visible post with the getPosts query
+func getPost(userID *int, postID int) (*Post, error) {
+	posts, err := queryPosts(userID, fmt.Sprintf(postsQuery, "p.pinned")+"\nWHERE p.id = ? AND p.hidden = 0", postID)
+	if err != nil {
+		return nil, err
+	}
+	if len(posts) == 0 {
+		return nil, sql.ErrNoRows
+	}
+	return &posts[0], nil
+}
+
+// queryPosts runs a query built on postsQuery and loads the categories,
+// tags, attachments, mentions and the user's votes and bookmarks of each post
+func queryPosts(userID *int, query string, args ...interface{}) ([]Post, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
 	defer rows.Close()
 
 	var posts []Post
+	var stale []renderedHTML
 	for rows.Next() {
 		var post Post
-		err := rows.Scan(&post.ID, &post.Title, &post.Content, &post.AuthorID, &post.AuthorName, &post.Created, &post.Updated, &post.Likes, &post.Dislikes)
+		var htmlVersion int
+		var acceptedID sql.NullInt64
+		err := rows.Scan(&post.ID, &post.Title, &post.Content, &post.ContentHTML, &htmlVersion, &post.AuthorID, &post.AuthorName, &post.Created, &post.Updated, &post.Likes, &post.Dislikes, &post.Pinned, &post.Locked, &post.IsQuestion, &acceptedID, &post.Views)
 		if err != nil {
 			return nil, err
 		}
+		if acceptedID.Valid {
+			id := int(acceptedID.Int64)
+			post.AcceptedID = &id
+		}
+		post.ContentHTML = cachedContentHTML("posts", post.ID, post.Content, post.ContentHTML, htmlVersion, &stale)
 
 		// Get categories for this post
 		categories, err := getPostCategories(post.ID)
@@ -304,6 +999,26 @@ func getPosts(userID *int, filter string, filterValue string) ([]Post, error) {
 		}
 		post.Categories = categories
 
+		post.Tags, err = getPostTags(post.ID)
+		if err != nil {
+			return nil, err
+		}
+
+		post.Attachments, err = getAttachments("post_id", post.ID)
+		if err != nil {
+			return nil, err
+		}
+
+		post.Mentions, err = getMentions("post_id", post.ID)
+		if err != nil {
+			return nil, err
+		}
+
+		post.Poll, err = getPoll(post.ID, userID)
+		if err != nil {
+			return nil, err
+		}
+
 		// Get user's like/dislike status if logged in
 		if userID != nil {
 			userLike, userDislike, err := getUserPostLikeStatus(*userID, post.ID)
@@ -311,12 +1026,28 @@ func getPosts(userID *int, filter string, filterValue string) ([]Post, error) {
 				post.UserLiked = userLike
 				post.UserDisliked = userDislike
 			}
+			if bookmarked, err := getBookmarkStatus(*userID, "post_id", post.ID); err == nil {
+				post.Bookmarked = bookmarked
+			}
+			post.IsNew, post.UnreadComments, err = getReadStatus(*userID, post.ID, post.AuthorID)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		post.Reactions, post.UserReactions, err = loadReactions(userID, "post_id", post.ID)
+		if err != nil {
+			return nil, err
 		}
 
 		posts = append(posts, post)
 	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+	storeContentHTML(stale)
 
-	log.Printf("getPosts - Found %d posts", len(posts))
 	return posts, nil
 }
 
@@ -344,7 +1075,7 @@ func getPostCategories(postID int) ([]string, error) {
 // getUserPostLikeStatus gets the like/dislike status for a user on a specific post
 func getUserPostLikeStatus(userID, postID int) (*bool, *bool, error) {
 	var isLike bool
-	err := db.QueryRow("SELECT is_like FROM likes WHERE user_id = ? AND post_id = ?", userID, postID).Scan(&isLike)
+	err := db.QueryRow("SELECT reaction = 'like' FROM reactions WHERE user_id = ? AND post_id = ? AND reaction IN ('like', 'dislike')", userID, postID).Scan(&isLike)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return nil, nil, nil
@@ -357,9 +1088,19 @@ func getUserPostLikeStatus(userID, postID int) (*bool, *bool, error) {
 	return &userLiked, &userDisliked, nil
 }
 
-// getCategories retrieves all categories
+// categorySubtreeQuery selects the IDs of the category named by its single
+// parameter and of all its descendants
+const categorySubtreeQuery = `
+	WITH RECURSIVE subtree(id) AS (
+		SELECT id FROM categories WHERE name = ?
+		UNION
+		SELECT c.id FROM categories c JOIN subtree s ON c.parent_id = s.id
+	)
+	SELECT id FROM subtree`
+
+// getCategories retrieves all categories as a flat list
 func getCategories() ([]Category, error) {
-	rows, err := db.Query("SELECT id, name FROM categories ORDER BY name")
+	rows, err := db.Query("SELECT id, name, parent_id, min_trust_level, qa FROM categories ORDER BY name")
 	if err != nil {
 		return nil, err
 	}
@@ -368,43 +1109,153 @@ func getCategories() ([]Category, error) {
 	var categories []Category
 	for rows.Next() {
 		var category Category
-		err := rows.Scan(&category.ID, &category.Name)
+		var parentID sql.NullInt64
+		err := rows.Scan(&category.ID, &category.Name, &parentID, &category.MinTrustLevel, &category.QA)
 		if err != nil {
 			return nil, err
 		}
+		if parentID.Valid {
+			id := int(parentID.Int64)
+			category.ParentID = &id
+		}
 		categories = append(categories, category)
 	}
 
 	return categories, nil
 }
 
-// createComment creates a new comment
-func createComment(postID int, content string, authorID int) error {
-	_, err := db.Exec("INSERT INTO comments (post_id, content, author_id) VALUES (?, ?, ?)", postID, content, authorID)
-	return err
+// getCategoryTree retrieves all categories nested under their parents
+func getCategoryTree() ([]Category, error) {
+	categories, err := getCategories()
+	if err != nil {
+		return nil, err
+	}
+	return buildCategoryTree(categories, nil), nil
+}
+
+// buildCategoryTree returns the children of parentID (roots when nil) with
+// their own children filled in recursively
+func buildCategoryTree(categories []Category, parentID *int) []Category {
+	var level []Category
+	for _, category := range categories {
+		if (parentID == nil && category.ParentID == nil) ||
+			(parentID != nil && category.ParentID != nil && *category.ParentID == *parentID) {
+			category.Children = buildCategoryTree(categories, &category.ID)
+			level = append(level, category)
+		}
+	}
+	return level
+}
+
+// countLeafCategories counts the selected categories that have no selected
+// descendant; picking a parent together with its child only uses one slot
+func countLeafCategories(selected []int, categories []Category) int {
+	parents := make(map[int]int)
+	for _, category := range categories {
+		if category.ParentID != nil {
+			parents[category.ID] = *category.ParentID
+		}
+	}
+
+	covered := make(map[int]bool)
+	for _, id := range selected {
+		for parent, ok := parents[id]; ok && !covered[parent]; parent, ok = parents[parent] {
+			covered[parent] = true
+		}
+	}
+
+	leaves := 0
+	for _, id := range selected {
+		if !covered[id] {
+			leaves++
+		}
+	}
+	return leaves
+}
+
+// createComment creates a new comment, optionally as a reply to parentID,
+// and links the given uploads to it
+func createComment(postID int, parentID *int, content string, authorID int, attachmentIDs []int) (int64, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("INSERT INTO comments (post_id, parent_id, content, content_html, content_html_version, author_id) VALUES (?, ?, ?, ?, ?, ?)",
+		postID, parentID, content, renderMarkdown(content), markdownVersion, authorID)
+	if err != nil {
+		return 0, err
+	}
+
+	commentID, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+
+	if err := linkAttachments(tx, authorID, attachmentIDs, "comment_id", commentID); err != nil {
+		return 0, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	return commentID, nil
 }
 
-// getComments retrieves comments for a specific post
+// getComments retrieves comments for a specific post. Answers to a question
+// start with the accepted one, followed by the best rated.
 func getComments(postID int, userID *int) ([]Comment, error) {
+	isQuestion, acceptedID, err := getQuestionStatus(postID)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	args := []interface{}{postID}
+	order := "ORDER BY c.created ASC"
+	if isQuestion {
+		order = "ORDER BY c.id = ? DESC, likes - dislikes DESC, c.created ASC"
+		args = append(args, acceptedID)
+	}
+
 	query := `
-		SELECT c.id, c.post_id, c.content, c.author_id, u.username, c.created,
-			   (SELECT COUNT(*) FROM likes WHERE comment_id = c.id AND is_like = 1) as likes,
-			   (SELECT COUNT(*) FROM likes WHERE comment_id = c.id AND is_like = 0) as dislikes
+		SELECT c.id, c.post_id, c.parent_id, c.content, c.content_html, c.content_html_version, c.author_id, u.username, c.created,
+			   (SELECT COUNT(*) FROM reactions WHERE comment_id = c.id AND reaction = 'like') as likes,
+			   (SELECT COUNT(*) FROM reactions WHERE comment_id = c.id AND reaction = 'dislike') as dislikes
 		FROM comments c
 		JOIN users u ON c.author_id = u.id
-		WHERE c.post_id = ?
-		ORDER BY c.created ASC`
+		WHERE c.post_id = ? AND c.hidden = 0
+		` + order
 
-	rows, err := db.Query(query, postID)
+	rows, err := db.Query(query, args...)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
 	var comments []Comment
+	var stale []renderedHTML
 	for rows.Next() {
 		var comment Comment
-		err := rows.Scan(&comment.ID, &comment.PostID, &comment.Content, &comment.AuthorID, &comment.AuthorName, &comment.Created, &comment.Likes, &comment.Dislikes)
+		var htmlVersion int
+		var parentID sql.NullInt64
+		err := rows.Scan(&comment.ID, &comment.PostID, &parentID, &comment.Content, &comment.ContentHTML, &htmlVersion, &comment.AuthorID, &comment.AuthorName, &comment.Created, &comment.Likes, &comment.Dislikes)
+		if err != nil {
+			return nil, err
+		}
+		if parentID.Valid {
+			id := int(parentID.Int64)
+			comment.ParentID = &id
+		}
+		comment.Accepted = isQuestion && comment.ID == acceptedID
+		comment.ContentHTML = cachedContentHTML("comments", comment.ID, comment.Content, comment.ContentHTML, htmlVersion, &stale)
+
+		comment.Attachments, err = getAttachments("comment_id", comment.ID)
+		if err != nil {
+			return nil, err
+		}
+
+		comment.Mentions, err = getMentions("comment_id", comment.ID)
 		if err != nil {
 			return nil, err
 		}
@@ -416,10 +1267,20 @@ func getComments(postID int, userID *int) ([]Comment, error) {
 				comment.UserLiked = userLike
 				comment.UserDisliked = userDislike
 			}
+			if bookmarked, err := getBookmarkStatus(*userID, "comment_id", comment.ID); err == nil {
+				comment.Bookmarked = bookmarked
+			}
+		}
+
+		comment.Reactions, comment.UserReactions, err = loadReactions(userID, "comment_id", comment.ID)
+		if err != nil {
+			return nil, err
 		}
 
 		comments = append(comments, comment)
 	}
+	rows.Close()
+	storeContentHTML(stale)
 
 	return comments, nil
 }
@@ -427,7 +1288,7 @@ func getComments(postID int, userID *int) ([]Comment, error) {
 // getUserCommentLikeStatus gets the like/dislike status for a user on a specific comment
 func getUserCommentLikeStatus(userID, commentID int) (*bool, *bool, error) {
 	var isLike bool
-	err := db.QueryRow("SELECT is_like FROM likes WHERE user_id = ? AND comment_id = ?", userID, commentID).Scan(&isLike)
+	err := db.QueryRow("SELECT reaction = 'like' FROM reactions WHERE user_id = ? AND comment_id = ? AND reaction IN ('like', 'dislike')", userID, commentID).Scan(&isLike)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return nil, nil, nil
@@ -439,40 +1300,3 @@ func getUserCommentLikeStatus(userID, commentID int) (*bool, *bool, error) {
 	userDisliked := !isLike
 	return &userLiked, &userDisliked, nil
 }
-
-// toggleLike toggles a like/dislike on a post or comment
-func toggleLike(userID int, postID *int, commentID *int, isLike bool) error {
-	// First, check if there's already a like/dislike
-	var existingID int
-	var existingIsLike bool
-	var err error
-
-	if postID != nil {
-		err = db.QueryRow("SELECT id, is_like FROM likes WHERE user_id = ? AND post_id = ?", userID, *postID).Scan(&existingID, &existingIsLike)
-	} else if commentID != nil {
-		err = db.QueryRow("SELECT id, is_like FROM likes WHERE user_id = ? AND comment_id = ?", userID, *commentID).Scan(&existingID, &existingIsLike)
-	}
-
-	if err == sql.ErrNoRows {
-		// No existing like/dislike, create new one
-		if postID != nil {
-			_, err = db.Exec("INSERT INTO likes (user_id, post_id, is_like) VALUES (?, ?, ?)", userID, *postID, isLike)
-		} else if commentID != nil {
-			_, err = db.Exec("INSERT INTO likes (user_id, comment_id, is_like) VALUES (?, ?, ?)", userID, *commentID, isLike)
-		}
-		return err
-	} else if err != nil {
-		return err
-	}
-
-	// Existing like/dislike found
-	if existingIsLike == isLike {
-		// Same type, remove it
-		_, err = db.Exec("DELETE FROM likes WHERE id = ?", existingID)
-	} else {
-		// Different type, update it
-		_, err = db.Exec("UPDATE likes SET is_like = ? WHERE id = ?", isLike, existingID)
-	}
-
-	return err
-}
@@ -0,0 +1,512 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// maxDraftsPerUser limits how many drafts a user can keep
+	maxDraftsPerUser = 100
+	// maxDraftSize limits the encoded form stored in a draft
+	maxDraftSize = 20000
+)
+
+var (
+	errDraftNotFound = errors.New("draft not found")
+	errTooManyDrafts = errors.New("too many drafts")
+	errDraftTooLarge = errors.New("draft too large")
+)
+
+// draftFields are the post form fields kept in a draft
+var draftFields = []string{
+	"title", "content", "categories", "tags", "attachments",
+	"poll_question", "poll_option", "poll_multiple", "poll_results", "poll_closes",
+}
+
+// draftPublishMu serializes draft publication so a draft published by its
+// author and by the scheduler at the same time only becomes one post
+var draftPublishMu sync.Mutex
+
+// draftFormFields keeps the draft fields of a submitted form. Without an
+// "attachments" field the attachments already in the draft are kept, so
+// autosave does not have to resend them.
+func draftFormFields(form url.Values, previous url.Values) url.Values {
+	fields := url.Values{}
+	for _, name := range draftFields {
+		if values, ok := form[name]; ok {
+			fields[name] = values
+		}
+	}
+	if _, ok := form["attachments"]; !ok && previous != nil {
+		if values, ok := previous["attachments"]; ok {
+			fields["attachments"] = values
+		}
+	}
+	return fields
+}
+
+// saveDraft creates a draft (draftID 0) or replaces the fields of an
+// existing one, and links its attachments. Editing a draft clears the error
+// of a failed scheduled publication.
+func saveDraft(userID, draftID int, fields url.Values) (int, error) {
+	encoded := fields.Encode()
+	if len(encoded) > maxDraftSize {
+		return 0, errDraftTooLarge
+	}
+	attachmentIDs, err := parseAttachmentIDs(fields.Get("attachments"))
+	if err != nil {
+		return 0, errAttachmentUnavailable
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	if draftID == 0 {
+		var count int
+		if err := tx.QueryRow("SELECT COUNT(*) FROM drafts WHERE user_id = ?", userID).Scan(&count); err != nil {
+			return 0, err
+		}
+		if count >= maxDraftsPerUser {
+			return 0, errTooManyDrafts
+		}
+		result, err := tx.Exec("INSERT INTO drafts (user_id, fields) VALUES (?, ?)", userID, encoded)
+		if err != nil {
+			return 0, err
+		}
+		id, err := result.LastInsertId()
+		if err != nil {
+			return 0, err
+		}
+		draftID = int(id)
+	} else {
+		result, err := tx.Exec("UPDATE drafts SET fields = ?, error = '', updated = CURRENT_TIMESTAMP WHERE id = ? AND user_id = ?",
+			encoded, draftID, userID)
+		if err != nil {
+			return 0, err
+		}
+		if affected, err := result.RowsAffected(); err != nil {
+			return 0, err
+		} else if affected == 0 {
+			return 0, errDraftNotFound
+		}
+	}
+
+	if _, err := tx.Exec("UPDATE attachments SET draft_id = NULL WHERE draft_id = ?", draftID); err != nil {
+		return 0, err
+	}
+	if err := linkAttachments(tx, userID, attachmentIDs, "draft_id", int64(draftID)); err != nil {
+		return 0, err
+	}
+
+	return draftID, tx.Commit()
+}
+
+// getDraftFields loads the saved form of a user's draft
+func getDraftFields(userID, draftID int) (url.Values, error) {
+	var encoded string
+	err := db.QueryRow("SELECT fields FROM drafts WHERE id = ? AND user_id = ?", draftID, userID).Scan(&encoded)
+	if err == sql.ErrNoRows {
+		return nil, errDraftNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return url.ParseQuery(encoded)
+}
+
+// draftColumns is the SELECT list matching scanDraft
+const draftColumns = "id, fields, publish_at, error, created, updated"
+
+// scanDraft reads a draft row selected with draftColumns
+func scanDraft(scanner interface{ Scan(...interface{}) error }) (*Draft, error) {
+	draft := &Draft{}
+	var encoded string
+	var publishAt sql.NullTime
+	if err := scanner.Scan(&draft.ID, &encoded, &publishAt, &draft.Error, &draft.Created, &draft.Updated); err != nil {
+		return nil, err
+	}
+	fields, err := url.ParseQuery(encoded)
+	if err != nil {
+		return nil, err
+	}
+	draft.Fields = fields
+	if publishAt.Valid {
+		draft.PublishAt = &publishAt.Time
+	}
+	return draft, nil
+}
+
+// getDraft retrieves a user's draft with its attachments
+func getDraft(userID, draftID int) (*Draft, error) {
+	draft, err := scanDraft(db.QueryRow("SELECT "+draftColumns+" FROM drafts WHERE id = ? AND user_id = ?", draftID, userID))
+	if err == sql.ErrNoRows {
+		return nil, errDraftNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	draft.Attachments, err = getAttachments("draft_id", draft.ID)
+	if err != nil {
+		return nil, err
+	}
+	return draft, nil
+}
+
+// getDrafts lists a user's drafts, most recently edited first
+func getDrafts(userID int) ([]Draft, error) {
+	rows, err := db.Query("SELECT "+draftColumns+" FROM drafts WHERE user_id = ? ORDER BY updated DESC, id DESC", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	drafts := []Draft{}
+	for rows.Next() {
+		draft, err := scanDraft(rows)
+		if err != nil {
+			return nil, err
+		}
+		drafts = append(drafts, *draft)
+	}
+	return drafts, rows.Err()
+}
+
+// deleteDraft removes a draft. Its remaining attachments become orphans and
+// are collected by the attachment GC.
+func deleteDraft(draftID int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := removeDraft(tx, draftID); err != nil && err != errDraftNotFound {
+		return err
+	}
+	return tx.Commit()
+}
+
+// removeDraft deletes a draft within a transaction, returning
+// errDraftNotFound if it's already gone
+func removeDraft(tx *sql.Tx, draftID int) error {
+	if _, err := tx.Exec("UPDATE attachments SET draft_id = NULL WHERE draft_id = ?", draftID); err != nil {
+		return err
+	}
+	result, err := tx.Exec("DELETE FROM drafts WHERE id = ?", draftID)
+	if err != nil {
+		return err
+	}
+	if affected, err := result.RowsAffected(); err != nil {
+		return err
+	} else if affected == 0 {
+		return errDraftNotFound
+	}
+	return nil
+}
+
+// scheduleDraft sets or clears (nil) the publication time of a draft
+func scheduleDraft(userID, draftID int, publishAt *time.Time) error {
+	var value interface{}
+	if publishAt != nil {
+		value = publishAt.UTC().Format(sqliteTimeLayout)
+	}
+	result, err := db.Exec("UPDATE drafts SET publish_at = ?, error = '' WHERE id = ? AND user_id = ?", value, draftID, userID)
+	if err != nil {
+		return err
+	}
+	if affected, err := result.RowsAffected(); err != nil {
+		return err
+	} else if affected == 0 {
+		return errDraftNotFound
+	}
+	return nil
+}
+
+// publishDraft validates a draft like a new post and publishes it. The draft
+// is deleted together with the post, so it can't be published twice.
+// Invalid drafts are reported as a requestError.
+func publishDraft(user *User, draftID int) (int64, error) {
+	draftPublishMu.Lock()
+	defer draftPublishMu.Unlock()
+
+	fields, err := getDraftFields(user.ID, draftID)
+	if err != nil {
+		return 0, err
+	}
+	input, err := preparePost(user, fields)
+	if err != nil {
+		return 0, err
+	}
+	input.DraftID = draftID
+	return publishPost(user, input)
+}
+
+// publishScheduledDrafts publishes the drafts whose time has come. Drafts
+// held back by the rate limit are retried on the next run; drafts that can
+// no longer be published are unscheduled and keep the reason for their
+// author.
+func publishScheduledDrafts() {
+	rows, err := db.Query("SELECT id, user_id FROM drafts WHERE publish_at IS NOT NULL AND publish_at <= ? ORDER BY publish_at",
+		time.Now().UTC().Format(sqliteTimeLayout))
+	if err != nil {
+		log.Printf("Drafts - error loading scheduled drafts: %v", err)
+		return
+	}
+	type scheduledDraft struct{ id, userID int }
+	var due []scheduledDraft
+	for rows.Next() {
+		var d scheduledDraft
+		if err := rows.Scan(&d.id, &d.userID); err != nil {
+			log.Printf("Drafts - error loading scheduled drafts: %v", err)
+			break
+		}
+		due = append(due, d)
+	}
+	rows.Close()
+
+	for _, d := range due {
+		user, err := getUserByID(d.userID)
+		if err != nil {
+			log.Printf("Drafts - error loading author of draft %d: %v", d.id, err)
+			continue
+		}
+
+		var postID int64
+		suspension, err := getActiveSuspension(user.ID)
+		if err == nil && suspension != nil {
+			err = &requestError{http.StatusForbidden, suspensionMessage(suspension)}
+		} else if err == nil {
+			postID, err = publishDraft(user, d.id)
+		}
+
+		var reqErr *requestError
+		switch {
+		case err == nil:
+			events.publish("draft", map[string]interface{}{"id": d.id, "post_id": postID}, userTopic(user.ID))
+		case err == errDraftNotFound:
+			// Published or deleted by its author in the meantime
+		case errors.As(err, &reqErr) && reqErr.status == http.StatusTooManyRequests:
+			// Rate limited; try again on the next run
+		case errors.As(err, &reqErr):
+			if _, err := db.Exec("UPDATE drafts SET publish_at = NULL, error = ? WHERE id = ?", reqErr.message, d.id); err != nil {
+				log.Printf("Drafts - error unscheduling draft %d: %v", d.id, err)
+			}
+			events.publish("draft", map[string]interface{}{"id": d.id, "error": reqErr.message}, userTopic(user.ID))
+		default:
+			log.Printf("Drafts - error publishing draft %d: %v", d.id, err)
+		}
+	}
+}
+
+// startDraftPublisher runs publishScheduledDrafts now and then every minute
+func startDraftPublisher() {
+	go func() {
+		for {
+			publishScheduledDrafts()
+			time.Sleep(time.Minute)
+		}
+	}()
+}
+
+// writeDraftError writes the response for an error of a draft operation
+func writeDraftError(w http.ResponseWriter, err error) {
+	switch err {
+	case errDraftNotFound:
+		ErrorResponse(w, http.StatusNotFound, "Draft not found")
+	case errTooManyDrafts:
+		ErrorResponse(w, http.StatusBadRequest, "Можно хранить не более 100 черновиков")
+	case errDraftTooLarge:
+		ErrorResponse(w, http.StatusRequestEntityTooLarge, "Черновик слишком большой")
+	case errAttachmentUnavailable:
+		ErrorResponse(w, http.StatusBadRequest, "Вложение не найдено или уже использовано")
+	default:
+		writeRequestError(w, err)
+	}
+}
+
+// draftsHandler lists the user's drafts (GET) or saves a new one (POST with
+// the fields of the post form)
+func draftsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Suspended users can read their drafts but not change them
+	user, ok := requireUserForMethod(w, r)
+	if !ok {
+		return
+	}
+
+	if r.Method == "GET" {
+		drafts, err := getDrafts(user.ID)
+		if err != nil {
+			ErrorResponse(w, http.StatusInternalServerError, "Error retrieving drafts")
+			return
+		}
+		JSONResponse(w, http.StatusOK, drafts)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		ErrorResponse(w, http.StatusBadRequest, "Invalid form data")
+		return
+	}
+	draftID, err := saveDraft(user.ID, 0, draftFormFields(r.PostForm, nil))
+	if err != nil {
+		writeDraftError(w, err)
+		return
+	}
+	draft, err := getDraft(user.ID, draftID)
+	if err != nil {
+		ErrorResponse(w, http.StatusInternalServerError, "Error retrieving draft")
+		return
+	}
+	JSONResponse(w, http.StatusCreated, draft)
+}
+
+// draftHandler handles a single draft of the current user:
+// GET, POST (save) and DELETE /api/drafts/{id},
+// POST /api/drafts/{id}/publish and POST /api/drafts/{id}/schedule
+// (publish_at=, empty to cancel)
+func draftHandler(w http.ResponseWriter, r *http.Request) {
+	// pathParts = ["api", "drafts", "5"] or ["api", "drafts", "5", "publish"]
+	pathParts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(pathParts) < 3 || len(pathParts) > 4 {
+		ErrorResponse(w, http.StatusNotFound, "Not found")
+		return
+	}
+	draftID, err := strconv.Atoi(pathParts[2])
+	if err != nil {
+		ErrorResponse(w, http.StatusBadRequest, "Invalid draft ID")
+		return
+	}
+	action := ""
+	if len(pathParts) == 4 {
+		action = pathParts[3]
+	}
+
+	switch {
+	case action == "" && (r.Method == "GET" || r.Method == "POST" || r.Method == "DELETE"):
+	case (action == "publish" || action == "schedule") && r.Method == "POST":
+	case action != "" && action != "publish" && action != "schedule":
+		ErrorResponse(w, http.StatusNotFound, "Not found")
+		return
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Suspended users can read their drafts but not change them
+	user, ok := requireUserForMethod(w, r)
+	if !ok {
+		return
+	}
+
+	switch {
+	case r.Method == "GET":
+		draft, err := getDraft(user.ID, draftID)
+		if err != nil {
+			writeDraftError(w, err)
+			return
+		}
+		JSONResponse(w, http.StatusOK, draft)
+
+	case r.Method == "DELETE":
+		if _, err := getDraftFields(user.ID, draftID); err != nil {
+			writeDraftError(w, err)
+			return
+		}
+		if err := deleteDraft(draftID); err != nil {
+			ErrorResponse(w, http.StatusInternalServerError, "Error deleting draft")
+			return
+		}
+		JSONResponse(w, http.StatusOK, map[string]string{"message": "Draft deleted"})
+
+	case action == "":
+		if err := r.ParseForm(); err != nil {
+			ErrorResponse(w, http.StatusBadRequest, "Invalid form data")
+			return
+		}
+		previous, err := getDraftFields(user.ID, draftID)
+		if err != nil {
+			writeDraftError(w, err)
+			return
+		}
+		if _, err := saveDraft(user.ID, draftID, draftFormFields(r.PostForm, previous)); err != nil {
+			writeDraftError(w, err)
+			return
+		}
+		draft, err := getDraft(user.ID, draftID)
+		if err != nil {
+			ErrorResponse(w, http.StatusInternalServerError, "Error retrieving draft")
+			return
+		}
+		JSONResponse(w, http.StatusOK, draft)
+
+	case action == "publish":
+		postID, err := publishDraft(user, draftID)
+		if err != nil {
+			writeDraftError(w, err)
+			return
+		}
+		JSONResponse(w, http.StatusCreated, map[string]interface{}{
+			"message": "Post created successfully",
+			"post_id": postID,
+		})
+
+	case action == "schedule":
+		if err := r.ParseForm(); err != nil {
+			ErrorResponse(w, http.StatusBadRequest, "Invalid form data")
+			return
+		}
+
+		var publishAt *time.Time
+		if value := r.FormValue("publish_at"); value != "" {
+			t, err := parseTimeParam(value)
+			if err != nil {
+				ErrorResponse(w, http.StatusBadRequest, "Некорректное время публикации")
+				return
+			}
+			if !t.After(time.Now()) {
+				ErrorResponse(w, http.StatusBadRequest, "Время публикации должно быть в будущем")
+				return
+			}
+			publishAt = &t
+
+			// Check the draft now rather than when it is due; the rate
+			// limit is only known at publication time
+			fields, err := getDraftFields(user.ID, draftID)
+			if err != nil {
+				writeDraftError(w, err)
+				return
+			}
+			_, err = preparePost(user, fields)
+			var reqErr *requestError
+			if err != nil && !(errors.As(err, &reqErr) && reqErr.status == http.StatusTooManyRequests) {
+				writeRequestError(w, err)
+				return
+			}
+		}
+
+		if err := scheduleDraft(user.ID, draftID, publishAt); err != nil {
+			writeDraftError(w, err)
+			return
+		}
+		draft, err := getDraft(user.ID, draftID)
+		if err != nil {
+			ErrorResponse(w, http.StatusInternalServerError, "Error retrieving draft")
+			return
+		}
+		JSONResponse(w, http.StatusOK, draft)
+	}
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// eventHistorySize is how many past events are kept for Last-Event-ID resume
+	eventHistorySize = 1000
+	// subscriberBuffer is how many events may queue up for a slow client
+	// before it is disconnected; it resumes from Last-Event-ID on reconnect
+	subscriberBuffer = 64
+	// heartbeatInterval keeps idle connections open through proxies
+	heartbeatInterval = 25 * time.Second
+	// maxStreamTopics limits the topics of a single connection
+	maxStreamTopics = 20
+)
+
+// Event is a message pushed to stream clients subscribed to its topic
+type Event struct {
+	ID     uint64
+	Topics []string // "posts", "post:{id}" or "user:{id}"
+	Type   string   // SSE event name, e.g. "comment"
+	Data   []byte   // JSON payload
+}
+
+// subscriber is one open stream connection
+type subscriber struct {
+	topics map[string]bool
+	events chan Event
+}
+
+// wants reports whether the subscriber listens to any topic of the event
+func (sub *subscriber) wants(event Event) bool {
+	for _, topic := range event.Topics {
+		if sub.topics[topic] {
+			return true
+		}
+	}
+	return false
+}
+
+// eventHub fans events out to subscribers and remembers recent events so
+// reconnecting clients can catch up
+type eventHub struct {
+	mu          sync.Mutex
+	lastID      uint64
+	history     []Event
+	subscribers map[*subscriber]bool
+}
+
+// events is the process-wide hub used by all handlers
+var events = &eventHub{subscribers: make(map[*subscriber]bool)}
+
+// publish sends an event once to every subscriber of any of the topics.
+// Subscribers that can't keep up are dropped instead of blocking the publisher.
+func (h *eventHub) publish(eventType string, payload interface{}, topics ...string) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		log.Printf("Events - error encoding %s event: %v", eventType, err)
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.lastID++
+	event := Event{ID: h.lastID, Topics: topics, Type: eventType, Data: data}
+	h.history = append(h.history, event)
+	if len(h.history) > eventHistorySize {
+		h.history = h.history[len(h.history)-eventHistorySize:]
+	}
+
+	for sub := range h.subscribers {
+		if !sub.wants(event) {
+			continue
+		}
+		select {
+		case sub.events <- event:
+		default:
+			delete(h.subscribers, sub)
+			close(sub.events)
+		}
+	}
+}
+
+// subscribe registers a subscriber and returns the events after lastEventID
+// that it missed. complete is false when some of them are no longer in the
+// history, so the client should reload instead of relying on the replay.
+func (h *eventHub) subscribe(topics map[string]bool, lastEventID uint64) (sub *subscriber, missed []Event, complete bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	sub = &subscriber{topics: topics, events: make(chan Event, subscriberBuffer)}
+	h.subscribers[sub] = true
+
+	complete = true
+	if lastEventID > 0 {
+		if len(h.history) > 0 && h.history[0].ID > lastEventID+1 {
+			complete = false
+		}
+		if lastEventID > h.lastID {
+			// The server restarted since the client's last event
+			complete = false
+		}
+		for _, event := range h.history {
+			if event.ID > lastEventID && sub.wants(event) {
+				missed = append(missed, event)
+			}
+		}
+	}
+	return sub, missed, complete
+}
+
+// unsubscribe removes a subscriber unless publish already dropped it
+func (h *eventHub) unsubscribe(sub *subscriber) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.subscribers[sub] {
+		delete(h.subscribers, sub)
+		close(sub.events)
+	}
+}
+
+// writeEvent writes an event in the text/event-stream format
+func writeEvent(w http.ResponseWriter, event Event) error {
+	_, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Type, event.Data)
+	return err
+}
+
+// streamHandler serves Server-Sent Events for the topics listed in
+// ?topics= ("posts" and "post:{id}"). Logged in users also receive their
+// own notifications. Reconnecting clients get the events they missed
+// through the Last-Event-ID header.
+func streamHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		ErrorResponse(w, http.StatusInternalServerError, "Streaming not supported")
+		return
+	}
+
+	topics := make(map[string]bool)
+	for _, topic := range strings.Split(r.URL.Query().Get("topics"), ",") {
+		topic = strings.TrimSpace(topic)
+		if topic == "" {
+			continue
+		}
+		if !isPublicTopic(topic) {
+			ErrorResponse(w, http.StatusBadRequest, "Unknown topic: "+topic)
+			return
+		}
+		topics[topic] = true
+	}
+	if len(topics) > maxStreamTopics {
+		ErrorResponse(w, http.StatusBadRequest, "Too many topics")
+		return
+	}
+	if user, err := getCurrentUser(r); err == nil {
+		topics[userTopic(user.ID)] = true
+	}
+
+	lastEventID, _ := strconv.ParseUint(r.Header.Get("Last-Event-ID"), 10, 64)
+	sub, missed, complete := events.subscribe(topics, lastEventID)
+	defer events.unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	// Reconnect after 3 seconds if the connection drops
+	fmt.Fprint(w, "retry: 3000\n\n")
+	if !complete {
+		fmt.Fprintf(w, "event: reset\ndata: {}\n\n")
+	}
+	for _, event := range missed {
+		if writeEvent(w, event) != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(heartbeatInterval)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case event, ok := <-sub.events:
+			if !ok {
+				// Dropped for falling behind; the client reconnects and resumes
+				return
+			}
+			if writeEvent(w, event) != nil {
+				return
+			}
+			flusher.Flush()
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// isPublicTopic checks a topic clients may subscribe to themselves
+func isPublicTopic(topic string) bool {
+	if topic == "posts" {
+		return true
+	}
+	if id, ok := strings.CutPrefix(topic, "post:"); ok {
+		_, err := strconv.Atoi(id)
+		return err == nil
+	}
+	return false
+}
+
+// postTopic is the topic for comments and votes of a post
+func postTopic(postID int) string {
+	return "post:" + strconv.Itoa(postID)
+}
+
+// userTopic is the private topic of a user's notifications
+func userTopic(userID int) string {
+	return "user:" + strconv.Itoa(userID)
+}
+
+// publishVoteCounts pushes the current like, dislike and reaction counts of
+// a post or comment
+func publishVoteCounts(postID int, commentID *int) {
+	column, id := "post_id", postID
+	if commentID != nil {
+		column, id = "comment_id", *commentID
+	}
+
+	counts, err := getReactionCounts(column, id)
+	if err != nil {
+		log.Printf("Events - error counting votes: %v", err)
+		return
+	}
+
+	payload := map[string]interface{}{
+		"post_id":    postID,
+		"comment_id": commentID,
+		"likes":      counts["like"],
+		"dislikes":   counts["dislike"],
+		"reactions":  counts,
+	}
+	if commentID == nil {
+		// Post lists show vote counts too
+		events.publish("votes", payload, postTopic(postID), "posts")
+	} else {
+		events.publish("votes", payload, postTopic(postID))
+	}
+}
+
+// publishUnreadCount pushes a user's unread notification count to their open streams
+func publishUnreadCount(userID int) {
+	unread, err := countUnreadNotifications(userID)
+	if err != nil {
+		log.Printf("Events - error counting notifications: %v", err)
+		return
+	}
+	events.publish("notification", map[string]int{"unread_count": unread}, userTopic(userID))
+}
@@ -0,0 +1,425 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// feedEntryLimit is the number of newest posts or comments in a feed
+	feedEntryLimit = 50
+	// feedExcerptLength is the length of entry summaries in runes
+	feedExcerptLength = 300
+)
+
+// feedDocument is a feed independent of its Atom or RSS encoding
+type feedDocument struct {
+	Title    string
+	Subtitle string
+	Link     string // Page the feed belongs to
+	Self     string // URL of the feed itself
+	Updated  time.Time
+	Entries  []feedEntry
+}
+
+// feedEntry is one post or comment of a feed
+type feedEntry struct {
+	Title      string
+	Link       string
+	Author     string
+	Published  time.Time
+	Updated    time.Time
+	Summary    string
+	Categories []string
+}
+
+// atomFeed and the following types map feedDocument to Atom (RFC 4287)
+type atomFeed struct {
+	XMLName  xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Title    string      `xml:"title"`
+	Subtitle string      `xml:"subtitle,omitempty"`
+	ID       string      `xml:"id"`
+	Updated  string      `xml:"updated"`
+	Links    []atomLink  `xml:"link"`
+	Entries  []atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Rel  string `xml:"rel,attr,omitempty"`
+	Type string `xml:"type,attr,omitempty"`
+	Href string `xml:"href,attr"`
+}
+
+type atomEntry struct {
+	Title      string         `xml:"title"`
+	ID         string         `xml:"id"`
+	Link       atomLink       `xml:"link"`
+	Published  string         `xml:"published"`
+	Updated    string         `xml:"updated"`
+	Author     atomAuthor     `xml:"author"`
+	Summary    atomText       `xml:"summary"`
+	Categories []atomCategory `xml:"category"`
+}
+
+type atomAuthor struct {
+	Name string `xml:"name"`
+}
+
+type atomText struct {
+	Type string `xml:"type,attr"`
+	Text string `xml:",chardata"`
+}
+
+type atomCategory struct {
+	Term string `xml:"term,attr"`
+}
+
+// rssFeed and the following types map feedDocument to RSS 2.0
+type rssFeed struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	AtomNS  string     `xml:"xmlns:atom,attr"`
+	DCNS    string     `xml:"xmlns:dc,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title         string    `xml:"title"`
+	Link          string    `xml:"link"`
+	Description   string    `xml:"description"`
+	LastBuildDate string    `xml:"lastBuildDate"`
+	Self          rssLink   `xml:"atom:link"`
+	Items         []rssItem `xml:"item"`
+}
+
+type rssLink struct {
+	Rel  string `xml:"rel,attr"`
+	Type string `xml:"type,attr"`
+	Href string `xml:"href,attr"`
+}
+
+type rssItem struct {
+	Title       string   `xml:"title"`
+	Link        string   `xml:"link"`
+	GUID        rssGUID  `xml:"guid"`
+	PubDate     string   `xml:"pubDate"`
+	Creator     string   `xml:"dc:creator"`
+	Description string   `xml:"description"`
+	Categories  []string `xml:"category"`
+}
+
+type rssGUID struct {
+	IsPermaLink bool   `xml:"isPermaLink,attr"`
+	Text        string `xml:",chardata"`
+}
+
+// encodeAtom renders a feed as an Atom document
+func encodeAtom(doc *feedDocument) ([]byte, error) {
+	feed := atomFeed{
+		Title:    doc.Title,
+		Subtitle: doc.Subtitle,
+		ID:       doc.Self,
+		Updated:  doc.Updated.UTC().Format(time.RFC3339),
+		Links: []atomLink{
+			{Rel: "self", Type: "application/atom+xml", Href: doc.Self},
+			{Rel: "alternate", Type: "text/html", Href: doc.Link},
+		},
+	}
+	for _, entry := range doc.Entries {
+		item := atomEntry{
+			Title:     entry.Title,
+			ID:        entry.Link,
+			Link:      atomLink{Rel: "alternate", Type: "text/html", Href: entry.Link},
+			Published: entry.Published.UTC().Format(time.RFC3339),
+			Updated:   entry.Updated.UTC().Format(time.RFC3339),
+			Author:    atomAuthor{Name: entry.Author},
+			Summary:   atomText{Type: "text", Text: entry.Summary},
+		}
+		for _, category := range entry.Categories {
+			item.Categories = append(item.Categories, atomCategory{Term: category})
+		}
+		feed.Entries = append(feed.Entries, item)
+	}
+	return marshalFeed(feed)
+}
+
+// encodeRSS renders a feed as an RSS 2.0 document
+func encodeRSS(doc *feedDocument) ([]byte, error) {
+	description := doc.Subtitle
+	if description == "" {
+		description = doc.Title
+	}
+	feed := rssFeed{
+		Version: "2.0",
+		AtomNS:  "http://www.w3.org/2005/Atom",
+		DCNS:    "http://purl.org/dc/elements/1.1/",
+		Channel: rssChannel{
+			Title:         doc.Title,
+			Link:          doc.Link,
+			Description:   description,
+			LastBuildDate: doc.Updated.UTC().Format(time.RFC1123Z),
+			Self:          rssLink{Rel: "self", Type: "application/rss+xml", Href: doc.Self},
+		},
+	}
+	for _, entry := range doc.Entries {
+		feed.Channel.Items = append(feed.Channel.Items, rssItem{
+			Title:       entry.Title,
+			Link:        entry.Link,
+			GUID:        rssGUID{IsPermaLink: true, Text: entry.Link},
+			PubDate:     entry.Published.UTC().Format(time.RFC1123Z),
+			Creator:     entry.Author,
+			Description: entry.Summary,
+			Categories:  entry.Categories,
+		})
+	}
+	return marshalFeed(feed)
+}
+
+// marshalFeed encodes a feed with the XML declaration
+func marshalFeed(feed interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+	encoder := xml.NewEncoder(&buf)
+	encoder.Indent("", "  ")
+	if err := encoder.Encode(feed); err != nil {
+		return nil, err
+	}
+	buf.WriteString("\n")
+	return buf.Bytes(), nil
+}
+
+// baseURL returns the public URL of the forum without a trailing slash
+func baseURL(r *http.Request) string {
+	if appConfig.BaseURL != "" {
+		return appConfig.BaseURL
+	}
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
+
+// getFeedPosts loads the newest visible posts matching the WHERE condition
+// for a feed. Unlike getPosts it ignores pins and stops at feedEntryLimit.
+func getFeedPosts(where string, args ...interface{}) ([]Post, error) {
+	query := fmt.Sprintf(postsQuery, "p.pinned") + "\nWHERE p.hidden = 0" + where + "\nORDER BY p.created DESC, p.id DESC LIMIT ?"
+	return queryPosts(nil, query, append(args, feedEntryLimit)...)
+}
+
+// getFeedComments loads the newest visible comments of a post for its feed,
+// newest first regardless of the order of answers to questions. Only the
+// fields used by feed entries are filled in.
+func getFeedComments(postID int) ([]Comment, error) {
+	rows, err := db.Query(`
+		SELECT c.id, c.content, u.username, c.created
+		FROM comments c
+		JOIN users u ON c.author_id = u.id
+		WHERE c.post_id = ? AND c.hidden = 0
+		ORDER BY c.created DESC, c.id DESC LIMIT ?`, postID, feedEntryLimit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var comments []Comment
+	for rows.Next() {
+		var comment Comment
+		if err := rows.Scan(&comment.ID, &comment.Content, &comment.AuthorName, &comment.Created); err != nil {
+			return nil, err
+		}
+		comments = append(comments, comment)
+	}
+	return comments, rows.Err()
+}
+
+// postEntries turns the newest posts into feed entries
+func postEntries(base string, posts []Post) []feedEntry {
+	entries := make([]feedEntry, 0, len(posts))
+	for _, post := range posts {
+		entries = append(entries, feedEntry{
+			Title:      post.Title,
+			Link:       fmt.Sprintf("%s/post/%d", base, post.ID),
+			Author:     post.AuthorName,
+			Published:  post.Created,
+			Updated:    post.Updated,
+			Summary:    truncateRunes(post.Content, feedExcerptLength),
+			Categories: post.Categories,
+		})
+	}
+	return entries
+}
+
+// buildFeed collects the feed for a path below /feeds/ without its extension:
+// "posts", "categories/{id}", "users/{id}" or "posts/{id}/comments"
+func buildFeed(r *http.Request, name string) (*feedDocument, error) {
+	base := baseURL(r)
+	doc := &feedDocument{Self: base + r.URL.Path}
+	// fallback is the feed's updated time when it has no entries
+	var fallback time.Time
+
+	parts := strings.Split(name, "/")
+	switch {
+	case len(parts) == 1 && parts[0] == "posts":
+		posts, err := getFeedPosts("")
+		if err != nil {
+			return nil, err
+		}
+		doc.Title = "Форум — новые посты"
+		doc.Link = base + "/"
+		doc.Entries = postEntries(base, posts)
+
+	case len(parts) == 2 && parts[0] == "categories":
+		categoryID, err := strconv.Atoi(parts[1])
+		if err != nil {
+			return nil, sql.ErrNoRows
+		}
+		var categoryName string
+		if err := db.QueryRow("SELECT name FROM categories WHERE id = ?", categoryID).Scan(&categoryName); err != nil {
+			return nil, err
+		}
+		posts, err := getFeedPosts(`
+			AND p.id IN (
+				SELECT pc.post_id FROM post_categories pc
+				WHERE pc.category_id IN (`+categorySubtreeQuery+`)
+			)`, categoryName)
+		if err != nil {
+			return nil, err
+		}
+		doc.Title = "Форум — " + categoryName
+		doc.Subtitle = "Новые посты в категории «" + categoryName + "» и её подкатегориях"
+		doc.Link = base + "/"
+		doc.Entries = postEntries(base, posts)
+
+	case len(parts) == 2 && parts[0] == "users":
+		userID, err := strconv.Atoi(parts[1])
+		if err != nil {
+			return nil, sql.ErrNoRows
+		}
+		user, err := getUserByID(userID)
+		if err != nil {
+			return nil, err
+		}
+		posts, err := getFeedPosts(" AND p.author_id = ?", userID)
+		if err != nil {
+			return nil, err
+		}
+		doc.Title = "Форум — посты " + user.Username
+		doc.Link = base + "/"
+		doc.Entries = postEntries(base, posts)
+		fallback = user.Created
+
+	case len(parts) == 3 && parts[0] == "posts" && parts[2] == "comments":
+		postID, err := strconv.Atoi(parts[1])
+		if err != nil {
+			return nil, sql.ErrNoRows
+		}
+		post, err := getPost(nil, postID)
+		if err != nil {
+			return nil, err
+		}
+		comments, err := getFeedComments(postID)
+		if err != nil {
+			return nil, err
+		}
+
+		doc.Title = "Комментарии к посту «" + post.Title + "»"
+		doc.Link = fmt.Sprintf("%s/post/%d", base, post.ID)
+		for _, comment := range comments {
+			doc.Entries = append(doc.Entries, feedEntry{
+				Title:     "Комментарий " + comment.AuthorName + " к «" + post.Title + "»",
+				Link:      fmt.Sprintf("%s/post/%d#comment-%d", base, post.ID, comment.ID),
+				Author:    comment.AuthorName,
+				Published: comment.Created,
+				Updated:   comment.Created,
+				Summary:   truncateRunes(comment.Content, feedExcerptLength),
+			})
+		}
+		fallback = post.Created
+
+	default:
+		return nil, sql.ErrNoRows
+	}
+
+	doc.Updated = fallback
+	for _, entry := range doc.Entries {
+		if entry.Updated.After(doc.Updated) {
+			doc.Updated = entry.Updated
+		}
+	}
+	return doc, nil
+}
+
+// feedsHandler serves Atom (.atom) and RSS 2.0 (.rss) feeds:
+// /feeds/posts, /feeds/categories/{id}, /feeds/users/{id} and
+// /feeds/posts/{id}/comments. Responses carry an ETag and Last-Modified
+// so feed readers can poll with conditional requests.
+func feedsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := strings.TrimPrefix(r.URL.Path, "/feeds/")
+	format := path.Ext(name)
+	if format != ".atom" && format != ".rss" {
+		http.NotFound(w, r)
+		return
+	}
+
+	doc, err := buildFeed(r, strings.TrimSuffix(name, format))
+	if err == sql.ErrNoRows {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		log.Printf("Feeds - error building %s: %v", r.URL.Path, err)
+		http.Error(w, "Error building feed", http.StatusInternalServerError)
+		return
+	}
+
+	var body []byte
+	contentType := "application/atom+xml; charset=utf-8"
+	if format == ".rss" {
+		contentType = "application/rss+xml; charset=utf-8"
+		body, err = encodeRSS(doc)
+	} else {
+		body, err = encodeAtom(doc)
+	}
+	if err != nil {
+		log.Printf("Feeds - error encoding %s: %v", r.URL.Path, err)
+		http.Error(w, "Error building feed", http.StatusInternalServerError)
+		return
+	}
+
+	sum := sha256.Sum256(body)
+	etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	if !doc.Updated.IsZero() {
+		w.Header().Set("Last-Modified", doc.Updated.UTC().Format(http.TimeFormat))
+	}
+
+	if match := r.Header.Get("If-None-Match"); match != "" {
+		if match == "*" || strings.Contains(match, etag) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	} else if since, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err == nil &&
+		!doc.Updated.IsZero() && !doc.Updated.Truncate(time.Second).After(since) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Write(body)
+}
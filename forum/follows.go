@@ -0,0 +1,283 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+const (
+	// feedPageSize is the number of posts per feed page
+	feedPageSize = 20
+	// maxFollows limits how many users, categories and posts one user follows
+	maxFollows = 500
+)
+
+var errFollowTargetNotFound = errors.New("follow target not found")
+
+// followTypes lists what can be followed
+var followTypes = []string{"user", "category", "post"}
+
+// isFollowType checks a follow target type name
+func isFollowType(name string) bool {
+	return containsString(followTypes, name)
+}
+
+// checkFollowTarget makes sure a followed user, category or visible post exists
+func checkFollowTarget(targetType string, targetID int) error {
+	var query string
+	switch targetType {
+	case "user":
+		query = "SELECT COUNT(*) FROM users WHERE id = ?"
+	case "category":
+		query = "SELECT COUNT(*) FROM categories WHERE id = ?"
+	case "post":
+		query = "SELECT COUNT(*) FROM posts WHERE id = ? AND hidden = 0"
+	default:
+		return errFollowTargetNotFound
+	}
+	var count int
+	if err := db.QueryRow(query, targetID).Scan(&count); err != nil {
+		return err
+	}
+	if count == 0 {
+		return errFollowTargetNotFound
+	}
+	return nil
+}
+
+// getFollows lists what a user follows, newest first. Name is the username,
+// category name or post title, empty if the post was deleted.
+func getFollows(userID int) ([]Follow, error) {
+	rows, err := db.Query(`
+		SELECT f.target_type, f.target_id, f.created,
+			COALESCE(CASE f.target_type
+				WHEN 'user' THEN (SELECT username FROM users WHERE id = f.target_id)
+				WHEN 'category' THEN (SELECT name FROM categories WHERE id = f.target_id)
+				WHEN 'post' THEN (SELECT title FROM posts WHERE id = f.target_id AND hidden = 0)
+			END, '')
+		FROM follows f
+		WHERE f.user_id = ?
+		ORDER BY f.created DESC`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	follows := []Follow{}
+	for rows.Next() {
+		var follow Follow
+		if err := rows.Scan(&follow.Type, &follow.ID, &follow.Created, &follow.Name); err != nil {
+			return nil, err
+		}
+		follows = append(follows, follow)
+	}
+	return follows, rows.Err()
+}
+
+// getPostFollowers lists the users following a post
+func getPostFollowers(postID int) ([]int, error) {
+	rows, err := db.Query("SELECT user_id FROM follows WHERE target_type = 'post' AND target_id = ?", postID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var userIDs []int
+	for rows.Next() {
+		var userID int
+		if err := rows.Scan(&userID); err != nil {
+			return nil, err
+		}
+		userIDs = append(userIDs, userID)
+	}
+	return userIDs, rows.Err()
+}
+
+// getFeed returns the visible posts by followed users, in followed
+// categories and their sub-categories, and followed posts, newest first.
+// beforeID continues after the last post of the previous page.
+func getFeed(userID int, beforeID int) ([]Post, bool, error) {
+	query := `
+		WITH RECURSIVE followed_categories(id) AS (
+			SELECT target_id FROM follows WHERE user_id = ? AND target_type = 'category'
+			UNION
+			SELECT c.id FROM categories c JOIN followed_categories fc ON c.parent_id = fc.id
+		)` + fmt.Sprintf(postsQuery, "p.pinned") + `
+		WHERE p.hidden = 0 AND (
+			p.author_id IN (SELECT target_id FROM follows WHERE user_id = ? AND target_type = 'user')
+			OR p.id IN (SELECT target_id FROM follows WHERE user_id = ? AND target_type = 'post')
+			OR p.id IN (SELECT post_id FROM post_categories WHERE category_id IN (SELECT id FROM followed_categories))
+		)`
+	args := []interface{}{userID, userID, userID}
+	if beforeID > 0 {
+		query += " AND p.id < ?"
+		args = append(args, beforeID)
+	}
+	query += " ORDER BY p.id DESC LIMIT ?"
+	args = append(args, feedPageSize+1)
+
+	posts, err := queryPosts(&userID, query, args...)
+	if err != nil {
+		return nil, false, err
+	}
+
+	hasMore := len(posts) > feedPageSize
+	if hasMore {
+		posts = posts[:feedPageSize]
+	}
+	if posts == nil {
+		posts = []Post{}
+	}
+	return posts, hasMore, nil
+}
+
+// notifyThreadFollowers tells the followers of a post about a new comment.
+// The comment author, the post author and the author of the parent comment
+// are skipped because they get their own notifications.
+func notifyThreadFollowers(postID, commentID, authorID int, skip ...int) {
+	followers, err := getPostFollowers(postID)
+	if err != nil {
+		log.Printf("Follows - error loading followers of post %d: %v", postID, err)
+		return
+	}
+	for _, followerID := range followers {
+		if containsInt(skip, followerID) {
+			continue
+		}
+		if err := createNotification(followerID, authorID, "thread", postID, &commentID); err != nil {
+			log.Printf("Follows - error notifying user %d: %v", followerID, err)
+		}
+	}
+}
+
+// containsInt reports whether a slice contains a value
+func containsInt(values []int, value int) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// followsHandler lists (GET), adds (POST type=&id=) or removes
+// (DELETE ?type=&id=) what the current user follows
+func followsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "POST" && r.Method != "DELETE" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Suspended users can see whom they follow but not change it
+	user, ok := requireUserForMethod(w, r)
+	if !ok {
+		return
+	}
+
+	if r.Method != "GET" {
+		if err := r.ParseForm(); err != nil {
+			ErrorResponse(w, http.StatusBadRequest, "Invalid form data")
+			return
+		}
+		targetType := r.FormValue("type")
+		if !isFollowType(targetType) {
+			ErrorResponse(w, http.StatusBadRequest, "Invalid follow type")
+			return
+		}
+		targetID, err := strconv.Atoi(r.FormValue("id"))
+		if err != nil {
+			ErrorResponse(w, http.StatusBadRequest, "Invalid ID")
+			return
+		}
+
+		if r.Method == "DELETE" {
+			if _, err := db.Exec("DELETE FROM follows WHERE user_id = ? AND target_type = ? AND target_id = ?",
+				user.ID, targetType, targetID); err != nil {
+				ErrorResponse(w, http.StatusInternalServerError, "Error updating follows")
+				return
+			}
+			JSONResponse(w, http.StatusOK, map[string]string{"message": "Unfollowed"})
+			return
+		}
+
+		if targetType == "user" && targetID == user.ID {
+			ErrorResponse(w, http.StatusBadRequest, "Нельзя подписаться на самого себя")
+			return
+		}
+		if err := checkFollowTarget(targetType, targetID); err == errFollowTargetNotFound {
+			ErrorResponse(w, http.StatusNotFound, "Not found")
+			return
+		} else if err != nil {
+			ErrorResponse(w, http.StatusInternalServerError, "Error updating follows")
+			return
+		}
+
+		var count int
+		if err := db.QueryRow("SELECT COUNT(*) FROM follows WHERE user_id = ?", user.ID).Scan(&count); err != nil {
+			ErrorResponse(w, http.StatusInternalServerError, "Error updating follows")
+			return
+		}
+		if count >= maxFollows {
+			ErrorResponse(w, http.StatusBadRequest, "Можно подписаться не более чем на 500 источников")
+			return
+		}
+
+		if _, err := db.Exec("INSERT OR IGNORE INTO follows (user_id, target_type, target_id) VALUES (?, ?, ?)",
+			user.ID, targetType, targetID); err != nil {
+			ErrorResponse(w, http.StatusInternalServerError, "Error updating follows")
+			return
+		}
+		JSONResponse(w, http.StatusCreated, map[string]string{"message": "Followed"})
+		return
+	}
+
+	follows, err := getFollows(user.ID)
+	if err != nil {
+		ErrorResponse(w, http.StatusInternalServerError, "Error retrieving follows")
+		return
+	}
+	JSONResponse(w, http.StatusOK, follows)
+}
+
+// feedHandler serves the current user's personalized feed. Pass the
+// next_before value of a page as ?before= to get the next one.
+func feedHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, err := getCurrentUser(r)
+	if err != nil {
+		ErrorResponse(w, http.StatusUnauthorized, "Authentication required")
+		return
+	}
+
+	beforeID := 0
+	if value := r.URL.Query().Get("before"); value != "" {
+		beforeID, err = strconv.Atoi(value)
+		if err != nil || beforeID < 1 {
+			ErrorResponse(w, http.StatusBadRequest, "Invalid cursor")
+			return
+		}
+	}
+
+	posts, hasMore, err := getFeed(user.ID, beforeID)
+	if err != nil {
+		log.Printf("Feed - error loading feed of user %d: %v", user.ID, err)
+		ErrorResponse(w, http.StatusInternalServerError, "Error retrieving feed")
+		return
+	}
+
+	response := map[string]interface{}{
+		"posts":    posts,
+		"has_more": hasMore,
+	}
+	if hasMore {
+		response["next_before"] = posts[len(posts)-1].ID
+	}
+	JSONResponse(w, http.StatusOK, response)
+}
@@ -1,9 +1,11 @@
 package main
 
 import (
+	"database/sql"
 	"html/template"
 	"log"
 	"net/http"
+	"net/url"
 	"path/filepath"
 	"regexp"
 	"strconv"
@@ -44,6 +46,10 @@ func registerHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !checkIPAllowed(w, r) {
+		return
+	}
+
 	// Check if email already exists
 	existingUser, _ := getUserByEmail(email)
 	if existingUser != nil {
@@ -80,25 +86,40 @@ func loginHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	email := r.FormValue("email")
-	password := r.FormValue("password")
-
-	if email == "" || password == "" {
-		ErrorResponse(w, http.StatusBadRequest, "Email and password are required")
+	user, err := logIn(w, r, r.FormValue("email"), r.FormValue("password"))
+	if !writeRequestError(w, err) {
 		return
 	}
 
-	// Get user by email
-	user, err := getUserByEmail(email)
-	if err != nil {
-		ErrorResponse(w, http.StatusUnauthorized, "Invalid credentials")
+	// Suspended users may still log in to read, but are told why they can't write
+	suspension, err := getActiveSuspension(user.ID)
+	if err == nil && suspension != nil {
+		JSONResponse(w, http.StatusOK, map[string]interface{}{
+			"message":    "Login successful",
+			"warning":    suspensionMessage(suspension),
+			"suspension": suspension,
+		})
 		return
 	}
 
-	// Check password
-	if !checkPassword(password, user.Password) {
-		ErrorResponse(w, http.StatusUnauthorized, "Invalid credentials")
-		return
+	JSONResponse(w, http.StatusOK, map[string]string{"message": "Login successful"})
+}
+
+// logIn checks a user's credentials and starts a new session, replacing
+// their previous ones. Rejected logins are reported as a requestError.
+func logIn(w http.ResponseWriter, r *http.Request, email, password string) (*User, error) {
+	if email == "" || password == "" {
+		return nil, &requestError{http.StatusBadRequest, "Email and password are required"}
+	}
+
+	if err := ipBlockedError(r); err != nil {
+		return nil, err
+	}
+
+	// Get user by email and check the password
+	user, err := getUserByEmail(email)
+	if err != nil || !checkPassword(password, user.Password) {
+		return nil, &requestError{http.StatusUnauthorized, "Invalid credentials"}
 	}
 
 	// Delete all previous sessions for this user
@@ -107,14 +128,12 @@ func loginHandler(w http.ResponseWriter, r *http.Request) {
 	// Create session
 	session, err := createUserSession(user.ID)
 	if err != nil {
-		ErrorResponse(w, http.StatusInternalServerError, "Error creating session")
-		return
+		return nil, err
 	}
 
 	// Set session cookie
 	setSessionCookie(w, session.ID)
-
-	JSONResponse(w, http.StatusOK, map[string]string{"message": "Login successful"})
+	return user, nil
 }
 
 // logoutHandler handles user logout
@@ -133,47 +152,88 @@ func logoutHandler(w http.ResponseWriter, r *http.Request) {
 	JSONResponse(w, http.StatusOK, map[string]string{"message": "Logout successful"})
 }
 
-// createPostHandler handles post creation
-func createPostHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != "POST" {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
-	}
+// requestError is a validation error with the status and message to send
+// to the client
+type requestError struct {
+	status  int
+	message string
+}
 
-	// Check if user is logged in
-	user, err := getCurrentUser(r)
-	if err != nil {
-		ErrorResponse(w, http.StatusUnauthorized, "Authentication required")
-		return
-	}
+func (e *requestError) Error() string {
+	return e.message
+}
 
-	if err := r.ParseForm(); err != nil {
-		ErrorResponse(w, http.StatusBadRequest, "Invalid form data")
-		return
+// writeRequestError writes the response for an error: its own status and
+// message for a requestError, 500 for anything else. It returns true for a
+// nil error so it can guard handlers like the other check functions.
+func writeRequestError(w http.ResponseWriter, err error) bool {
+	if err == nil {
+		return true
 	}
+	if reqErr, ok := err.(*requestError); ok {
+		ErrorResponse(w, reqErr.status, reqErr.message)
+	} else {
+		ErrorResponse(w, http.StatusInternalServerError, "Error processing request")
+	}
+	return false
+}
+
+// postInput is a validated new post
+type postInput struct {
+	Title         string
+	Content       string
+	CategoryIDs   []int
+	Tags          []string
+	AttachmentIDs []int
+	Poll          *pollInput
+	DraftID       int // draft deleted along with the post, 0 for none
+}
 
-	title := r.FormValue("title")
-	content := r.FormValue("content")
-	categoriesStr := r.FormValue("categories")
+// preparePost validates the fields of a new post (title, content,
+// categories, tags, attachments and the poll fields) for a user. Invalid input is
+// reported as a requestError.
+func preparePost(user *User, form url.Values) (*postInput, error) {
+	title := form.Get("title")
+	content := form.Get("content")
+	categoriesStr := form.Get("categories")
 
 	if isTextEmpty(title) || isTextEmpty(content) {
-		ErrorResponse(w, http.StatusBadRequest, "Title and content are required")
-		return
+		return nil, &requestError{http.StatusBadRequest, "Title and content are required"}
 	}
 	if len(title) < 5 || len(title) > 100 {
-		ErrorResponse(w, http.StatusBadRequest, "Оглавление поста должно быть от 5 до 100 символов")
-		return
+		return nil, &requestError{http.StatusBadRequest, "Оглавление поста должно быть от 5 до 100 символов"}
 	}
 	if len(content) < 10 || len(content) > 2000 {
-		ErrorResponse(w, http.StatusBadRequest, "Текст поста должен быть от 10 до 2000 символов")
-		return
+		return nil, &requestError{http.StatusBadRequest, "Текст поста должен быть от 10 до 2000 символов"}
+	}
+
+	attachmentIDs, err := parseAttachmentIDs(form.Get("attachments"))
+	if err != nil {
+		return nil, &requestError{http.StatusBadRequest, "Можно прикрепить не более 10 файлов"}
+	}
+
+	tags, err := parseTags(form.Get("tags"))
+	if err != nil {
+		return nil, err
+	}
+
+	poll, err := parsePollForm(form)
+	if err != nil {
+		return nil, &requestError{http.StatusBadRequest, err.Error()}
+	}
+
+	// New users post less often and without links or images
+	if err := rateLimitError(user, "post"); err != nil {
+		return nil, err
+	}
+	if err := linksError(user, title+"\n"+content, attachmentIDs); err != nil {
+		return nil, err
 	}
 
 	// Получить все существующие категории
 	allCategories, err := getCategories()
 	if err != nil {
-		ErrorResponse(w, http.StatusInternalServerError, "Error processing categories")
-		return
+		return nil, err
 	}
 	categoryNameToID := make(map[string]int)
 	for _, cat := range allCategories {
@@ -181,21 +241,24 @@ func createPostHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var categoryIDs []int
-	var selectedNames []string
 	if categoriesStr != "" {
 		categoryNames := strings.Split(categoriesStr, ",")
+		seen := make(map[int]bool)
 		for _, name := range categoryNames {
 			name = strings.TrimSpace(name)
 			if name != "" {
-				if id, ok := categoryNameToID[name]; ok {
+				if id, ok := categoryNameToID[name]; ok && !seen[id] {
+					seen[id] = true
 					categoryIDs = append(categoryIDs, id)
-					selectedNames = append(selectedNames, name)
 				}
 			}
 		}
-		if len(categoryIDs) > 4 {
-			ErrorResponse(w, http.StatusBadRequest, "Можно выбрать не более 4 категорий")
-			return
+		// Родительская категория, выбранная вместе с подкатегорией, не занимает отдельного места
+		if countLeafCategories(categoryIDs, allCategories) > 4 {
+			return nil, &requestError{http.StatusBadRequest, "Можно выбрать не более 4 категорий"}
+		}
+		if err := categoryTrustError(user, categoryIDs, allCategories); err != nil {
+			return nil, err
 		}
 	}
 	if len(categoryIDs) == 0 {
@@ -205,8 +268,7 @@ func createPostHandler(w http.ResponseWriter, r *http.Request) {
 			// Создать категорию 'Другие'
 			_, err := db.Exec("INSERT INTO categories (name) VALUES (?)", "Другие")
 			if err != nil {
-				ErrorResponse(w, http.StatusInternalServerError, "Не удалось создать категорию 'Другие'")
-				return
+				return nil, &requestError{http.StatusInternalServerError, "Не удалось создать категорию 'Другие'"}
 			}
 			// Получить id только что созданной категории
 			row := db.QueryRow("SELECT id FROM categories WHERE name = ?", "Другие")
@@ -215,30 +277,49 @@ func createPostHandler(w http.ResponseWriter, r *http.Request) {
 		categoryIDs = append(categoryIDs, otherID)
 	}
 
-	// Create post
-	postID, err := createPost(title, content, user.ID, categoryIDs)
+	return &postInput{
+		Title:         title,
+		Content:       content,
+		CategoryIDs:   categoryIDs,
+		Tags:          tags,
+		AttachmentIDs: attachmentIDs,
+		Poll:          poll,
+	}, nil
+}
+
+// publishPost creates a validated post and announces it: mentions, badges
+// and the live "post" event
+func publishPost(user *User, input *postInput) (int64, error) {
+	postID, err := createPost(input.Title, input.Content, user.ID, input.CategoryIDs, input.Tags, input.AttachmentIDs, input.Poll, input.DraftID)
+	if err == errAttachmentUnavailable {
+		return 0, &requestError{http.StatusBadRequest, "Вложение не найдено или уже использовано"}
+	}
 	if err != nil {
-		ErrorResponse(w, http.StatusInternalServerError, "Error creating post")
-		return
+		return 0, err
 	}
 
-	JSONResponse(w, http.StatusCreated, map[string]interface{}{
-		"message": "Post created successfully",
-		"post_id": postID,
-	})
+	saveMentions(user.ID, int(postID), nil, input.Content)
+	evaluateBadges(user.ID, "posts")
+	events.publish("post", map[string]interface{}{
+		"id":          postID,
+		"title":       input.Title,
+		"author_id":   user.ID,
+		"author_name": user.Username,
+	}, "posts")
+
+	return postID, nil
 }
 
-// createCommentHandler handles comment creation
-func createCommentHandler(w http.ResponseWriter, r *http.Request) {
+// createPostHandler handles post creation
+func createPostHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	// Check if user is logged in
-	user, err := getCurrentUser(r)
-	if err != nil {
-		ErrorResponse(w, http.StatusUnauthorized, "Authentication required")
+	// Check if user is logged in and allowed to write
+	user, ok := requireActiveUser(w, r)
+	if !ok {
 		return
 	}
 
@@ -247,45 +328,127 @@ func createCommentHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	postIDStr := r.FormValue("post_id")
-	content := r.FormValue("content")
+	input, err := preparePost(user, r.Form)
+	if !writeRequestError(w, err) {
+		return
+	}
 
-	if postIDStr == "" || isTextEmpty(content) {
-		ErrorResponse(w, http.StatusBadRequest, "Post ID and content are required")
+	// Create post
+	postID, err := publishPost(user, input)
+	if !writeRequestError(w, err) {
 		return
 	}
+
+	JSONResponse(w, http.StatusCreated, map[string]interface{}{
+		"message": "Post created successfully",
+		"post_id": postID,
+	})
+}
+
+// commentInput is a validated new comment
+type commentInput struct {
+	PostID        int
+	ParentID      *int
+	Content       string
+	AttachmentIDs []int
+}
+
+// prepareComment validates the fields of a new comment (post_id, content,
+// parent_id and attachments) for a user. Invalid input is reported as a
+// requestError.
+func prepareComment(user *User, form url.Values) (*commentInput, error) {
+	postIDStr := form.Get("post_id")
+	content := form.Get("content")
+
+	if postIDStr == "" || isTextEmpty(content) {
+		return nil, &requestError{http.StatusBadRequest, "Post ID and content are required"}
+	}
 	if len(content) < 2 || len(content) > 500 {
-		ErrorResponse(w, http.StatusBadRequest, "Комментарий должен быть от 2 до 500 символов")
-		return
+		return nil, &requestError{http.StatusBadRequest, "Комментарий должен быть от 2 до 500 символов"}
 	}
 
 	postID, err := strconv.Atoi(postIDStr)
 	if err != nil {
-		ErrorResponse(w, http.StatusBadRequest, "Invalid post ID")
-		return
+		return nil, &requestError{http.StatusBadRequest, "Invalid post ID"}
 	}
 
-	// Create comment
-	err = createComment(postID, content, user.ID)
+	// Locked posts don't accept new comments
+	if err := postOpenError(postID); err != nil {
+		return nil, err
+	}
+
+	// A reply must belong to a visible comment of the same post
+	var parentID *int
+	if parentIDStr := form.Get("parent_id"); parentIDStr != "" {
+		id, err := strconv.Atoi(parentIDStr)
+		if err != nil {
+			return nil, &requestError{http.StatusBadRequest, "Invalid parent comment ID"}
+		}
+		parentPostID, err := getCommentPostID(id)
+		if err == errContentNotFound || (err == nil && parentPostID != postID) {
+			return nil, &requestError{http.StatusBadRequest, "Комментарий, на который вы отвечаете, не найден"}
+		} else if err != nil {
+			return nil, err
+		}
+		parentID = &id
+	}
+
+	attachmentIDs, err := parseAttachmentIDs(form.Get("attachments"))
 	if err != nil {
-		ErrorResponse(w, http.StatusInternalServerError, "Error creating comment")
-		return
+		return nil, &requestError{http.StatusBadRequest, "Можно прикрепить не более 10 файлов"}
+	}
+
+	if err := rateLimitError(user, "comment"); err != nil {
+		return nil, err
+	}
+	if err := linksError(user, content, attachmentIDs); err != nil {
+		return nil, err
 	}
 
-	JSONResponse(w, http.StatusCreated, map[string]string{"message": "Comment created successfully"})
+	return &commentInput{
+		PostID:        postID,
+		ParentID:      parentID,
+		Content:       content,
+		AttachmentIDs: attachmentIDs,
+	}, nil
 }
 
-// likeHandler handles likes and dislikes
-func likeHandler(w http.ResponseWriter, r *http.Request) {
+// publishComment creates a validated comment and announces it:
+// notifications, mentions, badges and the live "comment" event
+func publishComment(user *User, input *commentInput) (int64, error) {
+	commentID, err := createComment(input.PostID, input.ParentID, input.Content, user.ID, input.AttachmentIDs)
+	if err == errAttachmentUnavailable {
+		return 0, &requestError{http.StatusBadRequest, "Вложение не найдено или уже использовано"}
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	newCommentID := int(commentID)
+	notifyNewComment(input.PostID, newCommentID, user.ID, input.ParentID)
+	saveMentions(user.ID, input.PostID, &newCommentID, input.Content)
+	evaluateBadges(user.ID, "comments", "comment_categories")
+	events.publish("comment", map[string]interface{}{
+		"post_id":     input.PostID,
+		"comment_id":  newCommentID,
+		"parent_id":   input.ParentID,
+		"author_id":   user.ID,
+		"author_name": user.Username,
+	}, postTopic(input.PostID))
+
+	return commentID, nil
+}
+
+// createCommentHandler handles comment creation
+func createCommentHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	// Check if user is logged in
-	user, err := getCurrentUser(r)
-	if err != nil {
-		ErrorResponse(w, http.StatusUnauthorized, "Authentication required")
+	// Check if user is logged in and allowed to write
+	user, ok := requireActiveUser(w, r)
+	if !ok {
 		return
 	}
 
@@ -294,42 +457,56 @@ func likeHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	postIDStr := r.FormValue("post_id")
-	commentIDStr := r.FormValue("comment_id")
-	isLikeStr := r.FormValue("is_like")
+	input, err := prepareComment(user, r.Form)
+	if !writeRequestError(w, err) {
+		return
+	}
 
-	if (postIDStr == "" && commentIDStr == "") || isLikeStr == "" {
-		ErrorResponse(w, http.StatusBadRequest, "Post ID or comment ID and is_like are required")
+	// Create comment
+	commentID, err := publishComment(user, input)
+	if !writeRequestError(w, err) {
 		return
 	}
 
-	isLike := isLikeStr == "true"
+	JSONResponse(w, http.StatusCreated, map[string]interface{}{
+		"message":    "Comment created successfully",
+		"comment_id": commentID,
+	})
+}
+
+// likeHandler handles likes and dislikes (is_like=true|false), the
+// score-bearing reactions
+func likeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
 
-	var postID *int
-	var commentID *int
+	// Check if user is logged in and allowed to write
+	user, ok := requireActiveUser(w, r)
+	if !ok {
+		return
+	}
 
-	if postIDStr != "" {
-		id, err := strconv.Atoi(postIDStr)
-		if err != nil {
-			ErrorResponse(w, http.StatusBadRequest, "Invalid post ID")
-			return
-		}
-		postID = &id
+	if err := r.ParseForm(); err != nil {
+		ErrorResponse(w, http.StatusBadRequest, "Invalid form data")
+		return
 	}
 
-	if commentIDStr != "" {
-		id, err := strconv.Atoi(commentIDStr)
-		if err != nil {
-			ErrorResponse(w, http.StatusBadRequest, "Invalid comment ID")
-			return
-		}
-		commentID = &id
+	if r.FormValue("is_like") == "" {
+		ErrorResponse(w, http.StatusBadRequest, "Post ID or comment ID and is_like are required")
+		return
+	}
+	reaction := "dislike"
+	if r.FormValue("is_like") == "true" {
+		reaction = "like"
 	}
 
-	// Toggle like
-	err = toggleLike(user.ID, postID, commentID, isLike)
-	if err != nil {
-		ErrorResponse(w, http.StatusInternalServerError, "Error processing like")
+	target, ok := parseReactionTarget(w, r)
+	if !ok {
+		return
+	}
+	if !applyReaction(w, user, target, reaction) {
 		return
 	}
 
@@ -358,8 +535,8 @@ func postsHandler(w http.ResponseWriter, r *http.Request) {
 	filterValue := r.URL.Query().Get("value")
 	log.Printf("PostsHandler - Filter: %s, FilterValue: %s", filter, filterValue)
 
-	// Только для текущего пользователя фильтры 'created' и 'liked'
-	if (filter == "created" || filter == "liked") && userID == nil {
+	// Только для текущего пользователя фильтры 'created', 'liked' и 'saved'
+	if (filter == "created" || filter == "liked" || filter == "saved") && userID == nil {
 		log.Printf("PostsHandler - Authentication required for filter: %s", filter)
 		ErrorResponse(w, http.StatusUnauthorized, "Authentication required for this filter")
 		return
@@ -410,23 +587,13 @@ func postHandler(w http.ResponseWriter, r *http.Request) {
 		userID = &user.ID
 	}
 
-	// Get post details (simplified - you'd want to create a specific function for this)
-	posts, err := getPosts(userID, "", "")
-	if err != nil {
-		ErrorResponse(w, http.StatusInternalServerError, "Error retrieving post")
+	targetPost, err := getPost(userID, postID)
+	if err == sql.ErrNoRows {
+		ErrorResponse(w, http.StatusNotFound, "Post not found")
 		return
 	}
-
-	var targetPost *Post
-	for _, post := range posts {
-		if post.ID == postID {
-			targetPost = &post
-			break
-		}
-	}
-
-	if targetPost == nil {
-		ErrorResponse(w, http.StatusNotFound, "Post not found")
+	if err != nil {
+		ErrorResponse(w, http.StatusInternalServerError, "Error retrieving post")
 		return
 	}
 
@@ -439,6 +606,11 @@ func postHandler(w http.ResponseWriter, r *http.Request) {
 	if comments == nil {
 		comments = []Comment{}
 	}
+
+	if err := recordPostVisit(r, userID, postID, comments); err != nil {
+		ErrorResponse(w, http.StatusInternalServerError, "Error retrieving comments")
+		return
+	}
 	response := map[string]interface{}{
 		"post":     targetPost,
 		"comments": comments,
@@ -447,18 +619,21 @@ func postHandler(w http.ResponseWriter, r *http.Request) {
 	JSONResponse(w, http.StatusOK, response)
 }
 
-// categoriesHandler handles getting all categories
+// categoriesHandler handles getting all categories as a tree
 func categoriesHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "GET" {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	categories, err := getCategories()
+	categories, err := getCategoryTree()
 	if err != nil {
 		ErrorResponse(w, http.StatusInternalServerError, "Error retrieving categories")
 		return
 	}
+	if categories == nil {
+		categories = []Category{}
+	}
 
 	JSONResponse(w, http.StatusOK, categories)
 }
@@ -476,12 +651,44 @@ func userHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	warnings, err := getUserWarnings(user.ID)
+	if err != nil {
+		ErrorResponse(w, http.StatusInternalServerError, "Error retrieving user")
+		return
+	}
+
+	suspension, err := getActiveSuspension(user.ID)
+	if err != nil {
+		ErrorResponse(w, http.StatusInternalServerError, "Error retrieving user")
+		return
+	}
+
+	trustStats, err := getTrustStats(user.ID)
+	if err != nil {
+		ErrorResponse(w, http.StatusInternalServerError, "Error retrieving user")
+		return
+	}
+
 	// Don't include password in response
 	userResponse := map[string]interface{}{
-		"id":       user.ID,
-		"username": user.Username,
-		"email":    user.Email,
-		"created":  user.Created,
+		"id":         user.ID,
+		"username":   user.Username,
+		"email":      user.Email,
+		"role":       user.Role,
+		"bio":        user.Bio,
+		"location":   user.Location,
+		"avatar_url": avatarURL(user),
+		"reputation": user.Reputation,
+		"created":    user.Created,
+		"warnings":   warnings,
+
+		"trust_level":        user.TrustLevel,
+		"trust_level_locked": user.TrustLevelLocked,
+		"trust_stats":        trustStats,
+		"abilities":          effectiveTrustLevel(user),
+	}
+	if suspension != nil {
+		userResponse["suspension"] = suspension
 	}
 
 	JSONResponse(w, http.StatusOK, userResponse)
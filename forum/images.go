@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+)
+
+// maxImagePixels guards against decompression bombs: images claiming more
+// pixels than this are rejected before they are decoded
+const maxImagePixels = 40_000_000
+
+// errImageTooLarge is returned for images whose dimensions exceed maxImagePixels
+var errImageTooLarge = errors.New("image dimensions are too large")
+
+// decodeImage decodes a JPEG, PNG or GIF image after checking its dimensions
+func decodeImage(data []byte) (image.Image, error) {
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Width <= 0 || cfg.Height <= 0 || cfg.Width*cfg.Height > maxImagePixels {
+		return nil, errImageTooLarge
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	return img, err
+}
+
+// encodeImage encodes an image as JPEG for "image/jpeg" and as PNG otherwise.
+// Re-encoding drops all metadata of the original file, including EXIF.
+func encodeImage(img image.Image, mimeType string) ([]byte, error) {
+	var buf bytes.Buffer
+	var err error
+	if mimeType == "image/jpeg" {
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: 88})
+	} else {
+		err = png.Encode(&buf, img)
+	}
+	return buf.Bytes(), err
+}
+
+// reencodeGIF decodes and re-encodes every frame of a GIF, which keeps the
+// animation but drops comment and application extensions such as XMP
+func reencodeGIF(data []byte) ([]byte, error) {
+	anim, err := gif.DecodeAll(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	err = gif.EncodeAll(&buf, anim)
+	return buf.Bytes(), err
+}
+
+// resizeImage scales an image down to fit into maxWidth x maxHeight, keeping
+// its aspect ratio. Each target pixel is the average of the source pixels it
+// covers, which gives smooth results for large reductions. Images that
+// already fit are returned unchanged.
+func resizeImage(src image.Image, maxWidth, maxHeight int) image.Image {
+	bounds := src.Bounds()
+	srcW, srcH := bounds.Dx(), bounds.Dy()
+	if srcW <= maxWidth && srcH <= maxHeight {
+		return src
+	}
+
+	dstW, dstH := maxWidth, srcH*maxWidth/srcW
+	if dstH > maxHeight {
+		dstW, dstH = srcW*maxHeight/srcH, maxHeight
+	}
+	if dstW < 1 {
+		dstW = 1
+	}
+	if dstH < 1 {
+		dstH = 1
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, dstW, dstH))
+	for y := 0; y < dstH; y++ {
+		y0 := bounds.Min.Y + y*srcH/dstH
+		y1 := bounds.Min.Y + (y+1)*srcH/dstH
+		if y1 <= y0 {
+			y1 = y0 + 1
+		}
+		for x := 0; x < dstW; x++ {
+			x0 := bounds.Min.X + x*srcW/dstW
+			x1 := bounds.Min.X + (x+1)*srcW/dstW
+			if x1 <= x0 {
+				x1 = x0 + 1
+			}
+
+			var r, g, b, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					cr, cg, cb, ca := src.At(sx, sy).RGBA()
+					r, g, b, a = r+uint64(cr), g+uint64(cg), b+uint64(cb), a+uint64(ca)
+					n++
+				}
+			}
+			dst.Set(x, y, color.RGBA64{
+				R: uint16(r / n),
+				G: uint16(g / n),
+				B: uint16(b / n),
+				A: uint16(a / n),
+			})
+		}
+	}
+	return dst
+}
+
+// cropSquare cuts the largest centered square out of an image
+func cropSquare(src image.Image) image.Image {
+	bounds := src.Bounds()
+	size := bounds.Dx()
+	if bounds.Dy() < size {
+		size = bounds.Dy()
+	}
+	x0 := bounds.Min.X + (bounds.Dx()-size)/2
+	y0 := bounds.Min.Y + (bounds.Dy()-size)/2
+
+	dst := image.NewRGBA(image.Rect(0, 0, size, size))
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			dst.Set(x, y, src.At(x0+x, y0+y))
+		}
+	}
+	return dst
+}
+
+// identicon draws a symmetric 5x5 pattern derived from a hash of seed, so
+// every user gets a distinct default avatar without storing anything
+func identicon(seed string, size int) image.Image {
+	sum := sha256.Sum256([]byte(seed))
+	fg := color.RGBA{R: sum[0]/2 + 64, G: sum[1]/2 + 64, B: sum[2]/2 + 64, A: 255}
+	bg := color.RGBA{R: 240, G: 240, B: 240, A: 255}
+
+	const cells, margin = 5, 1
+	cell := size / (cells + 2*margin)
+	offset := (size - cell*cells) / 2
+
+	img := image.NewRGBA(image.Rect(0, 0, size, size))
+	draw.Draw(img, img.Bounds(), &image.Uniform{bg}, image.Point{}, draw.Src)
+
+	// Only the left three columns are random; the right two mirror them
+	for row := 0; row < cells; row++ {
+		for col := 0; col < 3; col++ {
+			if sum[3+row*3+col]%2 == 0 {
+				continue
+			}
+			for _, c := range []int{col, cells - 1 - col} {
+				rect := image.Rect(offset+c*cell, offset+row*cell, offset+(c+1)*cell, offset+(row+1)*cell)
+				draw.Draw(img, rect, &image.Uniform{fg}, image.Point{}, draw.Src)
+			}
+		}
+	}
+	return img
+}
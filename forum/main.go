@@ -5,8 +5,13 @@ import (
 	"log"
 	"net/http"
 	"path/filepath"
+
+	"forum/config"
 )
 
+// appConfig holds the settings loaded from the environment at startup
+var appConfig config.Config
+
 // postsRouteHandler handles both GET and POST requests for /api/posts
 func postsRouteHandler(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
@@ -31,14 +36,6 @@ func renderHTML(w http.ResponseWriter, filename string, data interface{}) {
 	tmpl.Execute(w, data)
 }
 
-func homeHandler(w http.ResponseWriter, r *http.Request) {
-	if r.URL.Path != "/" {
-		renderError(w, "Страница не найдена")
-		return
-	}
-	renderHTML(w, "index.html", nil)
-}
-
 func aboutHandler(w http.ResponseWriter, r *http.Request) {
 	renderHTML(w, "about.html", nil)
 }
@@ -49,10 +46,27 @@ func healthHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func main() {
+	appConfig = config.Load()
+
 	// Initialize database
 	initDB()
 	defer db.Close()
 
+	// Reputation is maintained incrementally; recomputing it at startup
+	// applies changed weights and existing votes
+	if err := recomputeReputation(db); err != nil {
+		log.Fatal(err)
+	}
+
+	// Initialize storage for uploaded files
+	if err := initBlobStore(appConfig); err != nil {
+		log.Fatal(err)
+	}
+	startAttachmentGC()
+	startTrustLevelJob()
+	startBadgeJob()
+	startDraftPublisher()
+
 	// Static files (CSS, JS)
 	fs := http.FileServer(http.Dir("templates"))
 	http.Handle("/static/", http.StripPrefix("/static/", fs))
@@ -62,16 +76,68 @@ func main() {
 	http.HandleFunc("/api/login", loginHandler)
 	http.HandleFunc("/api/logout", logoutHandler)
 	http.HandleFunc("/api/user", userHandler)
+	http.HandleFunc("/api/user/profile", profileHandler)
+	http.HandleFunc("/api/user/avatar", avatarHandler)
+	http.HandleFunc("/api/users/", usersHandler)
+	http.HandleFunc("/api/users/autocomplete", autocompleteHandler)
 	http.HandleFunc("/api/posts", postsRouteHandler)
 	http.HandleFunc("/api/post/", postHandler)
 	http.HandleFunc("/api/comments", createCommentHandler)
 	http.HandleFunc("/api/like", likeHandler)
+	http.HandleFunc("/api/reactions", reactionsHandler)
+	http.HandleFunc("/api/reactions/types", reactionTypesHandler)
+	http.HandleFunc("/api/accepted-answer", acceptedAnswerHandler)
+	http.HandleFunc("/api/polls/", pollHandler)
+	http.HandleFunc("/api/drafts", draftsHandler)
+	http.HandleFunc("/api/drafts/", draftHandler)
+	http.HandleFunc("/api/feed", feedHandler)
+	http.HandleFunc("/api/follows", followsHandler)
+	http.HandleFunc("/api/bookmarks", bookmarksHandler)
+	http.HandleFunc("/api/bookmarks/folders", bookmarkFoldersHandler)
+	http.HandleFunc("/api/bookmarks/folders/", bookmarkFolderHandler)
+	http.HandleFunc("/api/conversations", conversationsHandler)
+	http.HandleFunc("/api/conversations/", conversationHandler)
+	http.HandleFunc("/api/blocks", blocksHandler)
+	http.HandleFunc("/api/stream", streamHandler)
+	http.HandleFunc("/api/notifications", notificationsHandler)
+	http.HandleFunc("/api/notifications/read", markNotificationsReadHandler)
+	http.HandleFunc("/api/notifications/read-all", markAllNotificationsReadHandler)
+	http.HandleFunc("/api/notifications/preferences", notificationPreferencesHandler)
+	http.HandleFunc("/api/attachments", uploadAttachmentHandler)
+	http.HandleFunc("/api/attachments/", attachmentHandler)
 	http.HandleFunc("/api/categories", categoriesHandler)
+	http.HandleFunc("/api/report", reportHandler)
+	http.HandleFunc("/api/moderation/reports", reportQueueHandler)
+	http.HandleFunc("/api/moderation/action", moderationActionHandler)
+	http.HandleFunc("/api/moderation/suspend", suspendHandler)
+	http.HandleFunc("/api/moderation/unsuspend", unsuspendHandler)
+	http.HandleFunc("/api/moderation/ip-blocks", ipBlocksHandler)
+	http.HandleFunc("/api/moderation/pin", pinHandler)
+	http.HandleFunc("/api/moderation/lock", lockHandler)
+	http.HandleFunc("/api/moderation/announcement", manageAnnouncementHandler)
+	http.HandleFunc("/api/moderation/trust-level", trustLevelHandler)
+	http.HandleFunc("/api/moderation/category-trust-level", categoryTrustLevelHandler)
+	http.HandleFunc("/api/moderation/category-qa", categoryQAHandler)
+	http.HandleFunc("/api/moderation/tags", tagModerationHandler)
+	http.HandleFunc("/api/admin/audit", auditLogHandler)
+	http.HandleFunc("/api/admin/reputation/recompute", recomputeReputationHandler)
+	http.HandleFunc("/api/leaderboard", leaderboardHandler)
+	http.HandleFunc("/api/trust-levels", trustLevelsHandler)
+	http.HandleFunc("/api/badges", badgesHandler)
+	http.HandleFunc("/api/tags", tagsHandler)
+	http.HandleFunc("/api/announcement", announcementHandler)
 	http.HandleFunc("/api/health", healthHandler)
 
 	// Page routes
 	http.HandleFunc("/", homeHandler)
 	http.HandleFunc("/about", aboutHandler)
+	http.HandleFunc("/post/", postPageHandler)
+	http.HandleFunc("/category/", categoryPageHandler)
+	http.HandleFunc("/user/", userPageHandler)
+	http.HandleFunc("/new", newPostPageHandler)
+	http.HandleFunc("/login", loginPageHandler)
+	http.HandleFunc("/logout", logoutPageHandler)
+	http.HandleFunc("/feeds/", feedsHandler)
 
 	// Start server
 	port := ":8080"
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"html"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// markdownVersion is bumped whenever the renderer output changes, so cached
+// HTML rendered by an older version is regenerated on the next read
+const markdownVersion = 1
+
+var (
+	orderedItemRe   = regexp.MustCompile(`^\d{1,9}[.)]\s+`)
+	unorderedItemRe = regexp.MustCompile(`^[-*+]\s+`)
+	codeSpanRe      = regexp.MustCompile("`([^`\n]+)`")
+	linkRe          = regexp.MustCompile(`\[([^\]\n]+)\]\(([^)\s]+)\)`)
+	autolinkRe      = regexp.MustCompile(`(^|[\s(])(https?://[^\s<]+[^\s<.,;:!?)'"])`)
+	boldRe          = regexp.MustCompile(`\*\*([^*\n]+)\*\*|__([^_\n]+)__`)
+	italicStarRe    = regexp.MustCompile(`\*([^*\n]+)\*`)
+	italicLineRe    = regexp.MustCompile(`(^|[^\w])_([^_\n]+)_([^\w]|$)`)
+	strikeRe        = regexp.MustCompile(`~~([^~\n]+)~~`)
+	placeholderRe   = regexp.MustCompile("\x00(\\d+)\x00")
+)
+
+// renderMarkdown converts the supported Markdown subset to sanitized HTML:
+// fenced code blocks, block quotes, ordered and unordered lists, paragraphs,
+// links and inline code, bold, italic and strikethrough
+func renderMarkdown(source string) string {
+	// NUL bytes are reserved for the placeholders used by renderInline
+	source = strings.ReplaceAll(source, "\x00", "")
+	source = strings.ReplaceAll(source, "\r\n", "\n")
+	lines := strings.Split(source, "\n")
+	return sanitizeHTML(renderBlocks(lines))
+}
+
+// renderBlocks renders a sequence of lines as block-level elements
+func renderBlocks(lines []string) string {
+	var out strings.Builder
+	var paragraph []string
+
+	flushParagraph := func() {
+		if len(paragraph) > 0 {
+			out.WriteString("<p>" + renderInline(strings.Join(paragraph, "\n")) + "</p>\n")
+			paragraph = nil
+		}
+	}
+
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+		trimmed := strings.TrimSpace(line)
+
+		switch {
+		case strings.HasPrefix(trimmed, "```"):
+			flushParagraph()
+			lang := strings.TrimSpace(strings.TrimPrefix(trimmed, "```"))
+			var code []string
+			for i++; i < len(lines) && !strings.HasPrefix(strings.TrimSpace(lines[i]), "```"); i++ {
+				code = append(code, lines[i])
+			}
+			out.WriteString("<pre><code")
+			if isSafeLanguage(lang) {
+				out.WriteString(` class="language-` + lang + `"`)
+			}
+			out.WriteString(">" + html.EscapeString(strings.Join(code, "\n")) + "</code></pre>\n")
+
+		case trimmed == "":
+			flushParagraph()
+
+		case strings.HasPrefix(trimmed, ">"):
+			flushParagraph()
+			var quoted []string
+			for ; i < len(lines) && strings.HasPrefix(strings.TrimSpace(lines[i]), ">"); i++ {
+				text := strings.TrimPrefix(strings.TrimSpace(lines[i]), ">")
+				quoted = append(quoted, strings.TrimPrefix(text, " "))
+			}
+			i--
+			out.WriteString("<blockquote>\n" + renderBlocks(quoted) + "</blockquote>\n")
+
+		case unorderedItemRe.MatchString(trimmed), orderedItemRe.MatchString(trimmed):
+			flushParagraph()
+			marker, tag := unorderedItemRe, "ul"
+			if !unorderedItemRe.MatchString(trimmed) {
+				marker, tag = orderedItemRe, "ol"
+			}
+			out.WriteString("<" + tag + ">\n")
+			for ; i < len(lines) && marker.MatchString(strings.TrimSpace(lines[i])); i++ {
+				item := marker.ReplaceAllString(strings.TrimSpace(lines[i]), "")
+				out.WriteString("<li>" + renderInline(item) + "</li>\n")
+			}
+			i--
+			out.WriteString("</" + tag + ">\n")
+
+		default:
+			paragraph = append(paragraph, trimmed)
+		}
+	}
+	flushParagraph()
+
+	return out.String()
+}
+
+// renderInline renders inline formatting within a block. Code spans and links
+// are replaced by placeholders first so their contents are not formatted.
+func renderInline(text string) string {
+	var tokens []string
+	hold := func(fragment string) string {
+		tokens = append(tokens, fragment)
+		return "\x00" + strconv.Itoa(len(tokens)-1) + "\x00"
+	}
+
+	text = codeSpanRe.ReplaceAllStringFunc(text, func(m string) string {
+		return hold("<code>" + html.EscapeString(codeSpanRe.FindStringSubmatch(m)[1]) + "</code>")
+	})
+
+	text = linkRe.ReplaceAllStringFunc(text, func(m string) string {
+		parts := linkRe.FindStringSubmatch(m)
+		if !isSafeURL(parts[2]) {
+			return m
+		}
+		return hold(`<a href="` + html.EscapeString(parts[2]) + `">` + html.EscapeString(parts[1]) + "</a>")
+	})
+
+	text = autolinkRe.ReplaceAllStringFunc(text, func(m string) string {
+		parts := autolinkRe.FindStringSubmatch(m)
+		return parts[1] + hold(`<a href="`+html.EscapeString(parts[2])+`">`+html.EscapeString(parts[2])+"</a>")
+	})
+
+	text = html.EscapeString(text)
+	text = boldRe.ReplaceAllString(text, "<strong>$1$2</strong>")
+	text = italicStarRe.ReplaceAllString(text, "<em>$1</em>")
+	text = italicLineRe.ReplaceAllString(text, "$1<em>$2</em>$3")
+	text = strikeRe.ReplaceAllString(text, "<del>$1</del>")
+	text = strings.ReplaceAll(text, "\n", "<br>\n")
+
+	return placeholderRe.ReplaceAllStringFunc(text, func(m string) string {
+		index, _ := strconv.Atoi(placeholderRe.FindStringSubmatch(m)[1])
+		return tokens[index]
+	})
+}
+
+// isSafeLanguage checks a fenced code block language name
+func isSafeLanguage(lang string) bool {
+	if lang == "" || len(lang) > 20 {
+		return false
+	}
+	for _, c := range lang {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '+' || c == '#') {
+			return false
+		}
+	}
+	return true
+}
+
+// isSafeURL allows only http(s), mailto and site-relative links
+func isSafeURL(url string) bool {
+	lower := strings.ToLower(url)
+	return strings.HasPrefix(lower, "http://") ||
+		strings.HasPrefix(lower, "https://") ||
+		strings.HasPrefix(lower, "mailto:") ||
+		(strings.HasPrefix(url, "/") && !strings.HasPrefix(url, "//"))
+}
+
+// renderedHTML is freshly rendered HTML waiting to be written back to the cache
+type renderedHTML struct {
+	table string
+	id    int
+	html  string
+}
+
+// cachedContentHTML returns the cached HTML of a post or comment when it was
+// rendered by the current renderer version. Otherwise it renders the source
+// again and queues the result in stale for storeContentHTML.
+func cachedContentHTML(table string, id int, source, cached string, version int, stale *[]renderedHTML) string {
+	if version == markdownVersion {
+		return cached
+	}
+	rendered := renderMarkdown(source)
+	*stale = append(*stale, renderedHTML{table: table, id: id, html: rendered})
+	return rendered
+}
+
+// storeContentHTML writes re-rendered HTML back to the posts and comments
+// tables. It must be called after the rows of the reading query are closed.
+func storeContentHTML(stale []renderedHTML) {
+	for _, item := range stale {
+		_, err := db.Exec("UPDATE "+item.table+" SET content_html = ?, content_html_version = ? WHERE id = ?", item.html, markdownVersion, item.id)
+		if err != nil {
+			log.Printf("Error caching rendered HTML for %s %d: %v", item.table, item.id, err)
+		}
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+import "testing"
+
+func TestRenderMarkdown(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{"formatting", "**bold** _it_ ~~del~~", "<p><strong>bold</strong> <em>it</em> <del>del</del></p>\n"},
+		{"blocks", "> quote\n- a\n- b", "<blockquote>\n<p>quote</p>\n</blockquote>\n<ul>\n<li>a</li>\n<li>b</li>\n</ul>\n"},
+		{"relative link", "[x](/post/1)", "<p><a href=\"/post/1\" rel=\"nofollow ugc noopener\">x</a></p>\n"},
+		{"javascript link", "[x](javascript:alert(1))", "<p>[x](javascript:alert(1))</p>\n"},
+		{"upper case javascript link", "[x](JAVASCRIPT:alert)", "<p>[x](JAVASCRIPT:alert)</p>\n"},
+		{"entity in scheme", "[x](&#106;avascript:alert)", "<p>[x](&amp;#106;avascript:alert)</p>\n"},
+		{"protocol relative link", "[x](//evil.com)", "<p>[x](//evil.com)</p>\n"},
+		{"attribute injection in URL", "[x](http://a.com/\"onmouseover=\"alert)", "<p><a href=\"http://a.com/&#34;onmouseover=&#34;alert\" rel=\"nofollow ugc noopener\">x</a></p>\n"},
+		{"attribute injection in text", "[x\"onclick=\"y](http://a.com)", "<p><a href=\"http://a.com\" rel=\"nofollow ugc noopener\">x&#34;onclick=&#34;y</a></p>\n"},
+		{"autolink breaking out", "http://a.com/\"><script>", "<p><a href=\"http://a.com/&#34;&gt;\" rel=\"nofollow ugc noopener\">http://a.com/&#34;&gt;</a>&lt;script&gt;</p>\n"},
+		{"raw img onerror", "<img src=x onerror=alert(1)>", "<p>&lt;img src=x onerror=alert(1)&gt;</p>\n"},
+		{"raw svg", "<svg onload=alert(1)>", "<p>&lt;svg onload=alert(1)&gt;</p>\n"},
+		{"onclick in code span", "`<b onclick=x>`", "<p><code>&lt;b onclick=x&gt;</code></p>\n"},
+		{"injection in code language", "```js\" onclick=\"x\n<script>\n```", "<pre><code>&lt;script&gt;</code></pre>\n"},
+		{"entities stay text", "&lt;script&gt;", "<p>&amp;lt;script&amp;gt;</p>\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := renderMarkdown(tt.input); got != tt.want {
+				t.Errorf("renderMarkdown(%q) = %q, want %q", tt.input, got, tt.want)
+			}
+		})
+	}
+}
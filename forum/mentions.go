@@ -0,0 +1,173 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+const (
+	// maxMentionsPerItem caps how many users one post or comment can notify
+	maxMentionsPerItem = 10
+	// maxMentionsPerPost caps how many mention notifications one author can
+	// send for a post and its comments together
+	maxMentionsPerPost = 30
+	// autocompleteLimit is the number of usernames suggested at once
+	autocompleteLimit = 8
+)
+
+var (
+	// mentionRe matches @username where the @ doesn't follow a word
+	// character, so e-mail addresses are not treated as mentions
+	mentionRe = regexp.MustCompile(`(?:^|[^\p{L}\p{N}_@])@([\p{L}\p{N}_.\-]{1,50})`)
+	// codeRe matches fenced code blocks and code spans, which can't mention anyone
+	codeRe = regexp.MustCompile("(?s)```.*?(```|$)|`[^`\n]+`")
+)
+
+// parseMentions returns the distinct usernames mentioned in Markdown source
+// in order of appearance
+func parseMentions(content string) []string {
+	content = codeRe.ReplaceAllString(content, " ")
+
+	var usernames []string
+	seen := make(map[string]bool)
+	for _, m := range mentionRe.FindAllStringSubmatch(content, -1) {
+		// A trailing dot or dash ends the sentence rather than the name
+		username := strings.TrimRight(m[1], ".-")
+		key := strings.ToLower(username)
+		if username == "" || seen[key] {
+			continue
+		}
+		seen[key] = true
+		usernames = append(usernames, username)
+	}
+	return usernames
+}
+
+// saveMentions links the users mentioned in a new post or comment to it and
+// notifies them. A user is notified at most once per post while the previous
+// mention notification is unread. Only existing users count towards the
+// limits: at most maxMentionsPerItem users per post or comment, and at most
+// maxMentionsPerPost notifications by the same author per post.
+func saveMentions(authorID, postID int, commentID *int, content string) {
+	linked := 0
+	for _, username := range parseMentions(content) {
+		if linked == maxMentionsPerItem {
+			break
+		}
+
+		var userID int
+		err := db.QueryRow("SELECT id FROM users WHERE username = ? COLLATE NOCASE ORDER BY username = ? DESC LIMIT 1",
+			username, username).Scan(&userID)
+		if err == sql.ErrNoRows {
+			continue
+		} else if err != nil {
+			log.Printf("Mentions - error looking up %q: %v", username, err)
+			continue
+		}
+
+		if _, err := db.Exec("INSERT INTO mentions (user_id, post_id, comment_id, author_id) VALUES (?, ?, ?, ?)",
+			userID, postID, commentID, authorID); err != nil {
+			log.Printf("Mentions - error saving mention of user %d: %v", userID, err)
+			continue
+		}
+		linked++
+
+		var sent int
+		err = db.QueryRow("SELECT COUNT(*) FROM notifications WHERE type = 'mention' AND post_id = ? AND actor_id = ?",
+			postID, authorID).Scan(&sent)
+		if err != nil || sent >= maxMentionsPerPost {
+			continue
+		}
+		var pending int
+		err = db.QueryRow("SELECT COUNT(*) FROM notifications WHERE user_id = ? AND type = 'mention' AND post_id = ? AND is_read = 0",
+			userID, postID).Scan(&pending)
+		if err != nil || pending > 0 {
+			continue
+		}
+		if err := createNotification(userID, authorID, "mention", postID, commentID); err != nil {
+			log.Printf("Mentions - error notifying user %d: %v", userID, err)
+		}
+	}
+}
+
+// getMentions returns the users mentioned in a post ("post_id" column with
+// no comment) or a comment ("comment_id" column)
+func getMentions(column string, id int) ([]Mention, error) {
+	query := `
+		SELECT DISTINCT u.id, u.username FROM mentions m
+		JOIN users u ON m.user_id = u.id
+		WHERE m.` + column + ` = ?`
+	if column == "post_id" {
+		query += " AND m.comment_id IS NULL"
+	}
+
+	rows, err := db.Query(query, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var mentions []Mention
+	for rows.Next() {
+		var mention Mention
+		if err := rows.Scan(&mention.UserID, &mention.Username); err != nil {
+			return nil, err
+		}
+		mentions = append(mentions, mention)
+	}
+	return mentions, rows.Err()
+}
+
+// searchUsernames finds users whose name starts with prefix, shortest names first
+func searchUsernames(prefix string) ([]Mention, error) {
+	escaped := strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(prefix)
+	rows, err := db.Query(`
+		SELECT id, username FROM users
+		WHERE username LIKE ? ESCAPE '\'
+		ORDER BY LENGTH(username), username
+		LIMIT ?`, escaped+"%", autocompleteLimit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := []Mention{}
+	for rows.Next() {
+		var user Mention
+		if err := rows.Scan(&user.UserID, &user.Username); err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+	return users, rows.Err()
+}
+
+// autocompleteHandler suggests usernames for @mentions (?prefix=)
+func autocompleteHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if _, err := getCurrentUser(r); err != nil {
+		ErrorResponse(w, http.StatusUnauthorized, "Authentication required")
+		return
+	}
+
+	prefix := strings.TrimPrefix(strings.TrimSpace(r.URL.Query().Get("prefix")), "@")
+	if prefix == "" || len([]rune(prefix)) > 50 {
+		JSONResponse(w, http.StatusOK, []Mention{})
+		return
+	}
+
+	users, err := searchUsernames(prefix)
+	if err != nil {
+		ErrorResponse(w, http.StatusInternalServerError, "Error searching users")
+		return
+	}
+
+	JSONResponse(w, http.StatusOK, users)
+}
@@ -0,0 +1,645 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	// maxConversationParticipants includes the user who starts the conversation
+	maxConversationParticipants = 10
+	maxMessageLength            = 2000
+	messagesPageSize            = 50
+	conversationsPageSize       = 20
+)
+
+var (
+	errNotParticipant = errors.New("not a participant of the conversation")
+	errMessageBlocked = errors.New("recipient has blocked the sender")
+)
+
+// isBlocked reports whether blockerID has blocked blockedID
+func isBlocked(blockerID, blockedID int) (bool, error) {
+	var count int
+	err := db.QueryRow("SELECT COUNT(*) FROM user_blocks WHERE blocker_id = ? AND blocked_id = ?",
+		blockerID, blockedID).Scan(&count)
+	return count > 0, err
+}
+
+// getConversationParticipants lists the members of a conversation with the
+// last message each of them has read
+func getConversationParticipants(conversationID int) ([]ConversationParticipant, error) {
+	rows, err := db.Query(`
+		SELECT cp.user_id, u.username, cp.last_read_message_id
+		FROM conversation_participants cp
+		JOIN users u ON cp.user_id = u.id
+		WHERE cp.conversation_id = ?
+		ORDER BY u.username`, conversationID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var participants []ConversationParticipant
+	for rows.Next() {
+		var p ConversationParticipant
+		if err := rows.Scan(&p.UserID, &p.Username, &p.LastReadMessageID); err != nil {
+			return nil, err
+		}
+		participants = append(participants, p)
+	}
+	return participants, rows.Err()
+}
+
+// checkParticipant returns errNotParticipant unless the user belongs to the conversation
+func checkParticipant(conversationID, userID int) error {
+	var count int
+	err := db.QueryRow("SELECT COUNT(*) FROM conversation_participants WHERE conversation_id = ? AND user_id = ?",
+		conversationID, userID).Scan(&count)
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return errNotParticipant
+	}
+	return nil
+}
+
+// findDirectConversation returns the existing one-to-one conversation of two users, or 0
+func findDirectConversation(userID, otherID int) (int, error) {
+	var conversationID int
+	err := db.QueryRow(`
+		SELECT c.id FROM conversations c
+		WHERE (SELECT COUNT(*) FROM conversation_participants WHERE conversation_id = c.id) = 2
+		  AND EXISTS (SELECT 1 FROM conversation_participants WHERE conversation_id = c.id AND user_id = ?)
+		  AND EXISTS (SELECT 1 FROM conversation_participants WHERE conversation_id = c.id AND user_id = ?)
+		LIMIT 1`, userID, otherID).Scan(&conversationID)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return conversationID, err
+}
+
+// createConversation starts a conversation between the creator and the
+// other users. A one-to-one conversation that already exists is reused.
+func createConversation(creatorID int, otherIDs []int) (int, error) {
+	for _, otherID := range otherIDs {
+		blocked, err := isBlocked(otherID, creatorID)
+		if err != nil {
+			return 0, err
+		}
+		if blocked {
+			return 0, errMessageBlocked
+		}
+	}
+
+	if len(otherIDs) == 1 {
+		existing, err := findDirectConversation(creatorID, otherIDs[0])
+		if err != nil || existing != 0 {
+			return existing, err
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("INSERT INTO conversations (created_by) VALUES (?)", creatorID)
+	if err != nil {
+		return 0, err
+	}
+	conversationID, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+
+	for _, userID := range append([]int{creatorID}, otherIDs...) {
+		if _, err := tx.Exec("INSERT INTO conversation_participants (conversation_id, user_id) VALUES (?, ?)",
+			conversationID, userID); err != nil {
+			return 0, err
+		}
+	}
+
+	return int(conversationID), tx.Commit()
+}
+
+// sendMessage adds a message to a conversation. In a one-to-one conversation
+// the message is refused if the other participant has blocked the sender.
+func sendMessage(conversationID, senderID int, content string) (*DirectMessage, error) {
+	if err := checkParticipant(conversationID, senderID); err != nil {
+		return nil, err
+	}
+
+	participants, err := getConversationParticipants(conversationID)
+	if err != nil {
+		return nil, err
+	}
+	if len(participants) == 2 {
+		for _, p := range participants {
+			if p.UserID == senderID {
+				continue
+			}
+			blocked, err := isBlocked(p.UserID, senderID)
+			if err != nil {
+				return nil, err
+			}
+			if blocked {
+				return nil, errMessageBlocked
+			}
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("INSERT INTO messages (conversation_id, sender_id, content) VALUES (?, ?, ?)",
+		conversationID, senderID, content)
+	if err != nil {
+		return nil, err
+	}
+	messageID, err := result.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+
+	// Sending a message also means the sender has read everything before it
+	if _, err := tx.Exec("UPDATE conversations SET updated = CURRENT_TIMESTAMP WHERE id = ?", conversationID); err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec("UPDATE conversation_participants SET last_read_message_id = ? WHERE conversation_id = ? AND user_id = ?",
+		messageID, conversationID, senderID); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	message := &DirectMessage{}
+	err = db.QueryRow(`
+		SELECT m.id, m.conversation_id, m.sender_id, u.username, m.content, m.created
+		FROM messages m JOIN users u ON m.sender_id = u.id
+		WHERE m.id = ?`, messageID).
+		Scan(&message.ID, &message.ConversationID, &message.SenderID, &message.SenderName, &message.Content, &message.Created)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, p := range participants {
+		events.publish("message", map[string]int{
+			"conversation_id": conversationID,
+			"message_id":      message.ID,
+			"sender_id":       senderID,
+		}, userTopic(p.UserID))
+	}
+	return message, nil
+}
+
+// getConversations lists a user's conversations, most recently active first
+func getConversations(userID, page int) ([]Conversation, bool, error) {
+	rows, err := db.Query(`
+		SELECT c.id, c.updated,
+			(SELECT COUNT(*) FROM messages m
+				WHERE m.conversation_id = c.id AND m.id > cp.last_read_message_id AND m.sender_id != ?) AS unread
+		FROM conversations c
+		JOIN conversation_participants cp ON cp.conversation_id = c.id AND cp.user_id = ?
+		ORDER BY c.updated DESC, c.id DESC
+		LIMIT ? OFFSET ?`,
+		userID, userID, conversationsPageSize+1, (page-1)*conversationsPageSize)
+	if err != nil {
+		return nil, false, err
+	}
+
+	conversations := []Conversation{}
+	for rows.Next() {
+		var conversation Conversation
+		if err := rows.Scan(&conversation.ID, &conversation.Updated, &conversation.UnreadCount); err != nil {
+			rows.Close()
+			return nil, false, err
+		}
+		conversations = append(conversations, conversation)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, false, err
+	}
+
+	hasMore := len(conversations) > conversationsPageSize
+	if hasMore {
+		conversations = conversations[:conversationsPageSize]
+	}
+
+	for i := range conversations {
+		conversations[i].Participants, err = getConversationParticipants(conversations[i].ID)
+		if err != nil {
+			return nil, false, err
+		}
+
+		messages, _, err := getMessages(conversations[i].ID, 0, 1)
+		if err != nil {
+			return nil, false, err
+		}
+		if len(messages) > 0 {
+			conversations[i].LastMessage = &messages[0]
+		}
+	}
+	return conversations, hasMore, nil
+}
+
+// getMessages returns up to limit messages older than beforeID (all when 0), newest first
+func getMessages(conversationID, beforeID, limit int) ([]DirectMessage, bool, error) {
+	query := `
+		SELECT m.id, m.conversation_id, m.sender_id, u.username, m.content, m.created
+		FROM messages m JOIN users u ON m.sender_id = u.id
+		WHERE m.conversation_id = ?`
+	args := []interface{}{conversationID}
+	if beforeID > 0 {
+		query += " AND m.id < ?"
+		args = append(args, beforeID)
+	}
+	query += " ORDER BY m.id DESC LIMIT ?"
+	args = append(args, limit+1)
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, false, err
+	}
+	defer rows.Close()
+
+	messages := []DirectMessage{}
+	for rows.Next() {
+		var message DirectMessage
+		if err := rows.Scan(&message.ID, &message.ConversationID, &message.SenderID, &message.SenderName, &message.Content, &message.Created); err != nil {
+			return nil, false, err
+		}
+		messages = append(messages, message)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, false, err
+	}
+
+	hasMore := len(messages) > limit
+	if hasMore {
+		messages = messages[:limit]
+	}
+	return messages, hasMore, nil
+}
+
+// markConversationRead records that a user has read all current messages
+func markConversationRead(conversationID, userID int) error {
+	_, err := db.Exec(`
+		UPDATE conversation_participants
+		SET last_read_message_id = COALESCE((SELECT MAX(id) FROM messages WHERE conversation_id = ?), 0)
+		WHERE conversation_id = ? AND user_id = ?`,
+		conversationID, conversationID, userID)
+	return err
+}
+
+// publishConversationRead tells the other participants' open streams that
+// a user has read a conversation, so their read receipts update
+func publishConversationRead(conversationID, userID int) {
+	participants, err := getConversationParticipants(conversationID)
+	if err != nil {
+		log.Printf("Messages - error loading participants of conversation %d: %v", conversationID, err)
+		return
+	}
+	for _, p := range participants {
+		if p.UserID == userID {
+			continue
+		}
+		events.publish("conversation_read", map[string]int{
+			"conversation_id": conversationID,
+			"user_id":         userID,
+		}, userTopic(p.UserID))
+	}
+}
+
+// countUnreadMessages counts the unread messages of a user over all conversations
+func countUnreadMessages(userID int) (int, error) {
+	var count int
+	err := db.QueryRow(`
+		SELECT COUNT(*) FROM messages m
+		JOIN conversation_participants cp ON cp.conversation_id = m.conversation_id AND cp.user_id = ?
+		WHERE m.id > cp.last_read_message_id AND m.sender_id != ?`, userID, userID).Scan(&count)
+	return count, err
+}
+
+// getBlockedUsers lists the users a user has blocked
+func getBlockedUsers(userID int) ([]Mention, error) {
+	rows, err := db.Query(`
+		SELECT u.id, u.username FROM user_blocks b JOIN users u ON b.blocked_id = u.id
+		WHERE b.blocker_id = ? ORDER BY u.username`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := []Mention{}
+	for rows.Next() {
+		var user Mention
+		if err := rows.Scan(&user.UserID, &user.Username); err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+	return users, rows.Err()
+}
+
+// conversationsHandler lists the current user's conversations (GET) or
+// starts a new one (POST with participants=<usernames> and content)
+func conversationsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		user, err := getCurrentUser(r)
+		if err != nil {
+			ErrorResponse(w, http.StatusUnauthorized, "Authentication required")
+			return
+		}
+
+		page := 1
+		if value := r.URL.Query().Get("page"); value != "" {
+			page, err = strconv.Atoi(value)
+			if err != nil || page < 1 {
+				ErrorResponse(w, http.StatusBadRequest, "Invalid page")
+				return
+			}
+		}
+
+		conversations, hasMore, err := getConversations(user.ID, page)
+		if err != nil {
+			ErrorResponse(w, http.StatusInternalServerError, "Error retrieving conversations")
+			return
+		}
+		unread, err := countUnreadMessages(user.ID)
+		if err != nil {
+			ErrorResponse(w, http.StatusInternalServerError, "Error retrieving conversations")
+			return
+		}
+
+		JSONResponse(w, http.StatusOK, map[string]interface{}{
+			"conversations": conversations,
+			"unread_count":  unread,
+			"page":          page,
+			"has_more":      hasMore,
+		})
+	case "POST":
+		startConversationHandler(w, r)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// startConversationHandler creates a conversation and sends its first message
+func startConversationHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := requireActiveUser(w, r)
+	if !ok {
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		ErrorResponse(w, http.StatusBadRequest, "Invalid form data")
+		return
+	}
+
+	content := strings.TrimSpace(r.FormValue("content"))
+	if !validMessage(w, content) {
+		return
+	}
+
+	var names []string
+	for _, name := range strings.Split(r.FormValue("participants"), ",") {
+		name = strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(name), "@"))
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+	if len(names) >= maxConversationParticipants {
+		ErrorResponse(w, http.StatusBadRequest, "В беседе может быть не более 10 участников")
+		return
+	}
+
+	var otherIDs []int
+	seen := map[int]bool{user.ID: true}
+	for _, name := range names {
+		var id int
+		err := db.QueryRow("SELECT id FROM users WHERE username = ? COLLATE NOCASE ORDER BY username = ? DESC LIMIT 1",
+			name, name).Scan(&id)
+		if err == sql.ErrNoRows {
+			ErrorResponse(w, http.StatusBadRequest, "Пользователь "+name+" не найден")
+			return
+		} else if err != nil {
+			ErrorResponse(w, http.StatusInternalServerError, "Error creating conversation")
+			return
+		}
+		if !seen[id] {
+			seen[id] = true
+			otherIDs = append(otherIDs, id)
+		}
+	}
+	if len(otherIDs) == 0 {
+		ErrorResponse(w, http.StatusBadRequest, "Укажите хотя бы одного собеседника")
+		return
+	}
+
+	conversationID, err := createConversation(user.ID, otherIDs)
+	if err == errMessageBlocked {
+		ErrorResponse(w, http.StatusForbidden, "Пользователь ограничил получение сообщений от вас")
+		return
+	}
+	if err != nil {
+		ErrorResponse(w, http.StatusInternalServerError, "Error creating conversation")
+		return
+	}
+
+	message, err := sendMessage(conversationID, user.ID, content)
+	if err == errMessageBlocked {
+		ErrorResponse(w, http.StatusForbidden, "Пользователь ограничил получение сообщений от вас")
+		return
+	}
+	if err != nil {
+		ErrorResponse(w, http.StatusInternalServerError, "Error sending message")
+		return
+	}
+
+	JSONResponse(w, http.StatusCreated, map[string]interface{}{
+		"conversation_id": conversationID,
+		"message":         message,
+	})
+}
+
+// validMessage checks the length of a message, writing the error response itself
+func validMessage(w http.ResponseWriter, content string) bool {
+	if content == "" {
+		ErrorResponse(w, http.StatusBadRequest, "Сообщение не может быть пустым")
+		return false
+	}
+	if utf8.RuneCountInString(content) > maxMessageLength {
+		ErrorResponse(w, http.StatusBadRequest, "Сообщение не должно превышать 2000 символов")
+		return false
+	}
+	return true
+}
+
+// conversationHandler serves /api/conversations/{id}/messages (GET to read
+// with ?before=<message id>, POST to send) and /api/conversations/{id}/read
+// (POST). Only participants can access a conversation.
+func conversationHandler(w http.ResponseWriter, r *http.Request) {
+	// pathParts = ["api", "conversations", "5", "messages"]
+	pathParts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(pathParts) != 4 || (pathParts[3] != "messages" && pathParts[3] != "read") {
+		ErrorResponse(w, http.StatusNotFound, "Not found")
+		return
+	}
+	conversationID, err := strconv.Atoi(pathParts[2])
+	if err != nil {
+		ErrorResponse(w, http.StatusBadRequest, "Invalid conversation ID")
+		return
+	}
+
+	var user *User
+	if r.Method == "GET" {
+		user, err = getCurrentUser(r)
+		if err != nil {
+			ErrorResponse(w, http.StatusUnauthorized, "Authentication required")
+			return
+		}
+	} else if r.Method == "POST" {
+		var ok bool
+		if user, ok = requireActiveUser(w, r); !ok {
+			return
+		}
+	} else {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := checkParticipant(conversationID, user.ID); err == errNotParticipant {
+		ErrorResponse(w, http.StatusNotFound, "Conversation not found")
+		return
+	} else if err != nil {
+		ErrorResponse(w, http.StatusInternalServerError, "Error retrieving conversation")
+		return
+	}
+
+	switch {
+	case pathParts[3] == "read" && r.Method == "POST":
+		if err := markConversationRead(conversationID, user.ID); err != nil {
+			ErrorResponse(w, http.StatusInternalServerError, "Error updating conversation")
+			return
+		}
+		publishConversationRead(conversationID, user.ID)
+		JSONResponse(w, http.StatusOK, map[string]string{"message": "Conversation marked as read"})
+
+	case pathParts[3] == "messages" && r.Method == "GET":
+		beforeID := 0
+		if value := r.URL.Query().Get("before"); value != "" {
+			beforeID, err = strconv.Atoi(value)
+			if err != nil || beforeID < 1 {
+				ErrorResponse(w, http.StatusBadRequest, "Invalid message ID")
+				return
+			}
+		}
+
+		messages, hasMore, err := getMessages(conversationID, beforeID, messagesPageSize)
+		if err != nil {
+			ErrorResponse(w, http.StatusInternalServerError, "Error retrieving messages")
+			return
+		}
+		participants, err := getConversationParticipants(conversationID)
+		if err != nil {
+			ErrorResponse(w, http.StatusInternalServerError, "Error retrieving messages")
+			return
+		}
+
+		JSONResponse(w, http.StatusOK, map[string]interface{}{
+			"messages":     messages,
+			"participants": participants,
+			"has_more":     hasMore,
+		})
+
+	case pathParts[3] == "messages" && r.Method == "POST":
+		if err := r.ParseForm(); err != nil {
+			ErrorResponse(w, http.StatusBadRequest, "Invalid form data")
+			return
+		}
+		content := strings.TrimSpace(r.FormValue("content"))
+		if !validMessage(w, content) {
+			return
+		}
+
+		message, err := sendMessage(conversationID, user.ID, content)
+		if err == errMessageBlocked {
+			ErrorResponse(w, http.StatusForbidden, "Пользователь ограничил получение сообщений от вас")
+			return
+		}
+		if err != nil {
+			ErrorResponse(w, http.StatusInternalServerError, "Error sending message")
+			return
+		}
+		JSONResponse(w, http.StatusCreated, message)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// blocksHandler lists (GET), adds (POST user_id=) or removes (DELETE ?user_id=)
+// the users the current user has blocked from messaging them
+func blocksHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "POST" && r.Method != "DELETE" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Suspended users can see whom they block but not change it
+	user, ok := requireUserForMethod(w, r)
+	if !ok {
+		return
+	}
+
+	if r.Method != "GET" {
+		if err := r.ParseForm(); err != nil {
+			ErrorResponse(w, http.StatusBadRequest, "Invalid form data")
+			return
+		}
+		blockedID, err := strconv.Atoi(r.FormValue("user_id"))
+		if err != nil {
+			ErrorResponse(w, http.StatusBadRequest, "Invalid user ID")
+			return
+		}
+
+		if r.Method == "POST" {
+			if blockedID == user.ID {
+				ErrorResponse(w, http.StatusBadRequest, "Нельзя заблокировать самого себя")
+				return
+			}
+			if _, err := getUserByID(blockedID); err != nil {
+				ErrorResponse(w, http.StatusNotFound, "User not found")
+				return
+			}
+			_, err = db.Exec("INSERT OR IGNORE INTO user_blocks (blocker_id, blocked_id) VALUES (?, ?)", user.ID, blockedID)
+		} else {
+			_, err = db.Exec("DELETE FROM user_blocks WHERE blocker_id = ? AND blocked_id = ?", user.ID, blockedID)
+		}
+		if err != nil {
+			ErrorResponse(w, http.StatusInternalServerError, "Error updating blocks")
+			return
+		}
+	}
+
+	blocked, err := getBlockedUsers(user.ID)
+	if err != nil {
+		ErrorResponse(w, http.StatusInternalServerError, "Error retrieving blocks")
+		return
+	}
+	JSONResponse(w, http.StatusOK, blocked)
+}
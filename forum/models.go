@@ -1,52 +1,235 @@
 package main
 
 import (
+	"encoding/json"
 	"time"
 )
 
 // User represents a forum user
 type User struct {
-	ID       int       `json:"id"`
-	Username string    `json:"username"`
-	Email    string    `json:"email"`
-	Password string    `json:"-"` // Don't expose password in JSON
-	Created  time.Time `json:"created"`
+	ID               int       `json:"id"`
+	Username         string    `json:"username"`
+	Email            string    `json:"email"`
+	Password         string    `json:"-"`    // Don't expose password in JSON
+	Role             string    `json:"role"` // "user", "moderator" or "admin"
+	Bio              string    `json:"bio"`
+	Location         string    `json:"location"`
+	AvatarKey        string    `json:"-"` // Blob key of the uploaded avatar, empty for the identicon
+	Reputation       int       `json:"reputation"`
+	TrustLevel       int       `json:"trust_level"`
+	TrustLevelLocked bool      `json:"trust_level_locked"` // Set by a moderator, not re-evaluated
+	Created          time.Time `json:"created"`
+}
+
+// PublicProfile is the part of a user's account anyone can see. It
+// deliberately has no email field.
+type PublicProfile struct {
+	ID            int            `json:"id"`
+	Username      string         `json:"username"`
+	Role          string         `json:"role"`
+	Bio           string         `json:"bio"`
+	Location      string         `json:"location"`
+	AvatarURL     string         `json:"avatar_url"`
+	Created       time.Time      `json:"created"`
+	PostCount     int            `json:"post_count"`
+	CommentCount  int            `json:"comment_count"`
+	LikesReceived int            `json:"likes_received"`
+	Reputation    int            `json:"reputation"`
+	TrustLevel    int            `json:"trust_level"`
+	TrustName     string         `json:"trust_level_name"`
+	Badges        []UserBadge    `json:"badges"`
+	Activity      []ActivityItem `json:"activity"`
+	Page          int            `json:"page"`
+	HasMore       bool           `json:"has_more"`
+}
+
+// ActivityItem is a post or comment in a user's recent activity
+type ActivityItem struct {
+	Type      string    `json:"type"` // "post" or "comment"
+	ID        int       `json:"id"`
+	PostID    int       `json:"post_id"`
+	PostTitle string    `json:"post_title"`
+	Excerpt   string    `json:"excerpt"`
+	Created   time.Time `json:"created"`
 }
 
 // Post represents a forum post
 type Post struct {
-	ID           int       `json:"id"`
-	Title        string    `json:"title"`
-	Content      string    `json:"content"`
-	AuthorID     int       `json:"author_id"`
-	AuthorName   string    `json:"author_name"`
-	Created      time.Time `json:"created"`
-	Updated      time.Time `json:"updated"`
-	Likes        int       `json:"likes"`
-	Dislikes     int       `json:"dislikes"`
-	Categories   []string  `json:"categories"`
-	UserLiked    *bool     `json:"user_liked,omitempty"`    // For logged in users
-	UserDisliked *bool     `json:"user_disliked,omitempty"` // For logged in users
+	ID           int          `json:"id"`
+	Title        string       `json:"title"`
+	Content      string       `json:"content"`      // Markdown source
+	ContentHTML  string       `json:"content_html"` // Sanitized HTML rendered from Content
+	AuthorID     int          `json:"author_id"`
+	AuthorName   string       `json:"author_name"`
+	Created      time.Time    `json:"created"`
+	Updated      time.Time    `json:"updated"`
+	Likes        int          `json:"likes"`
+	Dislikes     int          `json:"dislikes"`
+	Categories   []string     `json:"categories"`
+	Tags         []string     `json:"tags,omitempty"`
+	Pinned       bool         `json:"pinned"` // Pinned globally or in the category being listed
+	Locked       bool         `json:"locked"` // No new comments or votes
+	Attachments  []Attachment `json:"attachments,omitempty"`
+	Mentions     []Mention    `json:"mentions,omitempty"`
+	UserLiked    *bool        `json:"user_liked,omitempty"`    // For logged in users
+	UserDisliked *bool        `json:"user_disliked,omitempty"` // For logged in users
+	Bookmarked   *bool        `json:"bookmarked,omitempty"`    // For logged in users
+
+	// Distinct viewers; for logged in users also whether they have never
+	// opened the post and how many comments appeared since they last did
+	Views          int   `json:"views"`
+	IsNew          *bool `json:"is_new,omitempty"`
+	UnreadComments *int  `json:"unread_comments,omitempty"`
+
+	// Counts of all reactions by key, likes and dislikes included
+	Reactions     map[string]int `json:"reactions"`
+	UserReactions []string       `json:"user_reactions,omitempty"` // For logged in users
+
+	// Posts in Q&A categories are questions that can have an accepted answer
+	IsQuestion bool `json:"is_question"`
+	AcceptedID *int `json:"accepted_comment_id,omitempty"`
+
+	Poll *Poll `json:"poll,omitempty"`
 }
 
 // Comment represents a comment on a post
 type Comment struct {
+	ID           int          `json:"id"`
+	PostID       int          `json:"post_id"`
+	ParentID     *int         `json:"parent_id,omitempty"` // Comment this one replies to
+	Content      string       `json:"content"`
+	ContentHTML  string       `json:"content_html"`
+	AuthorID     int          `json:"author_id"`
+	AuthorName   string       `json:"author_name"`
+	Created      time.Time    `json:"created"`
+	Likes        int          `json:"likes"`
+	Dislikes     int          `json:"dislikes"`
+	Accepted     bool         `json:"accepted,omitempty"` // Accepted answer of a question
+	Attachments  []Attachment `json:"attachments,omitempty"`
+	Mentions     []Mention    `json:"mentions,omitempty"`
+	UserLiked    *bool        `json:"user_liked,omitempty"`
+	UserDisliked *bool        `json:"user_disliked,omitempty"`
+	Bookmarked   *bool        `json:"bookmarked,omitempty"`
+	IsNew        bool         `json:"is_new,omitempty"` // Posted since the user last opened the post
+
+	Reactions     map[string]int `json:"reactions"`
+	UserReactions []string       `json:"user_reactions,omitempty"`
+}
+
+// Attachment represents an uploaded file linked to a post or comment
+type Attachment struct {
 	ID           int       `json:"id"`
-	PostID       int       `json:"post_id"`
-	Content      string    `json:"content"`
-	AuthorID     int       `json:"author_id"`
-	AuthorName   string    `json:"author_name"`
+	UploaderID   int       `json:"uploader_id"`
+	Filename     string    `json:"filename"`
+	MimeType     string    `json:"mime_type"`
+	Size         int64     `json:"size"`
+	Width        int       `json:"width,omitempty"`  // Images only
+	Height       int       `json:"height,omitempty"` // Images only
+	URL          string    `json:"url"`
+	ThumbnailURL string    `json:"thumbnail_url,omitempty"` // Images only
 	Created      time.Time `json:"created"`
-	Likes        int       `json:"likes"`
-	Dislikes     int       `json:"dislikes"`
-	UserLiked    *bool     `json:"user_liked,omitempty"`
-	UserDisliked *bool     `json:"user_disliked,omitempty"`
+	BlobKey      string    `json:"-"`
+	ThumbKey     string    `json:"-"`
+	PostID       *int      `json:"-"`
+	CommentID    *int      `json:"-"`
+}
+
+// Mention is a user referenced as @username in a post or comment
+type Mention struct {
+	UserID   int    `json:"user_id"`
+	Username string `json:"username"`
+}
+
+// NotificationGroup is one or more notifications of the same type about the
+// same content, e.g. all unread likes of a post
+type NotificationGroup struct {
+	IDs        []int     `json:"ids"` // Notification IDs to pass to the mark-read endpoint
+	Type       string    `json:"type"`
+	PostID     int       `json:"post_id"`
+	PostTitle  string    `json:"post_title"`
+	CommentID  *int      `json:"comment_id,omitempty"`
+	Actors     []string  `json:"actors"` // Up to three most recent usernames
+	ActorCount int       `json:"actor_count"`
+	Count      int       `json:"count"`
+	Message    string    `json:"message"`
+	Read       bool      `json:"read"`
+	Created    time.Time `json:"created"` // Time of the latest notification
+}
+
+// Conversation is a private one-to-one or group conversation
+type Conversation struct {
+	ID           int                       `json:"id"`
+	Participants []ConversationParticipant `json:"participants"`
+	LastMessage  *DirectMessage            `json:"last_message,omitempty"`
+	UnreadCount  int                       `json:"unread_count"`
+	Updated      time.Time                 `json:"updated"` // Time of the latest message
+}
+
+// ConversationParticipant is a member of a conversation. LastReadMessageID
+// serves as the read receipt: every message up to it has been read.
+type ConversationParticipant struct {
+	UserID            int    `json:"user_id"`
+	Username          string `json:"username"`
+	LastReadMessageID int    `json:"last_read_message_id"`
+}
+
+// DirectMessage is a message in a private conversation
+type DirectMessage struct {
+	ID             int       `json:"id"`
+	ConversationID int       `json:"conversation_id"`
+	SenderID       int       `json:"sender_id"`
+	SenderName     string    `json:"sender_name"`
+	Content        string    `json:"content"`
+	Created        time.Time `json:"created"`
+}
+
+// Bookmark is a post or comment a user saved. Content that was deleted or
+// hidden since stays listed as unavailable, without its title and excerpt.
+type Bookmark struct {
+	ID         int       `json:"id"`
+	Type       string    `json:"type"` // "post" or "comment"
+	PostID     int       `json:"post_id"`
+	CommentID  *int      `json:"comment_id,omitempty"`
+	FolderID   *int      `json:"folder_id"`
+	Available  bool      `json:"available"`
+	PostTitle  string    `json:"post_title,omitempty"`
+	Excerpt    string    `json:"excerpt,omitempty"`
+	AuthorName string    `json:"author_name,omitempty"`
+	Created    time.Time `json:"created"` // When the bookmark was saved
+}
+
+// BookmarkFolder is a named group of a user's bookmarks
+type BookmarkFolder struct {
+	ID      int       `json:"id"`
+	Name    string    `json:"name"`
+	Count   int       `json:"count"`
+	Created time.Time `json:"created"`
+}
+
+// Follow is a user, category or post that a user follows
+type Follow struct {
+	Type    string    `json:"type"` // "user", "category" or "post"
+	ID      int       `json:"id"`
+	Name    string    `json:"name"` // Username, category name or post title
+	Created time.Time `json:"created"`
+}
+
+// LeaderboardEntry is a user's place on the reputation leaderboard
+type LeaderboardEntry struct {
+	Rank       int    `json:"rank"`
+	UserID     int    `json:"user_id"`
+	Username   string `json:"username"`
+	Reputation int    `json:"reputation"` // Within the selected time window
 }
 
 // Category represents a post category
 type Category struct {
-	ID   int    `json:"id"`
-	Name string `json:"name"`
+	ID            int        `json:"id"`
+	Name          string     `json:"name"`
+	ParentID      *int       `json:"parent_id,omitempty"`
+	MinTrustLevel int        `json:"min_trust_level"`    // Trust level needed to create posts in it
+	QA            bool       `json:"qa"`                 // Posts are questions that can have an accepted answer
+	Children      []Category `json:"children,omitempty"` // Filled in only when returned as a tree
 }
 
 // Session represents a user session
@@ -56,14 +239,19 @@ type Session struct {
 	ExpiresAt time.Time `json:"expires_at"`
 }
 
-// Like represents a like/dislike on a post or comment
-type Like struct {
-	ID        int       `json:"id"`
-	UserID    int       `json:"user_id"`
-	PostID    *int      `json:"post_id,omitempty"`
-	CommentID *int      `json:"comment_id,omitempty"`
-	IsLike    bool      `json:"is_like"` // true for like, false for dislike
-	Created   time.Time `json:"created"`
+// Reactor is a user who reacted to a post or comment
+type Reactor struct {
+	UserID   int       `json:"user_id"`
+	Username string    `json:"username"`
+	Reaction string    `json:"reaction"`
+	Created  time.Time `json:"created"`
+}
+
+// ReactionType is a reaction users can give
+type ReactionType struct {
+	Key   string `json:"key"`
+	Emoji string `json:"emoji"`
+	Score bool   `json:"score"` // Like and dislike count as votes
 }
 
 // PostCategory represents the many-to-many relationship between posts and categories
@@ -71,3 +259,168 @@ type PostCategory struct {
 	PostID     int `json:"post_id"`
 	CategoryID int `json:"category_id"`
 }
+
+// Report represents a user flag on a post or comment
+type Report struct {
+	ID           int       `json:"id"`
+	ReporterID   int       `json:"reporter_id"`
+	ReporterName string    `json:"reporter_name"`
+	TargetType   string    `json:"target_type"` // "post" or "comment"
+	TargetID     int       `json:"target_id"`
+	Reason       string    `json:"reason"`
+	Details      string    `json:"details"`
+	Created      time.Time `json:"created"`
+}
+
+// ReportGroup collects the open reports on a single post or comment
+type ReportGroup struct {
+	TargetType   string         `json:"target_type"`
+	TargetID     int            `json:"target_id"`
+	AuthorID     int            `json:"author_id"`
+	AuthorName   string         `json:"author_name"`
+	Preview      string         `json:"preview"`
+	Hidden       bool           `json:"hidden"`
+	Count        int            `json:"count"`
+	Reasons      map[string]int `json:"reasons"`
+	LastReported time.Time      `json:"last_reported"`
+	Reports      []Report       `json:"reports"`
+}
+
+// Suspension represents a moderator ban on a user
+type Suspension struct {
+	ID        int        `json:"id"`
+	UserID    int        `json:"user_id"`
+	Reason    string     `json:"reason"`
+	Until     *time.Time `json:"until,omitempty"` // Not set for permanent suspensions
+	Permanent bool       `json:"permanent"`
+	Created   time.Time  `json:"created"`
+}
+
+// IPBlock represents an IP range barred from registering and logging in
+type IPBlock struct {
+	ID        int       `json:"id"`
+	CIDR      string    `json:"cidr"`
+	Reason    string    `json:"reason"`
+	CreatedBy int       `json:"created_by"`
+	Created   time.Time `json:"created"`
+}
+
+// Announcement represents a site-wide banner message
+type Announcement struct {
+	ID         int        `json:"id"`
+	Message    string     `json:"message"`
+	AuthorID   int        `json:"author_id"`
+	AuthorName string     `json:"author_name"`
+	Created    time.Time  `json:"created"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+}
+
+// AuditEntry represents a privileged action recorded in the audit log
+type AuditEntry struct {
+	ID         int             `json:"id"`
+	ActorID    int             `json:"actor_id"`
+	ActorName  string          `json:"actor_name"`
+	Action     string          `json:"action"`
+	TargetType string          `json:"target_type"`
+	TargetID   int             `json:"target_id"`
+	Before     json.RawMessage `json:"before,omitempty"`
+	After      json.RawMessage `json:"after,omitempty"`
+	Reason     string          `json:"reason"`
+	IP         string          `json:"ip"`
+	Created    time.Time       `json:"created"`
+}
+
+// Warning represents a moderator warning issued to a user
+type Warning struct {
+	ID      int       `json:"id"`
+	Reason  string    `json:"reason"`
+	Created time.Time `json:"created"`
+}
+
+// TrustLevel describes what a trust level requires and what it unlocks.
+// Rate limits are per hour; 0 means unlimited.
+type TrustLevel struct {
+	Level             int    `json:"level"`
+	Name              string `json:"name"`
+	ManualOnly        bool   `json:"manual_only"` // Only granted by moderators
+	MinAccountDays    int    `json:"min_account_days"`
+	MinPostsRead      int    `json:"min_posts_read"`
+	MinContentCreated int    `json:"min_content_created"`
+	MinLikesReceived  int    `json:"min_likes_received"`
+	CanPostLinks      bool   `json:"can_post_links"` // Links and image attachments
+	CanVote           bool   `json:"can_vote"`
+	PostsPerHour      int    `json:"posts_per_hour"`
+	CommentsPerHour   int    `json:"comments_per_hour"`
+	VotesPerHour      int    `json:"votes_per_hour"`
+}
+
+// TrustStats is the activity a user's automatic trust level is based on
+type TrustStats struct {
+	AccountDays    int `json:"account_days"`
+	PostsRead      int `json:"posts_read"`
+	ContentCreated int `json:"content_created"`
+	LikesReceived  int `json:"likes_received"`
+}
+
+// BadgeRule declares a badge, awarded once Metric reaches Threshold
+type BadgeRule struct {
+	Key         string
+	Name        string
+	Description string
+	Metric      string // Key of badgeMetrics
+	Threshold   int
+}
+
+// Badge is a badge in the list of all badges
+type Badge struct {
+	Key          string `json:"key"`
+	Name         string `json:"name"`
+	Description  string `json:"description"`
+	AwardedCount int    `json:"awarded_count"`
+}
+
+// UserBadge is a badge awarded to a user
+type UserBadge struct {
+	Key         string    `json:"key"`
+	Name        string    `json:"name"`
+	Description string    `json:"description"`
+	Awarded     time.Time `json:"awarded"`
+}
+
+// Poll is a poll attached to a post
+type Poll struct {
+	ID             int          `json:"id"`
+	Question       string       `json:"question"`
+	Multiple       bool         `json:"multiple"` // Several options can be chosen
+	Results        string       `json:"results"`  // "always", "after_vote" or "after_close"
+	ClosesAt       *time.Time   `json:"closes_at,omitempty"`
+	Closed         bool         `json:"closed"`
+	Options        []PollOption `json:"options"`
+	ResultsVisible bool         `json:"results_visible"`
+	Voters         *int         `json:"voters,omitempty"` // Only when the results are visible
+	UserVotes      []int        `json:"user_votes"`       // Options chosen by the current user
+}
+
+// PollOption is an answer of a poll
+type PollOption struct {
+	ID    int    `json:"id"`
+	Text  string `json:"text"`
+	Votes *int   `json:"votes,omitempty"` // Only when the results are visible
+}
+
+// Draft is an unpublished post, visible only to its author
+type Draft struct {
+	ID          int                 `json:"id"`
+	Fields      map[string][]string `json:"fields"` // Post form fields as saved, possibly incomplete
+	Attachments []Attachment        `json:"attachments,omitempty"`
+	PublishAt   *time.Time          `json:"publish_at,omitempty"` // Scheduled publication time
+	Error       string              `json:"error,omitempty"`      // Why the last scheduled publication failed
+	Created     time.Time           `json:"created"`
+	Updated     time.Time           `json:"updated"`
+}
+
+// TagCount is a tag with the number of visible posts carrying it
+type TagCount struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
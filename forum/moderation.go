@@ -0,0 +1,429 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// reportReasons lists the reason codes accepted by POST /api/report
+var reportReasons = map[string]bool{
+	"spam":       true,
+	"abuse":      true,
+	"harassment": true,
+	"off_topic":  true,
+	"illegal":    true,
+	"other":      true,
+}
+
+// moderationActions lists the actions a moderator can take on a reported target
+var moderationActions = map[string]bool{
+	"dismiss": true,
+	"hide":    true,
+	"delete":  true,
+	"warn":    true,
+}
+
+// errContentNotFound is returned when a report or action targets missing content
+var errContentNotFound = errors.New("content not found")
+
+// parseContentTarget reads post_id or comment_id from the form, the same way
+// likeHandler does, and returns the target type and ID
+func parseContentTarget(r *http.Request) (string, int, error) {
+	postIDStr := r.FormValue("post_id")
+	commentIDStr := r.FormValue("comment_id")
+
+	switch {
+	case postIDStr != "" && commentIDStr == "":
+		id, err := strconv.Atoi(postIDStr)
+		return "post", id, err
+	case commentIDStr != "" && postIDStr == "":
+		id, err := strconv.Atoi(commentIDStr)
+		return "comment", id, err
+	default:
+		return "", 0, errors.New("exactly one of post_id and comment_id is required")
+	}
+}
+
+// getContentInfo retrieves the author, a short preview and the hidden flag of a post or comment
+func getContentInfo(targetType string, targetID int) (authorID int, authorName, preview string, hidden bool, err error) {
+	var query string
+	switch targetType {
+	case "post":
+		query = "SELECT p.author_id, u.username, p.title, p.hidden FROM posts p JOIN users u ON p.author_id = u.id WHERE p.id = ?"
+	case "comment":
+		query = "SELECT c.author_id, u.username, c.content, c.hidden FROM comments c JOIN users u ON c.author_id = u.id WHERE c.id = ?"
+	default:
+		return 0, "", "", false, errContentNotFound
+	}
+
+	err = db.QueryRow(query, targetID).Scan(&authorID, &authorName, &preview, &hidden)
+	if err == sql.ErrNoRows {
+		return 0, "", "", false, errContentNotFound
+	}
+	return authorID, authorName, truncateRunes(preview, 100), hidden, err
+}
+
+// truncateRunes shortens text to at most n characters, adding an ellipsis when cut
+func truncateRunes(text string, n int) string {
+	runes := []rune(text)
+	if len(runes) <= n {
+		return text
+	}
+	return string(runes[:n]) + "…"
+}
+
+// hasOpenReport checks whether the user already has an open report on the target
+func hasOpenReport(reporterID int, targetType string, targetID int) (bool, error) {
+	var count int
+	err := db.QueryRow("SELECT COUNT(*) FROM reports WHERE reporter_id = ? AND target_type = ? AND target_id = ? AND status = 'open'",
+		reporterID, targetType, targetID).Scan(&count)
+	return count > 0, err
+}
+
+// createReport stores a new open report
+func createReport(reporterID int, targetType string, targetID int, reason, details string) error {
+	_, err := db.Exec("INSERT INTO reports (reporter_id, target_type, target_id, reason, details) VALUES (?, ?, ?, ?, ?)",
+		reporterID, targetType, targetID, reason, details)
+	return err
+}
+
+// getReportQueue retrieves all open reports grouped by target, the most reported first
+func getReportQueue() ([]ReportGroup, error) {
+	rows, err := db.Query(`
+		SELECT r.id, r.reporter_id, u.username, r.target_type, r.target_id, r.reason, r.details, r.created
+		FROM reports r
+		JOIN users u ON r.reporter_id = u.id
+		WHERE r.status = 'open'
+		ORDER BY r.created DESC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var groups []*ReportGroup
+	byTarget := make(map[string]*ReportGroup)
+	for rows.Next() {
+		var report Report
+		err := rows.Scan(&report.ID, &report.ReporterID, &report.ReporterName, &report.TargetType, &report.TargetID, &report.Reason, &report.Details, &report.Created)
+		if err != nil {
+			return nil, err
+		}
+
+		key := report.TargetType + ":" + strconv.Itoa(report.TargetID)
+		group, ok := byTarget[key]
+		if !ok {
+			group = &ReportGroup{
+				TargetType:   report.TargetType,
+				TargetID:     report.TargetID,
+				Reasons:      make(map[string]int),
+				LastReported: report.Created,
+			}
+			byTarget[key] = group
+			groups = append(groups, group)
+		}
+		group.Count++
+		group.Reasons[report.Reason]++
+		group.Reports = append(group.Reports, report)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	result := make([]ReportGroup, 0, len(groups))
+	for _, group := range groups {
+		authorID, authorName, preview, hidden, err := getContentInfo(group.TargetType, group.TargetID)
+		if err != nil && err != errContentNotFound {
+			return nil, err
+		}
+		group.AuthorID = authorID
+		group.AuthorName = authorName
+		group.Preview = preview
+		group.Hidden = hidden
+		result = append(result, *group)
+	}
+
+	// Groups are already ordered by their latest report; the stable sort keeps
+	// that order among targets with the same number of reports
+	sort.SliceStable(result, func(i, j int) bool {
+		return result[i].Count > result[j].Count
+	})
+
+	return result, nil
+}
+
+// moderationAuditActions maps moderation actions to their audit log names
+var moderationAuditActions = map[string]string{
+	"dismiss": "reports.dismiss",
+	"hide":    "content.hide",
+	"delete":  "content.delete",
+	"warn":    "user.warn",
+}
+
+// applyModerationAction performs an action on a reported target, resolves
+// all of its open reports and records it in the audit log in a single transaction
+func applyModerationAction(moderatorID int, targetType string, targetID int, action, reason, ip string) error {
+	authorID, _, _, _, err := getContentInfo(targetType, targetID)
+	if err != nil && !(err == errContentNotFound && action == "dismiss") {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	before, err := snapshotContent(tx, targetType, targetID)
+	if err != nil {
+		return err
+	}
+
+	switch action {
+	case "hide":
+		_, err = tx.Exec("UPDATE "+targetType+"s SET hidden = 1 WHERE id = ?", targetID)
+		if err == nil && targetType == "comment" {
+			// A hidden comment can no longer be the accepted answer
+			_, err = tx.Exec("UPDATE posts SET accepted_comment_id = NULL WHERE accepted_comment_id = ?", targetID)
+		}
+	case "delete":
+		err = deleteContent(tx, targetType, targetID)
+	case "warn":
+		_, err = tx.Exec("INSERT INTO warnings (user_id, moderator_id, reason, target_type, target_id) VALUES (?, ?, ?, ?, ?)",
+			authorID, moderatorID, reason, targetType, targetID)
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`
+		UPDATE reports SET status = 'resolved', resolution = ?, resolved_by = ?, resolved_at = CURRENT_TIMESTAMP
+		WHERE target_type = ? AND target_id = ? AND status = 'open'`,
+		action, moderatorID, targetType, targetID)
+	if err != nil {
+		return err
+	}
+
+	after, err := snapshotContent(tx, targetType, targetID)
+	if err != nil {
+		return err
+	}
+	if action == "warn" {
+		after = map[string]interface{}{"user_id": authorID, "warning": reason}
+	}
+
+	err = recordAudit(tx, moderatorID, moderationAuditActions[action], targetType, targetID, before, after, reason, ip)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// deleteContent removes a post or comment together with everything attached to it
+func deleteContent(tx *sql.Tx, targetType string, targetID int) error {
+	// Votes on the content go away with it, and so does the reputation they gave
+	authorIDs, err := contentAuthors(tx, targetType, targetID)
+	if err != nil {
+		return err
+	}
+
+	var statements []string
+	switch targetType {
+	case "post":
+		statements = []string{
+			"DELETE FROM reactions WHERE comment_id IN (SELECT id FROM comments WHERE post_id = ?)",
+			"DELETE FROM comments WHERE post_id = ?",
+			"DELETE FROM reactions WHERE post_id = ?",
+			"DELETE FROM notifications WHERE post_id = ?",
+			"DELETE FROM mentions WHERE post_id = ?",
+			"DELETE FROM follows WHERE target_type = 'post' AND target_id = ?",
+			"DELETE FROM post_categories WHERE post_id = ?",
+			"DELETE FROM post_tags WHERE post_id = ?",
+			"DELETE FROM post_views WHERE post_id = ?",
+			"DELETE FROM poll_votes WHERE poll_id IN (SELECT id FROM polls WHERE post_id = ?)",
+			"DELETE FROM poll_options WHERE poll_id IN (SELECT id FROM polls WHERE post_id = ?)",
+			"DELETE FROM polls WHERE post_id = ?",
+			"DELETE FROM posts WHERE id = ?",
+		}
+	case "comment":
+		statements = []string{
+			"DELETE FROM reactions WHERE comment_id = ?",
+			"DELETE FROM notifications WHERE comment_id = ?",
+			"DELETE FROM mentions WHERE comment_id = ?",
+			"UPDATE comments SET parent_id = NULL WHERE parent_id = ?",
+			"UPDATE posts SET accepted_comment_id = NULL WHERE accepted_comment_id = ?",
+			"DELETE FROM comments WHERE id = ?",
+		}
+	default:
+		return errContentNotFound
+	}
+
+	for _, stmt := range statements {
+		if _, err := tx.Exec(stmt, targetID); err != nil {
+			return err
+		}
+	}
+	if len(authorIDs) > 0 {
+		return recomputeReputation(tx, authorIDs...)
+	}
+	return nil
+}
+
+// getUserWarnings retrieves the warnings issued to a user, newest first
+func getUserWarnings(userID int) ([]Warning, error) {
+	rows, err := db.Query("SELECT id, reason, created FROM warnings WHERE user_id = ? ORDER BY created DESC", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	warnings := []Warning{}
+	for rows.Next() {
+		var warning Warning
+		if err := rows.Scan(&warning.ID, &warning.Reason, &warning.Created); err != nil {
+			return nil, err
+		}
+		warnings = append(warnings, warning)
+	}
+	return warnings, rows.Err()
+}
+
+// reportHandler handles flagging a post or comment
+func reportHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, ok := requireActiveUser(w, r)
+	if !ok {
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		ErrorResponse(w, http.StatusBadRequest, "Invalid form data")
+		return
+	}
+
+	targetType, targetID, err := parseContentTarget(r)
+	if err != nil {
+		ErrorResponse(w, http.StatusBadRequest, "Post ID or comment ID is required")
+		return
+	}
+
+	reason := r.FormValue("reason")
+	details := strings.TrimSpace(r.FormValue("details"))
+	if !reportReasons[reason] {
+		ErrorResponse(w, http.StatusBadRequest, "Invalid report reason")
+		return
+	}
+	if reason == "other" && details == "" {
+		ErrorResponse(w, http.StatusBadRequest, "Опишите причину жалобы")
+		return
+	}
+	if len([]rune(details)) > 500 {
+		ErrorResponse(w, http.StatusBadRequest, "Описание жалобы должно быть не длиннее 500 символов")
+		return
+	}
+
+	authorID, _, _, _, err := getContentInfo(targetType, targetID)
+	if err == errContentNotFound {
+		ErrorResponse(w, http.StatusNotFound, "Content not found")
+		return
+	} else if err != nil {
+		ErrorResponse(w, http.StatusInternalServerError, "Error processing report")
+		return
+	}
+	if authorID == user.ID {
+		ErrorResponse(w, http.StatusBadRequest, "Нельзя пожаловаться на собственный контент")
+		return
+	}
+
+	exists, err := hasOpenReport(user.ID, targetType, targetID)
+	if err != nil {
+		ErrorResponse(w, http.StatusInternalServerError, "Error processing report")
+		return
+	}
+	if exists {
+		ErrorResponse(w, http.StatusConflict, "Вы уже отправили жалобу на этот контент")
+		return
+	}
+
+	if err := createReport(user.ID, targetType, targetID, reason, details); err != nil {
+		ErrorResponse(w, http.StatusInternalServerError, "Error creating report")
+		return
+	}
+
+	JSONResponse(w, http.StatusCreated, map[string]string{"message": "Report submitted successfully"})
+}
+
+// reportQueueHandler lists open reports grouped by target for moderators
+func reportQueueHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if _, ok := requireModerator(w, r); !ok {
+		return
+	}
+
+	groups, err := getReportQueue()
+	if err != nil {
+		ErrorResponse(w, http.StatusInternalServerError, "Error retrieving reports")
+		return
+	}
+
+	JSONResponse(w, http.StatusOK, groups)
+}
+
+// moderationActionHandler applies a moderator action to a reported post or comment
+func moderationActionHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	moderator, ok := requireModerator(w, r)
+	if !ok {
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		ErrorResponse(w, http.StatusBadRequest, "Invalid form data")
+		return
+	}
+
+	targetType, targetID, err := parseContentTarget(r)
+	if err != nil {
+		ErrorResponse(w, http.StatusBadRequest, "Post ID or comment ID is required")
+		return
+	}
+
+	action := r.FormValue("action")
+	reason := strings.TrimSpace(r.FormValue("reason"))
+	if !moderationActions[action] {
+		ErrorResponse(w, http.StatusBadRequest, "Invalid moderation action")
+		return
+	}
+	if action == "warn" && reason == "" {
+		ErrorResponse(w, http.StatusBadRequest, "Укажите причину предупреждения")
+		return
+	}
+
+	err = applyModerationAction(moderator.ID, targetType, targetID, action, reason, clientIP(r))
+	if err == errContentNotFound {
+		ErrorResponse(w, http.StatusNotFound, "Content not found")
+		return
+	} else if err != nil {
+		ErrorResponse(w, http.StatusInternalServerError, "Error applying moderation action")
+		return
+	}
+
+	JSONResponse(w, http.StatusOK, map[string]string{"message": "Moderation action applied"})
+}
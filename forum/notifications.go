@@ -0,0 +1,505 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// notificationTypes lists the kinds of notifications a user can receive
+// and turn off individually
+var notificationTypes = []string{"comment", "reply", "mention", "like", "dislike", "thread", "answer"}
+
+// notificationFetchLimit is how many recent notifications are read before
+// they are collapsed into groups
+const notificationFetchLimit = 300
+
+// isNotificationType checks a notification type name
+func isNotificationType(name string) bool {
+	for _, t := range notificationTypes {
+		if t == name {
+			return true
+		}
+	}
+	return false
+}
+
+// notificationEnabled reports whether a user wants notifications of a type.
+// Every type is enabled until the user turns it off.
+func notificationEnabled(userID int, notificationType string) (bool, error) {
+	var enabled bool
+	err := db.QueryRow("SELECT enabled FROM notification_preferences WHERE user_id = ? AND type = ?",
+		userID, notificationType).Scan(&enabled)
+	if err == sql.ErrNoRows {
+		return true, nil
+	}
+	return enabled, err
+}
+
+// createNotification notifies a user about something another user did.
+// Nothing is stored for a user's own actions, for disabled types, or when
+// the same unread notification already exists.
+func createNotification(userID, actorID int, notificationType string, postID int, commentID *int) error {
+	if userID == actorID {
+		return nil
+	}
+
+	enabled, err := notificationEnabled(userID, notificationType)
+	if err != nil || !enabled {
+		return err
+	}
+
+	result, err := db.Exec(`
+		INSERT INTO notifications (user_id, actor_id, type, post_id, comment_id)
+		SELECT ?, ?, ?, ?, ?
+		WHERE NOT EXISTS (
+			SELECT 1 FROM notifications
+			WHERE user_id = ? AND actor_id = ? AND type = ? AND post_id = ? AND comment_id IS ? AND is_read = 0
+		)`,
+		userID, actorID, notificationType, postID, commentID,
+		userID, actorID, notificationType, postID, commentID)
+	if err != nil {
+		return err
+	}
+
+	if inserted, err := result.RowsAffected(); err == nil && inserted > 0 {
+		publishUnreadCount(userID)
+	}
+	return nil
+}
+
+// notifyNewComment tells the post author about a new comment, the author of
+// the parent comment about a reply, and the followers of the post
+func notifyNewComment(postID, commentID, authorID int, parentID *int) {
+	var postAuthorID int
+	if err := db.QueryRow("SELECT author_id FROM posts WHERE id = ?", postID).Scan(&postAuthorID); err != nil {
+		log.Printf("Notifications - error loading post %d: %v", postID, err)
+		return
+	}
+
+	parentAuthorID := 0
+	if parentID != nil {
+		if err := db.QueryRow("SELECT author_id FROM comments WHERE id = ?", *parentID).Scan(&parentAuthorID); err != nil {
+			log.Printf("Notifications - error loading comment %d: %v", *parentID, err)
+		}
+	}
+
+	// A post author replied to directly only gets the reply notification
+	if parentAuthorID != 0 {
+		if err := createNotification(parentAuthorID, authorID, "reply", postID, &commentID); err != nil {
+			log.Printf("Notifications - error creating reply notification: %v", err)
+		}
+	}
+	if postAuthorID != parentAuthorID {
+		if err := createNotification(postAuthorID, authorID, "comment", postID, &commentID); err != nil {
+			log.Printf("Notifications - error creating comment notification: %v", err)
+		}
+	}
+	notifyThreadFollowers(postID, commentID, authorID, postAuthorID, parentAuthorID)
+}
+
+// syncVoteNotification updates the vote notification of a post or comment
+// author after a user liked, disliked or withdrew their vote
+func syncVoteNotification(actorID, postID int, commentID *int) {
+	var authorID int
+	var err error
+	var liked, disliked *bool
+	if commentID != nil {
+		err = db.QueryRow("SELECT author_id FROM comments WHERE id = ?", *commentID).Scan(&authorID)
+		if err == nil {
+			liked, disliked, err = getUserCommentLikeStatus(actorID, *commentID)
+		}
+	} else {
+		err = db.QueryRow("SELECT author_id FROM posts WHERE id = ?", postID).Scan(&authorID)
+		if err == nil {
+			liked, disliked, err = getUserPostLikeStatus(actorID, postID)
+		}
+	}
+	if err != nil {
+		log.Printf("Notifications - error loading vote on post %d: %v", postID, err)
+		return
+	}
+
+	// Withdrawn or changed votes take back the unread notification
+	result, err := db.Exec(`
+		DELETE FROM notifications
+		WHERE actor_id = ? AND type IN ('like', 'dislike') AND post_id = ? AND comment_id IS ? AND is_read = 0`,
+		actorID, postID, commentID)
+	if err != nil {
+		log.Printf("Notifications - error removing vote notification: %v", err)
+		return
+	}
+	if removed, err := result.RowsAffected(); err == nil && removed > 0 {
+		publishUnreadCount(authorID)
+	}
+
+	switch {
+	case liked != nil && *liked:
+		err = createNotification(authorID, actorID, "like", postID, commentID)
+	case disliked != nil && *disliked:
+		err = createNotification(authorID, actorID, "dislike", postID, commentID)
+	}
+	if err != nil {
+		log.Printf("Notifications - error creating vote notification: %v", err)
+	}
+}
+
+// countUnreadNotifications counts a user's unread notifications about visible posts
+func countUnreadNotifications(userID int) (int, error) {
+	var count int
+	err := db.QueryRow(`
+		SELECT COUNT(*) FROM notifications n JOIN posts p ON n.post_id = p.id
+		WHERE n.user_id = ? AND n.is_read = 0 AND p.hidden = 0`, userID).Scan(&count)
+	return count, err
+}
+
+// getNotifications returns a user's recent notifications collapsed into
+// groups (same type, target and read state) plus the number of unread ones
+func getNotifications(userID int, unreadOnly bool) ([]NotificationGroup, int, error) {
+	unreadCount, err := countUnreadNotifications(userID)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	query := `
+		SELECT n.id, n.type, n.post_id, p.title, n.comment_id, u.username, n.is_read, n.created
+		FROM notifications n
+		JOIN posts p ON n.post_id = p.id
+		JOIN users u ON n.actor_id = u.id
+		WHERE n.user_id = ? AND p.hidden = 0`
+	if unreadOnly {
+		query += " AND n.is_read = 0"
+	}
+	query += " ORDER BY n.created DESC, n.id DESC LIMIT ?"
+
+	rows, err := db.Query(query, userID, notificationFetchLimit)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	groups := []NotificationGroup{}
+	index := make(map[string]int)
+	for rows.Next() {
+		var id, postID int
+		var notificationType, postTitle, actor string
+		var commentID sql.NullInt64
+		var read bool
+		var created time.Time
+		if err := rows.Scan(&id, &notificationType, &postID, &postTitle, &commentID, &actor, &read, &created); err != nil {
+			return nil, 0, err
+		}
+
+		// Comments and mentions in a post collapse per post; votes per voted item
+		target := ""
+		if commentID.Valid && (notificationType == "like" || notificationType == "dislike") {
+			target = strconv.FormatInt(commentID.Int64, 10)
+		}
+		key := fmt.Sprintf("%s/%d/%s/%t", notificationType, postID, target, read)
+
+		i, ok := index[key]
+		if !ok {
+			group := NotificationGroup{
+				Type:      notificationType,
+				PostID:    postID,
+				PostTitle: postTitle,
+				Read:      read,
+				Created:   created,
+				Actors:    []string{},
+			}
+			if commentID.Valid {
+				id := int(commentID.Int64)
+				group.CommentID = &id
+			}
+			groups = append(groups, group)
+			i = len(groups) - 1
+			index[key] = i
+		}
+
+		group := &groups[i]
+		group.IDs = append(group.IDs, id)
+		if !containsString(group.Actors, actor) {
+			group.Actors = append(group.Actors, actor)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, err
+	}
+
+	for i := range groups {
+		groups[i].Count = len(groups[i].IDs)
+		groups[i].ActorCount = len(groups[i].Actors)
+		groups[i].Message = notificationMessage(&groups[i])
+		if len(groups[i].Actors) > 3 {
+			groups[i].Actors = groups[i].Actors[:3]
+		}
+	}
+	return groups, unreadCount, nil
+}
+
+// notificationMessage summarizes a notification group, e.g.
+// "Ваш пост понравился 5 пользователям"
+func notificationMessage(group *NotificationGroup) string {
+	who := "пользователю " + group.Actors[0]
+	if len(group.Actors) > 1 {
+		who = fmt.Sprintf("%d пользователям", len(group.Actors))
+	}
+	target := "пост «" + group.PostTitle + "»"
+	if group.CommentID != nil && (group.Type == "like" || group.Type == "dislike") {
+		target = "комментарий"
+	}
+
+	switch group.Type {
+	case "like":
+		return fmt.Sprintf("Ваш %s понравился %s", target, who)
+	case "dislike":
+		return fmt.Sprintf("Ваш %s не понравился %s", target, who)
+	case "comment":
+		if group.Count == 1 {
+			return fmt.Sprintf("%s прокомментировал(а) ваш пост «%s»", group.Actors[0], group.PostTitle)
+		}
+		return fmt.Sprintf("%d %s к вашему посту «%s»", group.Count,
+			russianPlural(group.Count, "новый комментарий", "новых комментария", "новых комментариев"), group.PostTitle)
+	case "reply":
+		if group.Count == 1 {
+			return fmt.Sprintf("%s ответил(а) на ваш комментарий к посту «%s»", group.Actors[0], group.PostTitle)
+		}
+		return fmt.Sprintf("%d %s на ваши комментарии к посту «%s»", group.Count,
+			russianPlural(group.Count, "ответ", "ответа", "ответов"), group.PostTitle)
+	case "thread":
+		if group.Count == 1 {
+			return fmt.Sprintf("%s прокомментировал(а) отслеживаемое обсуждение «%s»", group.Actors[0], group.PostTitle)
+		}
+		return fmt.Sprintf("%d %s в отслеживаемом обсуждении «%s»", group.Count,
+			russianPlural(group.Count, "новый комментарий", "новых комментария", "новых комментариев"), group.PostTitle)
+	case "answer":
+		return fmt.Sprintf("%s принял(а) ваш ответ на вопрос «%s»", group.Actors[0], group.PostTitle)
+	case "mention":
+		if group.Count == 1 {
+			return fmt.Sprintf("%s упомянул(а) вас в посте «%s»", group.Actors[0], group.PostTitle)
+		}
+		return fmt.Sprintf("Вас упомянули %d %s в посте «%s»", group.Count,
+			russianPlural(group.Count, "раз", "раза", "раз"), group.PostTitle)
+	}
+	return ""
+}
+
+// russianPlural picks the Russian noun form for a count: one (1, 21),
+// few (2-4, 22-24) or many (5-20, 25-30, ...)
+func russianPlural(n int, one, few, many string) string {
+	n %= 100
+	switch {
+	case n%10 == 1 && n != 11:
+		return one
+	case n%10 >= 2 && n%10 <= 4 && (n < 12 || n > 14):
+		return few
+	default:
+		return many
+	}
+}
+
+// containsString reports whether a slice contains a string
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// markNotificationsRead marks some of a user's notifications as read
+func markNotificationsRead(userID int, ids []int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, id := range ids {
+		if _, err := tx.Exec("UPDATE notifications SET is_read = 1 WHERE id = ? AND user_id = ?", id, userID); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// markAllNotificationsRead marks every notification of a user as read
+func markAllNotificationsRead(userID int) error {
+	_, err := db.Exec("UPDATE notifications SET is_read = 1 WHERE user_id = ? AND is_read = 0", userID)
+	return err
+}
+
+// getNotificationPreferences returns whether each notification type is enabled for a user
+func getNotificationPreferences(userID int) (map[string]bool, error) {
+	preferences := make(map[string]bool)
+	for _, t := range notificationTypes {
+		preferences[t] = true
+	}
+
+	rows, err := db.Query("SELECT type, enabled FROM notification_preferences WHERE user_id = ?", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var notificationType string
+		var enabled bool
+		if err := rows.Scan(&notificationType, &enabled); err != nil {
+			return nil, err
+		}
+		preferences[notificationType] = enabled
+	}
+	return preferences, rows.Err()
+}
+
+// setNotificationPreference enables or disables a notification type for a user
+func setNotificationPreference(userID int, notificationType string, enabled bool) error {
+	_, err := db.Exec(`
+		INSERT INTO notification_preferences (user_id, type, enabled) VALUES (?, ?, ?)
+		ON CONFLICT (user_id, type) DO UPDATE SET enabled = excluded.enabled`,
+		userID, notificationType, enabled)
+	return err
+}
+
+// notificationsHandler lists the current user's notifications (?unread=1 for unread only)
+func notificationsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, err := getCurrentUser(r)
+	if err != nil {
+		ErrorResponse(w, http.StatusUnauthorized, "Authentication required")
+		return
+	}
+
+	unreadOnly := r.URL.Query().Get("unread") == "1" || r.URL.Query().Get("unread") == "true"
+	groups, unreadCount, err := getNotifications(user.ID, unreadOnly)
+	if err != nil {
+		ErrorResponse(w, http.StatusInternalServerError, "Error retrieving notifications")
+		return
+	}
+
+	JSONResponse(w, http.StatusOK, map[string]interface{}{
+		"unread_count":  unreadCount,
+		"notifications": groups,
+	})
+}
+
+// markNotificationsReadHandler marks the notifications listed in "ids"
+// (comma-separated) as read
+func markNotificationsReadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, ok := requireActiveUser(w, r)
+	if !ok {
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		ErrorResponse(w, http.StatusBadRequest, "Invalid form data")
+		return
+	}
+
+	var ids []int
+	for _, part := range strings.Split(r.FormValue("ids"), ",") {
+		if part = strings.TrimSpace(part); part == "" {
+			continue
+		}
+		id, err := strconv.Atoi(part)
+		if err != nil {
+			ErrorResponse(w, http.StatusBadRequest, "Invalid notification ID")
+			return
+		}
+		ids = append(ids, id)
+	}
+	if len(ids) == 0 {
+		ErrorResponse(w, http.StatusBadRequest, "Notification IDs are required")
+		return
+	}
+
+	if err := markNotificationsRead(user.ID, ids); err != nil {
+		ErrorResponse(w, http.StatusInternalServerError, "Error updating notifications")
+		return
+	}
+	publishUnreadCount(user.ID)
+
+	JSONResponse(w, http.StatusOK, map[string]string{"message": "Notifications marked as read"})
+}
+
+// markAllNotificationsReadHandler marks all of the current user's notifications as read
+func markAllNotificationsReadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, ok := requireActiveUser(w, r)
+	if !ok {
+		return
+	}
+
+	if err := markAllNotificationsRead(user.ID); err != nil {
+		ErrorResponse(w, http.StatusInternalServerError, "Error updating notifications")
+		return
+	}
+	publishUnreadCount(user.ID)
+
+	JSONResponse(w, http.StatusOK, map[string]string{"message": "All notifications marked as read"})
+}
+
+// notificationPreferencesHandler returns (GET) or changes (POST with
+// type=<type>&enabled=true|false) the current user's notification preferences
+func notificationPreferencesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Suspended users can see their preferences but not change them
+	user, ok := requireUserForMethod(w, r)
+	if !ok {
+		return
+	}
+
+	if r.Method == "POST" {
+		if err := r.ParseForm(); err != nil {
+			ErrorResponse(w, http.StatusBadRequest, "Invalid form data")
+			return
+		}
+
+		notificationType := r.FormValue("type")
+		if !isNotificationType(notificationType) {
+			ErrorResponse(w, http.StatusBadRequest, "Unknown notification type")
+			return
+		}
+		enabled, err := strconv.ParseBool(r.FormValue("enabled"))
+		if err != nil {
+			ErrorResponse(w, http.StatusBadRequest, "enabled must be true or false")
+			return
+		}
+
+		if err := setNotificationPreference(user.ID, notificationType, enabled); err != nil {
+			ErrorResponse(w, http.StatusInternalServerError, "Error updating preferences")
+			return
+		}
+	}
+
+	preferences, err := getNotificationPreferences(user.ID)
+	if err != nil {
+		ErrorResponse(w, http.StatusInternalServerError, "Error retrieving preferences")
+		return
+	}
+
+	JSONResponse(w, http.StatusOK, preferences)
+}
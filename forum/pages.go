@@ -0,0 +1,455 @@
+package main
+
+import (
+	"database/sql"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// pageData is what the server-rendered pages get. index.html is the layout;
+// each page template defines its "content". View and ViewValue tell app.js
+// what to open in place of the server-rendered content, so the pages work
+// without JavaScript and become the usual app with it.
+type pageData struct {
+	Title       string // Page title, before the forum name
+	Description string // Meta description
+	View        string // "posts", "category", "post", "profile" or "" to keep the page as is
+	ViewValue   string
+
+	User       *User
+	Categories []Category // Category tree for the sidebar
+	Error      string     // Why a submitted form was rejected
+	Form       url.Values // The submitted form, to fill it in again
+
+	Posts    []Post
+	Category string
+	Post     *Post
+	Comments []Comment
+	ReplyTo  *Comment // Comment the comment form answers
+	Profile  *PublicProfile
+	Next     string // Where to go after logging in
+
+	CategoryOptions []categoryOption // Categories to choose for a new post
+}
+
+// categoryOption is a category in the new post form, indented by its depth
+// in the tree
+type categoryOption struct {
+	Name    string
+	Depth   int
+	Checked bool
+}
+
+// categoryOptions flattens the category tree into the options of the new
+// post form, checking the selected ones
+func categoryOptions(categories []Category, depth int, selected []string) []categoryOption {
+	var options []categoryOption
+	for _, category := range categories {
+		options = append(options, categoryOption{category.Name, depth, containsString(selected, category.Name)})
+		options = append(options, categoryOptions(category.Children, depth+1, selected)...)
+	}
+	return options
+}
+
+// reactionCount is an emoji reaction given to a post or comment
+type reactionCount struct {
+	Emoji string
+	Count int
+}
+
+var pageFuncs = template.FuncMap{
+	// Post and comment HTML is rendered from Markdown and sanitized
+	"contentHTML": func(html string) template.HTML { return template.HTML(html) },
+	"date":        func(t time.Time) string { return t.Local().Format("02.01.2006 15:04") },
+	"day":         func(t time.Time) string { return t.Local().Format("02.01.2006") },
+	"excerpt":     excerpt,
+	"pathEscape":  url.PathEscape,
+	"isTrue":      func(b *bool) bool { return b != nil && *b },
+	"count": func(n *int) int {
+		if n == nil {
+			return 0
+		}
+		return *n
+	},
+	"emojiReactions": func(counts map[string]int) []reactionCount {
+		var reactions []reactionCount
+		for _, reaction := range appConfig.Reactions {
+			if counts[reaction.Key] > 0 {
+				reactions = append(reactions, reactionCount{reaction.Emoji, counts[reaction.Key]})
+			}
+		}
+		return reactions
+	},
+	"add": func(a, b int) int { return a + b },
+}
+
+// excerpt shortens text to at most n characters
+func excerpt(text string, n int) string {
+	text = strings.TrimSpace(text)
+	if utf8.RuneCountInString(text) <= n {
+		return text
+	}
+	return string([]rune(text)[:n]) + "..."
+}
+
+// renderPage renders a page template inside the index.html layout
+func renderPage(w http.ResponseWriter, status int, page string, data *pageData) {
+	tmpl, err := template.New("index.html").Funcs(pageFuncs).ParseFiles(
+		filepath.Join("templates", "index.html"), filepath.Join("templates", page))
+	if err != nil {
+		http.Error(w, "Template error", http.StatusInternalServerError)
+		log.Println("Template error:", err)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	if err := tmpl.Execute(w, data); err != nil {
+		log.Println("Template error:", err)
+	}
+}
+
+// newPageData starts the data of a page for the current user, with the
+// category tree for the sidebar
+func newPageData(r *http.Request) (*pageData, error) {
+	data := &pageData{}
+	if user, err := getCurrentUser(r); err == nil {
+		data.User = user
+	}
+	categories, err := getCategoryTree()
+	if err != nil {
+		return nil, err
+	}
+	data.Categories = categories
+	return data, nil
+}
+
+// userID returns the ID of the user viewing the page, nil for guests
+func (data *pageData) userID() *int {
+	if data.User == nil {
+		return nil
+	}
+	return &data.User.ID
+}
+
+// renderPageError answers 500 for a page that failed to load
+func renderPageError(w http.ResponseWriter, err error) {
+	log.Printf("Pages - error loading page: %v", err)
+	http.Error(w, "Error loading page", http.StatusInternalServerError)
+}
+
+// redirectToLogin sends guests to the login page, returning to the current
+// page afterwards
+func redirectToLogin(w http.ResponseWriter, r *http.Request) {
+	http.Redirect(w, r, "/login?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusSeeOther)
+}
+
+// homeHandler renders the list of all posts
+func homeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		renderError(w, "Страница не найдена")
+		return
+	}
+
+	data, err := newPageData(r)
+	if err != nil {
+		renderPageError(w, err)
+		return
+	}
+	data.Posts, err = getPosts(data.userID(), "", "")
+	if err != nil {
+		renderPageError(w, err)
+		return
+	}
+	data.Description = "Форум: обсуждения, вопросы и ответы"
+	data.View = "posts"
+	renderPage(w, http.StatusOK, "posts.html", data)
+}
+
+// categoryPageHandler renders the posts of a category and its
+// sub-categories (/category/{name})
+func categoryPageHandler(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/category/")
+	categories, err := getCategories()
+	if err != nil {
+		renderPageError(w, err)
+		return
+	}
+	found := false
+	for _, category := range categories {
+		found = found || category.Name == name
+	}
+	if !found {
+		renderError(w, "Категория не найдена")
+		return
+	}
+
+	data, err := newPageData(r)
+	if err != nil {
+		renderPageError(w, err)
+		return
+	}
+	data.Posts, err = getPosts(data.userID(), "category", name)
+	if err != nil {
+		renderPageError(w, err)
+		return
+	}
+	data.Title = name
+	data.Description = "Посты в категории «" + name + "»"
+	data.Category = name
+	data.View, data.ViewValue = "category", name
+	renderPage(w, http.StatusOK, "posts.html", data)
+}
+
+// postPageHandler renders a post with its comments (/post/{id}). POST adds a
+// comment from the form under the post and returns to it.
+func postPageHandler(w http.ResponseWriter, r *http.Request) {
+	postID, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/post/"))
+	if err != nil {
+		renderError(w, "Страница не найдена")
+		return
+	}
+	if r.Method != "GET" && r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	data, err := newPageData(r)
+	if err != nil {
+		renderPageError(w, err)
+		return
+	}
+
+	status := http.StatusOK
+	if r.Method == "POST" {
+		if data.User == nil {
+			redirectToLogin(w, r)
+			return
+		}
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, "Invalid form data", http.StatusBadRequest)
+			return
+		}
+		r.Form.Set("post_id", strconv.Itoa(postID))
+		commentID, err := addComment(data.User, r.Form)
+		if err == nil {
+			http.Redirect(w, r, "/post/"+strconv.Itoa(postID)+"#comment-"+strconv.FormatInt(commentID, 10), http.StatusSeeOther)
+			return
+		}
+		reqErr, ok := err.(*requestError)
+		if !ok {
+			renderPageError(w, err)
+			return
+		}
+		status, data.Error, data.Form = reqErr.status, reqErr.message, r.Form
+	}
+
+	data.Post, err = getPost(data.userID(), postID)
+	if err == sql.ErrNoRows {
+		renderError(w, "Пост не найден")
+		return
+	}
+	if err != nil {
+		renderPageError(w, err)
+		return
+	}
+	data.Comments, err = getComments(postID, data.userID())
+	if err != nil {
+		renderPageError(w, err)
+		return
+	}
+	if err := recordPostVisit(r, data.userID(), postID, data.Comments); err != nil {
+		renderPageError(w, err)
+		return
+	}
+
+	// ?reply={comment id} turns the comment form into a reply
+	replyTo := r.FormValue("reply")
+	if replyTo == "" {
+		replyTo = r.FormValue("parent_id")
+	}
+	for i := range data.Comments {
+		if strconv.Itoa(data.Comments[i].ID) == replyTo {
+			data.ReplyTo = &data.Comments[i]
+		}
+	}
+
+	data.Title = data.Post.Title
+	data.Description = excerpt(data.Post.Content, 160)
+	data.View, data.ViewValue = "post", strconv.Itoa(postID)
+	renderPage(w, status, "post.html", data)
+}
+
+// addComment validates and publishes a comment for a user who must not be
+// suspended
+func addComment(user *User, form url.Values) (int64, error) {
+	if err := suspensionError(user); err != nil {
+		return 0, err
+	}
+	input, err := prepareComment(user, form)
+	if err != nil {
+		return 0, err
+	}
+	return publishComment(user, input)
+}
+
+// userPageHandler renders a user's public profile (/user/{id}?page=)
+func userPageHandler(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/user/"))
+	if err != nil {
+		renderError(w, "Страница не найдена")
+		return
+	}
+	page, err := strconv.Atoi(r.URL.Query().Get("page"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+
+	data, err := newPageData(r)
+	if err != nil {
+		renderPageError(w, err)
+		return
+	}
+	data.Profile, err = getPublicProfile(userID, page)
+	if err == sql.ErrNoRows {
+		renderError(w, "Пользователь не найден")
+		return
+	}
+	if err != nil {
+		renderPageError(w, err)
+		return
+	}
+
+	data.Title = data.Profile.Username
+	data.Description = "Профиль пользователя " + data.Profile.Username
+	if data.Profile.Bio != "" {
+		data.Description = excerpt(data.Profile.Bio, 160)
+	}
+	data.View, data.ViewValue = "profile", strconv.Itoa(userID)
+	renderPage(w, http.StatusOK, "profile.html", data)
+}
+
+// newPostPageHandler renders the form for a new post (/new) and creates the
+// post when it is submitted
+func newPostPageHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	data, err := newPageData(r)
+	if err != nil {
+		renderPageError(w, err)
+		return
+	}
+	if data.User == nil {
+		redirectToLogin(w, r)
+		return
+	}
+	data.Title = "Новый пост"
+
+	status := http.StatusOK
+	if r.Method == "POST" {
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, "Invalid form data", http.StatusBadRequest)
+			return
+		}
+		// The form has a checkbox per category; the API takes a list
+		r.Form.Set("categories", strings.Join(r.Form["category"], ","))
+		postID, err := addPost(data.User, r.Form)
+		if err == nil {
+			http.Redirect(w, r, "/post/"+strconv.FormatInt(postID, 10), http.StatusSeeOther)
+			return
+		}
+		reqErr, ok := err.(*requestError)
+		if !ok {
+			renderPageError(w, err)
+			return
+		}
+		status, data.Error, data.Form = reqErr.status, reqErr.message, r.Form
+	}
+
+	data.CategoryOptions = categoryOptions(data.Categories, 0, data.Form["category"])
+	renderPage(w, status, "new_post.html", data)
+}
+
+// addPost validates and publishes a post for a user who must not be
+// suspended
+func addPost(user *User, form url.Values) (int64, error) {
+	if err := suspensionError(user); err != nil {
+		return 0, err
+	}
+	input, err := preparePost(user, form)
+	if err != nil {
+		return 0, err
+	}
+	return publishPost(user, input)
+}
+
+// safeRedirect keeps redirects after logging in on this site
+func safeRedirect(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return "/"
+	}
+	return next
+}
+
+// loginPageHandler renders the login form (/login?next=) and logs the user
+// in when it is submitted
+func loginPageHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	data, err := newPageData(r)
+	if err != nil {
+		renderPageError(w, err)
+		return
+	}
+	data.Title = "Вход"
+	data.Next = safeRedirect(r.FormValue("next"))
+
+	status := http.StatusOK
+	if r.Method == "POST" {
+		_, err := logIn(w, r, r.FormValue("email"), r.FormValue("password"))
+		if err == nil {
+			http.Redirect(w, r, data.Next, http.StatusSeeOther)
+			return
+		}
+		reqErr, ok := err.(*requestError)
+		if !ok {
+			renderPageError(w, err)
+			return
+		}
+		status, data.Error, data.Form = reqErr.status, reqErr.message, r.Form
+		switch status {
+		case http.StatusBadRequest:
+			data.Error = "Введите email и пароль"
+		case http.StatusUnauthorized:
+			data.Error = "Неверный email или пароль"
+		}
+	}
+
+	renderPage(w, status, "login.html", data)
+}
+
+// logoutPageHandler ends the session from the logout form and returns to
+// the post list
+func logoutPageHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if cookie, err := r.Cookie("session_id"); err == nil {
+		deleteSession(cookie.Value)
+	}
+	clearSessionCookie(w)
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
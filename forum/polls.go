@@ -0,0 +1,335 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	minPollOptions        = 2
+	maxPollOptions        = 10
+	maxPollQuestionLength = 200
+	maxPollOptionLength   = 100
+)
+
+var (
+	errPollClosed        = errors.New("poll closed")
+	errPollInvalidChoice = errors.New("invalid poll choice")
+)
+
+// pollResultModes lists when poll results are shown: always, once the user
+// voted, or only after the poll closed
+var pollResultModes = []string{"always", "after_vote", "after_close"}
+
+// pollInput is a poll submitted together with a new post
+type pollInput struct {
+	Question string
+	Options  []string
+	Multiple bool
+	Results  string
+	ClosesAt *time.Time
+}
+
+// parsePollForm reads the optional poll of a new post from the form fields
+// poll_question, poll_option (repeated), poll_multiple, poll_results and
+// poll_closes. It returns nil without a question; errors are user-facing.
+func parsePollForm(form url.Values) (*pollInput, error) {
+	question := strings.TrimSpace(form.Get("poll_question"))
+	if question == "" {
+		return nil, nil
+	}
+	if utf8.RuneCountInString(question) > maxPollQuestionLength {
+		return nil, errors.New("Вопрос опроса должен быть не длиннее 200 символов")
+	}
+
+	poll := &pollInput{
+		Question: question,
+		Multiple: form.Get("poll_multiple") == "true",
+		Results:  form.Get("poll_results"),
+	}
+	for _, option := range form["poll_option"] {
+		option = strings.TrimSpace(option)
+		if option == "" {
+			continue
+		}
+		if utf8.RuneCountInString(option) > maxPollOptionLength {
+			return nil, errors.New("Вариант ответа должен быть не длиннее 100 символов")
+		}
+		if containsString(poll.Options, option) {
+			return nil, errors.New("Варианты ответа не должны повторяться")
+		}
+		poll.Options = append(poll.Options, option)
+	}
+	if len(poll.Options) < minPollOptions || len(poll.Options) > maxPollOptions {
+		return nil, errors.New("В опросе должно быть от 2 до 10 вариантов ответа")
+	}
+
+	if poll.Results == "" {
+		poll.Results = "always"
+	}
+	if !containsString(pollResultModes, poll.Results) {
+		return nil, errors.New("Неизвестный режим показа результатов")
+	}
+
+	if value := form.Get("poll_closes"); value != "" {
+		closesAt, err := parseTimeParam(value)
+		if err != nil {
+			return nil, errors.New("Некорректное время закрытия опроса")
+		}
+		if !closesAt.After(time.Now()) {
+			return nil, errors.New("Время закрытия опроса должно быть в будущем")
+		}
+		poll.ClosesAt = &closesAt
+	}
+	if poll.Results == "after_close" && poll.ClosesAt == nil {
+		return nil, errors.New("Чтобы скрыть результаты до закрытия, укажите время закрытия опроса")
+	}
+	return poll, nil
+}
+
+// createPoll stores the poll of a new post
+func createPoll(tx *sql.Tx, postID int64, poll *pollInput) error {
+	var closesAt interface{}
+	if poll.ClosesAt != nil {
+		closesAt = poll.ClosesAt.UTC().Format(sqliteTimeLayout)
+	}
+	result, err := tx.Exec("INSERT INTO polls (post_id, question, multiple, results, closes_at) VALUES (?, ?, ?, ?, ?)",
+		postID, poll.Question, poll.Multiple, poll.Results, closesAt)
+	if err != nil {
+		return err
+	}
+	pollID, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+
+	for i, option := range poll.Options {
+		if _, err := tx.Exec("INSERT INTO poll_options (poll_id, position, text) VALUES (?, ?, ?)", pollID, i, option); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// getPoll loads the poll of a post, or nil when it has none. Vote counts
+// are only filled in when the results are visible to the user.
+func getPoll(postID int, userID *int) (*Poll, error) {
+	poll := &Poll{}
+	var closesAt sql.NullTime
+	err := db.QueryRow("SELECT id, question, multiple, results, closes_at FROM polls WHERE post_id = ?", postID).
+		Scan(&poll.ID, &poll.Question, &poll.Multiple, &poll.Results, &closesAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if closesAt.Valid {
+		poll.ClosesAt = &closesAt.Time
+		poll.Closed = !closesAt.Time.After(time.Now())
+	}
+
+	rows, err := db.Query(`
+		SELECT o.id, o.text, (SELECT COUNT(*) FROM poll_votes v WHERE v.option_id = o.id)
+		FROM poll_options o WHERE o.poll_id = ? ORDER BY o.position`, poll.ID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var counts []int
+	for rows.Next() {
+		var option PollOption
+		var count int
+		if err := rows.Scan(&option.ID, &option.Text, &count); err != nil {
+			return nil, err
+		}
+		poll.Options = append(poll.Options, option)
+		counts = append(counts, count)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	poll.UserVotes = []int{}
+	if userID != nil {
+		voteRows, err := db.Query("SELECT option_id FROM poll_votes WHERE poll_id = ? AND user_id = ?", poll.ID, *userID)
+		if err != nil {
+			return nil, err
+		}
+		defer voteRows.Close()
+		for voteRows.Next() {
+			var optionID int
+			if err := voteRows.Scan(&optionID); err != nil {
+				return nil, err
+			}
+			poll.UserVotes = append(poll.UserVotes, optionID)
+		}
+		if err := voteRows.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	switch poll.Results {
+	case "after_vote":
+		poll.ResultsVisible = poll.Closed || len(poll.UserVotes) > 0
+	case "after_close":
+		poll.ResultsVisible = poll.Closed
+	default:
+		poll.ResultsVisible = true
+	}
+	if poll.ResultsVisible {
+		for i := range poll.Options {
+			poll.Options[i].Votes = &counts[i]
+		}
+		var voters int
+		if err := db.QueryRow("SELECT COUNT(DISTINCT user_id) FROM poll_votes WHERE poll_id = ?", poll.ID).Scan(&voters); err != nil {
+			return nil, err
+		}
+		poll.Voters = &voters
+	}
+	return poll, nil
+}
+
+// castPollVote replaces a user's ballot in a poll with the chosen options
+func castPollVote(pollID, userID int, optionIDs []int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var multiple bool
+	var closesAt sql.NullTime
+	if err := tx.QueryRow("SELECT multiple, closes_at FROM polls WHERE id = ?", pollID).Scan(&multiple, &closesAt); err != nil {
+		return err
+	}
+	if closesAt.Valid && !closesAt.Time.After(time.Now()) {
+		return errPollClosed
+	}
+	if len(optionIDs) == 0 || (!multiple && len(optionIDs) > 1) {
+		return errPollInvalidChoice
+	}
+
+	seen := make(map[int]bool)
+	for _, optionID := range optionIDs {
+		var count int
+		if err := tx.QueryRow("SELECT COUNT(*) FROM poll_options WHERE id = ? AND poll_id = ?", optionID, pollID).Scan(&count); err != nil {
+			return err
+		}
+		if count == 0 || seen[optionID] {
+			return errPollInvalidChoice
+		}
+		seen[optionID] = true
+	}
+
+	if _, err := tx.Exec("DELETE FROM poll_votes WHERE poll_id = ? AND user_id = ?", pollID, userID); err != nil {
+		return err
+	}
+	for _, optionID := range optionIDs {
+		if _, err := tx.Exec("INSERT INTO poll_votes (poll_id, option_id, user_id) VALUES (?, ?, ?)", pollID, optionID, userID); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// retractPollVote removes a user's ballot from an open poll
+func retractPollVote(pollID, userID int) error {
+	var closesAt sql.NullTime
+	if err := db.QueryRow("SELECT closes_at FROM polls WHERE id = ?", pollID).Scan(&closesAt); err != nil {
+		return err
+	}
+	if closesAt.Valid && !closesAt.Time.After(time.Now()) {
+		return errPollClosed
+	}
+	_, err := db.Exec("DELETE FROM poll_votes WHERE poll_id = ? AND user_id = ?", pollID, userID)
+	return err
+}
+
+// pollHandler votes in a poll (POST /api/polls/{id}/vote with one or more
+// option_id values) or retracts the vote (DELETE /api/polls/{id}/vote)
+func pollHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" && r.Method != "DELETE" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// pathParts = ["api", "polls", "5", "vote"]
+	pathParts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(pathParts) != 4 || pathParts[3] != "vote" {
+		ErrorResponse(w, http.StatusNotFound, "Not found")
+		return
+	}
+	pollID, err := strconv.Atoi(pathParts[2])
+	if err != nil {
+		ErrorResponse(w, http.StatusBadRequest, "Invalid poll ID")
+		return
+	}
+
+	user, ok := requireActiveUser(w, r)
+	if !ok {
+		return
+	}
+
+	var postID int
+	err = db.QueryRow("SELECT p.id FROM polls pl JOIN posts p ON pl.post_id = p.id WHERE pl.id = ? AND p.hidden = 0", pollID).Scan(&postID)
+	if err == sql.ErrNoRows {
+		ErrorResponse(w, http.StatusNotFound, "Poll not found")
+		return
+	} else if err != nil {
+		ErrorResponse(w, http.StatusInternalServerError, "Error processing vote")
+		return
+	}
+	// Like comments and votes, polls of locked posts are frozen
+	if !checkPostOpen(w, postID) {
+		return
+	}
+
+	if r.Method == "DELETE" {
+		err = retractPollVote(pollID, user.ID)
+	} else {
+		if err := r.ParseForm(); err != nil {
+			ErrorResponse(w, http.StatusBadRequest, "Invalid form data")
+			return
+		}
+		var optionIDs []int
+		for _, value := range r.Form["option_id"] {
+			optionID, err := strconv.Atoi(value)
+			if err != nil {
+				ErrorResponse(w, http.StatusBadRequest, "Invalid option ID")
+				return
+			}
+			optionIDs = append(optionIDs, optionID)
+		}
+		err = castPollVote(pollID, user.ID, optionIDs)
+	}
+	switch {
+	case err == errPollClosed:
+		ErrorResponse(w, http.StatusBadRequest, "Опрос закрыт")
+		return
+	case err == errPollInvalidChoice:
+		ErrorResponse(w, http.StatusBadRequest, "Выберите один вариант ответа или несколько, если опрос это позволяет")
+		return
+	case err != nil:
+		log.Printf("Polls - error voting in poll %d: %v", pollID, err)
+		ErrorResponse(w, http.StatusInternalServerError, "Error processing vote")
+		return
+	}
+
+	events.publish("poll", map[string]interface{}{"post_id": postID, "poll_id": pollID}, postTopic(postID))
+
+	poll, err := getPoll(postID, &user.ID)
+	if err != nil {
+		ErrorResponse(w, http.StatusInternalServerError, "Error retrieving poll")
+		return
+	}
+	JSONResponse(w, http.StatusOK, poll)
+}
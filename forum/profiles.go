@@ -0,0 +1,365 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// avatarSize is the width and height of stored avatars and identicons
+	avatarSize = 256
+	// activityPageSize is the number of activity items per profile page
+	activityPageSize  = 20
+	maxBioLength      = 500
+	maxLocationLength = 100
+)
+
+// avatarURL returns the public URL of a user's avatar. The version parameter
+// changes with every upload so browsers don't keep showing the old picture.
+func avatarURL(user *User) string {
+	url := fmt.Sprintf("/api/users/%d/avatar", user.ID)
+	if user.AvatarKey != "" {
+		url += "?v=" + user.AvatarKey[strings.LastIndex(user.AvatarKey, "/")+1:]
+	}
+	return url
+}
+
+// updateProfile saves the editable profile fields of a user
+func updateProfile(userID int, bio, location string) error {
+	_, err := db.Exec("UPDATE users SET bio = ?, location = ? WHERE id = ?", bio, location, userID)
+	return err
+}
+
+// setAvatarKey replaces the avatar of a user and returns the previous key
+func setAvatarKey(userID int, key string) (string, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	var oldKey string
+	if err := tx.QueryRow("SELECT avatar_key FROM users WHERE id = ?", userID).Scan(&oldKey); err != nil {
+		return "", err
+	}
+	if _, err := tx.Exec("UPDATE users SET avatar_key = ? WHERE id = ?", key, userID); err != nil {
+		return "", err
+	}
+	return oldKey, tx.Commit()
+}
+
+// getPublicProfile collects a user's public details, counters and one page of activity
+func getPublicProfile(userID, page int) (*PublicProfile, error) {
+	user, err := getUserByID(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	profile := &PublicProfile{
+		ID:         user.ID,
+		Username:   user.Username,
+		Role:       user.Role,
+		Bio:        user.Bio,
+		Location:   user.Location,
+		AvatarURL:  avatarURL(user),
+		Reputation: user.Reputation,
+		TrustLevel: effectiveTrustLevel(user).Level,
+		TrustName:  effectiveTrustLevel(user).Name,
+		Created:    user.Created,
+		Page:       page,
+	}
+
+	err = db.QueryRow(`
+		SELECT
+			(SELECT COUNT(*) FROM posts WHERE author_id = ? AND hidden = 0),
+			(SELECT COUNT(*) FROM comments WHERE author_id = ? AND hidden = 0),
+			(SELECT COUNT(*) FROM reactions l
+				LEFT JOIN posts p ON l.post_id = p.id
+				LEFT JOIN comments c ON l.comment_id = c.id
+				WHERE l.reaction = 'like' AND (p.author_id = ? OR c.author_id = ?))`,
+		userID, userID, userID, userID).Scan(&profile.PostCount, &profile.CommentCount, &profile.LikesReceived)
+	if err != nil {
+		return nil, err
+	}
+
+	profile.Badges, err = getUserBadges(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	profile.Activity, profile.HasMore, err = getUserActivity(userID, page)
+	if err != nil {
+		return nil, err
+	}
+	return profile, nil
+}
+
+// getUserActivity lists a user's visible posts and comments, newest first
+func getUserActivity(userID, page int) ([]ActivityItem, bool, error) {
+	rows, err := db.Query(`
+		SELECT 'post', p.id, p.id, p.title, p.content, p.created
+		FROM posts p
+		WHERE p.author_id = ? AND p.hidden = 0
+		UNION ALL
+		SELECT 'comment', c.id, c.post_id, p.title, c.content, c.created
+		FROM comments c
+		JOIN posts p ON c.post_id = p.id
+		WHERE c.author_id = ? AND c.hidden = 0 AND p.hidden = 0
+		ORDER BY 6 DESC
+		LIMIT ? OFFSET ?`,
+		userID, userID, activityPageSize+1, (page-1)*activityPageSize)
+	if err != nil {
+		return nil, false, err
+	}
+	defer rows.Close()
+
+	activity := []ActivityItem{}
+	for rows.Next() {
+		var item ActivityItem
+		var content string
+		if err := rows.Scan(&item.Type, &item.ID, &item.PostID, &item.PostTitle, &content, &item.Created); err != nil {
+			return nil, false, err
+		}
+		item.Excerpt = truncateRunes(content, 200)
+		activity = append(activity, item)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, false, err
+	}
+
+	hasMore := len(activity) > activityPageSize
+	if hasMore {
+		activity = activity[:activityPageSize]
+	}
+	return activity, hasMore, nil
+}
+
+// processAvatar crops an uploaded image to a square and scales it to avatarSize
+func processAvatar(data []byte) ([]byte, string, error) {
+	mimeType, _, _ := mime.ParseMediaType(http.DetectContentType(data))
+	if mimeType != "image/jpeg" && mimeType != "image/png" && mimeType != "image/gif" {
+		return nil, "", errUnsupportedFileType
+	}
+
+	img, err := decodeImage(data)
+	if err == errImageTooLarge {
+		return nil, "", err
+	} else if err != nil {
+		return nil, "", errInvalidImage
+	}
+
+	// Animated GIFs keep only their first frame
+	if mimeType != "image/jpeg" {
+		mimeType = "image/png"
+	}
+	encoded, err := encodeImage(resizeImage(cropSquare(img), avatarSize, avatarSize), mimeType)
+	return encoded, mimeType, err
+}
+
+// usersHandler serves public profiles (/api/users/{id}) and avatars (/api/users/{id}/avatar)
+func usersHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// pathParts = ["api", "users", "5"] or ["api", "users", "5", "avatar"]
+	pathParts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(pathParts) < 3 || len(pathParts) > 4 || (len(pathParts) == 4 && pathParts[3] != "avatar") {
+		ErrorResponse(w, http.StatusNotFound, "Not found")
+		return
+	}
+	userID, err := strconv.Atoi(pathParts[2])
+	if err != nil {
+		ErrorResponse(w, http.StatusBadRequest, "Invalid user ID")
+		return
+	}
+
+	if len(pathParts) == 4 {
+		serveAvatar(w, r, userID)
+		return
+	}
+
+	page := 1
+	if value := r.URL.Query().Get("page"); value != "" {
+		page, err = strconv.Atoi(value)
+		if err != nil || page < 1 {
+			ErrorResponse(w, http.StatusBadRequest, "Invalid page")
+			return
+		}
+	}
+
+	profile, err := getPublicProfile(userID, page)
+	if err == sql.ErrNoRows {
+		ErrorResponse(w, http.StatusNotFound, "User not found")
+		return
+	}
+	if err != nil {
+		ErrorResponse(w, http.StatusInternalServerError, "Error retrieving profile")
+		return
+	}
+
+	JSONResponse(w, http.StatusOK, profile)
+}
+
+// serveAvatar writes a user's uploaded avatar, or their identicon if they have none
+func serveAvatar(w http.ResponseWriter, r *http.Request, userID int) {
+	user, err := getUserByID(userID)
+	if err != nil {
+		ErrorResponse(w, http.StatusNotFound, "User not found")
+		return
+	}
+
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+
+	if user.AvatarKey != "" {
+		reader, err := blobs.Get(r.Context(), user.AvatarKey)
+		if err == nil {
+			defer reader.Close()
+			contentType := "image/png"
+			if strings.HasSuffix(user.AvatarKey, ".jpg") {
+				contentType = "image/jpeg"
+			}
+			w.Header().Set("Content-Type", contentType)
+			io.Copy(w, reader)
+			return
+		}
+		log.Printf("Avatar of user %d - error reading blob %s: %v", userID, user.AvatarKey, err)
+	}
+
+	data, err := encodeImage(identicon(user.Username, avatarSize), "image/png")
+	if err != nil {
+		ErrorResponse(w, http.StatusInternalServerError, "Error generating avatar")
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Write(data)
+}
+
+// profileHandler updates the bio and location of the current user
+func profileHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, ok := requireActiveUser(w, r)
+	if !ok {
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		ErrorResponse(w, http.StatusBadRequest, "Invalid form data")
+		return
+	}
+
+	bio := strings.TrimSpace(r.FormValue("bio"))
+	location := strings.TrimSpace(r.FormValue("location"))
+	if utf8.RuneCountInString(bio) > maxBioLength {
+		ErrorResponse(w, http.StatusBadRequest, "Описание профиля не должно превышать 500 символов")
+		return
+	}
+	if utf8.RuneCountInString(location) > maxLocationLength || strings.ContainsAny(location, "\r\n") {
+		ErrorResponse(w, http.StatusBadRequest, "Местоположение должно быть одной строкой до 100 символов")
+		return
+	}
+
+	if err := updateProfile(user.ID, bio, location); err != nil {
+		ErrorResponse(w, http.StatusInternalServerError, "Error updating profile")
+		return
+	}
+
+	JSONResponse(w, http.StatusOK, map[string]string{"message": "Profile updated successfully"})
+}
+
+// avatarHandler uploads (POST, multipart field "avatar") or removes (DELETE)
+// the avatar of the current user
+func avatarHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" && r.Method != "DELETE" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, ok := requireActiveUser(w, r)
+	if !ok {
+		return
+	}
+
+	newKey := ""
+	if r.Method == "POST" {
+		maxBytes := appConfig.MaxUploadBytes
+		r.Body = http.MaxBytesReader(w, r.Body, maxBytes+64<<10)
+		if err := r.ParseMultipartForm(maxBytes); err != nil {
+			ErrorResponse(w, http.StatusRequestEntityTooLarge, "Файл слишком большой")
+			return
+		}
+		defer r.MultipartForm.RemoveAll()
+
+		file, _, err := r.FormFile("avatar")
+		if err != nil {
+			ErrorResponse(w, http.StatusBadRequest, "Avatar file is required")
+			return
+		}
+		defer file.Close()
+
+		data, err := io.ReadAll(io.LimitReader(file, maxBytes+1))
+		if err != nil || int64(len(data)) > maxBytes {
+			ErrorResponse(w, http.StatusRequestEntityTooLarge, "Файл слишком большой")
+			return
+		}
+
+		avatar, mimeType, err := processAvatar(data)
+		switch {
+		case err == errUnsupportedFileType:
+			ErrorResponse(w, http.StatusUnsupportedMediaType, "Аватар должен быть изображением JPEG, PNG или GIF")
+			return
+		case err == errImageTooLarge:
+			ErrorResponse(w, http.StatusBadRequest, "Слишком большое разрешение изображения")
+			return
+		case err == errInvalidImage:
+			ErrorResponse(w, http.StatusBadRequest, "Не удалось обработать изображение")
+			return
+		case err != nil:
+			ErrorResponse(w, http.StatusInternalServerError, "Error processing avatar")
+			return
+		}
+
+		extension := ".png"
+		if mimeType == "image/jpeg" {
+			extension = ".jpg"
+		}
+		newKey = "avatars/" + uuid.New().String() + extension
+		if err := blobs.Put(r.Context(), newKey, avatar, mimeType); err != nil {
+			log.Printf("Avatar upload error: %v", err)
+			ErrorResponse(w, http.StatusInternalServerError, "Error storing avatar")
+			return
+		}
+	}
+
+	oldKey, err := setAvatarKey(user.ID, newKey)
+	if err != nil {
+		if newKey != "" {
+			blobs.Delete(r.Context(), newKey)
+		}
+		ErrorResponse(w, http.StatusInternalServerError, "Error updating avatar")
+		return
+	}
+	if oldKey != "" {
+		if err := blobs.Delete(r.Context(), oldKey); err != nil {
+			log.Printf("Avatar of user %d - error deleting blob %s: %v", user.ID, oldKey, err)
+		}
+	}
+
+	user.AvatarKey = newKey
+	JSONResponse(w, http.StatusOK, map[string]string{"avatar_url": avatarURL(user)})
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+// isQuestionSQL decides whether the post p is a question: it is one when
+// any of its categories is a Q&A category
+const isQuestionSQL = `EXISTS (
+		SELECT 1 FROM post_categories qpc JOIN categories qc ON qpc.category_id = qc.id
+		WHERE qpc.post_id = p.id AND qc.qa = 1
+	)`
+
+// getQuestionStatus tells whether a post is a question and which comment is
+// its accepted answer (0 for none)
+func getQuestionStatus(postID int) (bool, int, error) {
+	var isQuestion bool
+	var acceptedID sql.NullInt64
+	err := db.QueryRow("SELECT "+isQuestionSQL+", p.accepted_comment_id FROM posts p WHERE p.id = ?", postID).
+		Scan(&isQuestion, &acceptedID)
+	return isQuestion, int(acceptedID.Int64), err
+}
+
+// setAcceptedAnswer marks a comment as the accepted answer of its post, or
+// clears the accepted answer when commentID is nil. Moderators acting on
+// someone else's question are recorded in the audit log.
+func setAcceptedAnswer(actorID, postAuthorID, postID int, commentID *int, ip string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var before sql.NullInt64
+	if err := tx.QueryRow("SELECT accepted_comment_id FROM posts WHERE id = ?", postID).Scan(&before); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("UPDATE posts SET accepted_comment_id = ? WHERE id = ?", commentID, postID); err != nil {
+		return err
+	}
+
+	if actorID != postAuthorID {
+		var beforeValue interface{}
+		if before.Valid {
+			beforeValue = map[string]interface{}{"accepted_comment_id": before.Int64}
+		}
+		var afterValue interface{}
+		if commentID != nil {
+			afterValue = map[string]interface{}{"accepted_comment_id": *commentID}
+		}
+		if err := recordAudit(tx, actorID, "post.accept_answer", "post", postID, beforeValue, afterValue, "", ip); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// setCategoryQA turns Q&A mode of a category on or off
+func setCategoryQA(moderatorID, categoryID int, qa bool, ip string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var before bool
+	if err := tx.QueryRow("SELECT qa FROM categories WHERE id = ?", categoryID).Scan(&before); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("UPDATE categories SET qa = ? WHERE id = ?", qa, categoryID); err != nil {
+		return err
+	}
+
+	if err := recordAudit(tx, moderatorID, "category.qa", "category", categoryID,
+		map[string]bool{"qa": before}, map[string]bool{"qa": qa}, "", ip); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// acceptedAnswerHandler lets the author of a question or a moderator accept
+// a comment as the answer (POST comment_id=) or clear it (DELETE ?post_id=)
+func acceptedAnswerHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" && r.Method != "DELETE" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, ok := requireActiveUser(w, r)
+	if !ok {
+		return
+	}
+
+	var postID int
+	var commentID *int
+	if r.Method == "POST" {
+		if err := r.ParseForm(); err != nil {
+			ErrorResponse(w, http.StatusBadRequest, "Invalid form data")
+			return
+		}
+		id, err := strconv.Atoi(r.FormValue("comment_id"))
+		if err != nil {
+			ErrorResponse(w, http.StatusBadRequest, "Invalid comment ID")
+			return
+		}
+		postID, err = getCommentPostID(id)
+		if err == errContentNotFound {
+			ErrorResponse(w, http.StatusNotFound, "Comment not found")
+			return
+		} else if err != nil {
+			ErrorResponse(w, http.StatusInternalServerError, "Error updating answer")
+			return
+		}
+		commentID = &id
+	} else {
+		var err error
+		postID, err = strconv.Atoi(r.URL.Query().Get("post_id"))
+		if err != nil {
+			ErrorResponse(w, http.StatusBadRequest, "Invalid post ID")
+			return
+		}
+	}
+
+	postAuthorID, _, _, hidden, err := getContentInfo("post", postID)
+	if err == errContentNotFound || hidden {
+		ErrorResponse(w, http.StatusNotFound, "Post not found")
+		return
+	} else if err != nil {
+		ErrorResponse(w, http.StatusInternalServerError, "Error updating answer")
+		return
+	}
+	if postAuthorID != user.ID && !isModerator(user) {
+		ErrorResponse(w, http.StatusForbidden, "Только автор вопроса или модератор может выбрать ответ")
+		return
+	}
+
+	isQuestion, _, err := getQuestionStatus(postID)
+	if err != nil {
+		ErrorResponse(w, http.StatusInternalServerError, "Error updating answer")
+		return
+	}
+	if !isQuestion {
+		ErrorResponse(w, http.StatusBadRequest, "Ответ можно выбрать только в категориях вопросов и ответов")
+		return
+	}
+
+	if err := setAcceptedAnswer(user.ID, postAuthorID, postID, commentID, clientIP(r)); err != nil {
+		log.Printf("Q&A - error updating answer of post %d: %v", postID, err)
+		ErrorResponse(w, http.StatusInternalServerError, "Error updating answer")
+		return
+	}
+
+	if commentID != nil {
+		if answerAuthorID, _, _, _, err := getContentInfo("comment", *commentID); err == nil {
+			if err := createNotification(answerAuthorID, user.ID, "answer", postID, commentID); err != nil {
+				log.Printf("Q&A - error notifying user %d: %v", answerAuthorID, err)
+			}
+		}
+	}
+	events.publish("answer", map[string]interface{}{
+		"post_id":    postID,
+		"comment_id": commentID,
+	}, postTopic(postID))
+
+	JSONResponse(w, http.StatusOK, map[string]string{"message": "Answer updated"})
+}
+
+// categoryQAHandler lets moderators turn Q&A mode of a category on or off
+// (category_id=, qa=true|false)
+func categoryQAHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	moderator, ok := requireModerator(w, r)
+	if !ok {
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		ErrorResponse(w, http.StatusBadRequest, "Invalid form data")
+		return
+	}
+
+	categoryID, err := strconv.Atoi(r.FormValue("category_id"))
+	if err != nil {
+		ErrorResponse(w, http.StatusBadRequest, "Invalid category ID")
+		return
+	}
+
+	err = setCategoryQA(moderator.ID, categoryID, r.FormValue("qa") == "true", clientIP(r))
+	if err == sql.ErrNoRows {
+		ErrorResponse(w, http.StatusNotFound, "Category not found")
+		return
+	} else if err != nil {
+		ErrorResponse(w, http.StatusInternalServerError, "Error updating category")
+		return
+	}
+
+	JSONResponse(w, http.StatusOK, map[string]string{"message": "Category updated"})
+}
@@ -0,0 +1,446 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"forum/config"
+)
+
+const reactorsPageSize = 50
+
+// scoreReactions are the reactions that count as votes: a user gives at
+// most one of them, and they make up the likes and dislikes that affect
+// reputation, badges and comment order
+var scoreReactions = []config.Reaction{
+	{Key: "like", Emoji: "👍"},
+	{Key: "dislike", Emoji: "👎"},
+}
+
+// reactionSet lists the available reactions: like and dislike followed by
+// the configured emoji reactions
+func reactionSet() []config.Reaction {
+	return append(append([]config.Reaction{}, scoreReactions...), appConfig.Reactions...)
+}
+
+// isReaction reports whether a key belongs to the reaction set
+func isReaction(key string) bool {
+	for _, reaction := range reactionSet() {
+		if reaction.Key == key {
+			return true
+		}
+	}
+	return false
+}
+
+// isScoreReaction reports whether a reaction is a like or a dislike
+func isScoreReaction(key string) bool {
+	return key == "like" || key == "dislike"
+}
+
+// reactionKeysSQL is the reaction set as an SQL list, so reactions removed
+// from the configuration are no longer counted or listed
+func reactionKeysSQL() (string, []interface{}) {
+	var args []interface{}
+	for _, reaction := range reactionSet() {
+		args = append(args, reaction.Key)
+	}
+	return "(?" + strings.Repeat(", ?", len(args)-1) + ")", args
+}
+
+// toggleReaction adds a user's reaction to a post or comment, or removes it
+// when the user already gave it. A like replaces a dislike and vice versa;
+// their change is applied to the author's reputation.
+func toggleReaction(userID int, postID, commentID *int, reaction string) error {
+	column, id := "post_id", 0
+	if commentID != nil {
+		column, id = "comment_id", *commentID
+	} else {
+		id = *postID
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if !isScoreReaction(reaction) {
+		result, err := tx.Exec("DELETE FROM reactions WHERE user_id = ? AND "+column+" = ? AND reaction = ?", userID, id, reaction)
+		if err != nil {
+			return err
+		}
+		if removed, err := result.RowsAffected(); err != nil {
+			return err
+		} else if removed == 0 {
+			if _, err := tx.Exec("INSERT INTO reactions (user_id, "+column+", reaction) VALUES (?, ?, ?)", userID, id, reaction); err != nil {
+				return err
+			}
+			if err := recordVoteEvent(tx, userID); err != nil {
+				return err
+			}
+		}
+		return tx.Commit()
+	}
+
+	var existingID int
+	var existing string
+	err = tx.QueryRow("SELECT id, reaction FROM reactions WHERE user_id = ? AND "+column+" = ? AND reaction IN ('like', 'dislike')",
+		userID, id).Scan(&existingID, &existing)
+
+	// before and after are the user's vote around this change, nil for none
+	var before, after *bool
+	isLike := reaction == "like"
+	wasLike := existing == "like"
+	switch {
+	case err == sql.ErrNoRows:
+		after = &isLike
+		_, err = tx.Exec("INSERT INTO reactions (user_id, "+column+", reaction) VALUES (?, ?, ?)", userID, id, reaction)
+	case err != nil:
+		return err
+	case existing == reaction:
+		// Same vote again, withdraw it
+		before = &wasLike
+		_, err = tx.Exec("DELETE FROM reactions WHERE id = ?", existingID)
+	default:
+		before, after = &wasLike, &isLike
+		_, err = tx.Exec("UPDATE reactions SET reaction = ? WHERE id = ?", reaction, existingID)
+	}
+	if err != nil {
+		return err
+	}
+	if after != nil {
+		if err := recordVoteEvent(tx, userID); err != nil {
+			return err
+		}
+	}
+
+	if err := updateVoteReputation(tx, userID, postID, commentID, before, after); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// recordVoteEvent counts a vote or reaction a user added towards their vote
+// rate limit and forgets their events that no longer count
+func recordVoteEvent(tx *sql.Tx, userID int) error {
+	if _, err := tx.Exec("INSERT INTO vote_events (user_id) VALUES (?)", userID); err != nil {
+		return err
+	}
+	_, err := tx.Exec("DELETE FROM vote_events WHERE user_id = ? AND created <= ?",
+		userID, time.Now().UTC().Add(-time.Hour).Format(sqliteTimeLayout))
+	return err
+}
+
+// getReactionCounts counts the reactions of a post ("post_id") or comment
+// ("comment_id") by key; reactions nobody gave are left out
+func getReactionCounts(column string, id int) (map[string]int, error) {
+	keys, args := reactionKeysSQL()
+	rows, err := db.Query("SELECT reaction, COUNT(*) FROM reactions WHERE "+column+" = ? AND reaction IN "+keys+" GROUP BY reaction",
+		append([]interface{}{id}, args...)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := make(map[string]int)
+	for rows.Next() {
+		var key string
+		var count int
+		if err := rows.Scan(&key, &count); err != nil {
+			return nil, err
+		}
+		counts[key] = count
+	}
+	return counts, rows.Err()
+}
+
+// getUserReactions lists the reactions a user gave to a post or comment
+func getUserReactions(userID int, column string, id int) ([]string, error) {
+	rows, err := db.Query("SELECT reaction FROM reactions WHERE user_id = ? AND "+column+" = ? ORDER BY id", userID, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	reactions := []string{}
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		if isReaction(key) {
+			reactions = append(reactions, key)
+		}
+	}
+	return reactions, rows.Err()
+}
+
+// loadReactions fills in the reaction counts of a post or comment and, for
+// a logged in user, their own reactions
+func loadReactions(userID *int, column string, id int) (map[string]int, []string, error) {
+	counts, err := getReactionCounts(column, id)
+	if err != nil || userID == nil {
+		return counts, nil, err
+	}
+	mine, err := getUserReactions(*userID, column, id)
+	return counts, mine, err
+}
+
+// getReactors lists who reacted to a post or comment, newest first,
+// optionally only with one reaction
+func getReactors(column string, id int, reaction string, page int) ([]Reactor, bool, error) {
+	keys, args := reactionKeysSQL()
+	query := `
+		SELECT r.user_id, u.username, r.reaction, r.created
+		FROM reactions r JOIN users u ON r.user_id = u.id
+		WHERE r.` + column + ` = ? AND r.reaction IN ` + keys
+	args = append([]interface{}{id}, args...)
+	if reaction != "" {
+		query += " AND r.reaction = ?"
+		args = append(args, reaction)
+	}
+	query += " ORDER BY r.created DESC, r.id DESC LIMIT ? OFFSET ?"
+	args = append(args, reactorsPageSize+1, (page-1)*reactorsPageSize)
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, false, err
+	}
+	defer rows.Close()
+
+	reactors := []Reactor{}
+	for rows.Next() {
+		var reactor Reactor
+		if err := rows.Scan(&reactor.UserID, &reactor.Username, &reactor.Reaction, &reactor.Created); err != nil {
+			return nil, false, err
+		}
+		reactors = append(reactors, reactor)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, false, err
+	}
+
+	hasMore := len(reactors) > reactorsPageSize
+	if hasMore {
+		reactors = reactors[:reactorsPageSize]
+	}
+	return reactors, hasMore, nil
+}
+
+// hasReaction reports whether a user already gave a reaction to the target,
+// so toggling it again withdraws it
+func hasReaction(userID int, target reactionTarget, reaction string) (bool, error) {
+	column, id := target.column()
+	var count int
+	err := db.QueryRow("SELECT COUNT(*) FROM reactions WHERE user_id = ? AND "+column+" = ? AND reaction = ?",
+		userID, id, reaction).Scan(&count)
+	return count > 0, err
+}
+
+// reactionTarget is the post or comment a reaction is about
+type reactionTarget struct {
+	PostID    *int // nil for comments
+	CommentID *int
+	ThreadID  int // Post the comment belongs to, or the post itself
+}
+
+// column returns the reactions column and ID of the target
+func (t reactionTarget) column() (string, int) {
+	if t.CommentID != nil {
+		return "comment_id", *t.CommentID
+	}
+	return "post_id", *t.PostID
+}
+
+// parseReactionTarget reads post_id or comment_id from the request. It
+// writes the error response itself and returns false when invalid.
+func parseReactionTarget(w http.ResponseWriter, r *http.Request) (reactionTarget, bool) {
+	var target reactionTarget
+	postIDStr := r.FormValue("post_id")
+	commentIDStr := r.FormValue("comment_id")
+
+	switch {
+	case postIDStr != "":
+		id, err := strconv.Atoi(postIDStr)
+		if err != nil {
+			ErrorResponse(w, http.StatusBadRequest, "Invalid post ID")
+			return target, false
+		}
+		target.PostID = &id
+		target.ThreadID = id
+	case commentIDStr != "":
+		id, err := strconv.Atoi(commentIDStr)
+		if err != nil {
+			ErrorResponse(w, http.StatusBadRequest, "Invalid comment ID")
+			return target, false
+		}
+		target.CommentID = &id
+		target.ThreadID, err = getCommentPostID(id)
+		if err == errContentNotFound {
+			ErrorResponse(w, http.StatusNotFound, "Comment not found")
+			return target, false
+		} else if err != nil {
+			ErrorResponse(w, http.StatusInternalServerError, "Error processing reaction")
+			return target, false
+		}
+	default:
+		ErrorResponse(w, http.StatusBadRequest, "Post ID or comment ID is required")
+		return target, false
+	}
+	return target, true
+}
+
+// applyReaction toggles a user's reaction after checking that the thread
+// is open and that the user may vote, then notifies the author of votes and
+// publishes the new counts. It writes the error response itself and returns
+// false when rejected.
+func applyReaction(w http.ResponseWriter, user *User, target reactionTarget, reaction string) bool {
+	if !isReaction(reaction) {
+		ErrorResponse(w, http.StatusBadRequest, "Unknown reaction")
+		return false
+	}
+
+	// Votes and reactions on a locked post and on its comments are rejected
+	if !checkPostOpen(w, target.ThreadID) {
+		return false
+	}
+
+	// Voting is unlocked by the first trust level; all reactions share its
+	// rate limit, which only applies to adding them, never to withdrawing
+	if isScoreReaction(reaction) && !checkCanVote(w, user) {
+		return false
+	}
+	withdrawing, err := hasReaction(user.ID, target, reaction)
+	if err != nil {
+		log.Printf("Reactions - error loading %s: %v", reaction, err)
+		ErrorResponse(w, http.StatusInternalServerError, "Error processing reaction")
+		return false
+	}
+	if !withdrawing && !checkRateLimit(w, user, "vote") {
+		return false
+	}
+
+	if err := toggleReaction(user.ID, target.PostID, target.CommentID, reaction); err != nil {
+		log.Printf("Reactions - error toggling %s: %v", reaction, err)
+		ErrorResponse(w, http.StatusInternalServerError, "Error processing reaction")
+		return false
+	}
+
+	if isScoreReaction(reaction) {
+		syncVoteNotification(user.ID, target.ThreadID, target.CommentID)
+		evaluateVoteBadges(user.ID, target.PostID, target.CommentID)
+	}
+	publishVoteCounts(target.ThreadID, target.CommentID)
+	return true
+}
+
+// reactionsHandler toggles a reaction (POST post_id= or comment_id=,
+// reaction=) or lists who reacted (GET post_id= or comment_id=, optional
+// reaction= and page=)
+func reactionsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if r.Method == "GET" {
+		target, ok := parseReactionTarget(w, r)
+		if !ok {
+			return
+		}
+		reaction := r.URL.Query().Get("reaction")
+		if reaction != "" && !isReaction(reaction) {
+			ErrorResponse(w, http.StatusBadRequest, "Unknown reaction")
+			return
+		}
+		page := 1
+		if value := r.URL.Query().Get("page"); value != "" {
+			var err error
+			page, err = strconv.Atoi(value)
+			if err != nil || page < 1 {
+				ErrorResponse(w, http.StatusBadRequest, "Invalid page")
+				return
+			}
+		}
+
+		// Reactions of hidden content are only visible where the content is
+		hidden := false
+		if target.CommentID != nil {
+			_, _, _, commentHidden, err := getContentInfo("comment", *target.CommentID)
+			if err != nil && err != errContentNotFound {
+				ErrorResponse(w, http.StatusInternalServerError, "Error retrieving reactions")
+				return
+			}
+			hidden = commentHidden || err == errContentNotFound
+		}
+		if _, err := getPostLocked(target.ThreadID); err == errContentNotFound || hidden {
+			if user, err := getCurrentUser(r); err != nil || !isModerator(user) {
+				ErrorResponse(w, http.StatusNotFound, "Content not found")
+				return
+			}
+		} else if err != nil {
+			ErrorResponse(w, http.StatusInternalServerError, "Error retrieving reactions")
+			return
+		}
+
+		column, id := target.column()
+		reactors, hasMore, err := getReactors(column, id, reaction, page)
+		if err != nil {
+			log.Printf("Reactions - error listing reactions: %v", err)
+			ErrorResponse(w, http.StatusInternalServerError, "Error retrieving reactions")
+			return
+		}
+		JSONResponse(w, http.StatusOK, map[string]interface{}{
+			"reactions": reactors,
+			"page":      page,
+			"has_more":  hasMore,
+		})
+		return
+	}
+
+	user, ok := requireActiveUser(w, r)
+	if !ok {
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		ErrorResponse(w, http.StatusBadRequest, "Invalid form data")
+		return
+	}
+	target, ok := parseReactionTarget(w, r)
+	if !ok {
+		return
+	}
+	if !applyReaction(w, user, target, r.FormValue("reaction")) {
+		return
+	}
+
+	column, id := target.column()
+	counts, mine, err := loadReactions(&user.ID, column, id)
+	if err != nil {
+		ErrorResponse(w, http.StatusInternalServerError, "Error retrieving reactions")
+		return
+	}
+	JSONResponse(w, http.StatusOK, map[string]interface{}{
+		"reactions":      counts,
+		"user_reactions": mine,
+	})
+}
+
+// reactionTypesHandler lists the available reactions
+func reactionTypesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	types := []ReactionType{}
+	for _, reaction := range reactionSet() {
+		types = append(types, ReactionType{Key: reaction.Key, Emoji: reaction.Emoji, Score: isScoreReaction(reaction.Key)})
+	}
+	JSONResponse(w, http.StatusOK, types)
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// leaderboardPageSize is the number of users per leaderboard page
+const leaderboardPageSize = 20
+
+// leaderboardWindows maps the ?window= values of the leaderboard to their length;
+// "all" uses the stored reputation instead
+var leaderboardWindows = map[string]time.Duration{
+	"day":   24 * time.Hour,
+	"week":  7 * 24 * time.Hour,
+	"month": 30 * 24 * time.Hour,
+	"year":  365 * 24 * time.Hour,
+}
+
+// voteWeight returns the reputation points of a vote; nil means no vote
+func voteWeight(onComment bool, isLike *bool) int {
+	switch {
+	case isLike == nil:
+		return 0
+	case onComment && *isLike:
+		return appConfig.ReputationCommentLike
+	case onComment:
+		return appConfig.ReputationCommentDislike
+	case *isLike:
+		return appConfig.ReputationPostLike
+	default:
+		return appConfig.ReputationPostDislike
+	}
+}
+
+// updateVoteReputation adjusts the reputation of the author of a post or
+// comment after a vote on it changed from before to after (nil for no vote).
+// Votes on one's own content don't count.
+func updateVoteReputation(tx *sql.Tx, voterID int, postID, commentID *int, before, after *bool) error {
+	var authorID int
+	var err error
+	if commentID != nil {
+		err = tx.QueryRow("SELECT author_id FROM comments WHERE id = ?", *commentID).Scan(&authorID)
+	} else {
+		err = tx.QueryRow("SELECT author_id FROM posts WHERE id = ?", *postID).Scan(&authorID)
+	}
+	if err == sql.ErrNoRows || authorID == voterID {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	delta := voteWeight(commentID != nil, after) - voteWeight(commentID != nil, before)
+	if delta == 0 {
+		return nil
+	}
+	_, err = tx.Exec("UPDATE users SET reputation = reputation + ? WHERE id = ?", delta, authorID)
+	return err
+}
+
+// reputationVotesQuery yields (author_id, points, created) for every vote
+// that counts towards reputation, with the four weights as its parameters
+const reputationVotesQuery = `
+	SELECT p.author_id AS author_id,
+		CASE WHEN l.reaction = 'like' THEN ? ELSE ? END AS points,
+		l.created AS created
+	FROM reactions l JOIN posts p ON l.post_id = p.id
+	WHERE l.comment_id IS NULL AND l.reaction IN ('like', 'dislike') AND l.user_id != p.author_id
+	UNION ALL
+	SELECT c.author_id, CASE WHEN l.reaction = 'like' THEN ? ELSE ? END, l.created
+	FROM reactions l JOIN comments c ON l.comment_id = c.id
+	WHERE l.reaction IN ('like', 'dislike') AND l.user_id != c.author_id`
+
+// reputationWeightArgs returns the parameters of reputationVotesQuery
+func reputationWeightArgs() []interface{} {
+	return []interface{}{
+		appConfig.ReputationPostLike, appConfig.ReputationPostDislike,
+		appConfig.ReputationCommentLike, appConfig.ReputationCommentDislike,
+	}
+}
+
+// recomputeReputation recalculates the reputation of the given users, or of
+// everyone when no IDs are passed, from the votes they received
+func recomputeReputation(ex execer, userIDs ...int) error {
+	query := `
+		UPDATE users SET reputation = COALESCE((
+			SELECT SUM(v.points) FROM (` + reputationVotesQuery + `) v
+			WHERE v.author_id = users.id
+		), 0)`
+	args := reputationWeightArgs()
+	if len(userIDs) > 0 {
+		query += " WHERE id IN (?" + strings.Repeat(", ?", len(userIDs)-1) + ")"
+		for _, id := range userIDs {
+			args = append(args, id)
+		}
+	}
+	_, err := ex.Exec(query, args...)
+	return err
+}
+
+// contentAuthors lists the authors whose reputation depends on a post (the
+// post and all its comments) or a comment
+func contentAuthors(q queryer, targetType string, targetID int) ([]int, error) {
+	query := "SELECT author_id FROM comments WHERE id = ?"
+	args := []interface{}{targetID}
+	if targetType == "post" {
+		query = "SELECT author_id FROM posts WHERE id = ? UNION SELECT author_id FROM comments WHERE post_id = ?"
+		args = append(args, targetID)
+	}
+
+	rows, err := q.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var authorIDs []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		authorIDs = append(authorIDs, id)
+	}
+	return authorIDs, rows.Err()
+}
+
+// getLeaderboard ranks users by reputation. Without a window it uses the
+// stored reputation; with one it sums the votes received in that period.
+func getLeaderboard(window time.Duration, page int) ([]LeaderboardEntry, bool, error) {
+	var rows *sql.Rows
+	var err error
+	offset := (page - 1) * leaderboardPageSize
+	if window == 0 {
+		rows, err = db.Query(`
+			SELECT id, username, reputation FROM users
+			WHERE reputation != 0
+			ORDER BY reputation DESC, username
+			LIMIT ? OFFSET ?`, leaderboardPageSize+1, offset)
+	} else {
+		since := time.Now().UTC().Add(-window).Format(sqliteTimeLayout)
+		args := append(reputationWeightArgs(), since, leaderboardPageSize+1, offset)
+		rows, err = db.Query(`
+			SELECT u.id, u.username, SUM(v.points) AS score
+			FROM (`+reputationVotesQuery+`) v
+			JOIN users u ON u.id = v.author_id
+			WHERE v.created >= ?
+			GROUP BY u.id
+			HAVING score != 0
+			ORDER BY score DESC, u.username
+			LIMIT ? OFFSET ?`, args...)
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	defer rows.Close()
+
+	entries := []LeaderboardEntry{}
+	for rows.Next() {
+		var entry LeaderboardEntry
+		if err := rows.Scan(&entry.UserID, &entry.Username, &entry.Reputation); err != nil {
+			return nil, false, err
+		}
+		entry.Rank = offset + len(entries) + 1
+		entries = append(entries, entry)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, false, err
+	}
+
+	hasMore := len(entries) > leaderboardPageSize
+	if hasMore {
+		entries = entries[:leaderboardPageSize]
+	}
+	return entries, hasMore, nil
+}
+
+// leaderboardHandler ranks users by reputation (?window=day|week|month|year|all, ?page=)
+func leaderboardHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	window := r.URL.Query().Get("window")
+	if window == "" {
+		window = "all"
+	}
+	length, ok := leaderboardWindows[window]
+	if !ok && window != "all" {
+		ErrorResponse(w, http.StatusBadRequest, "Invalid window")
+		return
+	}
+
+	page := 1
+	if value := r.URL.Query().Get("page"); value != "" {
+		var err error
+		page, err = strconv.Atoi(value)
+		if err != nil || page < 1 {
+			ErrorResponse(w, http.StatusBadRequest, "Invalid page")
+			return
+		}
+	}
+
+	entries, hasMore, err := getLeaderboard(length, page)
+	if err != nil {
+		log.Printf("Leaderboard - error: %v", err)
+		ErrorResponse(w, http.StatusInternalServerError, "Error retrieving leaderboard")
+		return
+	}
+
+	JSONResponse(w, http.StatusOK, map[string]interface{}{
+		"window":   window,
+		"users":    entries,
+		"page":     page,
+		"has_more": hasMore,
+	})
+}
+
+// recomputeReputationHandler recalculates everyone's reputation from the
+// votes, e.g. after the weights changed (admins only)
+func recomputeReputationHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	admin, ok := requireAdmin(w, r)
+	if !ok {
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		ErrorResponse(w, http.StatusInternalServerError, "Error recomputing reputation")
+		return
+	}
+	defer tx.Rollback()
+
+	if err := recomputeReputation(tx); err != nil {
+		log.Printf("Reputation - error recomputing: %v", err)
+		ErrorResponse(w, http.StatusInternalServerError, "Error recomputing reputation")
+		return
+	}
+	weights := map[string]int{
+		"post_like":       appConfig.ReputationPostLike,
+		"post_dislike":    appConfig.ReputationPostDislike,
+		"comment_like":    appConfig.ReputationCommentLike,
+		"comment_dislike": appConfig.ReputationCommentDislike,
+	}
+	if err := recordAudit(tx, admin.ID, "reputation.recompute", "site", 0, nil, weights, "", clientIP(r)); err != nil {
+		ErrorResponse(w, http.StatusInternalServerError, "Error recomputing reputation")
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		ErrorResponse(w, http.StatusInternalServerError, "Error recomputing reputation")
+		return
+	}
+
+	JSONResponse(w, http.StatusOK, map[string]string{"message": "Reputation recomputed"})
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"html"
+	"regexp"
+	"strings"
+)
+
+// allowedTags lists the HTML elements that survive sanitization, with the
+// attributes each of them may keep. Other tags are dropped along with their
+// attributes, but the text inside them is kept and escaped.
+var allowedTags = map[string][]string{
+	"p":          nil,
+	"br":         nil,
+	"strong":     nil,
+	"em":         nil,
+	"del":        nil,
+	"code":       {"class"},
+	"pre":        nil,
+	"blockquote": nil,
+	"ul":         nil,
+	"ol":         nil,
+	"li":         nil,
+	"a":          {"href", "title"},
+}
+
+// voidTags are allowed elements that never have a closing tag
+var voidTags = map[string]bool{"br": true}
+
+var (
+	tagRe       = regexp.MustCompile(`^<(/?)([a-zA-Z][a-zA-Z0-9]*)((?:\s+[a-zA-Z-]+(?:\s*=\s*"[^"<>]*")?)*)\s*/?>`)
+	attributeRe = regexp.MustCompile(`([a-zA-Z-]+)\s*=\s*"([^"<>]*)"`)
+	languageRe  = regexp.MustCompile(`^language-[a-zA-Z0-9+#-]{1,20}$`)
+)
+
+// sanitizeHTML keeps only allowlisted tags and attributes, drops other tags,
+// escapes text and stray markup characters and closes any elements left open
+func sanitizeHTML(input string) string {
+	var out strings.Builder
+	var open []string
+
+	for len(input) > 0 {
+		lt := strings.IndexByte(input, '<')
+		if lt < 0 {
+			out.WriteString(escapeText(input))
+			break
+		}
+		out.WriteString(escapeText(input[:lt]))
+		input = input[lt:]
+
+		m := tagRe.FindStringSubmatch(input)
+		if m == nil {
+			out.WriteString("&lt;")
+			input = input[1:]
+			continue
+		}
+		input = input[len(m[0]):]
+
+		name := strings.ToLower(m[2])
+		allowedAttrs, ok := allowedTags[name]
+		if !ok {
+			// Disallowed tags are dropped, their text content is kept
+			continue
+		}
+
+		if m[1] == "/" {
+			// Close the element and anything opened inside it; stray closing tags are dropped
+			for i := len(open) - 1; i >= 0; i-- {
+				if open[i] == name {
+					for j := len(open) - 1; j >= i; j-- {
+						out.WriteString("</" + open[j] + ">")
+					}
+					open = open[:i]
+					break
+				}
+			}
+			continue
+		}
+
+		out.WriteString("<" + name)
+		for _, attr := range attributeRe.FindAllStringSubmatch(m[3], -1) {
+			attrName := strings.ToLower(attr[1])
+			value := html.UnescapeString(attr[2])
+			if !isAllowedAttribute(name, attrName, value, allowedAttrs) {
+				continue
+			}
+			out.WriteString(" " + attrName + `="` + html.EscapeString(value) + `"`)
+		}
+		if name == "a" {
+			out.WriteString(` rel="nofollow ugc noopener"`)
+		}
+		out.WriteString(">")
+
+		if !voidTags[name] {
+			open = append(open, name)
+		}
+	}
+
+	for i := len(open) - 1; i >= 0; i-- {
+		out.WriteString("</" + open[i] + ">")
+	}
+	return out.String()
+}
+
+// isAllowedAttribute checks an attribute against the allowlist of its element
+// and validates the values of attributes that could carry scripts
+func isAllowedAttribute(tag, name, value string, allowed []string) bool {
+	for _, a := range allowed {
+		if a != name {
+			continue
+		}
+		switch {
+		case tag == "a" && name == "href":
+			return isSafeURL(value)
+		case tag == "code" && name == "class":
+			return languageRe.MatchString(value)
+		default:
+			return true
+		}
+	}
+	return false
+}
+
+// escapeText escapes markup characters in text between tags while leaving
+// existing entities alone
+func escapeText(text string) string {
+	return html.EscapeString(html.UnescapeString(text))
+}
@@ -0,0 +1,40 @@
+package main
+
+import "testing"
+
+func TestSanitizeHTML(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{"allowed link", `<a href="/post/1" title="t">x</a>`, `<a href="/post/1" title="t" rel="nofollow ugc noopener">x</a>`},
+		{"javascript link", `<a href="javascript:alert(1)">x</a>`, `<a rel="nofollow ugc noopener">x</a>`},
+		{"mixed case javascript link", `<a href="JaVaScRiPt:alert(1)">x</a>`, `<a rel="nofollow ugc noopener">x</a>`},
+		{"numeric entity in scheme", `<a href="jav&#x61;script:alert(1)">x</a>`, `<a rel="nofollow ugc noopener">x</a>`},
+		{"named entity in scheme", `<a href="javascript&colon;alert(1)">x</a>`, `<a rel="nofollow ugc noopener">x</a>`},
+		{"protocol relative link", `<a href="//evil.com">x</a>`, `<a rel="nofollow ugc noopener">x</a>`},
+		{"onclick on link", `<a href="https://example.com" onclick="alert(1)">x</a>`, `<a href="https://example.com" rel="nofollow ugc noopener">x</a>`},
+		{"onclick on paragraph", `<p title="a" onclick="alert(1)">t</p>`, `<p>t</p>`},
+		{"img onerror", `<img src="x" onerror="alert(1)">`, ``},
+		{"unquoted onerror", `<img src=x onerror="alert(1)">`, `&lt;img src=x onerror=&#34;alert(1)&#34;&gt;`},
+		{"svg onload", `<svg onload="alert(1)"><circle/></svg>`, ``},
+		{"script inside svg", `<svg><script>alert(1)</script></svg>`, `alert(1)`},
+		{"nested script tag", `<scr<script>ipt>alert(1)</script>`, `&lt;script&gt;alert(1)`},
+		{"attribute injection with entities", `<a href="https://x.com/&quot; onclick=&quot;alert(1)">x</a>`, `<a href="https://x.com/&#34; onclick=&#34;alert(1)" rel="nofollow ugc noopener">x</a>`},
+		{"escaped tags stay text", `&lt;script&gt;alert(1)&lt;/script&gt;`, `&lt;script&gt;alert(1)&lt;/script&gt;`},
+		{"bare markup characters", `a < b & c`, `a &lt; b &amp; c`},
+		{"code language class", `<code class="language-go">x</code>`, `<code class="language-go">x</code>`},
+		{"invalid code class", `<code class="x onclick=alert(1)">x</code>`, `<code>x</code>`},
+		{"unclosed element", `<strong>open`, `<strong>open</strong>`},
+		{"stray closing tag", `</em>stray`, `stray`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sanitizeHTML(tt.input); got != tt.want {
+				t.Errorf("sanitizeHTML(%q) = %q, want %q", tt.input, got, tt.want)
+			}
+		})
+	}
+}
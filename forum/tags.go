@@ -0,0 +1,323 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	maxTagsPerPost  = 5
+	maxTagLength    = 30
+	tagCloudSize    = 100
+	maxTagCloudSize = 500
+)
+
+var (
+	errTagNotFound = errors.New("tag not found")
+	errTagExists   = errors.New("tag already exists")
+)
+
+// normalizeTag lower-cases and trims a tag and joins its words with
+// hyphens. Leading "#" and characters other than letters, digits and
+// "-+#." are dropped, so "#Node JS" becomes "node-js".
+func normalizeTag(tag string) string {
+	tag = strings.TrimLeft(strings.ToLower(strings.TrimSpace(tag)), "#")
+	tag = strings.Join(strings.Fields(tag), "-")
+	tag = strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || strings.ContainsRune("-+#.", r) {
+			return r
+		}
+		return -1
+	}, tag)
+	return strings.Trim(tag, "-.")
+}
+
+// resolveTag maps a normalized tag to the tag its name is a synonym of, or
+// returns it unchanged
+func resolveTag(q queryer, name string) (string, error) {
+	var tag string
+	err := q.QueryRow("SELECT t.name FROM tag_synonyms s JOIN tags t ON s.tag_id = t.id WHERE s.synonym = ?", name).Scan(&tag)
+	if err == sql.ErrNoRows {
+		return name, nil
+	}
+	return tag, err
+}
+
+// parseTags reads the comma-separated "tags" form field into normalized,
+// synonym-mapped and deduplicated tags. Invalid input is reported as a
+// requestError.
+func parseTags(value string) ([]string, error) {
+	var tags []string
+	for _, part := range strings.Split(value, ",") {
+		name := normalizeTag(part)
+		if name == "" {
+			continue
+		}
+		if utf8.RuneCountInString(name) > maxTagLength {
+			return nil, &requestError{http.StatusBadRequest, "Тег должен быть не длиннее 30 символов"}
+		}
+		name, err := resolveTag(db, name)
+		if err != nil {
+			return nil, err
+		}
+		if !containsString(tags, name) {
+			tags = append(tags, name)
+		}
+	}
+	if len(tags) > maxTagsPerPost {
+		return nil, &requestError{http.StatusBadRequest, "Можно указать не более 5 тегов"}
+	}
+	return tags, nil
+}
+
+// setPostTags attaches tags to a new post, creating the tags that don't
+// exist yet
+func setPostTags(tx *sql.Tx, postID int64, tags []string) error {
+	for _, name := range tags {
+		if _, err := tx.Exec("INSERT OR IGNORE INTO tags (name) VALUES (?)", name); err != nil {
+			return err
+		}
+		if _, err := tx.Exec("INSERT OR IGNORE INTO post_tags (post_id, tag_id) SELECT ?, id FROM tags WHERE name = ?", postID, name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// getPostTags retrieves the tags of a post in alphabetical order
+func getPostTags(postID int) ([]string, error) {
+	rows, err := db.Query("SELECT t.name FROM tags t JOIN post_tags pt ON t.id = pt.tag_id WHERE pt.post_id = ? ORDER BY t.name", postID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tags []string
+	for rows.Next() {
+		var tag string
+		if err := rows.Scan(&tag); err != nil {
+			return nil, err
+		}
+		tags = append(tags, tag)
+	}
+	return tags, rows.Err()
+}
+
+// getTagCloud lists the most used tags with the number of visible posts
+// carrying each
+func getTagCloud(limit int) ([]TagCount, error) {
+	rows, err := db.Query(`
+		SELECT t.name, COUNT(*) AS count FROM tags t
+		JOIN post_tags pt ON t.id = pt.tag_id
+		JOIN posts p ON pt.post_id = p.id AND p.hidden = 0
+		GROUP BY t.id ORDER BY count DESC, t.name LIMIT ?`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tags := []TagCount{}
+	for rows.Next() {
+		var tag TagCount
+		if err := rows.Scan(&tag.Name, &tag.Count); err != nil {
+			return nil, err
+		}
+		tags = append(tags, tag)
+	}
+	return tags, rows.Err()
+}
+
+// getTagID looks up a tag by its normalized name
+func getTagID(q queryer, name string) (int, error) {
+	var id int
+	err := q.QueryRow("SELECT id FROM tags WHERE name = ?", name).Scan(&id)
+	if err == sql.ErrNoRows {
+		return 0, errTagNotFound
+	}
+	return id, err
+}
+
+// mergeTags moves the posts of one tag to another and makes the old name a
+// synonym, so it is mapped to the remaining tag from now on. Merging a name
+// that no post uses yet just declares the synonym.
+func mergeTags(moderatorID int, from, into, ip string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	intoID, err := getTagID(tx, into)
+	if err != nil {
+		return err
+	}
+
+	var posts int64
+	fromID, err := getTagID(tx, from)
+	if err == nil {
+		if _, err := tx.Exec("INSERT OR IGNORE INTO post_tags (post_id, tag_id) SELECT post_id, ? FROM post_tags WHERE tag_id = ?", intoID, fromID); err != nil {
+			return err
+		}
+		result, err := tx.Exec("DELETE FROM post_tags WHERE tag_id = ?", fromID)
+		if err != nil {
+			return err
+		}
+		if posts, err = result.RowsAffected(); err != nil {
+			return err
+		}
+		if _, err := tx.Exec("UPDATE tag_synonyms SET tag_id = ? WHERE tag_id = ?", intoID, fromID); err != nil {
+			return err
+		}
+		if _, err := tx.Exec("DELETE FROM tags WHERE id = ?", fromID); err != nil {
+			return err
+		}
+	} else if err != errTagNotFound {
+		return err
+	}
+	if _, err := tx.Exec("INSERT OR REPLACE INTO tag_synonyms (synonym, tag_id) VALUES (?, ?)", from, intoID); err != nil {
+		return err
+	}
+
+	if err := recordAudit(tx, moderatorID, "tag.merge", "tag", intoID,
+		map[string]interface{}{"tag": from, "posts": posts}, map[string]string{"tag": into}, "", ip); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// renameTag changes the name of a tag. The old name becomes a synonym so
+// posts written with it still get the tag.
+func renameTag(moderatorID int, name, newName, ip string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	tagID, err := getTagID(tx, name)
+	if err != nil {
+		return err
+	}
+	// The new name must not belong to another tag, as a name or a synonym
+	if _, err := getTagID(tx, newName); err == nil {
+		return errTagExists
+	} else if err != errTagNotFound {
+		return err
+	}
+	if target, err := resolveTag(tx, newName); err != nil {
+		return err
+	} else if target != newName && target != name {
+		return errTagExists
+	}
+
+	if _, err := tx.Exec("DELETE FROM tag_synonyms WHERE synonym = ?", newName); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("UPDATE tags SET name = ? WHERE id = ?", newName, tagID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("INSERT OR REPLACE INTO tag_synonyms (synonym, tag_id) VALUES (?, ?)", name, tagID); err != nil {
+		return err
+	}
+
+	if err := recordAudit(tx, moderatorID, "tag.rename", "tag", tagID,
+		map[string]string{"tag": name}, map[string]string{"tag": newName}, "", ip); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// tagsHandler returns the tag cloud: the most used tags with their post
+// counts (limit=, 100 by default)
+func tagsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	limit := tagCloudSize
+	if value := r.URL.Query().Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			ErrorResponse(w, http.StatusBadRequest, "Invalid limit")
+			return
+		}
+		limit = min(n, maxTagCloudSize)
+	}
+
+	tags, err := getTagCloud(limit)
+	if err != nil {
+		ErrorResponse(w, http.StatusInternalServerError, "Error retrieving tags")
+		return
+	}
+	JSONResponse(w, http.StatusOK, tags)
+}
+
+// tagModerationHandler lets moderators merge a tag into another
+// (action=merge, tag=, into=) or rename it (action=rename, tag=, name=)
+func tagModerationHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	moderator, ok := requireModerator(w, r)
+	if !ok {
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		ErrorResponse(w, http.StatusBadRequest, "Invalid form data")
+		return
+	}
+
+	tag := normalizeTag(r.FormValue("tag"))
+	var target string
+	switch r.FormValue("action") {
+	case "merge":
+		target = normalizeTag(r.FormValue("into"))
+	case "rename":
+		target = normalizeTag(r.FormValue("name"))
+	default:
+		ErrorResponse(w, http.StatusBadRequest, "Invalid action")
+		return
+	}
+	if tag == "" || target == "" || tag == target {
+		ErrorResponse(w, http.StatusBadRequest, "Укажите два разных тега")
+		return
+	}
+	if utf8.RuneCountInString(target) > maxTagLength {
+		ErrorResponse(w, http.StatusBadRequest, "Тег должен быть не длиннее 30 символов")
+		return
+	}
+
+	var err error
+	if r.FormValue("action") == "merge" {
+		err = mergeTags(moderator.ID, tag, target, clientIP(r))
+	} else {
+		err = renameTag(moderator.ID, tag, target, clientIP(r))
+	}
+	switch {
+	case err == errTagNotFound:
+		ErrorResponse(w, http.StatusNotFound, "Tag not found")
+		return
+	case err == errTagExists:
+		ErrorResponse(w, http.StatusConflict, fmt.Sprintf("Тег «%s» уже есть, объедините теги вместо переименования", target))
+		return
+	case err != nil:
+		log.Printf("Tags - error updating tag %s: %v", tag, err)
+		ErrorResponse(w, http.StatusInternalServerError, "Error updating tag")
+		return
+	}
+
+	JSONResponse(w, http.StatusOK, map[string]string{"message": "Tag updated"})
+}
@@ -2,14 +2,218 @@
 let currentUser = null;
 let currentFilter = '';
 let currentFilterValue = '';
+let currentComments = [];
+let currentPostId = null;
+let currentConversationId = null;
+let currentProfile = null;
+let categoryIds = {};
+let followed = new Set();
+let currentDraft = null;
+let reactionTypes = [];
+let serverUnreadComments = new Set();
+let draftAutosaveTimer = null;
 
 // Загрузка постов и категорий при загрузке страницы
-document.addEventListener('DOMContentLoaded', function() {
+document.addEventListener('DOMContentLoaded', async function() {
     fetchCurrentUser();
-    loadPosts();
+    loadAnnouncement();
+    // Набор реакций нужен до первой отрисовки постов
+    await loadReactionTypes();
+    // Страница уже отрисована сервером; data-view говорит, что открыть вместо неё.
+    // Формы входа и нового поста (пустой data-view) остаются как есть.
+    const container = document.getElementById('posts-container');
+    const value = container.dataset.value;
+    // Сервер уже отметил комментарии прочитанными, новые видны только в его разметке
+    container.querySelectorAll('.comment-unread').forEach(el => serverUnreadComments.add(Number(el.id.replace('comment-', ''))));
+    switch (container.dataset.view) {
+        case 'posts': loadPosts(); break;
+        case 'category': loadPosts('category', value); break;
+        case 'post': loadPost(value); break;
+        case 'profile': loadProfile(value); break;
+    }
     loadCategories();
+    loadTagCloud();
 });
 
+// Объявление для всего сайта
+async function loadAnnouncement() {
+    const el = document.getElementById('announcement-banner');
+    if (!el) return;
+    try {
+        const response = await fetch('/api/announcement');
+        const announcement = await response.json();
+        if (announcement && announcement.message) {
+            el.textContent = '📢 ' + announcement.message;
+            el.style.display = 'block';
+        } else {
+            el.style.display = 'none';
+        }
+    } catch (error) {
+        console.error('Error loading announcement:', error);
+    }
+}
+
+// Уведомления
+const notificationTypeNames = {
+    comment: 'Комментарии к моим постам',
+    reply: 'Ответы на мои комментарии',
+    mention: 'Упоминания',
+    like: 'Лайки',
+    dislike: 'Дизлайки',
+    thread: 'Комментарии в отслеживаемых обсуждениях',
+    answer: 'Принятые ответы'
+};
+async function loadNotificationCount() {
+    if (!currentUser) return;
+    try {
+        const response = await fetch('/api/notifications?unread=1');
+        if (!response.ok) return;
+        const data = await response.json();
+        const el = document.getElementById('notification-count');
+        if (el) el.textContent = data.unread_count > 0 ? data.unread_count : '';
+    } catch (error) {
+        console.error('Error loading notifications:', error);
+    }
+}
+async function toggleNotifications() {
+    const panel = document.getElementById('notifications-panel');
+    if (panel.style.display === 'block') {
+        panel.style.display = 'none';
+        return;
+    }
+    panel.style.display = 'block';
+    panel.innerHTML = '<div class="loading">Загрузка...</div>';
+    try {
+        const [data, preferences] = await Promise.all([
+            fetch('/api/notifications').then(r => r.json()),
+            fetch('/api/notifications/preferences').then(r => r.json())
+        ]);
+        const items = data.notifications.length === 0 ? '<p>Уведомлений нет.</p>' : data.notifications.map(n =>
+            `<div class="notification ${n.read ? '' : 'unread'}" onclick="openNotification('${n.ids.join(',')}', ${n.post_id})">
+                <div>${escapeHTML(n.message)}</div>
+                <div class="post-meta">${new Date(n.created).toLocaleString('ru-RU')}</div>
+            </div>`
+        ).join('');
+        const settings = Object.keys(notificationTypeNames).map(type =>
+            `<label><input type="checkbox" ${preferences[type] ? 'checked' : ''} onchange="setNotificationPreference('${type}', this.checked)"> ${notificationTypeNames[type]}</label>`
+        ).join('');
+        panel.innerHTML = `
+            <button class="btn btn-secondary" onclick="markAllNotificationsRead()">Отметить все прочитанными</button>
+            ${items}
+            <details class="notification-settings"><summary>Настройки</summary>${settings}</details>`;
+    } catch (error) {
+        panel.innerHTML = '<p>Ошибка загрузки уведомлений.</p>';
+    }
+}
+async function openNotification(ids, postId) {
+    await fetch('/api/notifications/read', {
+        method: 'POST',
+        headers: { 'Content-Type': 'application/x-www-form-urlencoded' },
+        body: new URLSearchParams({ ids })
+    });
+    document.getElementById('notifications-panel').style.display = 'none';
+    loadNotificationCount();
+    loadPost(postId);
+}
+async function markAllNotificationsRead() {
+    await fetch('/api/notifications/read-all', { method: 'POST' });
+    document.getElementById('notifications-panel').style.display = 'none';
+    loadNotificationCount();
+}
+async function setNotificationPreference(type, enabled) {
+    await fetch('/api/notifications/preferences', {
+        method: 'POST',
+        headers: { 'Content-Type': 'application/x-www-form-urlencoded' },
+        body: new URLSearchParams({ type, enabled })
+    });
+}
+
+// Живые обновления через Server-Sent Events
+let eventSource = null;
+let streamTopics = '';
+function openStream(topics) {
+    const key = topics.join(',');
+    if (eventSource && key === streamTopics) return;
+    if (eventSource) eventSource.close();
+    streamTopics = key;
+    eventSource = new EventSource('/api/stream?topics=' + encodeURIComponent(key));
+    eventSource.addEventListener('post', e => {
+        const post = JSON.parse(e.data);
+        if (currentPostId === null && (!currentUser || post.author_id !== currentUser.id)) {
+            showLiveBanner('Появились новые посты', () => loadPosts(currentFilter, currentFilterValue));
+        }
+    });
+    eventSource.addEventListener('comment', e => {
+        const comment = JSON.parse(e.data);
+        if (comment.post_id === currentPostId && (!currentUser || comment.author_id !== currentUser.id)) {
+            showLiveBanner('Новые комментарии', () => loadPost(currentPostId));
+        }
+    });
+    eventSource.addEventListener('poll', e => {
+        const data = JSON.parse(e.data);
+        if (data.post_id === currentPostId) refreshPoll(currentPostId);
+    });
+    eventSource.addEventListener('answer', e => {
+        const answer = JSON.parse(e.data);
+        if (answer.post_id === currentPostId) showLiveBanner('Выбран ответ на вопрос', () => loadPost(currentPostId));
+    });
+    eventSource.addEventListener('votes', e => {
+        const votes = JSON.parse(e.data);
+        const key = votes.comment_id ? 'comment-' + votes.comment_id : 'post-' + votes.post_id;
+        document.querySelectorAll(`[data-votes="${key}"]`).forEach(el => {
+            el.querySelector('.like-btn').textContent = '👍 ' + votes.likes;
+            el.querySelector('.dislike-btn').textContent = '👎 ' + votes.dislikes;
+            el.querySelectorAll('.reaction-btn').forEach(btn => {
+                btn.querySelector('.reaction-count').textContent = votes.reactions[btn.dataset.reaction] || '';
+            });
+        });
+    });
+    eventSource.addEventListener('notification', e => {
+        const data = JSON.parse(e.data);
+        const el = document.getElementById('notification-count');
+        if (el) el.textContent = data.unread_count > 0 ? data.unread_count : '';
+    });
+    eventSource.addEventListener('message', e => {
+        const data = JSON.parse(e.data);
+        if (data.conversation_id === currentConversationId) {
+            openConversation(currentConversationId);
+        } else {
+            loadMessageCount();
+            if (document.getElementById('conversations')) loadConversations();
+        }
+    });
+    eventSource.addEventListener('conversation_read', e => {
+        const data = JSON.parse(e.data);
+        if (data.conversation_id === currentConversationId) openConversation(currentConversationId, false);
+    });
+    eventSource.addEventListener('badge', e => {
+        const badge = JSON.parse(e.data);
+        showLiveBanner(`Новый значок: ${badge.name}`, () => loadProfile(currentUser.id));
+    });
+    eventSource.addEventListener('draft', e => {
+        const draft = JSON.parse(e.data);
+        if (draft.error) {
+            showLiveBanner(`Не удалось опубликовать черновик: ${draft.error}`, () => loadDrafts());
+        } else {
+            showLiveBanner('Запланированный пост опубликован', () => loadPost(draft.post_id));
+        }
+    });
+    eventSource.addEventListener('reset', () => {
+        showLiveBanner('Страница устарела', () => location.reload());
+    });
+}
+function showLiveBanner(text, onClick) {
+    const el = document.getElementById('live-banner');
+    if (!el) return;
+    el.textContent = text + ' — нажмите, чтобы обновить';
+    el.onclick = onClick;
+    el.style.display = 'block';
+}
+function hideLiveBanner() {
+    const el = document.getElementById('live-banner');
+    if (el) el.style.display = 'none';
+}
+
 // Модальные окна
 function showLogin() {
     renderLoginModal();
@@ -19,11 +223,12 @@ function showRegister() {
     renderRegisterModal();
     document.getElementById('registerModal').style.display = 'block';
 }
-function showCreatePost() {
-    renderCreatePostModal();
+function showCreatePost(draft = null) {
+    renderCreatePostModal(draft);
     document.getElementById('createPostModal').style.display = 'block';
 }
 function closeModal(modalId) {
+    if (modalId === 'createPostModal') clearTimeout(draftAutosaveTimer);
     document.getElementById(modalId).style.display = 'none';
 }
 window.onclick = function(event) {
@@ -39,6 +244,7 @@ function fetchCurrentUser() {
             currentUser = user;
             renderAuthButtons();
             renderUserFilters();
+            loadNotificationCount();
         } else {
             currentUser = null;
             renderAuthButtons();
@@ -57,6 +263,10 @@ function renderAuthButtons() {
     if (currentUser) {
         el.innerHTML = `
             <span style="font-size:1.1rem;color:#1877f2;font-weight:500;margin-right:16px;">Привет, <b>${currentUser.username}</b>!</span>
+            <span class="notifications">
+                <button class="btn btn-secondary" onclick="toggleNotifications()">🔔 <span id="notification-count" class="notification-count"></span></button>
+                <div id="notifications-panel" class="notifications-panel" style="display:none;"></div>
+            </span>
             <button class="btn btn-primary" onclick="showCreatePost()">Создать пост</button>
             <button class="btn btn-secondary" onclick="logout()">Выйти</button>
         `;
@@ -73,9 +283,16 @@ function renderUserFilters() {
     if (currentUser) {
         el.innerHTML = `<h3>Мои фильтры</h3>
             <ul>
+                <li><a href="#" onclick="loadFeed(); return false;">Моя лента</a></li>
                 <li><a href="#" onclick="loadPosts('created', '')">Мои посты</a></li>
                 <li><a href="#" onclick="loadPosts('liked', '')">Понравившиеся</a></li>
+                <li><a href="#" onclick="loadBookmarks(); return false;">Сохранённое</a></li>
+                <li><a href="#" onclick="loadDrafts(); return false;">Черновики</a></li>
+                <li><a href="#" onclick="loadProfile(${currentUser.id}); return false;">Мой профиль</a></li>
+                <li><a href="#" onclick="loadConversations(); return false;">Сообщения <span id="message-count" class="notification-count"></span></a></li>
             </ul>`;
+        loadMessageCount();
+        loadFollows();
     } else {
         el.innerHTML = '';
     }
@@ -86,6 +303,10 @@ async function loadPosts(filter = '', value = '') {
     // Сохраняем текущий фильтр
     currentFilter = filter;
     currentFilterValue = value;
+    currentPostId = null;
+    currentConversationId = null;
+    openStream(['posts']);
+    hideLiveBanner();
     const container = document.getElementById('posts-container');
     container.innerHTML = '<div class="loading">Загрузка постов...</div>';
     let url = '/api/posts';
@@ -104,47 +325,55 @@ async function loadPosts(filter = '', value = '') {
         }
         const posts = await response.json();
         console.log('Posts loaded:', posts.length, 'posts');
+        const header = filter === 'category' ? renderCategoryHeader(value)
+            : filter === 'tag' ? `<h2 class="tag-header">#${escapeHTML(value)}</h2>` : '';
         if (!posts || posts.length === 0) {
-            container.innerHTML = '<p>Постов не найдено.</p>';
+            container.innerHTML = header + '<p>Постов не найдено.</p>';
             return;
         }
-        container.innerHTML = posts.map(post =>
-            `<div class="post post-clickable" onclick="if(event.target === this || event.target.classList.contains('post-main')){loadPost(${post.id});}">
-                ${renderAvatar(post.author_name)}
-                <div class="post-main">
-                    <div class="post-title">
-                        <a href="/post/${post.id}" onclick="loadPost(${post.id}); return false;">${post.title}</a>
-                        ${renderNewBadge(post.created)}
-                    </div>
-                    <div class="post-meta">
-                        Автор: ${post.author_name} | ${new Date(post.created).toLocaleString('ru-RU')}
-                    </div>
-                    <div class="post-content">${post.content.substring(0, 200)}${post.content.length > 200 ? '...' : ''}</div>
-                    <div class="post-categories">
-                        ${post.categories ? post.categories.map(cat => `<span class="category-tag">${cat}</span>`).join('') : ''}
-                    </div>
-                    <div class="post-actions">
-                        <button class="like-btn ${post.user_liked ? 'active' : ''}" onclick="toggleLike(${post.id}, null, true);event.stopPropagation();">👍 ${post.likes}</button>
-                        <button class="dislike-btn ${post.user_disliked ? 'active' : ''}" onclick="toggleLike(${post.id}, null, false);event.stopPropagation();">👎 ${post.dislikes}</button>
-                    </div>
-                </div>
-            </div>`
-        ).join('');
+        container.innerHTML = header + posts.map(renderPostCard).join('');
     } catch (error) {
         console.error('Error loading posts:', error);
         container.innerHTML = '<p>Ошибка загрузки постов: ' + error.message + '</p>';
     }
 }
 
+// Карточка поста в списке
+function renderPostCard(post) {
+    return `<div class="post post-clickable" onclick="if(event.target === this || event.target.classList.contains('post-main')){loadPost(${post.id});}">
+        ${renderAvatar(post.author_id)}
+        <div class="post-main">
+            <div class="post-title">
+                ${renderThreadMarkers(post)}<a href="/post/${post.id}" onclick="loadPost(${post.id}); return false;">${post.title}</a>
+                ${renderNewBadge(post.created, post.is_new)}
+                ${renderUnreadComments(post.unread_comments)}
+            </div>
+            <div class="post-meta">
+                Автор: ${renderAuthorLink(post.author_name, post.author_id)} | ${new Date(post.created).toLocaleString('ru-RU')} | 👁 ${post.views}
+            </div>
+            <div class="post-content">${escapeHTML(post.content.substring(0, 200))}${post.content.length > 200 ? '...' : ''}</div>
+            <div class="post-categories">
+                ${post.categories ? post.categories.map(cat => `<span class="category-tag">${cat}</span>`).join('') : ''}
+                ${renderPostTags(post.tags)}
+            </div>
+            <div class="post-actions" data-votes="post-${post.id}">
+                ${renderReactionButtons(post.id, null, post)}
+                ${renderBookmarkButton(post.bookmarked, post.id, null)}
+            </div>
+        </div>
+    </div>`;
+}
+
 // Загрузка категорий
 async function loadCategories() {
     try {
         const response = await fetch('/api/categories');
         const categories = await response.json();
         const categoriesList = document.getElementById('categories-list');
+        categoriesList.querySelectorAll('[data-server]').forEach(li => li.remove());
         categories.forEach(category => {
             const li = document.createElement('li');
-            li.innerHTML = `<a href="#" onclick="loadPosts('category', '${category.name}')">${category.name}</a>`;
+            li.innerHTML = renderCategoryItem(category);
             categoriesList.appendChild(li);
         });
     } catch (error) {
@@ -152,21 +381,77 @@ async function loadCategories() {
     }
 }
 
+// Облако тегов: размер шрифта растёт с числом постов
+async function loadTagCloud() {
+    const el = document.getElementById('tag-cloud');
+    if (!el) return;
+    try {
+        const response = await fetch('/api/tags?limit=30');
+        const tags = await response.json();
+        const max = Math.max(1, ...tags.map(t => t.count));
+        el.innerHTML = tags.length === 0 ? '<small>Тегов пока нет</small>' : tags.map(t =>
+            `<a href="#" class="cloud-tag" style="font-size: ${(0.8 + 0.7 * t.count / max).toFixed(2)}rem" title="${t.count}" onclick="loadPosts('tag', '${t.name}'); return false;">#${t.name}</a>`
+        ).join(' ');
+    } catch (error) {
+        console.error('Error loading tags:', error);
+    }
+}
+// Теги поста; имена тегов состоят только из букв, цифр и -+#.
+function renderPostTags(tags) {
+    return (tags || []).map(tag =>
+        `<a href="#" class="post-tag" onclick="event.stopPropagation(); loadPosts('tag', '${tag}'); return false;">#${tag}</a>`
+    ).join('');
+}
+
+// Категория со вложенными подкатегориями
+function renderCategoryItem(category) {
+    categoryIds[category.name] = category.id;
+    let html = `<a href="/category/${encodeURIComponent(category.name)}" onclick="loadPosts('category', '${category.name}'); return false;">${category.name}</a>`;
+    if (category.children && category.children.length > 0) {
+        html += '<ul class="subcategories">' +
+            category.children.map(child => `<li>${renderCategoryItem(child)}</li>`).join('') +
+            '</ul>';
+    }
+    return html;
+}
+
+// Дерево категорий в плоский список с уровнем вложенности
+function flattenCategories(categories, depth = 0) {
+    return categories.flatMap(category => [
+        { name: category.name, depth: depth },
+        ...flattenCategories(category.children || [], depth + 1)
+    ]);
+}
+
 // Загрузка конкретного поста
 async function loadPost(postId) {
+    currentPostId = Number(postId);
+    currentConversationId = null;
+    openStream(['posts', 'post:' + postId]);
+    hideLiveBanner();
     const container = document.getElementById('posts-container');
     container.innerHTML = '<div class="loading">Загрузка поста...</div>';
     try {
         const response = await fetch('/api/post/' + postId);
         const data = await response.json();
+        currentComments = data.comments || [];
+        currentComments.forEach(c => { if (serverUnreadComments.has(c.id)) c.is_new = true; });
+        serverUnreadComments.clear();
         let commentForm = '';
-        if (currentUser) {
+        if (data.post.locked) {
+            commentForm = '<p>🔒 Обсуждение закрыто модератором.</p>';
+        } else if (currentUser) {
             commentForm =
                 `<form id="commentForm" style="margin-bottom: 20px;">
                     <div class="form-group">
                         <textarea name="content" placeholder="Написать комментарий..." required></textarea>
                     </div>
+                    <div class="form-group">
+                        <input type="file" id="commentFiles" multiple accept="image/*,.pdf,.txt,.zip">
+                    </div>
                     <input type="hidden" name="post_id" value="${data.post.id}">
+                    <input type="hidden" name="parent_id" value="">
+                    <div id="replyTarget" class="reply-target"></div>
                     <div id="commentError" class="error" style="color: red; margin-bottom: 10px;"></div>
                     <button type="submit" class="btn btn-primary">Добавить комментарий</button>
                 </form>`;
@@ -175,15 +460,18 @@ async function loadPost(postId) {
         }
         container.innerHTML =
             `<div class="post">
-                ${renderAvatar(data.post.author_name)}
+                ${renderAvatar(data.post.author_id)}
                 <div class="post-main">
-                    <div class="post-title">${data.post.title} ${renderNewBadge(data.post.created)}</div>
-                    <div class="post-meta">Автор: ${data.post.author_name} | ${new Date(data.post.created).toLocaleString('ru-RU')}</div>
-                    <div class="post-content">${data.post.content}</div>
-                    <div class="post-categories">${(data.post.categories || []).map(cat => `<span class="category-tag">${cat}</span>`).join('')}</div>
-                    <div class="post-actions">
-                        <button class="like-btn ${data.post.user_liked ? 'active' : ''}" onclick="toggleLike(${data.post.id}, null, true)">👍 ${data.post.likes}</button>
-                        <button class="dislike-btn ${data.post.user_disliked ? 'active' : ''}" onclick="toggleLike(${data.post.id}, null, false)">👎 ${data.post.dislikes}</button>
+                    <div class="post-title">${renderThreadMarkers(data.post)}${data.post.title} ${renderNewBadge(data.post.created)}</div>
+                    <div class="post-meta">Автор: ${renderAuthorLink(data.post.author_name, data.post.author_id)} | ${new Date(data.post.created).toLocaleString('ru-RU')} | 👁 ${data.post.views}</div>
+                    <div class="post-content markdown" id="post-body">${data.post.content_html}</div>
+                    ${renderAttachments(data.post.attachments)}
+                    <div id="poll-container">${renderPoll(data.post.poll)}</div>
+                    <div class="post-categories">${(data.post.categories || []).map(cat => `<span class="category-tag">${cat}</span>`).join('')}${renderPostTags(data.post.tags)}</div>
+                    <div class="post-actions" data-votes="post-${data.post.id}">
+                        ${renderReactionButtons(data.post.id, null, data.post)}
+                        ${renderBookmarkButton(data.post.bookmarked, data.post.id, null)}
+                        ${renderFollowButton('post', data.post.id)}
                     </div>
                 </div>
             </div>
@@ -192,14 +480,17 @@ async function loadPost(postId) {
                 ${commentForm}
                 <div id="comments-container">
                     ${(data.comments || []).map(comment =>
-                        `<div class="post">
-                            ${renderAvatar(comment.author_name)}
+                        `<div class="post ${comment.accepted ? 'accepted-answer' : ''} ${comment.is_new ? 'comment-unread' : ''}" id="comment-${comment.id}">
+                            ${renderAvatar(comment.author_id)}
                             <div class="post-main">
-                                <div class="post-meta">${comment.author_name} | ${new Date(comment.created).toLocaleString('ru-RU')}</div>
-                                <div class="post-content">${comment.content}</div>
-                                <div class="post-actions">
-                                    <button class="like-btn ${comment.user_liked ? 'active' : ''}" onclick="toggleLike(null, ${comment.id}, true)">👍 ${comment.likes}</button>
-                                    <button class="dislike-btn ${comment.user_disliked ? 'active' : ''}" onclick="toggleLike(null, ${comment.id}, false)">👎 ${comment.dislikes}</button>
+                                <div class="post-meta">${comment.is_new ? '<span class="badge-new">новый</span> ' : ''}${comment.accepted ? '<span class="accepted-marker">✔ Принятый ответ</span> ' : ''}${renderAuthorLink(comment.author_name, comment.author_id)}${renderReplyTo(comment, data.comments)} | ${new Date(comment.created).toLocaleString('ru-RU')}</div>
+                                <div class="post-content markdown" id="comment-body-${comment.id}">${comment.content_html}</div>
+                                ${renderAttachments(comment.attachments)}
+                                <div class="post-actions" data-votes="comment-${comment.id}">
+                                    ${renderReactionButtons(null, comment.id, comment)}
+                                    ${renderBookmarkButton(comment.bookmarked, data.post.id, comment.id)}
+                                    ${currentUser && !data.post.locked ? `<button class="btn btn-secondary" onclick="replyTo(${comment.id})">Ответить</button>` : ''}
+                                    ${renderAcceptButton(data.post, comment)}
                                 </div>
                             </div>
                         </div>`
@@ -207,14 +498,131 @@ async function loadPost(postId) {
                 </div>
             </div>
             <button class="btn btn-secondary" onclick="loadPosts()" style="margin-top: 20px;">← Назад к постам</button>`;
-        if (currentUser) {
-            document.getElementById('commentForm').addEventListener('submit', handleCommentSubmit);
+        linkMentions(document.getElementById('post-body'), data.post.mentions);
+        currentComments.forEach(comment =>
+            linkMentions(document.getElementById('comment-body-' + comment.id), comment.mentions));
+        const commentFormEl = document.getElementById('commentForm');
+        if (commentFormEl) {
+            attachMentionAutocomplete(commentFormEl.elements.content);
+            commentFormEl.addEventListener('submit', handleCommentSubmit);
         }
+        const anchor = location.hash.startsWith('#comment-') && document.getElementById(location.hash.slice(1));
+        if (anchor) anchor.scrollIntoView();
     } catch (error) {
         container.innerHTML = '<p>Ошибка загрузки поста.</p>';
     }
 }
 
+// Профиль пользователя с последней активностью
+async function loadProfile(userId, page = 1) {
+    currentPostId = null;
+    currentConversationId = null;
+    hideLiveBanner();
+    const container = document.getElementById('posts-container');
+    container.innerHTML = '<div class="loading">Загрузка профиля...</div>';
+    try {
+        const response = await fetch(`/api/users/${userId}?page=${page}`);
+        const profile = await response.json();
+        if (!response.ok) {
+            container.innerHTML = `<p>${escapeHTML(profile.error || 'Профиль не найден.')}</p>`;
+            return;
+        }
+        const isOwn = currentUser && currentUser.id === profile.id;
+        currentProfile = profile;
+        container.innerHTML =
+            `<div class="profile">
+                <img class="profile-avatar" src="${profile.avatar_url}" alt="">
+                <div class="post-main">
+                    <h2>${escapeHTML(profile.username)}</h2>
+                    <div class="post-meta">${profile.location ? '📍 ' + escapeHTML(profile.location) + ' | ' : ''}На форуме с ${new Date(profile.created).toLocaleDateString('ru-RU')}</div>
+                    <p class="profile-bio">${escapeHTML(profile.bio)}</p>
+                    ${renderBadges(profile.badges)}
+                    <div class="profile-stats">Уровень доверия: ${escapeHTML(profile.trust_level_name)} | Репутация: <b>${profile.reputation}</b> | Постов: ${profile.post_count} | Комментариев: ${profile.comment_count} | Получено лайков: ${profile.likes_received}</div>
+                    ${currentUser && !isOwn ? `<div class="profile-actions">
+                        <button class="btn btn-primary" onclick="messageProfileUser()">Написать сообщение</button>
+                        ${renderFollowButton('user', profile.id)}
+                        <button class="btn btn-secondary" id="blockButton" onclick="toggleBlock(${profile.id})">Заблокировать</button>
+                    </div>` : ''}
+                </div>
+            </div>
+            ${isOwn ? renderProfileForm(profile) : ''}
+            <h3>Последняя активность</h3>
+            ${profile.activity.length === 0 ? '<p>Пока ничего нет.</p>' : profile.activity.map(item =>
+                `<div class="post post-clickable" onclick="loadPost(${item.post_id})">
+                    <div class="post-main">
+                        <div class="post-meta">${item.type === 'post' ? 'Пост' : 'Комментарий к посту'} «${escapeHTML(item.post_title)}» | ${new Date(item.created).toLocaleString('ru-RU')}</div>
+                        <div class="post-content">${escapeHTML(item.excerpt)}</div>
+                    </div>
+                </div>`
+            ).join('')}
+            <div class="pagination">
+                ${page > 1 ? `<button class="btn btn-secondary" onclick="loadProfile(${userId}, ${page - 1})">← Назад</button>` : ''}
+                ${profile.has_more ? `<button class="btn btn-secondary" onclick="loadProfile(${userId}, ${page + 1})">Дальше →</button>` : ''}
+            </div>`;
+        if (currentUser && !isOwn) renderBlockButton(profile.id);
+        const form = document.getElementById('profileForm');
+        if (form) {
+            form.elements.location.value = profile.location;
+            form.addEventListener('submit', handleProfileSubmit);
+        }
+    } catch (error) {
+        container.innerHTML = '<p>Ошибка загрузки профиля.</p>';
+    }
+}
+function renderProfileForm(profile) {
+    return `<form id="profileForm" class="profile-form">
+            <div class="form-group">
+                <label for="profileBio">О себе (до 500 символов):</label>
+                <textarea id="profileBio" name="bio" maxlength="500">${escapeHTML(profile.bio)}</textarea>
+            </div>
+            <div class="form-group">
+                <label for="profileLocation">Местоположение:</label>
+                <input type="text" id="profileLocation" name="location" maxlength="100">
+            </div>
+            <div class="form-group">
+                <label for="profileAvatar">Новый аватар:</label>
+                <input type="file" id="profileAvatar" accept="image/jpeg,image/png,image/gif">
+            </div>
+            <div id="profileError" class="error"></div>
+            <button type="submit" class="btn btn-primary">Сохранить</button>
+            <button type="button" class="btn btn-secondary" onclick="removeAvatar(${profile.id})">Удалить аватар</button>
+        </form>`;
+}
+async function handleProfileSubmit(e) {
+    e.preventDefault();
+    const errorElement = document.getElementById('profileError');
+    const file = document.getElementById('profileAvatar').files[0];
+    try {
+        if (file) {
+            const avatarData = new FormData();
+            avatarData.append('avatar', file);
+            const avatarResponse = await fetch('/api/user/avatar', { method: 'POST', body: avatarData });
+            if (!avatarResponse.ok) {
+                const data = await avatarResponse.json();
+                errorElement.textContent = data.error || 'Ошибка загрузки аватара';
+                return;
+            }
+        }
+        const response = await fetch('/api/user/profile', {
+            method: 'POST',
+            headers: { 'Content-Type': 'application/x-www-form-urlencoded' },
+            body: new URLSearchParams(new FormData(this))
+        });
+        if (!response.ok) {
+            const data = await response.json();
+            errorElement.textContent = data.error || 'Ошибка сохранения профиля';
+            return;
+        }
+        loadProfile(currentUser.id);
+    } catch (error) {
+        errorElement.textContent = 'Ошибка сохранения профиля';
+    }
+}
+async function removeAvatar(userId) {
+    await fetch('/api/user/avatar', { method: 'DELETE' });
+    loadProfile(userId);
+}
+
 // Лайк/дизлайк
 async function toggleLike(postId, commentId, isLike) {
     if (!currentUser) {
@@ -261,12 +669,78 @@ async function toggleLike(postId, commentId, isLike) {
         } else {
             const error = await response.json();
             console.error('Like error:', error);
+            // Голосование открывается с первого уровня доверия и ограничено по частоте
+            if (response.status === 403 || response.status === 429) {
+                alert(error.error);
+            }
         }
     } catch (error) {
         console.error('Error toggling like:', error);
     }
 }
 
+// Реакции: лайк и дизлайк влияют на рейтинг, остальные — просто эмодзи
+async function loadReactionTypes() {
+    try {
+        const response = await fetch('/api/reactions/types');
+        reactionTypes = await response.json();
+    } catch (error) {
+        console.error('Error loading reactions:', error);
+    }
+}
+function renderReactionButtons(postId, commentId, item) {
+    const counts = item.reactions || {};
+    const mine = item.user_reactions || [];
+    const target = postId ? `${postId}, null` : `null, ${commentId}`;
+    return `<button class="like-btn ${item.user_liked ? 'active' : ''}" onclick="toggleLike(${target}, true);event.stopPropagation();">👍 ${item.likes}</button>
+        <button class="dislike-btn ${item.user_disliked ? 'active' : ''}" onclick="toggleLike(${target}, false);event.stopPropagation();">👎 ${item.dislikes}</button>
+        ${reactionTypes.filter(t => !t.score).map(t =>
+            `<button class="reaction-btn ${mine.includes(t.key) ? 'active' : ''}" data-reaction="${t.key}" onclick="toggleReaction(${target}, '${t.key}', this);event.stopPropagation();">${escapeHTML(t.emoji)}<span class="reaction-count">${counts[t.key] || ''}</span></button>`
+        ).join('')}
+        <button class="btn-link reactors-btn" title="Кто отреагировал" onclick="showReactors(${target});event.stopPropagation();">👥</button>`;
+}
+async function toggleReaction(postId, commentId, reaction, button) {
+    if (!currentUser) {
+        alert('Войдите, чтобы ставить реакции');
+        return;
+    }
+    const body = new URLSearchParams({ reaction: reaction });
+    if (postId) body.append('post_id', postId);
+    if (commentId) body.append('comment_id', commentId);
+    const response = await fetch('/api/reactions', {
+        method: 'POST',
+        headers: { 'Content-Type': 'application/x-www-form-urlencoded' },
+        body: body
+    });
+    const data = await response.json();
+    if (!response.ok) {
+        alert(data.error || 'Ошибка');
+        return;
+    }
+    // Обновляем только кнопки этого поста или комментария
+    button.closest('[data-votes]').querySelectorAll('.reaction-btn').forEach(btn => {
+        btn.classList.toggle('active', data.user_reactions.includes(btn.dataset.reaction));
+        btn.querySelector('.reaction-count').textContent = data.reactions[btn.dataset.reaction] || '';
+    });
+}
+async function showReactors(postId, commentId) {
+    const response = await fetch('/api/reactions?' + (postId ? `post_id=${postId}` : `comment_id=${commentId}`));
+    const data = await response.json();
+    const emoji = Object.fromEntries(reactionTypes.map(t => [t.key, t.emoji]));
+    const modal = document.getElementById('reactorsModal');
+    modal.innerHTML = `
+        <div class="modal-content">
+            <span class="close" onclick="closeModal('reactorsModal')">&times;</span>
+            <h2>Реакции</h2>
+            ${!response.ok ? `<p>${escapeHTML(data.error || 'Ошибка загрузки')}</p>`
+                : data.reactions.length === 0 ? '<p>Реакций пока нет.</p>'
+                : `<ul class="reactors">${data.reactions.map(r =>
+                    `<li>${escapeHTML(emoji[r.reaction] || r.reaction)} <a href="#" onclick="closeModal('reactorsModal'); loadProfile(${r.user_id}); return false;">${escapeHTML(r.username)}</a></li>`
+                ).join('')}</ul>${data.has_more ? '<p>…и другие</p>' : ''}`}
+        </div>`;
+    modal.style.display = 'block';
+}
+
 // Обработчики форм
 function renderLoginModal() {
     document.getElementById('loginModal').innerHTML = `
@@ -356,19 +830,21 @@ function renderRegisterModal() {
         }
     });
 }
-function renderCreatePostModal() {
+function renderCreatePostModal(draft = null) {
+    currentDraft = draft;
+    clearTimeout(draftAutosaveTimer);
     // Сначала загрузим категории для выпадающего списка
     fetch('/api/categories')
         .then(response => response.json())
         .then(categories => {
-            const categoryOptions = categories.map(cat => 
-                `<option value="${cat.name}">${cat.name}</option>`
+            const categoryOptions = flattenCategories(categories).map(cat =>
+                `<option value="${cat.name}">${'— '.repeat(cat.depth)}${cat.name}</option>`
             ).join('');
             
             document.getElementById('createPostModal').innerHTML = `
                 <div class="modal-content">
                     <span class="close" onclick="closeModal('createPostModal')">&times;</span>
-                    <h2>Создать пост</h2>
+                    <h2>${draft ? 'Черновик' : 'Создать пост'}</h2>
                     <form id="createPostForm">
                         <div class="form-group">
                             <label for="postTitle">Заголовок (5-100 символов):</label>
@@ -385,33 +861,103 @@ function renderCreatePostModal() {
                             </select>
                             <small>Удерживайте Ctrl (Cmd на Mac) для выбора нескольких категорий</small>
                         </div>
+                        <div class="form-group">
+                            <label for="postTags">Теги (до 5, через запятую):</label>
+                            <input type="text" id="postTags" name="tags" placeholder="например: go, базы данных">
+                        </div>
+                        <div class="form-group">
+                            <label for="postFiles">Вложения (изображения, PDF, TXT, ZIP):</label>
+                            <div id="draftAttachments" class="draft-attachments">${renderDraftAttachments(draft)}</div>
+                            <input type="file" id="postFiles" multiple accept="image/*,.pdf,.txt,.zip">
+                        </div>
+                        <details class="poll-fields">
+                            <summary>Добавить опрос</summary>
+                            <div class="form-group">
+                                <label for="pollQuestion">Вопрос:</label>
+                                <input type="text" id="pollQuestion" name="poll_question" maxlength="200">
+                            </div>
+                            <div class="form-group">
+                                <label for="pollOptions">Варианты ответа (от 2 до 10, по одному в строке):</label>
+                                <textarea id="pollOptions" name="poll_options_text"></textarea>
+                            </div>
+                            <div class="form-group">
+                                <label><input type="checkbox" name="poll_multiple" value="true"> Можно выбрать несколько вариантов</label>
+                            </div>
+                            <div class="form-group">
+                                <label for="pollResults">Результаты:</label>
+                                <select id="pollResults" name="poll_results">
+                                    <option value="always">видны всем</option>
+                                    <option value="after_vote">видны после голосования</option>
+                                    <option value="after_close">скрыты до закрытия опроса</option>
+                                </select>
+                            </div>
+                            <div class="form-group">
+                                <label for="pollCloses">Закрыть опрос (необязательно):</label>
+                                <input type="datetime-local" id="pollCloses" name="poll_closes">
+                            </div>
+                        </details>
+                        <div class="form-group draft-schedule">
+                            <label for="draftPublishAt">Опубликовать позже:</label>
+                            <input type="datetime-local" id="draftPublishAt">
+                            <button type="button" class="btn btn-secondary" onclick="scheduleCurrentDraft()">Запланировать</button>
+                        </div>
                         <div id="createPostError" class="error"></div>
-                        <button type="submit" class="btn btn-primary">Создать</button>
+                        <div id="draftStatus" class="draft-status"></div>
+                        <button type="submit" class="btn btn-primary">Опубликовать</button>
+                        <button type="button" class="btn btn-secondary" onclick="saveCurrentDraft()">Сохранить черновик</button>
                     </form>
                 </div>`;
             
-            document.getElementById('createPostForm').addEventListener('submit', async function(e) {
+            const form = document.getElementById('createPostForm');
+            if (draft) fillPostForm(form, draft);
+            attachMentionAutocomplete(document.getElementById('postContent'));
+
+            // Черновик сохраняется сам через пару секунд после последней правки
+            const scheduleAutosave = () => {
+                clearTimeout(draftAutosaveTimer);
+                draftAutosaveTimer = setTimeout(() => {
+                    if (form.elements.title.value.trim() || form.elements.content.value.trim()) saveCurrentDraft();
+                }, 2000);
+            };
+            form.addEventListener('input', scheduleAutosave);
+            form.addEventListener('change', e => { if (e.target.type !== 'file') scheduleAutosave(); });
+
+            form.addEventListener('submit', async function(e) {
                 e.preventDefault();
-                const formData = new FormData(this);
-                
-                // Получить выбранные категории из select
-                const categorySelect = document.getElementById('postCategories');
-                const selectedCategories = Array.from(categorySelect.selectedOptions).map(option => option.value);
-                formData.set('categories', selectedCategories.join(','));
+                clearTimeout(draftAutosaveTimer);
+                const formData = postFormData(this);
                 
-                const urlEncodedData = new URLSearchParams(formData);
                 try {
-                    const response = await fetch('/api/posts', {
-                        method: 'POST',
-                        headers: {
-                            'Content-Type': 'application/x-www-form-urlencoded',
-                        },
-                        body: urlEncodedData
-                    });
+                    formData.set('attachments', await uploadAttachments(document.getElementById('postFiles').files));
+                } catch (error) {
+                    document.getElementById('createPostError').textContent = error.message;
+                    return;
+                }
+
+                try {
+                    let response;
+                    if (currentDraft) {
+                        // Черновик публикуется со всеми своими вложениями
+                        const ids = (currentDraft.attachments || []).map(a => a.id);
+                        if (formData.get('attachments')) ids.push(formData.get('attachments'));
+                        formData.set('attachments', ids.join(','));
+                        if (!await saveCurrentDraft(formData)) return;
+                        response = await fetch(`/api/drafts/${currentDraft.id}/publish`, { method: 'POST' });
+                    } else {
+                        response = await fetch('/api/posts', {
+                            method: 'POST',
+                            headers: {
+                                'Content-Type': 'application/x-www-form-urlencoded',
+                            },
+                            body: new URLSearchParams(formData)
+                        });
+                    }
                     if (response.ok) {
+                        currentDraft = null;
                         closeModal('createPostModal');
                         this.reset();
                         loadPosts();
+                        loadTagCloud();
                     } else {
                         const data = await response.json();
                         document.getElementById('createPostError').textContent = data.error || 'Ошибка создания поста';
@@ -443,10 +989,178 @@ function renderCreatePostModal() {
                 </div>`;
         });
 }
+// Поля формы поста в том виде, в каком их ждёт сервер (без вложений)
+function postFormData(form) {
+    const formData = new FormData(form);
+    
+    // Получить выбранные категории из select
+    const categorySelect = document.getElementById('postCategories');
+    const selectedCategories = Array.from(categorySelect.selectedOptions).map(option => option.value);
+    formData.set('categories', selectedCategories.join(','));
+
+    // Варианты опроса отправляются отдельными полями poll_option
+    formData.delete('poll_options_text');
+    document.getElementById('pollOptions').value.split('\n')
+        .map(option => option.trim()).filter(Boolean)
+        .forEach(option => formData.append('poll_option', option));
+    if (formData.get('poll_closes')) {
+        formData.set('poll_closes', new Date(formData.get('poll_closes')).toISOString());
+    }
+    return formData;
+}
+// Значение для поля datetime-local в местном времени
+function toLocalInputValue(date) {
+    const d = new Date(date);
+    d.setMinutes(d.getMinutes() - d.getTimezoneOffset());
+    return d.toISOString().slice(0, 16);
+}
+function fillPostForm(form, draft) {
+    const field = name => (draft.fields[name] || [''])[0];
+    form.elements.title.value = field('title');
+    form.elements.content.value = field('content');
+    form.elements.tags.value = field('tags');
+    const categories = field('categories').split(',');
+    Array.from(document.getElementById('postCategories').options).forEach(option => {
+        option.selected = categories.includes(option.value);
+    });
+    if (field('poll_question')) {
+        form.querySelector('.poll-fields').open = true;
+        form.elements.poll_question.value = field('poll_question');
+        document.getElementById('pollOptions').value = (draft.fields.poll_option || []).join('\n');
+        form.elements.poll_multiple.checked = field('poll_multiple') === 'true';
+        form.elements.poll_results.value = field('poll_results') || 'always';
+        if (field('poll_closes')) form.elements.poll_closes.value = toLocalInputValue(field('poll_closes'));
+    }
+    if (draft.publish_at) document.getElementById('draftPublishAt').value = toLocalInputValue(draft.publish_at);
+    if (draft.error) document.getElementById('createPostError').textContent = 'Публикация не удалась: ' + draft.error;
+}
+function renderDraftAttachments(draft) {
+    if (!draft || !draft.attachments) return '';
+    return 'В черновике: ' + draft.attachments.map(a => escapeHTML(a.filename)).join(', ');
+}
+// Сохраняет открытый в форме черновик (или создаёт новый) и возвращает true при успехе
+async function saveCurrentDraft(formData = null) {
+    clearTimeout(draftAutosaveTimer);
+    const form = document.getElementById('createPostForm');
+    if (!form) return false;
+    formData = formData || postFormData(form);
+    const response = await fetch(currentDraft ? `/api/drafts/${currentDraft.id}` : '/api/drafts', {
+        method: 'POST',
+        headers: { 'Content-Type': 'application/x-www-form-urlencoded' },
+        body: new URLSearchParams(formData)
+    });
+    const data = await response.json();
+    const status = document.getElementById('draftStatus');
+    if (!response.ok) {
+        if (status) status.textContent = 'Черновик не сохранён: ' + (data.error || 'ошибка');
+        return false;
+    }
+    currentDraft = data;
+    if (formData.has('attachments')) {
+        // Загруженные файлы теперь хранятся в черновике
+        document.getElementById('postFiles').value = '';
+        document.getElementById('draftAttachments').innerHTML = renderDraftAttachments(data);
+    }
+    if (status) status.textContent = 'Черновик сохранён в ' + new Date().toLocaleTimeString('ru-RU');
+    return true;
+}
+async function scheduleCurrentDraft() {
+    const value = document.getElementById('draftPublishAt').value;
+    const errorElement = document.getElementById('createPostError');
+    if (!value) {
+        errorElement.textContent = 'Укажите время публикации';
+        return;
+    }
+    const formData = postFormData(document.getElementById('createPostForm'));
+    const files = document.getElementById('postFiles').files;
+    if (files.length > 0) {
+        try {
+            const ids = (currentDraft && currentDraft.attachments || []).map(a => a.id);
+            ids.push(await uploadAttachments(files));
+            formData.set('attachments', ids.join(','));
+        } catch (error) {
+            errorElement.textContent = error.message;
+            return;
+        }
+    }
+    if (!await saveCurrentDraft(formData)) return;
+    const response = await fetch(`/api/drafts/${currentDraft.id}/schedule`, {
+        method: 'POST',
+        headers: { 'Content-Type': 'application/x-www-form-urlencoded' },
+        body: new URLSearchParams({ publish_at: new Date(value).toISOString() })
+    });
+    const data = await response.json();
+    if (!response.ok) {
+        errorElement.textContent = data.error || 'Ошибка планирования';
+        return;
+    }
+    currentDraft = null;
+    closeModal('createPostModal');
+    loadDrafts();
+}
+async function loadDrafts() {
+    currentPostId = null;
+    currentConversationId = null;
+    hideLiveBanner();
+    const container = document.getElementById('posts-container');
+    const response = await fetch('/api/drafts');
+    if (!response.ok) {
+        container.innerHTML = '<p>Ошибка загрузки черновиков.</p>';
+        return;
+    }
+    const drafts = await response.json();
+    container.innerHTML =
+        `<h2>Черновики</h2>
+        ${drafts.length === 0 ? '<p>Черновиков нет.</p>' : drafts.map(d => {
+            const title = (d.fields.title || [''])[0] || 'Без названия';
+            return `<div class="post">
+                <div class="post-main">
+                    <div class="post-title">${escapeHTML(title)}</div>
+                    <div class="post-meta">Изменён ${new Date(d.updated).toLocaleString('ru-RU')}${d.publish_at ? ` | <span class="draft-scheduled">Будет опубликован ${new Date(d.publish_at).toLocaleString('ru-RU')}</span>` : ''}</div>
+                    ${d.error ? `<div class="error">Публикация не удалась: ${escapeHTML(d.error)}</div>` : ''}
+                    <div class="post-actions">
+                        <button class="btn btn-primary" onclick="openDraft(${d.id})">Открыть</button>
+                        <button class="btn btn-secondary" onclick="publishDraft(${d.id})">Опубликовать</button>
+                        ${d.publish_at ? `<button class="btn btn-secondary" onclick="unscheduleDraft(${d.id})">Отменить публикацию</button>` : ''}
+                        <button class="btn btn-secondary" onclick="deleteDraft(${d.id})">Удалить</button>
+                    </div>
+                </div>
+            </div>`;
+        }).join('')}`;
+}
+async function openDraft(id) {
+    const response = await fetch(`/api/drafts/${id}`);
+    if (!response.ok) {
+        loadDrafts();
+        return;
+    }
+    showCreatePost(await response.json());
+}
+async function publishDraft(id) {
+    const response = await fetch(`/api/drafts/${id}/publish`, { method: 'POST' });
+    const data = await response.json();
+    if (!response.ok) {
+        alert(data.error || 'Ошибка публикации');
+        return;
+    }
+    loadPost(data.post_id);
+}
+async function unscheduleDraft(id) {
+    await fetch(`/api/drafts/${id}/schedule`, {
+        method: 'POST',
+        headers: { 'Content-Type': 'application/x-www-form-urlencoded' },
+        body: new URLSearchParams({ publish_at: '' })
+    });
+    loadDrafts();
+}
+async function deleteDraft(id) {
+    if (!confirm('Удалить черновик?')) return;
+    await fetch(`/api/drafts/${id}`, { method: 'DELETE' });
+    loadDrafts();
+}
 async function handleCommentSubmit(e) {
     e.preventDefault();
     const formData = new FormData(this);
-    const urlEncodedData = new URLSearchParams(formData);
     
     // Clear previous error
     const errorElement = document.getElementById('commentError');
@@ -454,6 +1168,14 @@ async function handleCommentSubmit(e) {
         errorElement.textContent = '';
     }
     
+    try {
+        formData.set('attachments', await uploadAttachments(document.getElementById('commentFiles').files));
+    } catch (error) {
+        errorElement.textContent = error.message;
+        return;
+    }
+    const urlEncodedData = new URLSearchParams(formData);
+    
     try {
         const response = await fetch('/api/comments', {
             method: 'POST',
@@ -501,13 +1223,633 @@ async function logout() {
     }
 }
 
-// Вспомогательная функция для аватарки
-function renderAvatar(username) {
-    const initial = username && username.length > 0 ? username[0].toUpperCase() : '?';
-    return `<div class="avatar">${initial}</div>`;
+// Экранирование текста перед вставкой в HTML
+function escapeHTML(text) {
+    const div = document.createElement('div');
+    div.textContent = text;
+    return div.innerHTML;
+}
+// Загрузка вложений; возвращает их ID через запятую
+async function uploadAttachments(files) {
+    const ids = [];
+    for (const file of files) {
+        const formData = new FormData();
+        formData.append('file', file);
+        const response = await fetch('/api/attachments', { method: 'POST', body: formData });
+        const data = await response.json();
+        if (!response.ok) {
+            throw new Error(`${file.name}: ${data.error || 'ошибка загрузки'}`);
+        }
+        ids.push(data.id);
+    }
+    return ids.join(',');
+}
+// Вложения поста или комментария: миниатюры изображений и ссылки на файлы
+function renderAttachments(attachments) {
+    if (!attachments || attachments.length === 0) return '';
+    return '<div class="attachments">' + attachments.map(a => a.thumbnail_url
+        ? `<a href="${a.url}" target="_blank"><img src="${a.thumbnail_url}" alt="Вложение"></a>`
+        : `<a class="attachment-file" href="${a.url}">📎 ${escapeHTML(a.filename)} (${Math.ceil(a.size / 1024)} КБ)</a>`
+    ).join('') + '</div>';
+}
+// Ссылки на профили упомянутых пользователей (@username) в тексте поста или комментария
+function linkMentions(root, mentions) {
+    if (!root || !mentions || mentions.length === 0) return;
+    const ids = {};
+    mentions.forEach(m => { ids[m.username.toLowerCase()] = m.user_id; });
+    const walker = document.createTreeWalker(root, NodeFilter.SHOW_TEXT);
+    const nodes = [];
+    while (walker.nextNode()) {
+        if (!walker.currentNode.parentElement.closest('a, code, pre')) nodes.push(walker.currentNode);
+    }
+    nodes.forEach(node => {
+        const parts = node.textContent.split(/(@[\p{L}\p{N}_.\-]+)/u);
+        if (parts.length === 1) return;
+        const fragment = document.createDocumentFragment();
+        parts.forEach(part => {
+            const name = part.startsWith('@') ? part.slice(1).replace(/[.\-]+$/, '') : '';
+            if (name && ids[name.toLowerCase()]) {
+                const link = document.createElement('a');
+                link.href = '#';
+                link.className = 'mention';
+                link.textContent = '@' + name;
+                link.onclick = () => { loadProfile(ids[name.toLowerCase()]); return false; };
+                fragment.appendChild(link);
+                fragment.appendChild(document.createTextNode(part.slice(name.length + 1)));
+            } else {
+                fragment.appendChild(document.createTextNode(part));
+            }
+        });
+        node.replaceWith(fragment);
+    });
+}
+// Подсказки имён пользователей при вводе @ в текстовом поле
+function attachMentionAutocomplete(textarea) {
+    if (!textarea) return;
+    const list = document.createElement('ul');
+    list.className = 'mention-suggestions';
+    list.style.display = 'none';
+    textarea.insertAdjacentElement('afterend', list);
+    let requestId = 0;
+    textarea.addEventListener('input', async () => {
+        const before = textarea.value.slice(0, textarea.selectionStart);
+        const match = before.match(/(?:^|[^\p{L}\p{N}_@])@([\p{L}\p{N}_.\-]{1,50})$/u);
+        if (!match) {
+            list.style.display = 'none';
+            return;
+        }
+        const current = ++requestId;
+        const response = await fetch('/api/users/autocomplete?prefix=' + encodeURIComponent(match[1]));
+        const users = response.ok ? await response.json() : [];
+        if (current !== requestId) return;
+        if (users.length === 0) {
+            list.style.display = 'none';
+            return;
+        }
+        list.innerHTML = '';
+        users.forEach(user => {
+            const item = document.createElement('li');
+            item.textContent = '@' + user.username;
+            item.onmousedown = e => {
+                e.preventDefault();
+                const start = before.length - match[1].length;
+                textarea.value = textarea.value.slice(0, start) + user.username + ' ' + textarea.value.slice(textarea.selectionStart);
+                textarea.selectionStart = textarea.selectionEnd = start + user.username.length + 1;
+                list.style.display = 'none';
+                textarea.focus();
+            };
+            list.appendChild(item);
+        });
+        list.style.display = 'block';
+    });
+    textarea.addEventListener('blur', () => { list.style.display = 'none'; });
+}
+// Отметка «в ответ на» у комментария
+function renderReplyTo(comment, comments) {
+    if (!comment.parent_id) return '';
+    const parent = comments.find(c => c.id === comment.parent_id);
+    return parent ? ` ↪ ${parent.author_name}` : '';
+}
+// Ответ на комментарий
+function replyTo(commentId) {
+    const form = document.getElementById('commentForm');
+    const parent = currentComments.find(c => c.id === commentId);
+    if (!form || !parent) return;
+    form.elements.parent_id.value = commentId;
+    document.getElementById('replyTarget').innerHTML =
+        `Ответ для ${escapeHTML(parent.author_name)} <a href="#" onclick="cancelReply(); return false;">отменить</a>`;
+    form.elements.content.focus();
+}
+function cancelReply() {
+    document.getElementById('commentForm').elements.parent_id.value = '';
+    document.getElementById('replyTarget').innerHTML = '';
+}
+// Рейтинг пользователей по репутации
+const leaderboardWindows = { day: 'День', week: 'Неделя', month: 'Месяц', year: 'Год', all: 'Всё время' };
+async function loadLeaderboard(window = 'all', page = 1) {
+    currentPostId = null;
+    currentConversationId = null;
+    hideLiveBanner();
+    const container = document.getElementById('posts-container');
+    const response = await fetch(`/api/leaderboard?window=${window}&page=${page}`);
+    const data = await response.json();
+    if (!response.ok) {
+        container.innerHTML = `<p>${escapeHTML(data.error || 'Ошибка загрузки рейтинга.')}</p>`;
+        return;
+    }
+    container.innerHTML =
+        `<h2>Рейтинг пользователей</h2>
+        <div class="leaderboard-windows">
+            ${Object.entries(leaderboardWindows).map(([key, name]) =>
+                `<button class="btn ${key === window ? 'btn-primary' : 'btn-secondary'}" onclick="loadLeaderboard('${key}')">${name}</button>`
+            ).join('')}
+        </div>
+        ${data.users.length === 0 ? '<p>Пока никто не получил голосов.</p>' : `<ol class="leaderboard" start="${data.users[0].rank}">
+            ${data.users.map(u => `<li>${renderAvatar(u.user_id)} ${renderAuthorLink(escapeHTML(u.username), u.user_id)} <span class="leaderboard-score">${u.reputation}</span></li>`).join('')}
+        </ol>`}
+        <div class="pagination">
+            ${page > 1 ? `<button class="btn btn-secondary" onclick="loadLeaderboard('${window}', ${page - 1})">← Назад</button>` : ''}
+            ${data.has_more ? `<button class="btn btn-secondary" onclick="loadLeaderboard('${window}', ${page + 1})">Дальше →</button>` : ''}
+        </div>`;
+}
+
+// Значки за достижения
+function renderBadges(badges) {
+    if (!badges || badges.length === 0) return '';
+    return `<div class="badges">${badges.map(b =>
+        `<span class="badge" title="${escapeHTML(b.description)} — ${new Date(b.awarded).toLocaleDateString('ru-RU')}">🏅 ${escapeHTML(b.name)}</span>`
+    ).join('')}</div>`;
+}
+async function loadBadges() {
+    currentPostId = null;
+    currentConversationId = null;
+    hideLiveBanner();
+    const container = document.getElementById('posts-container');
+    const response = await fetch('/api/badges');
+    const badges = await response.json();
+    if (!response.ok) {
+        container.innerHTML = `<p>${escapeHTML(badges.error || 'Ошибка загрузки значков.')}</p>`;
+        return;
+    }
+    container.innerHTML =
+        `<h2>Значки</h2>
+        <ul class="badge-list">
+            ${badges.map(b => `<li><span class="badge">🏅 ${escapeHTML(b.name)}</span> ${escapeHTML(b.description)} <span class="post-meta">— получили: ${b.awarded_count}</span></li>`).join('')}
+        </ul>`;
+}
+
+// Подписки на пользователей, категории и обсуждения
+async function loadFollows() {
+    const response = await fetch('/api/follows');
+    if (!response.ok) return;
+    const follows = await response.json();
+    followed = new Set(follows.map(f => f.type + ':' + f.id));
+}
+function renderFollowButton(type, id) {
+    if (!currentUser || id === undefined) return '';
+    const active = followed.has(type + ':' + id);
+    return `<button class="btn btn-secondary follow-btn ${active ? 'active' : ''}" onclick="toggleFollow(this, '${type}', ${id});event.stopPropagation();">${active ? 'Вы подписаны' : 'Подписаться'}</button>`;
+}
+async function toggleFollow(button, type, id) {
+    const key = type + ':' + id;
+    const active = followed.has(key);
+    const params = new URLSearchParams({ type, id });
+    const response = active
+        ? await fetch('/api/follows?' + params, { method: 'DELETE' })
+        : await fetch('/api/follows', {
+            method: 'POST',
+            headers: { 'Content-Type': 'application/x-www-form-urlencoded' },
+            body: params
+        });
+    if (!response.ok) return;
+    if (active) followed.delete(key); else followed.add(key);
+    button.classList.toggle('active', !active);
+    button.textContent = active ? 'Подписаться' : 'Вы подписаны';
+}
+function renderCategoryHeader(name) {
+    return `<div class="category-header"><h2>${escapeHTML(name)}</h2>${renderFollowButton('category', categoryIds[name])}</div>`;
+}
+// Лента из подписок
+async function loadFeed() {
+    currentPostId = null;
+    currentConversationId = null;
+    openStream(['posts']);
+    hideLiveBanner();
+    const container = document.getElementById('posts-container');
+    const response = await fetch('/api/feed');
+    const data = await response.json();
+    if (!response.ok) {
+        container.innerHTML = `<p>${escapeHTML(data.error || 'Ошибка загрузки ленты.')}</p>`;
+        return;
+    }
+    container.innerHTML = '<h2>Моя лента</h2>' + (data.posts.length === 0
+        ? '<p>В ленте пока пусто. Подпишитесь на пользователей, категории или обсуждения.</p>'
+        : data.posts.map(renderPostCard).join('') + renderFeedMore(data));
+}
+function renderFeedMore(data) {
+    if (!data.has_more) return '';
+    return `<div class="pagination" id="feedMore"><button class="btn btn-secondary" onclick="loadMoreFeed(${data.next_before})">Показать ещё</button></div>`;
+}
+async function loadMoreFeed(before) {
+    const response = await fetch('/api/feed?before=' + before);
+    if (!response.ok) return;
+    const data = await response.json();
+    const more = document.getElementById('feedMore');
+    more.insertAdjacentHTML('beforebegin', data.posts.map(renderPostCard).join('') + renderFeedMore(data));
+    more.remove();
+}
+
+// Закладки
+function renderBookmarkButton(bookmarked, postId, commentId) {
+    if (!currentUser) return '';
+    return `<button class="bookmark-btn ${bookmarked ? 'active' : ''}" title="${bookmarked ? 'Убрать из сохранённого' : 'Сохранить'}" onclick="toggleBookmark(this, ${postId}, ${commentId});event.stopPropagation();">${bookmarked ? '★' : '☆'}</button>`;
+}
+async function toggleBookmark(button, postId, commentId) {
+    const bookmarked = button.classList.contains('active');
+    const params = commentId ? { comment_id: commentId } : { post_id: postId };
+    const response = bookmarked
+        ? await fetch('/api/bookmarks?' + new URLSearchParams(params), { method: 'DELETE' })
+        : await fetch('/api/bookmarks', {
+            method: 'POST',
+            headers: { 'Content-Type': 'application/x-www-form-urlencoded' },
+            body: new URLSearchParams(params)
+        });
+    if (!response.ok) return;
+    button.classList.toggle('active', !bookmarked);
+    button.textContent = bookmarked ? '☆' : '★';
+    button.title = bookmarked ? 'Сохранить' : 'Убрать из сохранённого';
+}
+async function loadBookmarks(folderId = '', page = 1) {
+    currentPostId = null;
+    currentConversationId = null;
+    hideLiveBanner();
+    const container = document.getElementById('posts-container');
+    const [foldersResponse, bookmarksResponse] = await Promise.all([
+        fetch('/api/bookmarks/folders'),
+        fetch(`/api/bookmarks?page=${page}` + (folderId ? `&folder_id=${folderId}` : ''))
+    ]);
+    if (!foldersResponse.ok || !bookmarksResponse.ok) {
+        container.innerHTML = '<p>Ошибка загрузки сохранённого.</p>';
+        return;
+    }
+    const folders = await foldersResponse.json();
+    const data = await bookmarksResponse.json();
+    const folderOptions = selected => '<option value="">Без папки</option>' + folders.map(f =>
+        `<option value="${f.id}" ${f.id === selected ? 'selected' : ''}>${escapeHTML(f.name)}</option>`).join('');
+    container.innerHTML =
+        `<h2>Сохранённое</h2>
+        <div class="bookmark-folders">
+            <a href="#" class="${folderId ? '' : 'active'}" onclick="loadBookmarks(); return false;">Все</a>
+            ${folders.map(f => `<span class="bookmark-folder">
+                <a href="#" class="${f.id === folderId ? 'active' : ''}" onclick="loadBookmarks(${f.id}); return false;">${escapeHTML(f.name)} (${f.count})</a>
+                <button class="btn-link" title="Удалить папку" onclick="deleteBookmarkFolder(${f.id})">✕</button>
+            </span>`).join('')}
+            <form id="folderForm" class="folder-form">
+                <input type="text" name="name" maxlength="50" placeholder="Новая папка" required>
+                <button type="submit" class="btn btn-secondary">Создать</button>
+            </form>
+        </div>
+        ${data.bookmarks.length === 0 ? '<p>Здесь пока ничего нет.</p>' : data.bookmarks.map(b =>
+            `<div class="post${b.available ? ' post-clickable' : ' unavailable'}" ${b.available ? `onclick="if(event.target === this || event.target.classList.contains('post-main')){loadPost(${b.post_id});}"` : ''}>
+                <div class="post-main">
+                    ${b.available
+                        ? `<div class="post-meta">${b.type === 'post' ? 'Пост' : 'Комментарий к посту'} «${escapeHTML(b.post_title)}» | ${escapeHTML(b.author_name)}</div>
+                           <div class="post-content">${escapeHTML(b.excerpt)}</div>`
+                        : `<div class="post-meta">${b.type === 'post' ? 'Пост' : 'Комментарий'} недоступен: он был удалён или скрыт</div>`}
+                    <div class="post-actions">
+                        <select onchange="moveBookmark(${b.post_id}, ${b.comment_id || null}, this.value, ${folderId || "''"})">${folderOptions(b.folder_id)}</select>
+                        <button class="btn btn-secondary" onclick="removeBookmark(${b.post_id}, ${b.comment_id || null}, ${folderId || "''"})">Удалить</button>
+                    </div>
+                </div>
+            </div>`
+        ).join('')}
+        <div class="pagination">
+            ${page > 1 ? `<button class="btn btn-secondary" onclick="loadBookmarks(${folderId || "''"}, ${page - 1})">← Назад</button>` : ''}
+            ${data.has_more ? `<button class="btn btn-secondary" onclick="loadBookmarks(${folderId || "''"}, ${page + 1})">Дальше →</button>` : ''}
+        </div>`;
+    document.getElementById('folderForm').addEventListener('submit', async e => {
+        e.preventDefault();
+        const response = await fetch('/api/bookmarks/folders', {
+            method: 'POST',
+            headers: { 'Content-Type': 'application/x-www-form-urlencoded' },
+            body: new URLSearchParams(new FormData(e.target))
+        });
+        const result = await response.json();
+        if (!response.ok) {
+            alert(result.error || 'Не удалось создать папку');
+            return;
+        }
+        loadBookmarks(folderId, page);
+    });
+}
+async function moveBookmark(postId, commentId, newFolderId, folderId) {
+    const params = commentId ? { comment_id: commentId } : { post_id: postId };
+    if (newFolderId) params.folder_id = newFolderId;
+    const response = await fetch('/api/bookmarks', {
+        method: 'POST',
+        headers: { 'Content-Type': 'application/x-www-form-urlencoded' },
+        body: new URLSearchParams(params)
+    });
+    if (!response.ok) {
+        const result = await response.json();
+        alert(result.error || 'Не удалось переместить закладку');
+    }
+    loadBookmarks(folderId);
+}
+async function removeBookmark(postId, commentId, folderId) {
+    const params = commentId ? { comment_id: commentId } : { post_id: postId };
+    await fetch('/api/bookmarks?' + new URLSearchParams(params), { method: 'DELETE' });
+    loadBookmarks(folderId);
+}
+async function deleteBookmarkFolder(folderId) {
+    if (!confirm('Удалить папку? Закладки из неё останутся в сохранённом.')) return;
+    await fetch(`/api/bookmarks/folders/${folderId}`, { method: 'DELETE' });
+    loadBookmarks();
+}
+
+// Личные сообщения
+async function loadMessageCount() {
+    const response = await fetch('/api/conversations');
+    if (!response.ok) return;
+    const data = await response.json();
+    const el = document.getElementById('message-count');
+    if (el) el.textContent = data.unread_count > 0 ? data.unread_count : '';
+}
+async function loadConversations(page = 1) {
+    currentPostId = null;
+    currentConversationId = null;
+    hideLiveBanner();
+    const container = document.getElementById('posts-container');
+    const response = await fetch(`/api/conversations?page=${page}`);
+    const data = await response.json();
+    if (!response.ok) {
+        container.innerHTML = `<p>${escapeHTML(data.error || 'Ошибка загрузки сообщений.')}</p>`;
+        return;
+    }
+    const el = document.getElementById('message-count');
+    if (el) el.textContent = data.unread_count > 0 ? data.unread_count : '';
+    container.innerHTML =
+        `<div id="conversations">
+            <h2>Сообщения</h2>
+            <form id="newConversationForm" class="message-form">
+                <input type="text" name="participants" placeholder="Кому: имена через запятую (до 9)" required>
+                <textarea name="content" maxlength="2000" placeholder="Сообщение" required></textarea>
+                <button type="submit" class="btn btn-primary">Начать беседу</button>
+            </form>
+            ${data.conversations.length === 0 ? '<p>Бесед пока нет.</p>' : data.conversations.map(c =>
+                `<div class="post post-clickable conversation${c.unread_count > 0 ? ' unread' : ''}" onclick="openConversation(${c.id})">
+                    <div class="post-main">
+                        <div class="post-meta">${escapeHTML(conversationTitle(c.participants))} | ${new Date(c.updated).toLocaleString('ru-RU')}${c.unread_count > 0 ? ` | <span class="notification-count">${c.unread_count} новых</span>` : ''}</div>
+                        ${c.last_message ? `<div class="post-content"><b>${escapeHTML(c.last_message.sender_name)}:</b> ${escapeHTML(c.last_message.content)}</div>` : ''}
+                    </div>
+                </div>`
+            ).join('')}
+            <div class="pagination">
+                ${page > 1 ? `<button class="btn btn-secondary" onclick="loadConversations(${page - 1})">← Назад</button>` : ''}
+                ${data.has_more ? `<button class="btn btn-secondary" onclick="loadConversations(${page + 1})">Дальше →</button>` : ''}
+            </div>
+        </div>`;
+    document.getElementById('newConversationForm').addEventListener('submit', handleNewConversation);
+}
+// Участники беседы, кроме текущего пользователя
+function conversationTitle(participants) {
+    return participants.filter(p => p.user_id !== currentUser.id).map(p => p.username).join(', ');
+}
+async function handleNewConversation(e) {
+    e.preventDefault();
+    const form = e.target;
+    const response = await fetch('/api/conversations', {
+        method: 'POST',
+        headers: { 'Content-Type': 'application/x-www-form-urlencoded' },
+        body: new URLSearchParams(new FormData(form))
+    });
+    const data = await response.json();
+    if (!response.ok) {
+        alert(data.error || 'Не удалось отправить сообщение');
+        return;
+    }
+    openConversation(data.conversation_id);
+}
+function messageProfileUser() {
+    loadConversations().then(() => {
+        const form = document.getElementById('newConversationForm');
+        if (form) {
+            form.elements.participants.value = currentProfile.username;
+            form.elements.content.focus();
+        }
+    });
+}
+let currentMessages = [];
+let currentParticipants = [];
+async function openConversation(conversationId, markRead = true) {
+    currentPostId = null;
+    currentConversationId = conversationId;
+    hideLiveBanner();
+    const container = document.getElementById('posts-container');
+    const response = await fetch(`/api/conversations/${conversationId}/messages`);
+    const data = await response.json();
+    if (!response.ok) {
+        container.innerHTML = `<p>${escapeHTML(data.error || 'Беседа не найдена.')}</p>`;
+        return;
+    }
+    currentMessages = data.messages.reverse();
+    currentParticipants = data.participants;
+    container.innerHTML =
+        `<div class="conversation-view">
+            <a href="#" onclick="loadConversations(); return false;">← Все беседы</a>
+            <h2>${escapeHTML(conversationTitle(data.participants))}</h2>
+            <div id="olderMessages">${data.has_more ? '<button class="btn btn-secondary" onclick="loadOlderMessages()">Загрузить предыдущие</button>' : ''}</div>
+            <div id="messages"></div>
+            <form id="messageForm" class="message-form">
+                <textarea name="content" maxlength="2000" placeholder="Сообщение" required></textarea>
+                <button type="submit" class="btn btn-primary">Отправить</button>
+            </form>
+        </div>`;
+    renderMessages();
+    document.getElementById('messageForm').addEventListener('submit', handleMessageSubmit);
+    if (markRead) {
+        await fetch(`/api/conversations/${conversationId}/read`, { method: 'POST' });
+        loadMessageCount();
+    }
+}
+async function loadOlderMessages() {
+    if (currentMessages.length === 0) return;
+    const response = await fetch(`/api/conversations/${currentConversationId}/messages?before=${currentMessages[0].id}`);
+    if (!response.ok) return;
+    const data = await response.json();
+    currentMessages = data.messages.reverse().concat(currentMessages);
+    document.getElementById('olderMessages').innerHTML = data.has_more ? '<button class="btn btn-secondary" onclick="loadOlderMessages()">Загрузить предыдущие</button>' : '';
+    renderMessages();
+}
+function renderMessages() {
+    const el = document.getElementById('messages');
+    if (!el) return;
+    const last = currentMessages[currentMessages.length - 1];
+    el.innerHTML = currentMessages.map(m => {
+        const own = m.sender_id === currentUser.id;
+        let receipt = '';
+        if (own && m === last) {
+            const readers = currentParticipants.filter(p => p.user_id !== currentUser.id && p.last_read_message_id >= m.id);
+            if (readers.length > 0) {
+                receipt = currentParticipants.length === 2 ? 'прочитано' : 'прочитали: ' + readers.map(p => p.username).join(', ');
+            }
+        }
+        return `<div class="message${own ? ' own' : ''}">
+            <div class="post-meta">${escapeHTML(m.sender_name)} | ${new Date(m.created).toLocaleString('ru-RU')}</div>
+            <div class="message-content">${escapeHTML(m.content)}</div>
+            ${receipt ? `<div class="message-receipt">${escapeHTML(receipt)}</div>` : ''}
+        </div>`;
+    }).join('');
+}
+async function handleMessageSubmit(e) {
+    e.preventDefault();
+    const form = e.target;
+    const response = await fetch(`/api/conversations/${currentConversationId}/messages`, {
+        method: 'POST',
+        headers: { 'Content-Type': 'application/x-www-form-urlencoded' },
+        body: new URLSearchParams(new FormData(form))
+    });
+    const data = await response.json();
+    if (!response.ok) {
+        alert(data.error || 'Не удалось отправить сообщение');
+        return;
+    }
+    form.reset();
+    currentMessages.push(data);
+    renderMessages();
+}
+// Блокировка пользователя в личных сообщениях
+async function renderBlockButton(userId) {
+    const response = await fetch('/api/blocks');
+    if (!response.ok) return;
+    const blocked = await response.json();
+    const button = document.getElementById('blockButton');
+    if (!button) return;
+    const isBlocked = blocked.some(u => u.user_id === userId);
+    button.textContent = isBlocked ? 'Разблокировать' : 'Заблокировать';
+    button.dataset.blocked = isBlocked ? '1' : '';
+}
+async function toggleBlock(userId) {
+    const button = document.getElementById('blockButton');
+    const isBlocked = button && button.dataset.blocked === '1';
+    const response = isBlocked
+        ? await fetch(`/api/blocks?user_id=${userId}`, { method: 'DELETE' })
+        : await fetch('/api/blocks', {
+            method: 'POST',
+            headers: { 'Content-Type': 'application/x-www-form-urlencoded' },
+            body: new URLSearchParams({ user_id: userId })
+        });
+    if (response.ok) renderBlockButton(userId);
+}
+// Аватар пользователя (загруженный или сгенерированный сервером)
+function renderAvatar(userId) {
+    return `<img class="avatar" src="/api/users/${userId}/avatar" alt="">`;
+}
+// Ссылка на профиль автора
+function renderAuthorLink(username, userId) {
+    return `<a href="/user/${userId}" class="author-link" onclick="loadProfile(${userId}); return false;">${username}</a>`;
+}
+// Опросы в постах
+function renderPoll(poll) {
+    if (!poll) return '';
+    const canVote = currentUser && !poll.closed;
+    const inputType = poll.multiple ? 'checkbox' : 'radio';
+    let status = poll.closed ? 'Опрос закрыт' : poll.closes_at ? `Открыт до ${new Date(poll.closes_at).toLocaleString('ru-RU')}` : '';
+    if (!poll.results_visible) {
+        status += (status ? ' | ' : '') + (poll.results === 'after_close' ? 'Результаты появятся после закрытия' : 'Проголосуйте, чтобы увидеть результаты');
+    } else {
+        status += (status ? ' | ' : '') + `Проголосовали: ${poll.voters}`;
+    }
+    return `<div class="poll">
+        <div class="poll-question">📊 ${escapeHTML(poll.question)}</div>
+        ${poll.options.map(option => {
+            const percent = poll.results_visible && poll.voters > 0 ? Math.round(option.votes * 100 / poll.voters) : 0;
+            return `<label class="poll-option">
+                ${canVote ? `<input type="${inputType}" name="poll-${poll.id}" value="${option.id}" ${poll.user_votes.includes(option.id) ? 'checked' : ''}>` : ''}
+                <span>${escapeHTML(option.text)}</span>
+                ${poll.results_visible ? `<span class="poll-votes">${option.votes} (${percent}%)</span>
+                    <span class="poll-bar" style="width: ${percent}%"></span>` : ''}
+            </label>`;
+        }).join('')}
+        <div class="post-meta">${status}</div>
+        ${canVote ? `<div class="poll-actions">
+            <button class="btn btn-primary" onclick="votePoll(${poll.id})">Голосовать</button>
+            ${poll.user_votes.length > 0 ? `<button class="btn btn-secondary" onclick="retractPollVote(${poll.id})">Отозвать голос</button>` : ''}
+        </div>` : ''}
+    </div>`;
+}
+async function votePoll(pollId) {
+    const body = new URLSearchParams();
+    document.querySelectorAll(`input[name="poll-${pollId}"]:checked`).forEach(input => body.append('option_id', input.value));
+    const response = await fetch(`/api/polls/${pollId}/vote`, { method: 'POST', body });
+    const data = await response.json();
+    if (!response.ok) {
+        alert(data.error || 'Не удалось проголосовать');
+        return;
+    }
+    document.getElementById('poll-container').innerHTML = renderPoll(data);
+}
+async function retractPollVote(pollId) {
+    const response = await fetch(`/api/polls/${pollId}/vote`, { method: 'DELETE' });
+    const data = await response.json();
+    if (!response.ok) {
+        alert(data.error || 'Не удалось отозвать голос');
+        return;
+    }
+    document.getElementById('poll-container').innerHTML = renderPoll(data);
+}
+async function refreshPoll(postId) {
+    const response = await fetch('/api/post/' + postId);
+    if (!response.ok) return;
+    const data = await response.json();
+    const el = document.getElementById('poll-container');
+    if (el) el.innerHTML = renderPoll(data.post.poll);
+}
+// Кнопка принятия ответа: для автора вопроса и модераторов
+function renderAcceptButton(post, comment) {
+    if (!post.is_question || !currentUser) return '';
+    if (currentUser.id !== post.author_id && currentUser.role !== 'moderator' && currentUser.role !== 'admin') return '';
+    return comment.accepted
+        ? `<button class="btn btn-secondary" onclick="setAcceptedAnswer(${post.id}, null)">Отменить принятие</button>`
+        : `<button class="btn btn-secondary" onclick="setAcceptedAnswer(${post.id}, ${comment.id})">Принять ответ</button>`;
+}
+async function setAcceptedAnswer(postId, commentId) {
+    const response = commentId
+        ? await fetch('/api/accepted-answer', {
+            method: 'POST',
+            headers: { 'Content-Type': 'application/x-www-form-urlencoded' },
+            body: new URLSearchParams({ comment_id: commentId })
+        })
+        : await fetch(`/api/accepted-answer?post_id=${postId}`, { method: 'DELETE' });
+    if (!response.ok) {
+        const error = await response.json();
+        alert(error.error || 'Не удалось выбрать ответ');
+        return;
+    }
+    loadPost(postId);
+}
+// Значки закреплённого, закрытого поста и вопроса
+function renderThreadMarkers(post) {
+    let markers = '';
+    if (post.pinned) markers += '<span class="thread-marker" title="Закреплено">📌</span>';
+    if (post.locked) markers += '<span class="thread-marker" title="Обсуждение закрыто">🔒</span>';
+    if (post.is_question) markers += post.accepted_comment_id
+        ? '<span class="thread-marker" title="Есть принятый ответ">✅</span>'
+        : '<span class="thread-marker" title="Вопрос без ответа">❓</span>';
+    return markers;
+}
+// Счётчик комментариев, появившихся с последнего визита
+function renderUnreadComments(count) {
+    if (!count) return '';
+    return `<span class="unread-comments" title="Новые комментарии с последнего визита">+${count} 💬</span>`;
 }
 // Вспомогательная функция для бейджа NEW
-function renderNewBadge(created) {
+// Вошедшим пользователям сервер сообщает, открывали ли они пост (isNew),
+// остальным новыми считаются посты за последние сутки
+function renderNewBadge(created, isNew) {
+    if (isNew !== undefined) {
+        return isNew ? '<span class="badge-new">NEW</span>' : '';
+    }
     const createdDate = new Date(created);
     const now = new Date();
     const diff = (now - createdDate) / (1000 * 60 * 60 * 24);
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// getPostLocked reports whether a post is locked; hidden and missing posts
+// yield errContentNotFound
+func getPostLocked(postID int) (bool, error) {
+	var locked, hidden bool
+	err := db.QueryRow("SELECT locked, hidden FROM posts WHERE id = ?", postID).Scan(&locked, &hidden)
+	if err == sql.ErrNoRows || (err == nil && hidden) {
+		return false, errContentNotFound
+	}
+	return locked, err
+}
+
+// getCommentPostID retrieves the ID of the post a comment belongs to
+func getCommentPostID(commentID int) (int, error) {
+	var postID int
+	err := db.QueryRow("SELECT post_id FROM comments WHERE id = ? AND hidden = 0", commentID).Scan(&postID)
+	if err == sql.ErrNoRows {
+		return 0, errContentNotFound
+	}
+	return postID, err
+}
+
+// postOpenError returns a requestError unless a post exists and still
+// accepts comments and votes
+func postOpenError(postID int) error {
+	locked, err := getPostLocked(postID)
+	if err == errContentNotFound {
+		return &requestError{http.StatusNotFound, "Post not found"}
+	} else if err != nil {
+		return err
+	}
+	if locked {
+		return &requestError{http.StatusForbidden, "Обсуждение закрыто: новые комментарии и оценки не принимаются"}
+	}
+	return nil
+}
+
+// checkPostOpen makes sure a post exists and still accepts comments and votes.
+// It writes the error response itself and returns false otherwise.
+func checkPostOpen(w http.ResponseWriter, postID int) bool {
+	return writeRequestError(w, postOpenError(postID))
+}
+
+// setPostPinned pins or unpins a post globally (categoryName == "") or within one of its categories
+func setPostPinned(moderatorID, postID int, categoryName string, pinned bool, ip string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var result sql.Result
+	if categoryName == "" {
+		result, err = tx.Exec("UPDATE posts SET pinned = ? WHERE id = ?", pinned, postID)
+	} else {
+		result, err = tx.Exec(`
+			UPDATE post_categories SET pinned = ?
+			WHERE post_id = ? AND category_id = (SELECT id FROM categories WHERE name = ?)`,
+			pinned, postID, categoryName)
+	}
+	if err != nil {
+		return err
+	}
+	if affected, err := result.RowsAffected(); err != nil {
+		return err
+	} else if affected == 0 {
+		return errContentNotFound
+	}
+
+	action := "post.pin"
+	if !pinned {
+		action = "post.unpin"
+	}
+	before := map[string]interface{}{"pinned": !pinned, "category": categoryName}
+	after := map[string]interface{}{"pinned": pinned, "category": categoryName}
+	if err := recordAudit(tx, moderatorID, action, "post", postID, before, after, "", ip); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// setPostLocked locks or unlocks a post for new comments and votes
+func setPostLocked(moderatorID, postID int, locked bool, ip string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("UPDATE posts SET locked = ? WHERE id = ?", locked, postID)
+	if err != nil {
+		return err
+	}
+	if affected, err := result.RowsAffected(); err != nil {
+		return err
+	} else if affected == 0 {
+		return errContentNotFound
+	}
+
+	action := "post.lock"
+	if !locked {
+		action = "post.unlock"
+	}
+	before := map[string]interface{}{"locked": !locked}
+	after := map[string]interface{}{"locked": locked}
+	if err := recordAudit(tx, moderatorID, action, "post", postID, before, after, "", ip); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// getActiveAnnouncement retrieves the current site-wide announcement, or nil when there is none
+func getActiveAnnouncement() (*Announcement, error) {
+	announcement := &Announcement{}
+	var expiresAt sql.NullTime
+	err := db.QueryRow(`
+		SELECT a.id, a.message, a.author_id, u.username, a.created, a.expires_at
+		FROM announcements a
+		JOIN users u ON a.author_id = u.id
+		WHERE a.active = 1 AND (a.expires_at IS NULL OR a.expires_at > ?)
+		ORDER BY a.id DESC
+		LIMIT 1`, time.Now().UTC().Format(sqliteTimeLayout)).
+		Scan(&announcement.ID, &announcement.Message, &announcement.AuthorID, &announcement.AuthorName, &announcement.Created, &expiresAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if expiresAt.Valid {
+		announcement.ExpiresAt = &expiresAt.Time
+	}
+	return announcement, nil
+}
+
+// publishAnnouncement replaces the current announcement with a new one
+func publishAnnouncement(moderatorID int, message string, expiresAt *time.Time, ip string) error {
+	before, err := getActiveAnnouncement()
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("UPDATE announcements SET active = 0 WHERE active = 1"); err != nil {
+		return err
+	}
+
+	var expiresValue interface{}
+	if expiresAt != nil {
+		expiresValue = expiresAt.UTC().Format(sqliteTimeLayout)
+	}
+	result, err := tx.Exec("INSERT INTO announcements (message, author_id, expires_at) VALUES (?, ?, ?)", message, moderatorID, expiresValue)
+	if err != nil {
+		return err
+	}
+	announcementID, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+
+	after := map[string]interface{}{"message": message, "expires_at": expiresAt}
+	if err := recordAudit(tx, moderatorID, "announcement.publish", "announcement", int(announcementID), announcementSnapshot(before), after, "", ip); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// removeAnnouncement takes down the current announcement
+func removeAnnouncement(moderatorID int, ip string) error {
+	before, err := getActiveAnnouncement()
+	if err != nil {
+		return err
+	}
+	if before == nil {
+		return sql.ErrNoRows
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("UPDATE announcements SET active = 0 WHERE active = 1"); err != nil {
+		return err
+	}
+
+	if err := recordAudit(tx, moderatorID, "announcement.remove", "announcement", before.ID, announcementSnapshot(before), nil, "", ip); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// announcementSnapshot describes an announcement for the audit log
+func announcementSnapshot(announcement *Announcement) interface{} {
+	if announcement == nil {
+		return nil
+	}
+	return map[string]interface{}{"id": announcement.ID, "message": announcement.Message, "expires_at": announcement.ExpiresAt}
+}
+
+// pinHandler pins or unpins a post, globally or within one of its categories
+func pinHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	moderator, ok := requireModerator(w, r)
+	if !ok {
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		ErrorResponse(w, http.StatusBadRequest, "Invalid form data")
+		return
+	}
+
+	postID, err := strconv.Atoi(r.FormValue("post_id"))
+	if err != nil {
+		ErrorResponse(w, http.StatusBadRequest, "Invalid post ID")
+		return
+	}
+	category := strings.TrimSpace(r.FormValue("category"))
+	pinned := r.FormValue("pinned") != "false"
+
+	err = setPostPinned(moderator.ID, postID, category, pinned, clientIP(r))
+	if err == errContentNotFound {
+		if category != "" {
+			ErrorResponse(w, http.StatusNotFound, "Post not found in this category")
+		} else {
+			ErrorResponse(w, http.StatusNotFound, "Post not found")
+		}
+		return
+	} else if err != nil {
+		ErrorResponse(w, http.StatusInternalServerError, "Error updating post")
+		return
+	}
+
+	JSONResponse(w, http.StatusOK, map[string]string{"message": "Post updated successfully"})
+}
+
+// lockHandler locks or unlocks a post
+func lockHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	moderator, ok := requireModerator(w, r)
+	if !ok {
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		ErrorResponse(w, http.StatusBadRequest, "Invalid form data")
+		return
+	}
+
+	postID, err := strconv.Atoi(r.FormValue("post_id"))
+	if err != nil {
+		ErrorResponse(w, http.StatusBadRequest, "Invalid post ID")
+		return
+	}
+	locked := r.FormValue("locked") != "false"
+
+	err = setPostLocked(moderator.ID, postID, locked, clientIP(r))
+	if err == errContentNotFound {
+		ErrorResponse(w, http.StatusNotFound, "Post not found")
+		return
+	} else if err != nil {
+		ErrorResponse(w, http.StatusInternalServerError, "Error updating post")
+		return
+	}
+
+	JSONResponse(w, http.StatusOK, map[string]string{"message": "Post updated successfully"})
+}
+
+// announcementHandler returns the current site-wide announcement (null when there is none)
+func announcementHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	announcement, err := getActiveAnnouncement()
+	if err != nil {
+		ErrorResponse(w, http.StatusInternalServerError, "Error retrieving announcement")
+		return
+	}
+
+	JSONResponse(w, http.StatusOK, announcement)
+}
+
+// manageAnnouncementHandler publishes (POST) or removes (DELETE) the site-wide announcement
+func manageAnnouncementHandler(w http.ResponseWriter, r *http.Request) {
+	moderator, ok := requireModerator(w, r)
+	if !ok {
+		return
+	}
+
+	switch r.Method {
+	case "POST":
+		if err := r.ParseForm(); err != nil {
+			ErrorResponse(w, http.StatusBadRequest, "Invalid form data")
+			return
+		}
+
+		message := strings.TrimSpace(r.FormValue("message"))
+		if message == "" || len([]rune(message)) > 500 {
+			ErrorResponse(w, http.StatusBadRequest, "Текст объявления должен быть от 1 до 500 символов")
+			return
+		}
+
+		var expiresAt *time.Time
+		if value := r.FormValue("expires_at"); value != "" {
+			t, err := parseTimeParam(value)
+			if err != nil || !t.After(time.Now()) {
+				ErrorResponse(w, http.StatusBadRequest, "Invalid expires_at")
+				return
+			}
+			expiresAt = &t
+		}
+
+		if err := publishAnnouncement(moderator.ID, message, expiresAt, clientIP(r)); err != nil {
+			ErrorResponse(w, http.StatusInternalServerError, "Error publishing announcement")
+			return
+		}
+		JSONResponse(w, http.StatusCreated, map[string]string{"message": "Announcement published"})
+	case "DELETE":
+		err := removeAnnouncement(moderator.ID, clientIP(r))
+		if err == sql.ErrNoRows {
+			ErrorResponse(w, http.StatusNotFound, "No active announcement")
+			return
+		} else if err != nil {
+			ErrorResponse(w, http.StatusInternalServerError, "Error removing announcement")
+			return
+		}
+		JSONResponse(w, http.StatusOK, map[string]string{"message": "Announcement removed"})
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
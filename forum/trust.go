@@ -0,0 +1,435 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxTrustLevel is the highest trust level; it is only granted by moderators
+// and is what moderators and admins themselves are treated as
+const maxTrustLevel = 4
+
+// trustLevels lists the trust levels in order. A user automatically reaches
+// a level once they meet its requirements and those of all lower levels.
+// Rate limits are per hour, 0 means unlimited. Newcomers can't vote, but
+// their votes limit still applies to emoji reactions.
+var trustLevels = []TrustLevel{
+	{Level: 0, Name: "Новичок",
+		PostsPerHour: 3, CommentsPerHour: 10, VotesPerHour: 10},
+	{Level: 1, Name: "Участник",
+		MinAccountDays: 1, MinPostsRead: 10, MinContentCreated: 1,
+		CanPostLinks: true, CanVote: true,
+		PostsPerHour: 10, CommentsPerHour: 30, VotesPerHour: 50},
+	{Level: 2, Name: "Постоянный участник",
+		MinAccountDays: 7, MinPostsRead: 50, MinContentCreated: 10, MinLikesReceived: 5,
+		CanPostLinks: true, CanVote: true,
+		PostsPerHour: 20, CommentsPerHour: 60, VotesPerHour: 200},
+	{Level: 3, Name: "Опытный участник",
+		MinAccountDays: 30, MinPostsRead: 200, MinContentCreated: 50, MinLikesReceived: 30,
+		CanPostLinks: true, CanVote: true,
+		PostsPerHour: 50, CommentsPerHour: 200, VotesPerHour: 500},
+	{Level: 4, Name: "Лидер", ManualOnly: true,
+		CanPostLinks: true, CanVote: true},
+}
+
+// effectiveTrustLevel returns the level whose abilities apply to a user
+func effectiveTrustLevel(user *User) TrustLevel {
+	if isModerator(user) {
+		return trustLevels[maxTrustLevel]
+	}
+	if user.TrustLevel < 0 || user.TrustLevel > maxTrustLevel {
+		return trustLevels[0]
+	}
+	return trustLevels[user.TrustLevel]
+}
+
+// getTrustStats collects the activity trust levels are based on
+func getTrustStats(userID int) (TrustStats, error) {
+	var stats TrustStats
+	var created time.Time
+	err := db.QueryRow(`
+		SELECT created,
+			(SELECT COUNT(*) FROM post_reads WHERE user_id = users.id),
+			(SELECT COUNT(*) FROM posts WHERE author_id = users.id AND hidden = 0) +
+				(SELECT COUNT(*) FROM comments WHERE author_id = users.id AND hidden = 0),
+			(SELECT COUNT(*) FROM reactions l
+				LEFT JOIN posts p ON l.post_id = p.id
+				LEFT JOIN comments c ON l.comment_id = c.id
+				WHERE l.reaction = 'like' AND l.user_id != users.id
+					AND (p.author_id = users.id OR c.author_id = users.id))
+		FROM users WHERE id = ?`, userID).
+		Scan(&created, &stats.PostsRead, &stats.ContentCreated, &stats.LikesReceived)
+	if err != nil {
+		return stats, err
+	}
+	stats.AccountDays = int(time.Since(created).Hours() / 24)
+	return stats, nil
+}
+
+// automaticTrustLevel returns the highest level a user qualifies for
+func automaticTrustLevel(stats TrustStats) int {
+	level := 0
+	for _, tl := range trustLevels[1:] {
+		if tl.ManualOnly ||
+			stats.AccountDays < tl.MinAccountDays ||
+			stats.PostsRead < tl.MinPostsRead ||
+			stats.ContentCreated < tl.MinContentCreated ||
+			stats.LikesReceived < tl.MinLikesReceived {
+			break
+		}
+		level = tl.Level
+	}
+	return level
+}
+
+// updateTrustLevels promotes every user whose level is not set by a
+// moderator to the highest level they qualify for. Automatic levels are
+// never lowered, so deleted content doesn't demote anyone.
+func updateTrustLevels() {
+	rows, err := db.Query("SELECT id, trust_level FROM users WHERE trust_level_locked = 0 AND trust_level < ?", maxTrustLevel)
+	if err != nil {
+		log.Printf("Trust levels - error loading users: %v", err)
+		return
+	}
+	current := make(map[int]int)
+	for rows.Next() {
+		var id, level int
+		if err := rows.Scan(&id, &level); err != nil {
+			log.Printf("Trust levels - error loading users: %v", err)
+			rows.Close()
+			return
+		}
+		current[id] = level
+	}
+	rows.Close()
+
+	promoted := 0
+	for userID, level := range current {
+		stats, err := getTrustStats(userID)
+		if err != nil {
+			log.Printf("Trust levels - error loading stats of user %d: %v", userID, err)
+			continue
+		}
+		newLevel := automaticTrustLevel(stats)
+		if newLevel <= level {
+			continue
+		}
+		if _, err := db.Exec("UPDATE users SET trust_level = ? WHERE id = ? AND trust_level_locked = 0", newLevel, userID); err != nil {
+			log.Printf("Trust levels - error updating user %d: %v", userID, err)
+			continue
+		}
+		promoted++
+	}
+
+	if promoted > 0 {
+		log.Printf("Trust levels - promoted %d users", promoted)
+	}
+}
+
+// startTrustLevelJob runs updateTrustLevels now and then every hour
+func startTrustLevelJob() {
+	go func() {
+		for {
+			updateTrustLevels()
+			time.Sleep(time.Hour)
+		}
+	}()
+}
+
+// rateLimitError returns a 429 requestError when a user already created as
+// many posts, comments or votes (kind) in the last hour as their trust
+// level allows
+func rateLimitError(user *User, kind string) error {
+	level := effectiveTrustLevel(user)
+	var limit int
+	var query, message string
+	switch kind {
+	case "post":
+		limit = level.PostsPerHour
+		query = "SELECT COUNT(*) FROM posts WHERE author_id = ? AND created > ?"
+		message = "Слишком много постов за последний час, попробуйте позже"
+	case "comment":
+		limit = level.CommentsPerHour
+		query = "SELECT COUNT(*) FROM comments WHERE author_id = ? AND created > ?"
+		message = "Слишком много комментариев за последний час, попробуйте позже"
+	default:
+		limit = level.VotesPerHour
+		// Every vote or reaction added counts, including ones withdrawn since
+		// and emoji reactions
+		query = "SELECT COUNT(*) FROM vote_events WHERE user_id = ? AND created > ?"
+		message = "Слишком много голосов и реакций за последний час, попробуйте позже"
+	}
+	if limit == 0 {
+		return nil
+	}
+
+	var count int
+	since := time.Now().UTC().Add(-time.Hour).Format(sqliteTimeLayout)
+	if err := db.QueryRow(query, user.ID, since).Scan(&count); err != nil {
+		return err
+	}
+	if count >= limit {
+		return &requestError{http.StatusTooManyRequests, message}
+	}
+	return nil
+}
+
+// checkRateLimit rejects requests over the hourly limit of rateLimitError.
+// It writes the error response itself and returns false when over the limit.
+func checkRateLimit(w http.ResponseWriter, user *User, kind string) bool {
+	return writeRequestError(w, rateLimitError(user, kind))
+}
+
+// containsLinks reports whether Markdown text contains links
+func containsLinks(content string) bool {
+	return linkRe.MatchString(content) || autolinkRe.MatchString(content)
+}
+
+// hasImageAttachments reports whether any of the attachments is an image
+func hasImageAttachments(attachmentIDs []int) (bool, error) {
+	if len(attachmentIDs) == 0 {
+		return false, nil
+	}
+	query := "SELECT COUNT(*) FROM attachments WHERE mime_type LIKE 'image/%' AND id IN (?" +
+		strings.Repeat(", ?", len(attachmentIDs)-1) + ")"
+	args := make([]interface{}, len(attachmentIDs))
+	for i, id := range attachmentIDs {
+		args[i] = id
+	}
+	var count int
+	err := db.QueryRow(query, args...).Scan(&count)
+	return count > 0, err
+}
+
+// linksError returns a 403 requestError for content with links or image
+// attachments from users whose trust level doesn't allow them yet
+func linksError(user *User, content string, attachmentIDs []int) error {
+	if effectiveTrustLevel(user).CanPostLinks {
+		return nil
+	}
+	hasImages, err := hasImageAttachments(attachmentIDs)
+	if err != nil {
+		return err
+	}
+	if hasImages || containsLinks(content) {
+		return &requestError{http.StatusForbidden, fmt.Sprintf("Ссылки и изображения доступны с уровня доверия «%s»",
+			minTrustLevelName(func(tl TrustLevel) bool { return tl.CanPostLinks }))}
+	}
+	return nil
+}
+
+// checkLinksAllowed rejects content rejected by linksError. It writes the
+// error response itself and returns false when rejected.
+func checkLinksAllowed(w http.ResponseWriter, user *User, content string, attachmentIDs []int) bool {
+	return writeRequestError(w, linksError(user, content, attachmentIDs))
+}
+
+// checkCanVote rejects votes from users whose trust level doesn't allow
+// voting yet, writing the error response itself
+func checkCanVote(w http.ResponseWriter, user *User) bool {
+	if effectiveTrustLevel(user).CanVote {
+		return true
+	}
+	ErrorResponse(w, http.StatusForbidden, fmt.Sprintf("Голосовать можно с уровня доверия «%s»", minTrustLevelName(func(tl TrustLevel) bool { return tl.CanVote })))
+	return false
+}
+
+// categoryTrustError returns a 403 requestError for posts in categories that
+// require a higher trust level than the user has
+func categoryTrustError(user *User, categoryIDs []int, categories []Category) error {
+	level := effectiveTrustLevel(user).Level
+	for _, category := range categories {
+		if containsInt(categoryIDs, category.ID) && category.MinTrustLevel > level {
+			return &requestError{http.StatusForbidden, fmt.Sprintf("Писать в категорию «%s» можно с уровня доверия «%s»",
+				category.Name, trustLevels[category.MinTrustLevel].Name)}
+		}
+	}
+	return nil
+}
+
+// minTrustLevelName names the lowest level with an ability
+func minTrustLevelName(has func(TrustLevel) bool) string {
+	for _, tl := range trustLevels {
+		if has(tl) {
+			return tl.Name
+		}
+	}
+	return trustLevels[maxTrustLevel].Name
+}
+
+// setTrustLevel fixes a user's trust level (nil returns it to automatic
+// evaluation) and records the change in the audit log
+func setTrustLevel(moderatorID, userID int, level *int, reason, ip string) error {
+	newLevel, locked := 0, level != nil
+	if locked {
+		newLevel = *level
+	} else {
+		stats, err := getTrustStats(userID)
+		if err != nil {
+			return err
+		}
+		newLevel = automaticTrustLevel(stats)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var oldLevel int
+	var oldLocked bool
+	err = tx.QueryRow("SELECT trust_level, trust_level_locked FROM users WHERE id = ?", userID).Scan(&oldLevel, &oldLocked)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("UPDATE users SET trust_level = ?, trust_level_locked = ? WHERE id = ?", newLevel, locked, userID)
+	if err != nil {
+		return err
+	}
+
+	before := map[string]interface{}{"trust_level": oldLevel, "locked": oldLocked}
+	after := map[string]interface{}{"trust_level": newLevel, "locked": locked}
+	if err := recordAudit(tx, moderatorID, "user.trust_level", "user", userID, before, after, reason, ip); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// setCategoryTrustLevel changes the trust level needed to post in a category
+func setCategoryTrustLevel(moderatorID, categoryID, level int, ip string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var oldLevel int
+	if err := tx.QueryRow("SELECT min_trust_level FROM categories WHERE id = ?", categoryID).Scan(&oldLevel); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("UPDATE categories SET min_trust_level = ? WHERE id = ?", level, categoryID); err != nil {
+		return err
+	}
+
+	before := map[string]interface{}{"min_trust_level": oldLevel}
+	after := map[string]interface{}{"min_trust_level": level}
+	if err := recordAudit(tx, moderatorID, "category.trust_level", "category", categoryID, before, after, "", ip); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// parseTrustLevel parses a trust level form value
+func parseTrustLevel(value string) (int, error) {
+	level, err := strconv.Atoi(value)
+	if err != nil || level < 0 || level > maxTrustLevel {
+		return 0, fmt.Errorf("invalid trust level %q", value)
+	}
+	return level, nil
+}
+
+// trustLevelsHandler lists the trust levels with their requirements and abilities
+func trustLevelsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	JSONResponse(w, http.StatusOK, trustLevels)
+}
+
+// trustLevelHandler lets moderators fix a user's trust level
+// (user_id=, level=0-4) or return it to automatic evaluation (level=auto)
+func trustLevelHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	moderator, ok := requireModerator(w, r)
+	if !ok {
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		ErrorResponse(w, http.StatusBadRequest, "Invalid form data")
+		return
+	}
+
+	userID, err := strconv.Atoi(r.FormValue("user_id"))
+	if err != nil {
+		ErrorResponse(w, http.StatusBadRequest, "Invalid user ID")
+		return
+	}
+
+	var level *int
+	if value := r.FormValue("level"); value != "auto" {
+		l, err := parseTrustLevel(value)
+		if err != nil {
+			ErrorResponse(w, http.StatusBadRequest, "Invalid trust level")
+			return
+		}
+		level = &l
+	}
+
+	err = setTrustLevel(moderator.ID, userID, level, strings.TrimSpace(r.FormValue("reason")), clientIP(r))
+	if err == sql.ErrNoRows {
+		ErrorResponse(w, http.StatusNotFound, "User not found")
+		return
+	} else if err != nil {
+		log.Printf("Trust levels - error setting level of user %d: %v", userID, err)
+		ErrorResponse(w, http.StatusInternalServerError, "Error updating trust level")
+		return
+	}
+
+	JSONResponse(w, http.StatusOK, map[string]string{"message": "Trust level updated"})
+}
+
+// categoryTrustLevelHandler lets moderators set the trust level needed to
+// create posts in a category (category_id=, level=0-4)
+func categoryTrustLevelHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	moderator, ok := requireModerator(w, r)
+	if !ok {
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		ErrorResponse(w, http.StatusBadRequest, "Invalid form data")
+		return
+	}
+
+	categoryID, err := strconv.Atoi(r.FormValue("category_id"))
+	if err != nil {
+		ErrorResponse(w, http.StatusBadRequest, "Invalid category ID")
+		return
+	}
+	level, err := parseTrustLevel(r.FormValue("level"))
+	if err != nil {
+		ErrorResponse(w, http.StatusBadRequest, "Invalid trust level")
+		return
+	}
+
+	err = setCategoryTrustLevel(moderator.ID, categoryID, level, clientIP(r))
+	if err == sql.ErrNoRows {
+		ErrorResponse(w, http.StatusNotFound, "Category not found")
+		return
+	} else if err != nil {
+		ErrorResponse(w, http.StatusInternalServerError, "Error updating category")
+		return
+	}
+
+	JSONResponse(w, http.StatusOK, map[string]string{"message": "Category updated"})
+}
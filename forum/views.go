@@ -0,0 +1,103 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+)
+
+// viewerKey identifies who is viewing a post for the view count. Logged in
+// users are counted by ID; anonymous visitors by a hash of their address
+// and browser, so reloading a post doesn't count as another view.
+func viewerKey(r *http.Request, userID *int) string {
+	if userID != nil {
+		return fmt.Sprintf("user:%d", *userID)
+	}
+	return "anon:" + sha256Hex([]byte(clientIP(r)+"|"+r.UserAgent()))
+}
+
+// recordPostView counts a view of a post unless this viewer already saw it
+func recordPostView(r *http.Request, userID *int, postID int) {
+	result, err := db.Exec("INSERT OR IGNORE INTO post_views (post_id, viewer) VALUES (?, ?)", postID, viewerKey(r, userID))
+	if err != nil {
+		log.Printf("Views - error recording view of post %d: %v", postID, err)
+		return
+	}
+	if added, _ := result.RowsAffected(); added == 0 {
+		return
+	}
+	if _, err := db.Exec("UPDATE posts SET views = views + 1 WHERE id = ?", postID); err != nil {
+		log.Printf("Views - error counting view of post %d: %v", postID, err)
+	}
+}
+
+// getLastReadComment returns the last comment a user has seen on a post and
+// whether they have opened the post at all
+func getLastReadComment(userID, postID int) (int, bool, error) {
+	var lastCommentID int
+	err := db.QueryRow("SELECT COALESCE(last_comment_id, 0) FROM post_reads WHERE user_id = ? AND post_id = ?", userID, postID).Scan(&lastCommentID)
+	if err == sql.ErrNoRows {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	return lastCommentID, true, nil
+}
+
+// markPostRead remembers that a user opened a post and has seen its comments
+// up to lastCommentID. The marker never moves back.
+func markPostRead(userID, postID, lastCommentID int) {
+	_, err := db.Exec(`
+		INSERT INTO post_reads (user_id, post_id, last_comment_id) VALUES (?, ?, ?)
+		ON CONFLICT (user_id, post_id) DO UPDATE SET
+			last_comment_id = MAX(COALESCE(last_comment_id, 0), excluded.last_comment_id),
+			updated = CURRENT_TIMESTAMP`,
+		userID, postID, lastCommentID)
+	if err != nil {
+		log.Printf("Views - error recording read of post %d: %v", postID, err)
+	}
+}
+
+// recordPostVisit counts a view of a post and, for logged in users, marks
+// the comments by others since their last visit as new before everything
+// shown counts as read
+func recordPostVisit(r *http.Request, userID *int, postID int, comments []Comment) error {
+	recordPostView(r, userID, postID)
+	if userID == nil {
+		return nil
+	}
+
+	lastCommentID, read, err := getLastReadComment(*userID, postID)
+	if err != nil {
+		return err
+	}
+	newest := lastCommentID
+	for i := range comments {
+		comments[i].IsNew = read && comments[i].ID > lastCommentID && comments[i].AuthorID != *userID
+		newest = max(newest, comments[i].ID)
+	}
+	markPostRead(*userID, postID, newest)
+	return nil
+}
+
+// getReadStatus tells whether a post is new to a user, i.e. they have never
+// opened it, and how many comments by others it got since they last did.
+// Users' own posts are never new to them.
+func getReadStatus(userID, postID, authorID int) (*bool, *int, error) {
+	lastCommentID, read, err := getLastReadComment(userID, postID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var unread int
+	err = db.QueryRow("SELECT COUNT(*) FROM comments WHERE post_id = ? AND hidden = 0 AND author_id != ? AND id > ?",
+		postID, userID, lastCommentID).Scan(&unread)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	isNew := !read && authorID != userID
+	return &isNew, &unread, nil
+}